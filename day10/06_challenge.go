@@ -1,9 +1,48 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	mathrand "math/rand/v2"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // ============================================================================
@@ -82,6 +121,7 @@ type Plugin interface {
 	Name() string
 	Version() string
 	Initialize() error
+	Shutdown() error
 }
 
 // TransformerPlugin is a plugin that provides transformations
@@ -90,6 +130,20 @@ type TransformerPlugin interface {
 	GetTransformers() []DocumentTransformer
 }
 
+// ReaderPlugin is a plugin that provides readers, usually for new
+// source schemes
+type ReaderPlugin interface {
+	Plugin
+	GetReaders() map[string]DocumentReader
+}
+
+// WriterPlugin is a plugin that provides writers, usually for new
+// destination schemes
+type WriterPlugin interface {
+	Plugin
+	GetWriters() map[string]DocumentWriter
+}
+
 // ============================================================================
 // OPTIONAL CAPABILITY INTERFACES
 // ============================================================================
@@ -97,19 +151,33 @@ type TransformerPlugin interface {
 // Searchable documents can be searched
 type Searchable interface {
 	Search(query string) []SearchResult
+	SearchQuery(query string, opts SearchOptions) ([]SearchResult, error)
 }
 
 // SearchResult represents a search match
 type SearchResult struct {
 	Line    int
-	Column  int
+	Column  int // 1-based, in runes
 	Context string
+	Match   string   // matched text, empty for lines matched only by NOT
+	Before  []string // up to SearchOptions.ContextLines preceding lines
+	After   []string // up to SearchOptions.ContextLines following lines
+}
+
+// SearchOptions tune how SearchQuery interprets its query
+type SearchOptions struct {
+	CaseSensitive bool
+	WholeWord     bool
+	ContextLines  int
 }
 
 // Versionable documents support versioning
 type Versionable interface {
 	GetVersion() int
 	GetHistory() []VersionInfo
+	Checkout(version int) (Document, error)
+	Diff(from, to int) (string, error)
+	Rollback(version int, author string) error
 }
 
 // VersionInfo represents a version entry
@@ -127,6 +195,26 @@ type Encryptable interface {
 	IsEncrypted() bool
 }
 
+// Traceable documents know how they were produced
+type Traceable interface {
+	Provenance() []ProvenanceStep
+}
+
+// Provenance step kinds
+const (
+	ProvenanceSource    = "source"
+	ProvenanceTransform = "transform"
+)
+
+// ProvenanceStep is one link in a document's lineage: the source it
+// started from or a transformer applied since
+type ProvenanceStep struct {
+	Kind      string
+	Name      string // source name or transformer name
+	Version   int    // document version the step produced
+	Timestamp time.Time
+}
+
 // ============================================================================
 // CONCRETE IMPLEMENTATIONS
 // ============================================================================
@@ -138,6 +226,12 @@ type TextDocument struct {
 	version   int
 	history   []VersionInfo
 	encrypted bool
+
+	// deltas[i] turns the content of version i+2 back into version i+1,
+	// so only the current version is stored in full
+	deltas []lineDelta
+
+	provenance []ProvenanceStep
 }
 
 // NewTextDocument creates a new text document
@@ -158,6 +252,9 @@ func NewTextDocument(name, content string, author string) *TextDocument {
 		history: []VersionInfo{
 			{Version: 1, Timestamp: now, Author: author, Comment: "Initial creation"},
 		},
+		provenance: []ProvenanceStep{
+			{Kind: ProvenanceSource, Name: name, Version: 1, Timestamp: now},
+		},
 	}
 }
 
@@ -169,21 +266,19 @@ func (t *TextDocument) GetMetadata() Metadata {
 	return t.metadata
 }
 
-// TextDocument implements Searchable
+// TextDocument implements Searchable. Search treats the whole query as
+// one case-insensitive literal; SearchQuery understands the full query
+// language (see ParseQuery).
 func (t *TextDocument) Search(query string) []SearchResult {
-	var results []SearchResult
-	lines := strings.Split(t.content, "\n")
+	return searchLines(splitLines(t.content), literalQuery(query), SearchOptions{})
+}
 
-	for i, line := range lines {
-		if idx := strings.Index(strings.ToLower(line), strings.ToLower(query)); idx != -1 {
-			results = append(results, SearchResult{
-				Line:    i + 1,
-				Column:  idx + 1,
-				Context: line,
-			})
-		}
+func (t *TextDocument) SearchQuery(query string, opts SearchOptions) ([]SearchResult, error) {
+	node, err := ParseQuery(query, opts)
+	if err != nil {
+		return nil, err
 	}
-	return results
+	return searchLines(splitLines(t.content), node, opts), nil
 }
 
 // TextDocument implements Versionable
@@ -196,6 +291,7 @@ func (t *TextDocument) GetHistory() []VersionInfo {
 }
 
 func (t *TextDocument) UpdateContent(content, author, comment string) {
+	t.deltas = append(t.deltas, makeLineDelta(splitLines(content), splitLines(t.content)))
 	t.content = content
 	t.version++
 	t.metadata.Modified = time.Now()
@@ -208,17 +304,90 @@ func (t *TextDocument) UpdateContent(content, author, comment string) {
 	})
 }
 
-// TextDocument implements Encryptable (simulated)
+// contentAt rebuilds the content of a past version by walking the
+// reverse deltas back from the current content
+func (t *TextDocument) contentAt(version int) (string, error) {
+	if version < 1 || version > t.version {
+		return "", fmt.Errorf("version %d does not exist (have 1-%d)", version, t.version)
+	}
+	if t.encrypted {
+		return "", fmt.Errorf("document is encrypted; decrypt it before reading history")
+	}
+	lines := splitLines(t.content)
+	for v := t.version; v > version; v-- {
+		lines = t.deltas[v-2].apply(lines)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Checkout returns a read-only snapshot of a past version
+func (t *TextDocument) Checkout(version int) (Document, error) {
+	content, err := t.contentAt(version)
+	if err != nil {
+		return nil, err
+	}
+	meta := t.metadata
+	meta.Size = len(content)
+	meta.Tags = append([]string(nil), t.metadata.Tags...)
+	for _, h := range t.history {
+		if h.Version == version {
+			meta.Modified = h.Timestamp
+		}
+	}
+	return DocumentSnapshot{content: content, metadata: meta, version: version}, nil
+}
+
+// Diff renders the changes between two versions as a unified diff
+func (t *TextDocument) Diff(from, to int) (string, error) {
+	a, err := t.contentAt(from)
+	if err != nil {
+		return "", err
+	}
+	b, err := t.contentAt(to)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(
+		fmt.Sprintf("%s@v%d", t.metadata.Name, from),
+		fmt.Sprintf("%s@v%d", t.metadata.Name, to),
+		splitLines(a), splitLines(b), 3,
+	), nil
+}
+
+// Rollback restores the content of a past version as a new version, so
+// the versions in between stay in the history
+func (t *TextDocument) Rollback(version int, author string) error {
+	content, err := t.contentAt(version)
+	if err != nil {
+		return err
+	}
+	t.UpdateContent(content, author, fmt.Sprintf("Rollback to version %d", version))
+	return nil
+}
+
+// DocumentSnapshot is an immutable view of one version of a document
+type DocumentSnapshot struct {
+	content  string
+	metadata Metadata
+	version  int
+}
+
+func (s DocumentSnapshot) GetContent() string    { return s.content }
+func (s DocumentSnapshot) GetMetadata() Metadata { return s.metadata }
+func (s DocumentSnapshot) Version() int          { return s.version }
+
+// TextDocument implements Encryptable with AES-256-GCM; the content is
+// replaced by a JSON envelope (see EncryptContent)
 func (t *TextDocument) Encrypt(key string) error {
 	if t.encrypted {
 		return fmt.Errorf("document already encrypted")
 	}
-	// Simulated encryption - just reverse the content
-	runes := []rune(t.content)
-	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
-		runes[i], runes[j] = runes[j], runes[i]
+	envelope, err := EncryptContent(t.content, key)
+	if err != nil {
+		return err
 	}
-	t.content = string(runes)
+	t.content = envelope
+	t.metadata.Size = len(envelope)
 	t.encrypted = true
 	return nil
 }
@@ -227,12 +396,12 @@ func (t *TextDocument) Decrypt(key string) error {
 	if !t.encrypted {
 		return fmt.Errorf("document is not encrypted")
 	}
-	// Reverse again to decrypt
-	runes := []rune(t.content)
-	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
-		runes[i], runes[j] = runes[j], runes[i]
+	plaintext, err := DecryptContent(t.content, key)
+	if err != nil {
+		return err
 	}
-	t.content = string(runes)
+	t.content = plaintext
+	t.metadata.Size = len(plaintext)
 	t.encrypted = false
 	return nil
 }
@@ -241,361 +410,8705 @@ func (t *TextDocument) IsEncrypted() bool {
 	return t.encrypted
 }
 
+// TextDocument implements Traceable
+func (t *TextDocument) Provenance() []ProvenanceStep {
+	return slices.Clone(t.provenance)
+}
+
 // Compile-time interface verification
 var _ Document = (*TextDocument)(nil)
 var _ Searchable = (*TextDocument)(nil)
 var _ Versionable = (*TextDocument)(nil)
 var _ Encryptable = (*TextDocument)(nil)
+var _ Traceable = (*TextDocument)(nil)
+var _ Document = DocumentSnapshot{}
 
 // ============================================================================
-// DOCUMENT READERS
+// SEARCH QUERIES
 // ============================================================================
+//
+// Query language, evaluated line by line:
+//
+//   word              literal term
+//   "two words"       phrase; any run of whitespace matches between words
+//   /go(lang)?/       regular expression (RE2 syntax, \/ for a slash)
+//   a b, a AND b      both must match on the line
+//   a OR b            either must match
+//   NOT a, -a         line must not match a
+//   ( ... )           grouping
+//
+// AND binds tighter than OR. SearchOptions.CaseSensitive and WholeWord
+// apply to every term.
 
-// FileReader reads documents from the filesystem
-type FileReader struct{}
-
-func (fr FileReader) Read(source string) (Document, error) {
-	// Simulated file reading
-	content := fmt.Sprintf("Content loaded from file: %s\nThis is simulated file content.\nLine 3 of the document.", source)
-	return NewTextDocument(source, content, "FileSystem"), nil
+// queryNode is one node of a parsed query
+type queryNode interface {
+	// eval reports whether line satisfies the node and the byte spans
+	// of the positive matches that made it so
+	eval(line string) (bool, [][]int)
 }
 
-func (fr FileReader) SupportedSources() []string {
-	return []string{"file://", "local path"}
+type termNode struct {
+	re        *regexp.Regexp
+	wholeWord bool // keep only matches with no word character either side
 }
 
-// URLReader reads documents from URLs
-type URLReader struct{}
-
-func (ur URLReader) Read(source string) (Document, error) {
-	// Simulated URL reading
-	content := fmt.Sprintf("Content fetched from URL: %s\n<html><body>Web content here</body></html>", source)
-	doc := NewTextDocument(source, content, "WebFetcher")
-	doc.metadata.MimeType = "text/html"
-	return doc, nil
+func (n termNode) eval(line string) (bool, [][]int) {
+	spans := n.re.FindAllStringIndex(line, -1)
+	if n.wholeWord {
+		spans = slices.DeleteFunc(spans, func(span []int) bool {
+			return !isWholeWord(line, span[0], span[1])
+		})
+	}
+	return len(spans) > 0, spans
 }
 
-func (ur URLReader) SupportedSources() []string {
-	return []string{"http://", "https://"}
+// isWordRune reports whether r belongs to a word. Unlike regexp's \b,
+// which only knows ASCII, this counts letters and digits of any script.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
 }
 
-// DatabaseReader reads documents from database
-type DatabaseReader struct {
-	ConnectionString string
+// isWholeWord reports whether line[start:end] is a non-empty match that
+// is neither preceded nor followed by a word rune
+func isWholeWord(line string, start, end int) bool {
+	if start == end {
+		return false
+	}
+	if before, _ := utf8.DecodeLastRuneInString(line[:start]); start > 0 && isWordRune(before) {
+		return false
+	}
+	if after, _ := utf8.DecodeRuneInString(line[end:]); end < len(line) && isWordRune(after) {
+		return false
+	}
+	return true
 }
 
-func (dr DatabaseReader) Read(source string) (Document, error) {
-	// Simulated database reading
-	content := fmt.Sprintf("Document retrieved from database\nTable: %s\nRecord data here...", source)
-	return NewTextDocument(source, content, "Database"), nil
+type andNode struct {
+	left, right queryNode
 }
 
-func (dr DatabaseReader) SupportedSources() []string {
-	return []string{"db://", "sql://"}
+func (n andNode) eval(line string) (bool, [][]int) {
+	okL, spansL := n.left.eval(line)
+	if !okL {
+		return false, nil
+	}
+	okR, spansR := n.right.eval(line)
+	if !okR {
+		return false, nil
+	}
+	return true, append(spansL, spansR...)
 }
 
-// ============================================================================
-// DOCUMENT WRITERS
-// ============================================================================
-
-// FileWriter writes documents to filesystem
-type FileWriter struct{}
+type orNode struct {
+	left, right queryNode
+}
 
-func (fw FileWriter) Write(doc Document, destination string) error {
-	meta := doc.GetMetadata()
-	fmt.Printf("Writing to file: %s\n", destination)
-	fmt.Printf("  Content length: %d bytes\n", len(doc.GetContent()))
-	fmt.Printf("  MIME type: %s\n", meta.MimeType)
-	return nil
+func (n orNode) eval(line string) (bool, [][]int) {
+	okL, spansL := n.left.eval(line)
+	okR, spansR := n.right.eval(line)
+	var spans [][]int
+	if okL {
+		spans = append(spans, spansL...)
+	}
+	if okR {
+		spans = append(spans, spansR...)
+	}
+	return okL || okR, spans
 }
 
-func (fw FileWriter) SupportedDestinations() []string {
-	return []string{"file://", "local path"}
+type notNode struct {
+	child queryNode
 }
 
-// ConsoleWriter outputs documents to console
-type ConsoleWriter struct {
-	Verbose bool
+func (n notNode) eval(line string) (bool, [][]int) {
+	ok, _ := n.child.eval(line)
+	return !ok, nil
 }
 
-func (cw ConsoleWriter) Write(doc Document, destination string) error {
-	meta := doc.GetMetadata()
-	fmt.Println("=== Console Output ===")
-	if cw.Verbose {
-		fmt.Printf("Name: %s\n", meta.Name)
-		fmt.Printf("Author: %s\n", meta.Author)
-		fmt.Printf("Type: %s\n", meta.MimeType)
-		fmt.Println("---")
+// compileTerm builds the regexp for one term according to opts
+func compileTerm(pattern string, opts SearchOptions) (queryNode, error) {
+	if !opts.CaseSensitive {
+		pattern = `(?i)` + pattern
 	}
-	fmt.Println(doc.GetContent())
-	fmt.Println("======================")
-	return nil
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid search pattern: %w", err)
+	}
+	return termNode{re: re, wholeWord: opts.WholeWord}, nil
 }
 
-func (cw ConsoleWriter) SupportedDestinations() []string {
-	return []string{"console://", "stdout"}
+// literalQuery matches query verbatim, case-insensitively
+func literalQuery(query string) queryNode {
+	return termNode{re: regexp.MustCompile(`(?i)` + regexp.QuoteMeta(query))}
 }
 
-// ============================================================================
-// DOCUMENT TRANSFORMERS
-// ============================================================================
-
-// UppercaseTransformer converts content to uppercase
-type UppercaseTransformer struct{}
-
-func (ut UppercaseTransformer) Transform(doc Document) (Document, error) {
-	content := strings.ToUpper(doc.GetContent())
-	meta := doc.GetMetadata()
-	return NewTextDocument(meta.Name, content, meta.Author), nil
+// queryToken is a lexed piece of a query; kind is one of
+// "word", "phrase", "regex", "(", ")", "-"
+type queryToken struct {
+	kind string
+	text string
 }
 
-func (ut UppercaseTransformer) Name() string {
-	return "uppercase"
+func lexQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, queryToken{kind: string(r)})
+			i++
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, queryToken{kind: "-"})
+			i++
+		case r == '"' || r == '/':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if r == '/' && runes[j] == '\\' && j+1 < len(runes) && runes[j+1] == '/' {
+					j++
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j == len(runes) {
+				return nil, fmt.Errorf("unterminated %c in query at column %d", r, i+1)
+			}
+			kind := "phrase"
+			if r == '/' {
+				kind = "regex"
+			}
+			tokens = append(tokens, queryToken{kind: kind, text: sb.String()})
+			i = j + 1
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) && runes[j] != '(' && runes[j] != ')' && runes[j] != '"' {
+				j++
+			}
+			tokens = append(tokens, queryToken{kind: "word", text: string(runes[i:j])})
+			i = j
+		}
+	}
+	return tokens, nil
 }
 
-// TrimTransformer trims whitespace
-type TrimTransformer struct{}
+// queryParser is a recursive-descent parser over lexed tokens
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	opts   SearchOptions
+}
 
-func (tt TrimTransformer) Transform(doc Document) (Document, error) {
-	lines := strings.Split(doc.GetContent(), "\n")
-	var trimmed []string
-	for _, line := range lines {
-		trimmed = append(trimmed, strings.TrimSpace(line))
+// ParseQuery parses a query in the language described above
+func ParseQuery(query string, opts SearchOptions) (queryNode, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
 	}
-	content := strings.Join(trimmed, "\n")
-	meta := doc.GetMetadata()
-	return NewTextDocument(meta.Name, content, meta.Author), nil
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty search query")
+	}
+	p := &queryParser{tokens: tokens, opts: opts}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in query", p.tokens[p.pos].kind)
+	}
+	return node, nil
 }
 
-func (tt TrimTransformer) Name() string {
-	return "trim"
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
 }
 
-// LineNumberTransformer adds line numbers
-type LineNumberTransformer struct{}
+func (p *queryParser) isKeyword(word string) bool {
+	tok, ok := p.peek()
+	return ok && tok.kind == "word" && tok.text == word
+}
 
-func (ln LineNumberTransformer) Transform(doc Document) (Document, error) {
-	lines := strings.Split(doc.GetContent(), "\n")
-	var numbered []string
-	for i, line := range lines {
-		numbered = append(numbered, fmt.Sprintf("%3d: %s", i+1, line))
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
 	}
-	content := strings.Join(numbered, "\n")
-	meta := doc.GetMetadata()
-	return NewTextDocument(meta.Name+"_numbered", content, meta.Author), nil
+	for p.isKeyword("OR") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
 }
 
-func (ln LineNumberTransformer) Name() string {
-	return "line-numbers"
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if p.isKeyword("AND") {
+			p.pos++
+		} else if tok, ok := p.peek(); !ok || tok.kind == ")" || p.isKeyword("OR") {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
 }
 
-// ============================================================================
-// PLUGIN SYSTEM
-// ============================================================================
-
-// TextToolsPlugin provides text transformation tools
-type TextToolsPlugin struct {
-	name    string
-	version string
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if tok, ok := p.peek(); ok && (tok.kind == "-" || p.isKeyword("NOT")) {
+		p.pos++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{child}, nil
+	}
+	return p.parsePrimary()
 }
 
-func NewTextToolsPlugin() *TextToolsPlugin {
-	return &TextToolsPlugin{
-		name:    "TextTools",
-		version: "1.0.0",
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("query ends unexpectedly")
 	}
-}
+	p.pos++
 
-func (p *TextToolsPlugin) Name() string {
-	return p.name
+	switch tok.kind {
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next, ok := p.peek(); !ok || next.kind != ")" {
+			return nil, fmt.Errorf("missing ) in query")
+		}
+		p.pos++
+		return node, nil
+	case "word":
+		if tok.text == "AND" || tok.text == "OR" {
+			return nil, fmt.Errorf("%s needs a term on both sides", tok.text)
+		}
+		return compileTerm(regexp.QuoteMeta(tok.text), p.opts)
+	case "phrase":
+		words := strings.Fields(tok.text)
+		if len(words) == 0 {
+			return nil, fmt.Errorf("empty phrase in query")
+		}
+		for i, w := range words {
+			words[i] = regexp.QuoteMeta(w)
+		}
+		return compileTerm(strings.Join(words, `\s+`), p.opts)
+	case "regex":
+		return compileTerm(tok.text, p.opts)
+	}
+	return nil, fmt.Errorf("unexpected %q in query", tok.kind)
 }
 
-func (p *TextToolsPlugin) Version() string {
-	return p.version
-}
+// searchLines evaluates node against every line, producing one result per
+// positive match (or one per line when only NOT terms matched it)
+func searchLines(lines []string, node queryNode, opts SearchOptions) []SearchResult {
+	var results []SearchResult
+	for i, line := range lines {
+		ok, spans := node.eval(line)
+		if !ok {
+			continue
+		}
 
-func (p *TextToolsPlugin) Initialize() error {
-	fmt.Printf("Initializing plugin: %s v%s\n", p.name, p.version)
-	return nil
-}
+		base := SearchResult{Line: i + 1, Context: line}
+		if opts.ContextLines > 0 {
+			base.Before = lines[max(0, i-opts.ContextLines):i]
+			base.After = lines[i+1 : min(len(lines), i+1+opts.ContextLines)]
+		}
+		if len(spans) == 0 {
+			base.Column = 1
+			results = append(results, base)
+			continue
+		}
 
-func (p *TextToolsPlugin) GetTransformers() []DocumentTransformer {
-	return []DocumentTransformer{
-		UppercaseTransformer{},
-		TrimTransformer{},
-		LineNumberTransformer{},
+		// Report overlapping matches from different terms once
+		sort.Slice(spans, func(a, b int) bool { return spans[a][0] < spans[b][0] })
+		end := -1
+		for _, span := range spans {
+			if span[0] < end || span[0] == span[1] {
+				continue
+			}
+			r := base
+			r.Column = utf8.RuneCountInString(line[:span[0]]) + 1
+			r.Match = line[span[0]:span[1]]
+			results = append(results, r)
+			end = span[1]
+		}
 	}
+	return results
 }
 
-// Verify plugin interfaces
-var _ Plugin = (*TextToolsPlugin)(nil)
-var _ TransformerPlugin = (*TextToolsPlugin)(nil)
+// GrepDocuments runs a query over a collection, keyed by document name.
+// Documents that are not Searchable are skipped.
+func GrepDocuments(docs []Document, query string, opts SearchOptions) (map[string][]SearchResult, error) {
+	hits := make(map[string][]SearchResult)
+	for _, doc := range docs {
+		searchable, ok := doc.(Searchable)
+		if !ok {
+			continue
+		}
+		results, err := searchable.SearchQuery(query, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) > 0 {
+			hits[doc.GetMetadata().Name] = results
+		}
+	}
+	return hits, nil
+}
 
 // ============================================================================
-// DOCUMENT PROCESSING ENGINE
+// LINE DIFFS
 // ============================================================================
 
-// ProcessingEngine orchestrates document processing
-type ProcessingEngine struct {
-	readers      map[string]DocumentReader
-	writers      map[string]DocumentWriter
-	transformers []DocumentTransformer
-	plugins      []Plugin
+// lineOp is one line of an edit script: ' ' keep, '-' delete, '+' insert
+type lineOp struct {
+	Kind byte
+	Text string
 }
 
-func NewProcessingEngine() *ProcessingEngine {
-	return &ProcessingEngine{
-		readers:      make(map[string]DocumentReader),
-		writers:      make(map[string]DocumentWriter),
-		transformers: []DocumentTransformer{},
-		plugins:      []Plugin{},
-	}
+// splitLines splits content so that strings.Join(lines, "\n") restores it
+func splitLines(content string) []string {
+	return strings.Split(content, "\n")
 }
 
-func (e *ProcessingEngine) RegisterReader(name string, reader DocumentReader) {
-	e.readers[name] = reader
+// diffLines computes a minimal edit script from a to b with Myers'
+// algorithm in linear space: it finds the middle of the shortest edit
+// path and recurses on either half, so memory stays O(len(a)+len(b)).
+// Time grows with the size of the inputs times the number of changed
+// lines, so a full rewrite of a large document is quadratic.
+func diffLines(a, b []string) []lineOp {
+	ops, _ := diffLinesLimited(a, b, 0)
+	return ops
 }
 
-func (e *ProcessingEngine) RegisterWriter(name string, writer DocumentWriter) {
-	e.writers[name] = writer
+// diffLinesLimited is diffLines that gives up, returning false, once the
+// search has tried more than limit diagonals. A limit of 0 means none.
+func diffLinesLimited(a, b []string, limit int) ([]lineOp, bool) {
+	// Compare lines as small integers rather than strings
+	ids := make(map[string]int)
+	intern := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	d := &lineDiffer{a: a, b: b, x: intern(a), y: intern(b), limit: limit}
+	d.diff(0, len(a), 0, len(b))
+	if d.gaveUp {
+		return nil, false
+	}
+
+	// Within each change, list the deleted lines before the inserted ones
+	ops := d.ops
+	for i := 0; i < len(ops); {
+		j := i
+		for j < len(ops) && ops[j].Kind != ' ' {
+			j++
+		}
+		slices.SortStableFunc(ops[i:j], func(p, q lineOp) int {
+			return cmp.Compare(q.Kind, p.Kind) // '-' sorts before '+'
+		})
+		i = j + 1
+	}
+	return ops, true
 }
 
-func (e *ProcessingEngine) RegisterTransformer(transformer DocumentTransformer) {
-	e.transformers = append(e.transformers, transformer)
+// lineDiffer holds the lines being diffed and the script built so far
+type lineDiffer struct {
+	a, b []string
+	x, y []int // interned a and b
+	ops  []lineOp
+
+	limit  int // diagonals the search may try; 0 for no limit
+	work   int // diagonals tried so far
+	gaveUp bool
 }
 
-func (e *ProcessingEngine) LoadPlugin(plugin Plugin) error {
-	if err := plugin.Initialize(); err != nil {
-		return fmt.Errorf("failed to initialize plugin %s: %w", plugin.Name(), err)
+// diff appends the edit script from a[aLo:aHi] to b[bLo:bHi]
+func (d *lineDiffer) diff(aLo, aHi, bLo, bHi int) {
+	// Common prefix and suffix need no search
+	for aLo < aHi && bLo < bHi && d.x[aLo] == d.y[bLo] {
+		d.ops = append(d.ops, lineOp{' ', d.a[aLo]})
+		aLo++
+		bLo++
 	}
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix && d.x[aHi-1-suffix] == d.y[bHi-1-suffix] {
+		suffix++
+	}
+	aHi -= suffix
+	bHi -= suffix
 
-	e.plugins = append(e.plugins, plugin)
-
-	// Check if plugin provides transformers
-	if tp, ok := plugin.(TransformerPlugin); ok {
-		for _, t := range tp.GetTransformers() {
-			e.RegisterTransformer(t)
-			fmt.Printf("  Registered transformer: %s\n", t.Name())
+	switch {
+	case aLo == aHi:
+		for _, line := range d.b[bLo:bHi] {
+			d.ops = append(d.ops, lineOp{'+', line})
 		}
+	case bLo == bHi:
+		for _, line := range d.a[aLo:aHi] {
+			d.ops = append(d.ops, lineOp{'-', line})
+		}
+	default:
+		x, y := d.middle(aLo, aHi, bLo, bHi)
+		if d.gaveUp {
+			return
+		}
+		d.diff(aLo, x, bLo, y)
+		d.diff(x, aHi, y, bHi)
 	}
 
-	return nil
+	for _, line := range d.a[aHi : aHi+suffix] {
+		d.ops = append(d.ops, lineOp{' ', line})
+	}
 }
 
-func (e *ProcessingEngine) Process(readerName, source string, transformerNames []string, writerName, destination string) error {
-	// Get reader
-	reader, ok := e.readers[readerName]
-	if !ok {
-		return fmt.Errorf("reader not found: %s", readerName)
+// middle finds where the forward and backward searches for the
+// shortest edit path from a[aLo:aHi] to b[bLo:bHi] meet, and returns
+// that point as a split of both ranges
+func (d *lineDiffer) middle(aLo, aHi, bLo, bHi int) (int, int) {
+	x, y := d.x[aLo:aHi], d.y[bLo:bHi]
+	n, m := len(x), len(y)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	// forward[k] and backward[k] are the furthest x reached on diagonal k
+	// (x - y = k), the backward search measuring from the ends
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
 	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	odd := delta%2 != 0
 
-	// Read document
-	doc, err := reader.Read(source)
+	for step := 0; step <= maxD; step++ {
+		d.work += 2 * (step + 1)
+		if d.limit > 0 && d.work > d.limit {
+			d.gaveUp = true
+			return aHi, bHi
+		}
+		for k := -step; k <= step; k += 2 {
+			var fx int
+			if k == -step || (k != step && forward[offset+k-1] < forward[offset+k+1]) {
+				fx = forward[offset+k+1]
+			} else {
+				fx = forward[offset+k-1] + 1
+			}
+			fy := fx - k
+			for fx < n && fy < m && x[fx] == y[fy] {
+				fx++
+				fy++
+			}
+			forward[offset+k] = fx
+			if fx > n || fy > m || !odd {
+				continue
+			}
+			if bk := offset + delta - k; bk >= 0 && bk < len(backward) && backward[bk] != -1 && fx >= n-backward[bk] {
+				return aLo + fx, bLo + fy
+			}
+		}
+		for k := -step; k <= step; k += 2 {
+			var bx int
+			if k == -step || (k != step && backward[offset+k-1] < backward[offset+k+1]) {
+				bx = backward[offset+k+1]
+			} else {
+				bx = backward[offset+k-1] + 1
+			}
+			by := bx - k
+			for bx < n && by < m && x[n-bx-1] == y[m-by-1] {
+				bx++
+				by++
+			}
+			backward[offset+k] = bx
+			if bx > n || by > m || odd {
+				continue
+			}
+			if fk := offset + delta - k; fk >= 0 && fk < len(forward) && forward[fk] != -1 {
+				fx := forward[fk]
+				if fy := fx - (delta - k); fx >= n-bx {
+					return aLo + fx, bLo + fy
+				}
+			}
+		}
+	}
+	// Unreachable: the searches always meet within maxD steps
+	return aHi, bLo
+}
+
+// deltaHunk keeps Keep lines, drops Delete lines, then inserts Insert
+type deltaHunk struct {
+	Keep   int
+	Delete int
+	Insert []string
+}
+
+// lineDelta is a compact edit script that only stores inserted lines
+type lineDelta []deltaHunk
+
+// deltaDiffWork bounds the diff behind a delta to this many diagonals per
+// line, keeping makeLineDelta linear; content changed too much to diff
+// within that is stored whole
+const deltaDiffWork = 64
+
+func makeLineDelta(from, to []string) lineDelta {
+	ops, ok := diffLinesLimited(from, to, deltaDiffWork*(len(from)+len(to)+1))
+	if !ok {
+		return lineDelta{{Delete: len(from), Insert: slices.Clone(to)}}
+	}
+	var delta lineDelta
+	var cur deltaHunk
+	for _, op := range ops {
+		if op.Kind == ' ' {
+			if cur.Delete > 0 || len(cur.Insert) > 0 {
+				delta = append(delta, cur)
+				cur = deltaHunk{}
+			}
+			cur.Keep++
+			continue
+		}
+		if op.Kind == '-' {
+			cur.Delete++
+		} else {
+			cur.Insert = append(cur.Insert, op.Text)
+		}
+	}
+	if cur.Keep > 0 || cur.Delete > 0 || len(cur.Insert) > 0 {
+		delta = append(delta, cur)
+	}
+	return delta
+}
+
+func (d lineDelta) apply(lines []string) []string {
+	var out []string
+	pos := 0
+	for _, h := range d {
+		out = append(out, lines[pos:pos+h.Keep]...)
+		pos += h.Keep + h.Delete
+		out = append(out, h.Insert...)
+	}
+	return append(out, lines[pos:]...)
+}
+
+// unifiedDiff renders a and b in unified diff format with the given
+// number of context lines around each change
+func unifiedDiff(fromName, toName string, a, b []string, context int) string {
+	ops := diffLines(a, b)
+
+	// aLine[i]/bLine[i] are the 0-based line numbers before ops[i]
+	aLine := make([]int, len(ops)+1)
+	bLine := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if op.Kind != '+' {
+			aLine[i+1]++
+		}
+		if op.Kind != '-' {
+			bLine[i+1]++
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", fromName, toName))
+	for i := 0; i < len(ops); {
+		if ops[i].Kind == ' ' {
+			i++
+			continue
+		}
+
+		// Grow the hunk while the next change is close enough that the
+		// context blocks would touch
+		start := max(i-context, 0)
+		last := i
+		for j := i + 1; j < len(ops) && j <= last+2*context; j++ {
+			if ops[j].Kind != ' ' {
+				last = j
+			}
+		}
+		end := min(last+context+1, len(ops))
+
+		aStart, aLen := aLine[start], aLine[end]-aLine[start]
+		bStart, bLen := bLine[start], bLine[end]-bLine[start]
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		sb.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen))
+		for _, op := range ops[start:end] {
+			sb.WriteString(fmt.Sprintf("%c%s\n", op.Kind, op.Text))
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+// ============================================================================
+// STRUCTURED DOCUMENT TYPES
+// ============================================================================
+
+// MIME types with first-class document implementations
+const (
+	MimeText     = "text/plain"
+	MimeMarkdown = "text/markdown"
+	MimeHTML     = "text/html"
+	MimeJSON     = "application/json"
+)
+
+// textBacked is implemented by every document built on TextDocument, so
+// readers can adjust metadata whatever the concrete type
+type textBacked interface {
+	text() *TextDocument
+}
+
+func (t *TextDocument) text() *TextDocument { return t }
+
+// NewTypedDocument picks the document implementation for mimeType. Content
+// that does not parse as its declared type (e.g. broken JSON) falls back
+// to a TextDocument that keeps the declared MIME type.
+func NewTypedDocument(name, content, author, mimeType string) Document {
+	switch mimeType {
+	case MimeMarkdown:
+		return NewMarkdownDocument(name, content, author)
+	case MimeHTML:
+		return NewHTMLDocument(name, content, author)
+	case MimeJSON:
+		if doc, err := NewJSONDocument(name, content, author); err == nil {
+			return doc
+		}
+	}
+	doc := NewTextDocument(name, content, author)
+	if mimeType != "" {
+		doc.metadata.MimeType = mimeType
+	}
+	return doc
+}
+
+// Heading is a section heading found in a structured document
+type Heading struct {
+	Level int
+	Text  string
+	Line  int
+}
+
+// Link is a hyperlink found in a structured document
+type Link struct {
+	Text string
+	URL  string
+}
+
+// MarkdownDocument is a TextDocument that understands Markdown structure
+type MarkdownDocument struct {
+	*TextDocument
+}
+
+func NewMarkdownDocument(name, content, author string) *MarkdownDocument {
+	doc := NewTextDocument(name, content, author)
+	doc.metadata.MimeType = MimeMarkdown
+	return &MarkdownDocument{TextDocument: doc}
+}
+
+var (
+	mdHeading    = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdLink       = regexp.MustCompile(`(!?)\[([^\]]*)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+	mdBold       = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	mdEmphasis   = regexp.MustCompile(`\*(.+?)\*`)
+	mdLinkSlot   = regexp.MustCompile("\x00[0-9]+\x00")
+	mdListItem   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdNumbered   = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdBlockquote = regexp.MustCompile(`^>\s?(.*)$`)
+)
+
+// Headings lists ATX (#-style) headings outside code fences
+func (m *MarkdownDocument) Headings() []Heading {
+	var headings []Heading
+	inFence := false
+	for i, line := range splitLines(m.content) {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			continue
+		}
+		if match := mdHeading.FindStringSubmatch(line); match != nil && !inFence {
+			headings = append(headings, Heading{Level: len(match[1]), Text: match[2], Line: i + 1})
+		}
+	}
+	return headings
+}
+
+// Links lists inline links, skipping images
+func (m *MarkdownDocument) Links() []Link {
+	var links []Link
+	for _, match := range mdLink.FindAllStringSubmatch(m.content, -1) {
+		if match[1] == "" {
+			links = append(links, Link{Text: match[2], URL: match[3]})
+		}
+	}
+	return links
+}
+
+// ToHTML renders the common Markdown subset: headings, paragraphs,
+// lists, blockquotes, code fences, code spans, links, bold and emphasis
+func (m *MarkdownDocument) ToHTML() string {
+	return markdownToHTML(m.content)
+}
+
+func markdownToHTML(content string) string {
+	var sb strings.Builder
+	var paragraph []string
+	list := "" // "ul" or "ol" while inside a list
+	inFence := false
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			sb.WriteString("<p>" + markdownInline(strings.Join(paragraph, " ")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			sb.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	openList := func(kind string) {
+		if list != kind {
+			closeList()
+			sb.WriteString("<" + kind + ">\n")
+			list = kind
+		}
+	}
+
+	for _, line := range splitLines(content) {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			flushParagraph()
+			closeList()
+			if inFence {
+				sb.WriteString("</code></pre>\n")
+			} else {
+				sb.WriteString("<pre><code>")
+			}
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			sb.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+
+		if match := mdHeading.FindStringSubmatch(line); match != nil {
+			flushParagraph()
+			closeList()
+			sb.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", len(match[1]), markdownInline(match[2]), len(match[1])))
+		} else if match := mdListItem.FindStringSubmatch(line); match != nil {
+			flushParagraph()
+			openList("ul")
+			sb.WriteString("<li>" + markdownInline(match[1]) + "</li>\n")
+		} else if match := mdNumbered.FindStringSubmatch(line); match != nil {
+			flushParagraph()
+			openList("ol")
+			sb.WriteString("<li>" + markdownInline(match[1]) + "</li>\n")
+		} else if match := mdBlockquote.FindStringSubmatch(line); match != nil {
+			flushParagraph()
+			closeList()
+			sb.WriteString("<blockquote><p>" + markdownInline(match[1]) + "</p></blockquote>\n")
+		} else if strings.TrimSpace(line) == "" {
+			flushParagraph()
+			closeList()
+		} else {
+			closeList()
+			paragraph = append(paragraph, strings.TrimSpace(line))
+		}
+	}
+	if inFence {
+		sb.WriteString("</code></pre>\n")
+	}
+	flushParagraph()
+	closeList()
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// markdownInline renders code spans, links, bold and emphasis in one line
+func markdownInline(text string) string {
+	var sb strings.Builder
+	for i, part := range strings.Split(text, "`") {
+		if i%2 == 1 {
+			sb.WriteString("<code>" + html.EscapeString(part) + "</code>")
+			continue
+		}
+		// Rendered links are set aside behind placeholders while bold
+		// and emphasis run, so a * in a URL or alt text stays put
+		var links []string
+		part = mdLink.ReplaceAllStringFunc(html.EscapeString(part), func(s string) string {
+			match := mdLink.FindStringSubmatch(s)
+			target, ok := safeURL(match[3])
+			switch {
+			case !ok:
+				return match[2] // keep the text, drop the unsafe link
+			case match[1] != "":
+				links = append(links, fmt.Sprintf(`<img src="%s" alt="%s">`, target, match[2]))
+			default:
+				links = append(links, fmt.Sprintf(`<a href="%s">%s</a>`, target, markdownEmphasis(match[2])))
+			}
+			return fmt.Sprintf("\x00%d\x00", len(links)-1)
+		})
+		part = markdownEmphasis(part)
+		part = mdLinkSlot.ReplaceAllStringFunc(part, func(s string) string {
+			if i, err := strconv.Atoi(strings.Trim(s, "\x00")); err == nil && i < len(links) {
+				return links[i]
+			}
+			return s
+		})
+		sb.WriteString(part)
+	}
+	return sb.String()
+}
+
+// markdownEmphasis renders bold and emphasis
+func markdownEmphasis(text string) string {
+	text = mdBold.ReplaceAllString(text, "<strong>$1</strong>")
+	return mdEmphasis.ReplaceAllString(text, "<em>$1</em>")
+}
+
+// safeURL vets a link target that markdownInline has already
+// HTML-escaped. Only http, https, mailto and relative URLs pass, so
+// javascript: and data: links can't run script in the converted page.
+func safeURL(escaped string) (string, bool) {
+	raw := html.UnescapeString(escaped)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return html.EscapeString(raw), true
+	}
+	return "", false
+}
+
+// HTMLNode is an element or text node of a parsed HTML document. Text
+// nodes have an empty Tag.
+type HTMLNode struct {
+	Tag      string
+	Attrs    map[string]string
+	Text     string
+	Children []*HTMLNode
+	Parent   *HTMLNode
+	Line     int // 1-based line of an element's start tag
+}
+
+// Elements without closing tags
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+// Elements that start a new line when extracting text
+var htmlBlockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"br": true, "dd": true, "div": true, "dl": true, "dt": true,
+	"footer": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hr": true, "li": true,
+	"main": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "title": true, "tr": true, "ul": true,
+}
+
+var htmlAttr = regexp.MustCompile(`([^\s=/>]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+)))?`)
+
+// parseHTML builds a node tree with a tolerant hand-written parser: it
+// skips comments and doctypes, keeps script/style bodies as raw text and
+// closes unterminated elements when an ancestor closes
+func parseHTML(content string) *HTMLNode {
+	root := &HTMLNode{Tag: "#document"}
+	current := root
+	// lineOf counts lines up to pos; positions only move forward
+	line, counted := 1, 0
+	lineOf := func(pos int) int {
+		line += strings.Count(content[counted:pos], "\n")
+		counted = pos
+		return line
+	}
+	addText := func(text string) {
+		if text != "" {
+			current.Children = append(current.Children, &HTMLNode{Text: html.UnescapeString(text), Parent: current})
+		}
+	}
+
+	for i := 0; i < len(content); {
+		lt := strings.IndexByte(content[i:], '<')
+		if lt < 0 {
+			addText(content[i:])
+			break
+		}
+		addText(content[i : i+lt])
+		i += lt
+
+		switch {
+		case strings.HasPrefix(content[i:], "<!--"):
+			end := strings.Index(content[i:], "-->")
+			if end < 0 {
+				return root
+			}
+			i += end + 3
+			continue
+		case strings.HasPrefix(content[i:], "<!") || strings.HasPrefix(content[i:], "<?"):
+			end := strings.IndexByte(content[i:], '>')
+			if end < 0 {
+				return root
+			}
+			i += end + 1
+			continue
+		}
+
+		end := strings.IndexByte(content[i:], '>')
+		if end < 0 {
+			addText(content[i:])
+			break
+		}
+		inner := content[i+1 : i+end]
+		tagLine := lineOf(i)
+		i += end + 1
+
+		if strings.HasPrefix(inner, "/") {
+			// Close the nearest open element with this name, if any
+			name := strings.ToLower(strings.TrimSpace(inner[1:]))
+			for n := current; n != root; n = n.Parent {
+				if n.Tag == name {
+					current = n.Parent
+					break
+				}
+			}
+			continue
+		}
+
+		fields := strings.Fields(inner)
+		if len(fields) == 0 {
+			addText("<" + inner + ">")
+			continue
+		}
+		name := strings.ToLower(strings.TrimSuffix(fields[0], "/"))
+		node := &HTMLNode{Tag: name, Attrs: make(map[string]string), Parent: current, Line: tagLine}
+		for _, m := range htmlAttr.FindAllStringSubmatch(strings.TrimPrefix(inner, fields[0]), -1) {
+			node.Attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3] + m[4])
+		}
+		current.Children = append(current.Children, node)
+
+		if name == "script" || name == "style" {
+			closing := strings.Index(strings.ToLower(content[i:]), "</"+name)
+			if closing < 0 {
+				closing = len(content) - i
+			}
+			node.Children = append(node.Children, &HTMLNode{Text: content[i : i+closing], Parent: node})
+			i += closing
+			if gt := strings.IndexByte(content[i:], '>'); gt >= 0 {
+				i += gt + 1
+			}
+			continue
+		}
+		if !htmlVoidElements[name] && !strings.HasSuffix(inner, "/") {
+			current = node
+		}
+	}
+	return root
+}
+
+// Find returns all descendant elements with the given tag
+func (n *HTMLNode) Find(tag string) []*HTMLNode {
+	var found []*HTMLNode
+	for _, child := range n.Children {
+		if child.Tag == tag {
+			found = append(found, child)
+		}
+		found = append(found, child.Find(tag)...)
+	}
+	return found
+}
+
+// InnerText returns the node's text with whitespace collapsed
+func (n *HTMLNode) InnerText() string {
+	if n.Tag == "" {
+		return strings.Join(strings.Fields(n.Text), " ")
+	}
+	var parts []string
+	for _, child := range n.Children {
+		if t := child.InnerText(); t != "" {
+			parts = append(parts, t)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// htmlText renders the visible text of a tree, one block per line
+func htmlText(root *HTMLNode) string {
+	var lines []string
+	var current strings.Builder
+	flush := func() {
+		if line := strings.Join(strings.Fields(current.String()), " "); line != "" {
+			lines = append(lines, line)
+		}
+		current.Reset()
+	}
+
+	var walk func(n *HTMLNode, pre bool)
+	walk = func(n *HTMLNode, pre bool) {
+		switch {
+		case n.Tag == "":
+			if pre {
+				for i, part := range strings.Split(n.Text, "\n") {
+					if i > 0 {
+						lines = append(lines, current.String())
+						current.Reset()
+					}
+					current.WriteString(part)
+				}
+				return
+			}
+			current.WriteString(n.Text)
+			return
+		case n.Tag == "script" || n.Tag == "style" || n.Tag == "head":
+			return
+		}
+		block := htmlBlockElements[n.Tag]
+		if block {
+			flush()
+		}
+		for _, child := range n.Children {
+			walk(child, pre || n.Tag == "pre")
+		}
+		if block {
+			flush()
+		}
+	}
+	walk(root, false)
+	flush()
+	return strings.Join(lines, "\n")
+}
+
+// HTMLDocument is a TextDocument that understands HTML structure
+type HTMLDocument struct {
+	*TextDocument
+}
+
+func NewHTMLDocument(name, content, author string) *HTMLDocument {
+	doc := NewTextDocument(name, content, author)
+	doc.metadata.MimeType = MimeHTML
+	return &HTMLDocument{TextDocument: doc}
+}
+
+// Root parses the current content into a node tree
+func (h *HTMLDocument) Root() *HTMLNode {
+	return parseHTML(h.content)
+}
+
+// Title returns the text of the first <title> element
+func (h *HTMLDocument) Title() string {
+	if titles := h.Root().Find("title"); len(titles) > 0 {
+		return titles[0].InnerText()
+	}
+	return ""
+}
+
+// Text extracts the visible text, one block element per line
+func (h *HTMLDocument) Text() string {
+	return htmlText(h.Root())
+}
+
+// Headings lists <h1>-<h6> elements in document order
+func (h *HTMLDocument) Headings() []Heading {
+	var headings []Heading
+	var walk func(n *HTMLNode)
+	walk = func(n *HTMLNode) {
+		if len(n.Tag) == 2 && n.Tag[0] == 'h' && n.Tag[1] >= '1' && n.Tag[1] <= '6' {
+			headings = append(headings, Heading{Level: int(n.Tag[1] - '0'), Text: n.InnerText(), Line: n.Line})
+		}
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(h.Root())
+	return headings
+}
+
+// Links lists <a href> elements
+func (h *HTMLDocument) Links() []Link {
+	var links []Link
+	for _, a := range h.Root().Find("a") {
+		if href, ok := a.Attrs["href"]; ok {
+			links = append(links, Link{Text: a.InnerText(), URL: href})
+		}
+	}
+	return links
+}
+
+// JSONDocument is a TextDocument whose content is valid JSON
+type JSONDocument struct {
+	*TextDocument
+}
+
+func NewJSONDocument(name, content, author string) (*JSONDocument, error) {
+	if _, err := decodeJSON(content); err != nil {
+		return nil, err
+	}
+	doc := NewTextDocument(name, content, author)
+	doc.metadata.MimeType = MimeJSON
+	return &JSONDocument{TextDocument: doc}, nil
+}
+
+// decodeJSON parses content keeping numbers as json.Number so they
+// round-trip exactly
+func decodeJSON(content string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(content))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	// More reports false before a stray ] or }, so insist on the end
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON: trailing data after value")
+	}
+	return value, nil
+}
+
+// Value returns the decoded content
+func (j *JSONDocument) Value() (any, error) {
+	return decodeJSON(j.content)
+}
+
+// Get resolves a path such as "store.books[0].title" ("$" is the root)
+func (j *JSONDocument) Get(path string) (any, error) {
+	value, err := j.Value()
+	if err != nil {
+		return nil, err
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return value, nil
+	}
+
+	for _, segment := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(segment, "[")
+		if key != "" {
+			obj, ok := value.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("path %s: %q is not an object", path, key)
+			}
+			if value, ok = obj[key]; !ok {
+				return nil, fmt.Errorf("path %s: no key %q", path, key)
+			}
+		}
+		for rest != "" {
+			idxText, after, ok := strings.Cut(rest, "]")
+			idx, err := strconv.Atoi(idxText)
+			if !ok || err != nil {
+				return nil, fmt.Errorf("path %s: bad index in %q", path, segment)
+			}
+			arr, isArr := value.([]any)
+			if !isArr || idx < 0 || idx >= len(arr) {
+				return nil, fmt.Errorf("path %s: index %d out of range", path, idx)
+			}
+			value = arr[idx]
+			rest = strings.TrimPrefix(after, "[")
+		}
+	}
+	return value, nil
+}
+
+// Paths lists the path of every leaf value, object keys in sorted order
+func (j *JSONDocument) Paths() ([]string, error) {
+	value, err := j.Value()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if prefix == "" {
+					walk(k, v[k])
+				} else {
+					walk(prefix+"."+k, v[k])
+				}
+			}
+		case []any:
+			for i, item := range v {
+				walk(fmt.Sprintf("%s[%d]", prefix, i), item)
+			}
+		default:
+			if prefix == "" {
+				prefix = "$"
+			}
+			paths = append(paths, prefix)
+		}
+	}
+	walk("", value)
+	return paths, nil
+}
+
+// Pretty re-indents the content
+func (j *JSONDocument) Pretty(indent string) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(j.content), "", indent); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Minify strips insignificant whitespace
+func (j *JSONDocument) Minify() (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(j.content)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var _ Document = (*MarkdownDocument)(nil)
+var _ Document = (*HTMLDocument)(nil)
+var _ Document = (*JSONDocument)(nil)
+var _ Searchable = (*MarkdownDocument)(nil)
+
+// ============================================================================
+// ENCRYPTION
+// ============================================================================
+
+// Envelope parameters. Bump envelopeVersion whenever the layout or the
+// algorithms change so old documents can still be recognised.
+const (
+	envelopeFormat     = "docenc"
+	envelopeVersion    = 1
+	envelopeAlgorithm  = "AES-256-GCM"
+	envelopeKDF        = "PBKDF2-HMAC-SHA256"
+	envelopeIterations = 600_000
+	envelopeSaltSize   = 16
+	envelopeKeySize    = 32
+)
+
+// ErrDecryptionFailed is returned when the key is wrong or the envelope
+// was modified after encryption; GCM cannot tell the two apart
+var ErrDecryptionFailed = errors.New("decryption failed: wrong key or tampered content")
+
+// encryptedEnvelope is the serialized form of an encrypted document
+type encryptedEnvelope struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	Algorithm  string `json:"alg"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iter"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"data"`
+}
+
+// header returns the authenticated-but-unencrypted part of the envelope,
+// so changing the algorithm, KDF parameters or salt also fails Decrypt
+func (env encryptedEnvelope) header() []byte {
+	return []byte(fmt.Sprintf("%s|%d|%s|%s|%d|%x",
+		env.Format, env.Version, env.Algorithm, env.KDF, env.Iterations, env.Salt))
+}
+
+func envelopeCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, envelopeKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptContent seals plaintext with a key derived from passphrase and
+// returns the JSON envelope
+func EncryptContent(plaintext, passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", fmt.Errorf("encryption key must not be empty")
+	}
+
+	env := encryptedEnvelope{
+		Format:     envelopeFormat,
+		Version:    envelopeVersion,
+		Algorithm:  envelopeAlgorithm,
+		KDF:        envelopeKDF,
+		Iterations: envelopeIterations,
+		Salt:       make([]byte, envelopeSaltSize),
+	}
+	if _, err := rand.Read(env.Salt); err != nil {
+		return "", err
+	}
+
+	aead, err := envelopeCipher(passphrase, env.Salt, env.Iterations)
+	if err != nil {
+		return "", err
+	}
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return "", err
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, []byte(plaintext), env.header())
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// DecryptContent opens an envelope produced by EncryptContent
+func DecryptContent(envelope, passphrase string) (string, error) {
+	var env encryptedEnvelope
+	if err := json.Unmarshal([]byte(envelope), &env); err != nil || env.Format != envelopeFormat {
+		return "", fmt.Errorf("content is not an encrypted envelope")
+	}
+	if env.Version != envelopeVersion || env.Algorithm != envelopeAlgorithm || env.KDF != envelopeKDF {
+		return "", fmt.Errorf("unsupported envelope: version %d, %s, %s", env.Version, env.Algorithm, env.KDF)
+	}
+	// The header is unauthenticated until the key is derived, so only
+	// accept the parameters EncryptContent writes; a forged iteration
+	// count would otherwise pin a CPU in PBKDF2
+	if env.Iterations != envelopeIterations || len(env.Salt) != envelopeSaltSize {
+		return "", ErrDecryptionFailed
+	}
+
+	aead, err := envelopeCipher(passphrase, env.Salt, env.Iterations)
+	if err != nil {
+		return "", err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return "", ErrDecryptionFailed
+	}
+	plaintext, err := aead.Open(nil, env.Nonce, env.Ciphertext, env.header())
+	if err != nil {
+		return "", ErrDecryptionFailed
+	}
+	return string(plaintext), nil
+}
+
+// IsEncryptedContent reports whether content looks like an envelope
+func IsEncryptedContent(content string) bool {
+	var env encryptedEnvelope
+	return json.Unmarshal([]byte(content), &env) == nil && env.Format == envelopeFormat
+}
+
+// ============================================================================
+// DOCUMENT READERS
+// ============================================================================
+
+// FileReader reads documents from the filesystem
+type FileReader struct{}
+
+func (fr FileReader) Read(source string) (Document, error) {
+	path, err := resolveFilePath(source)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, classifyFileError("read", path, err)
+	}
+	if info.IsDir() {
+		return nil, IsDirectoryError{Path: path}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, classifyFileError("read", path, err)
+	}
+
+	doc := NewTypedDocument(path, string(data), "FileSystem", detectMimeType(path, data))
+	td := doc.(textBacked).text()
+	td.metadata.Size = int(info.Size())
+	// os.FileInfo has no portable birth time, so the modification
+	// time is the best creation estimate the filesystem gives us.
+	td.metadata.Created = info.ModTime()
+	td.metadata.Modified = info.ModTime()
+	td.history[0].Timestamp = info.ModTime()
+	td.encrypted = IsEncryptedContent(td.content)
+	return doc, nil
+}
+
+func (fr FileReader) SupportedSources() []string {
+	return []string{"file://", "local path"}
+}
+
+// OpenStream opens a file for streaming. The MIME type is sniffed from
+// the first 512 bytes instead of the whole file.
+func (fr FileReader) OpenStream(source string) (io.ReadCloser, Metadata, error) {
+	path, err := resolveFilePath(source)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, Metadata{}, classifyFileError("read", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Metadata{}, classifyFileError("read", path, err)
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, Metadata{}, IsDirectoryError{Path: path}
+	}
+
+	buffered := bufio.NewReader(f)
+	head, _ := buffered.Peek(512)
+	meta := Metadata{
+		Name:     path,
+		Size:     int(info.Size()),
+		Created:  info.ModTime(),
+		Modified: info.ModTime(),
+		MimeType: detectMimeType(path, head),
+		Author:   "FileSystem",
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{buffered, f}, meta, nil
+}
+
+// URLReader fetches documents over HTTP(S). The zero value works with the
+// defaults noted below, no cache and no rate limiting.
+type URLReader struct {
+	Timeout      time.Duration // whole request; 30s when zero
+	MaxRedirects int           // 10 when zero; negative forbids redirects
+	MaxBodyBytes int64         // 10 MiB when zero
+	CacheDir     string        // cache for conditional requests; "" disables
+	Limiter      *HostLimiter  // spaces out requests per host; nil disables
+	UserAgent    string        // "docproc/<EngineVersion>" when empty
+}
+
+func (ur URLReader) Read(source string) (Document, error) {
+	return ur.ReadContext(context.Background(), source)
+}
+
+// ReadContext is Read, abandoning the request when ctx is done
+func (ur URLReader) ReadContext(ctx context.Context, source string) (Document, error) {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL: %s", source)
+	}
+
+	var cached *urlCacheEntry
+	if ur.CacheDir != "" {
+		cached = loadURLCache(ur.CacheDir, source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s: %w", source, err)
+	}
+	req.Header.Set("User-Agent", cmp.Or(ur.UserAgent, "docproc/"+EngineVersion))
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	if ur.Limiter != nil {
+		if _, err := ur.Limiter.Wait(ctx, u.Host); err != nil {
+			return nil, fmt.Errorf("fetch %s: %w", source, err)
+		}
+	}
+	resp, err := ur.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return cached.document()
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, HTTPStatusError{URL: source, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err := readLimited(resp.Body, ur.maxBodyBytes(), resp.ContentLength)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", source, err)
+	}
+	entry := &urlCacheEntry{
+		URL:          source,
+		FinalURL:     resp.Request.URL.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		body:         body,
+	}
+	doc, err := entry.document()
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", source, err)
+	}
+	if ur.CacheDir != "" && (entry.ETag != "" || entry.LastModified != "") {
+		// A failed cache write only costs a full fetch next time
+		entry.save(ur.CacheDir)
+	}
+	return doc, nil
+}
+
+func (ur URLReader) SupportedSources() []string {
+	return []string{"http://", "https://"}
+}
+
+// DatabaseReader reads documents from a SQLite database (see DocumentDB)
+type DatabaseReader struct {
+	ConnectionString string // path of the database file
+	Driver           string // database/sql driver; DefaultSQLiteDriver if empty
+}
+
+func (dr DatabaseReader) Read(source string) (Document, error) {
+	loc, err := parseDBLocation(source)
+	if err != nil {
+		return nil, err
+	}
+	db, err := OpenDocumentDB(dr.Driver, dr.ConnectionString)
+	if err != nil {
+		return nil, err
+	}
+	id := loc.id
+	if id == "" {
+		ids, err := db.Find(loc.collection, loc.filter)
+		if err != nil {
+			return nil, fmt.Errorf("query %s: %w", source, err)
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("no document matches %s: %w", source, fs.ErrNotExist)
+		}
+		id = ids[0]
+	}
+	return db.Load(loc.collection, id)
+}
+
+func (dr DatabaseReader) SupportedSources() []string {
+	return []string{"db://", "sql://"}
+}
+
+// ============================================================================
+// FILE STORAGE HELPERS
+// ============================================================================
+
+// NotFoundError is returned when a file source does not exist
+type NotFoundError struct {
+	Path string
+	Err  error
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("file not found: %s", e.Path)
+}
+
+func (e NotFoundError) Unwrap() error { return e.Err }
+
+// PermissionError is returned when the process may not access a file
+type PermissionError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e PermissionError) Error() string {
+	return fmt.Sprintf("permission denied: cannot %s %s", e.Op, e.Path)
+}
+
+func (e PermissionError) Unwrap() error { return e.Err }
+
+// IsDirectoryError is returned when a file operation targets a directory
+type IsDirectoryError struct {
+	Path string
+}
+
+func (e IsDirectoryError) Error() string {
+	return fmt.Sprintf("is a directory: %s", e.Path)
+}
+
+// resolveFilePath turns a file:// URI or a plain local path into a
+// filesystem path. The URI is not parsed as a URL, so # and ? are part
+// of the file name; percent escapes are decoded when they are valid.
+func resolveFilePath(source string) (string, error) {
+	rest, ok := strings.CutPrefix(source, "file://")
+	if !ok {
+		if source == "" {
+			return "", fmt.Errorf("empty file path")
+		}
+		return filepath.Clean(source), nil
+	}
+
+	// file://relative/path is common shorthand, so anything other than
+	// localhost where the host would be is the first path segment
+	if after, ok := strings.CutPrefix(rest, "localhost"); ok && (after == "" || after[0] == '/') {
+		rest = after
+	}
+	if rest == "" {
+		return "", fmt.Errorf("file URI has no path: %s", source)
+	}
+	if unescaped, err := url.PathUnescape(rest); err == nil {
+		rest = unescaped
+	}
+	return filepath.Clean(filepath.FromSlash(rest)), nil
+}
+
+// classifyFileError maps os errors onto the typed storage errors
+func classifyFileError(op, path string, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return NotFoundError{Path: path, Err: err}
+	case errors.Is(err, fs.ErrPermission):
+		return PermissionError{Op: op, Path: path, Err: err}
+	case errors.Is(err, syscall.EISDIR):
+		return IsDirectoryError{Path: path}
+	}
+	return fmt.Errorf("%s %s: %w", op, path, err)
+}
+
+// detectMimeType infers a MIME type from the file extension, falling
+// back to sniffing the content
+func detectMimeType(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		// Not in Go's built-in table and missing from many system ones
+		return MimeMarkdown
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(path))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return mediaType
+	}
+	return mimeType
+}
+
+// ============================================================================
+// DATABASE STORAGE
+// ============================================================================
+//
+// Documents live in a SQLite file, accessed through database/sql. A SQLite
+// driver has to be linked into the binary, e.g. with
+//
+//	import _ "modernc.org/sqlite"      // driver "sqlite" (pure Go)
+//	import _ "github.com/mattn/go-sqlite3" // driver "sqlite3" (cgo)
+//
+// This file sticks to the standard library so it runs anywhere, which
+// means no driver is linked in as shipped. Without one the demo and the
+// CLI do not register db:// at all (see SQLiteLinked), and a
+// DatabaseReader or DatabaseWriter used directly fails with a clear error.
+// The tests for this part build only with the sqlite tag, which links
+// one in (see 06_challenge_sqlite_test.go).
+//
+// Sources and destinations name a collection and a document id:
+//
+//	db://reports/q1                     one document
+//	db://reports?tag=final&author=Ann   newest document matching every filter
+//
+// Filters: tag (repeatable), author, mime, name. sql:// is an alias.
+
+// DefaultSQLiteDriver is the database/sql driver name used when none is set
+const DefaultSQLiteDriver = "sqlite"
+
+// SQLiteLinked reports whether the named database/sql driver
+// (DefaultSQLiteDriver if empty) is linked into the binary
+func SQLiteLinked(driver string) bool {
+	return slices.Contains(sql.Drivers(), cmp.Or(driver, DefaultSQLiteDriver))
+}
+
+// dbTimeFormat is fixed-width so stored timestamps sort as text
+const dbTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// dbMigrations build the schema one step at a time; the engine records
+// how many it has applied in schema_migrations
+var dbMigrations = []string{
+	`CREATE TABLE documents (
+		collection  TEXT    NOT NULL,
+		id          TEXT    NOT NULL,
+		name        TEXT    NOT NULL,
+		mime_type   TEXT    NOT NULL,
+		author      TEXT    NOT NULL,
+		created_at  TEXT    NOT NULL,
+		modified_at TEXT    NOT NULL,
+		version     INTEGER NOT NULL,
+		encrypted   INTEGER NOT NULL DEFAULT 0,
+		content     TEXT    NOT NULL,
+		PRIMARY KEY (collection, id)
+	)`,
+	`CREATE TABLE document_tags (
+		collection TEXT NOT NULL,
+		id         TEXT NOT NULL,
+		tag        TEXT NOT NULL,
+		PRIMARY KEY (collection, id, tag)
+	)`,
+	`CREATE TABLE document_versions (
+		collection TEXT    NOT NULL,
+		id         TEXT    NOT NULL,
+		version    INTEGER NOT NULL,
+		author     TEXT    NOT NULL,
+		comment    TEXT    NOT NULL,
+		created_at TEXT    NOT NULL,
+		content    TEXT    NOT NULL,
+		PRIMARY KEY (collection, id, version)
+	)`,
+	`CREATE INDEX documents_by_modified ON documents (collection, modified_at)`,
+}
+
+// DocumentDB stores documents, their tags and every version in SQLite
+type DocumentDB struct {
+	db *sql.DB
+}
+
+var (
+	documentDBsMu sync.Mutex
+	documentDBs   = make(map[string]*DocumentDB) // by driver and path
+)
+
+// OpenDocumentDB opens (creating if needed) the database at path and
+// migrates its schema. Readers and writers for the same path share one
+// connection pool.
+func OpenDocumentDB(driver, path string) (*DocumentDB, error) {
+	if driver == "" {
+		driver = DefaultSQLiteDriver
+	}
+	key := driver + "\x00" + path
+	documentDBsMu.Lock()
+	defer documentDBsMu.Unlock()
+	if ddb, ok := documentDBs[key]; ok {
+		return ddb, nil
+	}
+
+	if !SQLiteLinked(driver) {
+		return nil, fmt.Errorf("open database %s: no %q driver linked in; import a SQLite driver such as modernc.org/sqlite", path, driver)
+	}
+	db, err := sql.Open(driver, path)
+	if err != nil {
+		return nil, fmt.Errorf("open database %s: %w", path, err)
+	}
+	// SQLite allows one writer at a time; a single connection keeps
+	// concurrent pipelines from failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	ddb := &DocumentDB{db: db}
+	if err := ddb.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate database %s: %w", path, err)
+	}
+	documentDBs[key] = ddb
+	return ddb, nil
+}
+
+// migrate applies the migrations not yet recorded in schema_migrations
+func (d *DocumentDB) migrate() error {
+	if _, err := d.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
+	var applied int
+	if err := d.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	for i := applied; i < len(dbMigrations); i++ {
+		tx, err := d.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(dbMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+			i+1, time.Now().UTC().Format(dbTimeFormat)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dbLocation is a parsed db:// or sql:// URI
+type dbLocation struct {
+	collection string
+	id         string     // empty for queries
+	filter     url.Values // tag, author, mime, name
+}
+
+func parseDBLocation(uri string) (dbLocation, error) {
+	scheme := uriScheme(uri)
+	if scheme != "db://" && scheme != "sql://" {
+		return dbLocation{}, fmt.Errorf("not a database URI: %s", uri)
+	}
+	rest, rawQuery, _ := strings.Cut(strings.TrimPrefix(uri, scheme), "?")
+	collection, id, _ := strings.Cut(rest, "/")
+	if collection == "" {
+		return dbLocation{}, fmt.Errorf("database URI has no collection: %s", uri)
+	}
+	filter, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return dbLocation{}, fmt.Errorf("invalid query in %s: %w", uri, err)
+	}
+	for key := range filter {
+		switch key {
+		case "tag", "author", "mime", "name":
+		default:
+			return dbLocation{}, fmt.Errorf("unknown filter %q in %s (want tag, author, mime or name)", key, uri)
+		}
+	}
+	if id == "" && len(filter) == 0 {
+		return dbLocation{}, fmt.Errorf("database URI needs an id or a filter: %s", uri)
+	}
+	if id != "" && len(filter) > 0 {
+		return dbLocation{}, fmt.Errorf("database URI has both an id and a filter: %s", uri)
+	}
+	return dbLocation{collection: collection, id: id, filter: filter}, nil
+}
+
+// Find returns the ids of documents in collection matching every filter,
+// newest first
+func (d *DocumentDB) Find(collection string, filter url.Values) ([]string, error) {
+	query := `SELECT d.id FROM documents d WHERE d.collection = ?`
+	args := []any{collection}
+	for _, f := range []struct{ key, column string }{{"author", "author"}, {"mime", "mime_type"}, {"name", "name"}} {
+		if v := filter.Get(f.key); v != "" {
+			query += " AND d." + f.column + " = ?"
+			args = append(args, v)
+		}
+	}
+	for _, tag := range filter["tag"] {
+		query += ` AND EXISTS (SELECT 1 FROM document_tags t
+			WHERE t.collection = d.collection AND t.id = d.id AND t.tag = ?)`
+		args = append(args, tag)
+	}
+	query += " ORDER BY d.modified_at DESC, d.id"
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Load rebuilds a stored document with its metadata, tags and full
+// version history
+func (d *DocumentDB) Load(collection, id string) (Document, error) {
+	var (
+		name, mimeType, author, created, modified, content string
+		version                                            int
+		encrypted                                          bool
+	)
+	err := d.db.QueryRow(`SELECT name, mime_type, author, created_at, modified_at, version, encrypted, content
+		FROM documents WHERE collection = ? AND id = ?`, collection, id).
+		Scan(&name, &mimeType, &author, &created, &modified, &version, &encrypted, &content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no document %s/%s: %w", collection, id, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	doc := NewTypedDocument(name, content, author, mimeType)
+	td := doc.(textBacked).text()
+	td.metadata.Created, _ = time.Parse(dbTimeFormat, created)
+	td.metadata.Modified, _ = time.Parse(dbTimeFormat, modified)
+	td.metadata.MimeType = mimeType
+	td.encrypted = encrypted
+
+	if td.metadata.Tags, err = d.tags(collection, id); err != nil {
+		return nil, err
+	}
+	if err := d.loadHistory(td, collection, id); err != nil {
+		return nil, err
+	}
+	if td.version != version {
+		return nil, fmt.Errorf("document %s/%s is at version %d but has %d stored versions", collection, id, version, td.version)
+	}
+	td.provenance[0].Name = "db://" + collection + "/" + id
+	return doc, nil
+}
+
+func (d *DocumentDB) tags(collection, id string) ([]string, error) {
+	rows, err := d.db.Query(`SELECT tag FROM document_tags WHERE collection = ? AND id = ? ORDER BY tag`, collection, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// loadHistory fills in td's versions, rebuilding the reverse deltas from
+// the full content stored for each version
+func (d *DocumentDB) loadHistory(td *TextDocument, collection, id string) error {
+	rows, err := d.db.Query(`SELECT version, author, comment, created_at, content
+		FROM document_versions WHERE collection = ? AND id = ? ORDER BY version`, collection, id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	td.history, td.deltas = nil, nil
+	var previous []string
+	for rows.Next() {
+		var info VersionInfo
+		var created, content string
+		if err := rows.Scan(&info.Version, &info.Author, &info.Comment, &created, &content); err != nil {
+			return err
+		}
+		info.Timestamp, _ = time.Parse(dbTimeFormat, created)
+		lines := splitLines(content)
+		if previous != nil {
+			td.deltas = append(td.deltas, makeLineDelta(lines, previous))
+		}
+		td.history = append(td.history, info)
+		previous = lines
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	td.version = len(td.history)
+	return nil
+}
+
+// dbVersion is one version of a document as Save stores it
+type dbVersion struct {
+	info    VersionInfo
+	content string
+}
+
+// versionsOf lists every version of doc with its content, oldest first.
+// A document without history, or an encrypted one whose past versions
+// cannot be rebuilt, yields only its current content.
+func versionsOf(doc Document) []dbVersion {
+	current := dbVersion{VersionInfo{Author: doc.GetMetadata().Author, Comment: "Saved"}, doc.GetContent()}
+	v, ok := doc.(Versionable)
+	if !ok || len(v.GetHistory()) == 0 {
+		return []dbVersion{current}
+	}
+	history := v.GetHistory()
+	versions := make([]dbVersion, 0, len(history))
+	for _, h := range history {
+		past, err := v.Checkout(h.Version)
+		if err != nil {
+			last := history[len(history)-1]
+			current.info.Author, current.info.Comment = last.Author, last.Comment
+			return []dbVersion{current}
+		}
+		versions = append(versions, dbVersion{h, past.GetContent()})
+	}
+	return versions
+}
+
+// Save stores doc as collection/id with every version in its history.
+// Saving over an existing document appends the versions the stored one
+// lacks: only the newer ones when doc carries on from what is stored
+// (it was loaded from here and edited), all of them otherwise.
+func (d *DocumentDB) Save(collection, id string, doc Document) (version int, err error) {
+	meta := doc.GetMetadata()
+	now := time.Now().UTC()
+	created := meta.Created
+	if created.IsZero() {
+		created = now
+	}
+	versions := versionsOf(doc)
+	encrypted := IsEncryptedContent(doc.GetContent())
+	if e, ok := doc.(Encryptable); ok {
+		encrypted = e.IsEncrypted()
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var stored int
+	err = tx.QueryRow(`SELECT version FROM documents WHERE collection = ? AND id = ?`, collection, id).Scan(&stored)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		version = len(versions)
+		_, err = tx.Exec(`INSERT INTO documents
+			(collection, id, name, mime_type, author, created_at, modified_at, version, encrypted, content)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			collection, id, meta.Name, meta.MimeType, meta.Author,
+			created.UTC().Format(dbTimeFormat), now.Format(dbTimeFormat), version, encrypted, doc.GetContent())
+	case err == nil:
+		var continues bool
+		if continues, err = continuesStored(tx, collection, id, versions); err != nil {
+			return 0, err
+		}
+		if continues {
+			versions = versions[stored:]
+		}
+		// created_at stays as the first save recorded it
+		version = stored + len(versions)
+		_, err = tx.Exec(`UPDATE documents SET name = ?, mime_type = ?, author = ?, modified_at = ?,
+			version = ?, encrypted = ?, content = ? WHERE collection = ? AND id = ?`,
+			meta.Name, meta.MimeType, meta.Author, now.Format(dbTimeFormat),
+			version, encrypted, doc.GetContent(), collection, id)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for i, v := range versions {
+		timestamp := v.info.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+		if _, err = tx.Exec(`INSERT INTO document_versions (collection, id, version, author, comment, created_at, content)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			collection, id, stored+i+1, v.info.Author, v.info.Comment,
+			timestamp.UTC().Format(dbTimeFormat), v.content); err != nil {
+			return 0, err
+		}
+	}
+	if _, err = tx.Exec(`DELETE FROM document_tags WHERE collection = ? AND id = ?`, collection, id); err != nil {
+		return 0, err
+	}
+	for _, tag := range slices.Compact(slices.Sorted(slices.Values(meta.Tags))) {
+		if _, err = tx.Exec(`INSERT INTO document_tags (collection, id, tag) VALUES (?, ?, ?)`, collection, id, tag); err != nil {
+			return 0, err
+		}
+	}
+	return version, tx.Commit()
+}
+
+// continuesStored reports whether versions start with exactly the
+// versions stored for collection/id
+func continuesStored(tx *sql.Tx, collection, id string, versions []dbVersion) (bool, error) {
+	rows, err := tx.Query(`SELECT content FROM document_versions
+		WHERE collection = ? AND id = ? ORDER BY version`, collection, id)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	i := 0
+	for ; rows.Next(); i++ {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			return false, err
+		}
+		if i >= len(versions) || versions[i].content != content {
+			return false, nil
+		}
+	}
+	return i > 0, rows.Err()
+}
+
+// Close closes the database and forgets it, so the next open starts fresh
+func (d *DocumentDB) Close() error {
+	documentDBsMu.Lock()
+	for key, ddb := range documentDBs {
+		if ddb == d {
+			delete(documentDBs, key)
+		}
+	}
+	documentDBsMu.Unlock()
+	return d.db.Close()
+}
+
+// ============================================================================
+// HTTP FETCHING
+// ============================================================================
+
+// client applies the reader's timeout and redirect limit. It shares
+// http.DefaultTransport, so connections are pooled across reads.
+func (ur URLReader) client() *http.Client {
+	timeout := ur.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	maxRedirects := ur.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = 10
+	}
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", max(maxRedirects, 0))
+			}
+			return nil
+		},
+	}
+}
+
+func (ur URLReader) maxBodyBytes() int64 {
+	if ur.MaxBodyBytes <= 0 {
+		return 10 << 20
+	}
+	return ur.MaxBodyBytes
+}
+
+// HTTPStatusError is returned for responses other than 2xx (and 304 with
+// a cached copy). 408, 429 and 5xx are retryable; 404 and 410 match
+// fs.ErrNotExist.
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e HTTPStatusError) Error() string {
+	return fmt.Sprintf("fetch %s: %s", e.URL, e.Status)
+}
+
+func (e HTTPStatusError) Retryable() bool {
+	return e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func (e HTTPStatusError) Unwrap() error {
+	if e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+// readLimited reads all of r, failing once it passes limit bytes
+func readLimited(r io.Reader, limit, contentLength int64) ([]byte, error) {
+	if contentLength > limit {
+		return nil, fmt.Errorf("body of %d bytes exceeds limit of %d", contentLength, limit)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("body exceeds limit of %d bytes", limit)
+	}
+	return data, nil
+}
+
+// HostLimiter spaces out requests to the same host by at least Interval
+type HostLimiter struct {
+	Interval time.Duration // the zero HostLimiter does not wait
+
+	mu   sync.Mutex
+	next map[string]time.Time // earliest start of the next request
+}
+
+func NewHostLimiter(interval time.Duration) *HostLimiter {
+	return &HostLimiter{Interval: interval}
+}
+
+// Wait blocks until host may be contacted again, or ctx is done, and
+// reports how long it waited. Slots are reserved in call order, so
+// waiters never pile up on the same instant; a cancelled wait gives its
+// slot back unless a later one was reserved behind it.
+func (l *HostLimiter) Wait(ctx context.Context, host string) (time.Duration, error) {
+	l.mu.Lock()
+	if l.next == nil {
+		l.next = make(map[string]time.Time)
+	}
+	now := time.Now()
+	slot := now
+	if next := l.next[host]; next.After(now) {
+		slot = next
+	}
+	l.next[host] = slot.Add(l.Interval)
+	l.mu.Unlock()
+
+	wait := slot.Sub(now)
+	if wait <= 0 {
+		return 0, ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return wait, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		if l.next[host].Equal(slot.Add(l.Interval)) {
+			l.next[host] = slot
+		}
+		l.mu.Unlock()
+		return time.Since(now), ctx.Err()
+	}
+}
+
+// urlCacheEntry is one cached response: <key>.json holds these fields
+// and <key>.body the raw bytes
+type urlCacheEntry struct {
+	URL          string    `json:"url"`
+	FinalURL     string    `json:"final_url"` // after redirects
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+
+	body []byte
+}
+
+func urlCacheKey(dir, source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(dir, fmt.Sprintf("%x", sum[:16]))
+}
+
+// loadURLCache returns the cached response for source, or nil
+func loadURLCache(dir, source string) *urlCacheEntry {
+	key := urlCacheKey(dir, source)
+	data, err := os.ReadFile(key + ".json")
+	if err != nil {
+		return nil
+	}
+	var entry urlCacheEntry
+	if json.Unmarshal(data, &entry) != nil || entry.URL != source {
+		return nil
+	}
+	if entry.body, err = os.ReadFile(key + ".body"); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+// save writes the body before the metadata, so a crash in between never
+// pairs new validators with an old body
+func (c *urlCacheEntry) save(dir string) error {
+	c.FetchedAt = time.Now()
+	meta, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := urlCacheKey(dir, c.URL)
+	if err := (FileWriter{}).Write(NewTextDocument(key+".body", string(c.body), "URLCache"), key+".body"); err != nil {
+		return err
+	}
+	return FileWriter{}.Write(NewTextDocument(key+".json", string(meta), "URLCache"), key+".json")
+}
+
+// document decodes the body into a typed document named by the final URL
+func (c *urlCacheEntry) document() (Document, error) {
+	mimeType := ""
+	if mediaType, _, err := mime.ParseMediaType(c.ContentType); err == nil {
+		mimeType = mediaType
+	}
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType, _, _ = strings.Cut(http.DetectContentType(c.body), ";")
+	}
+	content, err := decodeCharset(c.body, c.ContentType, mimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := NewTypedDocument(cmp.Or(c.FinalURL, c.URL), content, "WebFetcher", mimeType)
+	td := doc.(textBacked).text()
+	td.metadata.MimeType = mimeType
+	if modified, err := http.ParseTime(c.LastModified); err == nil {
+		td.metadata.Created = modified
+		td.metadata.Modified = modified
+		td.history[0].Timestamp = modified
+	}
+	return doc, nil
+}
+
+var htmlMetaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?([\w-]+)`)
+
+// decodeCharset converts body to UTF-8. The charset comes from the
+// Content-Type header, else a byte order mark, else an HTML <meta> tag,
+// else UTF-8 is assumed. Only charsets the standard library can handle
+// without tables are supported.
+func decodeCharset(body []byte, contentType, mimeType string) (string, error) {
+	charset := ""
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		charset = params["charset"]
+	}
+	switch {
+	case charset != "":
+	case bytes.HasPrefix(body, []byte{0xEF, 0xBB, 0xBF}):
+		charset = "utf-8"
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		charset = "utf-16le"
+	case bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		charset = "utf-16be"
+	case mimeType == MimeHTML:
+		if m := htmlMetaCharset.FindSubmatch(body[:min(len(body), 1024)]); m != nil {
+			charset = string(m[1])
+		}
+	}
+
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		body = bytes.TrimPrefix(body, []byte{0xEF, 0xBB, 0xBF})
+		return strings.ToValidUTF8(string(body), "\uFFFD"), nil
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		runes := make([]rune, len(body))
+		for i, b := range body {
+			runes[i] = rune(b)
+		}
+		return string(runes), nil
+	case "windows-1252", "cp1252":
+		runes := make([]rune, len(body))
+		for i, b := range body {
+			runes[i] = rune(b)
+			if b >= 0x80 && b <= 0x9F {
+				runes[i] = cp1252[b-0x80]
+			}
+		}
+		return string(runes), nil
+	case "utf-16", "utf-16le", "utf-16be":
+		bigEndian := strings.EqualFold(charset, "utf-16be")
+		if bytes.HasPrefix(body, []byte{0xFE, 0xFF}) {
+			bigEndian, body = true, body[2:]
+		} else if bytes.HasPrefix(body, []byte{0xFF, 0xFE}) {
+			bigEndian, body = false, body[2:]
+		}
+		if len(body)%2 != 0 {
+			return "", fmt.Errorf("odd number of bytes in UTF-16 body")
+		}
+		units := make([]uint16, len(body)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = uint16(body[2*i])<<8 | uint16(body[2*i+1])
+			} else {
+				units[i] = uint16(body[2*i+1])<<8 | uint16(body[2*i])
+			}
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return "", fmt.Errorf("unsupported charset %q", charset)
+}
+
+// cp1252 maps bytes 0x80-0x9F, where windows-1252 differs from Latin-1
+var cp1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
+
+// ============================================================================
+// DOCUMENT WRITERS
+// ============================================================================
+
+// FileWriter writes documents to filesystem
+type FileWriter struct {
+	Perm os.FileMode // defaults to 0644 when zero
+}
+
+func (fw FileWriter) Write(doc Document, destination string) error {
+	path, err := resolveFilePath(destination)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return IsDirectoryError{Path: path}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return classifyFileError("write", filepath.Dir(path), err)
+	}
+
+	perm := fw.Perm
+	if perm == 0 {
+		perm = 0o644
+	}
+
+	// Write to a temporary file first and rename it into place so a
+	// failed write never leaves a half-written document behind.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return classifyFileError("write", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(doc.GetContent()); err != nil {
+		tmp.Close()
+		return classifyFileError("write", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return classifyFileError("write", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return classifyFileError("write", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return classifyFileError("write", path, err)
+	}
+	return nil
+}
+
+func (fw FileWriter) SupportedDestinations() []string {
+	return []string{"file://", "local path"}
+}
+
+// CreateStream returns a writer to a temporary file that Close renames
+// into place, so readers never see a half-streamed document
+func (fw FileWriter) CreateStream(destination string, meta Metadata) (io.WriteCloser, error) {
+	path, err := resolveFilePath(destination)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil, IsDirectoryError{Path: path}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, classifyFileError("write", filepath.Dir(path), err)
+	}
+	perm := fw.Perm
+	if perm == 0 {
+		perm = 0o644
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, classifyFileError("write", path, err)
+	}
+	return &atomicFile{File: tmp, path: path, perm: perm}, nil
+}
+
+// atomicFile is a temporary file that becomes path on Close
+type atomicFile struct {
+	*os.File
+	path string
+	perm os.FileMode
+}
+
+func (af *atomicFile) Close() error {
+	defer os.Remove(af.Name())
+	if err := af.File.Close(); err != nil {
+		return classifyFileError("write", af.path, err)
+	}
+	if err := os.Chmod(af.Name(), af.perm); err != nil {
+		return classifyFileError("write", af.path, err)
+	}
+	if err := os.Rename(af.Name(), af.path); err != nil {
+		return classifyFileError("write", af.path, err)
+	}
+	return nil
+}
+
+// Abort discards the temporary file and leaves any existing file alone
+func (af *atomicFile) Abort() error {
+	af.File.Close()
+	return os.Remove(af.Name())
+}
+
+// ConsoleWriter outputs documents to console
+type ConsoleWriter struct {
+	Verbose bool
+}
+
+func (cw ConsoleWriter) Write(doc Document, destination string) error {
+	meta := doc.GetMetadata()
+	fmt.Println("=== Console Output ===")
+	if cw.Verbose {
+		fmt.Printf("Name: %s\n", meta.Name)
+		fmt.Printf("Author: %s\n", meta.Author)
+		fmt.Printf("Type: %s\n", meta.MimeType)
+		fmt.Println("---")
+	}
+	fmt.Println(doc.GetContent())
+	fmt.Println("======================")
+	return nil
+}
+
+func (cw ConsoleWriter) SupportedDestinations() []string {
+	return []string{"console://", "stdout"}
+}
+
+// Indexed keeps console output out of the index: "stdout" names no
+// document, so each write would replace the last
+func (cw ConsoleWriter) Indexed() bool { return false }
+
+func (cw ConsoleWriter) CreateStream(destination string, meta Metadata) (io.WriteCloser, error) {
+	fmt.Println("=== Console Output ===")
+	if cw.Verbose {
+		fmt.Printf("Name: %s\n", meta.Name)
+		fmt.Printf("Author: %s\n", meta.Author)
+		fmt.Printf("Type: %s\n", meta.MimeType)
+		fmt.Println("---")
+	}
+	return consoleStream{}, nil
+}
+
+// consoleStream writes to stdout and prints the footer on Close
+type consoleStream struct{}
+
+func (consoleStream) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+
+func (consoleStream) Close() error {
+	fmt.Println()
+	fmt.Println("======================")
+	return nil
+}
+
+// DatabaseWriter saves documents to a SQLite database (see DocumentDB).
+// Writing to an existing id stores a new version.
+type DatabaseWriter struct {
+	ConnectionString string // path of the database file
+	Driver           string // database/sql driver; DefaultSQLiteDriver if empty
+}
+
+func (dw DatabaseWriter) Write(doc Document, destination string) error {
+	loc, err := parseDBLocation(destination)
+	if err != nil {
+		return err
+	}
+	if loc.id == "" {
+		return fmt.Errorf("database destination needs an id, not a query: %s", destination)
+	}
+	db, err := OpenDocumentDB(dw.Driver, dw.ConnectionString)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Save(loc.collection, loc.id, doc); err != nil {
+		return fmt.Errorf("save %s: %w", destination, err)
+	}
+	return nil
+}
+
+func (dw DatabaseWriter) SupportedDestinations() []string {
+	return []string{"db://", "sql://"}
+}
+
+// ============================================================================
+// DOCUMENT LINEAGE
+// ============================================================================
+
+// DeriveDocument builds what a transformer produces from doc: a document
+// holding content, typed by mimeType ("" keeps doc's type), that inherits
+// doc's metadata, version history and provenance, plus one new version
+// and provenance step naming the transformer.
+//
+// Encryption state follows the new content. Encrypting or decrypting
+// changes how the content is stored, not the plaintext the history
+// describes, so those versions carry no content change.
+func DeriveDocument(doc Document, transformer, content, mimeType string) Document {
+	lineage := lineageOf(doc)
+	comment := "Transformed by " + transformer
+	encrypted := IsEncryptedContent(content)
+	if !lineage.encrypted && !encrypted {
+		lineage.UpdateContent(content, transformer, comment)
+	} else {
+		lineage.deltas = append(lineage.deltas, nil)
+		lineage.version++
+		lineage.metadata.Modified = time.Now()
+		lineage.history = append(lineage.history, VersionInfo{
+			Version:   lineage.version,
+			Timestamp: lineage.metadata.Modified,
+			Author:    transformer,
+			Comment:   comment,
+		})
+		lineage.content = content
+		lineage.metadata.Size = len(content)
+		lineage.encrypted = encrypted
+	}
+	lineage.provenance = append(lineage.provenance, ProvenanceStep{
+		Kind:      ProvenanceTransform,
+		Name:      transformer,
+		Version:   lineage.version,
+		Timestamp: lineage.metadata.Modified,
+	})
+
+	if mimeType == "" {
+		mimeType = lineage.metadata.MimeType
+	}
+	if encrypted {
+		// Keep the plaintext's type so decrypting restores it
+		lineage.metadata.MimeType = mimeType
+		return lineage
+	}
+	out := NewTypedDocument(lineage.metadata.Name, content, lineage.metadata.Author, mimeType)
+	td := out.(textBacked).text()
+	mimeType = td.metadata.MimeType
+	*td = *lineage
+	td.metadata.MimeType = mimeType
+	return out
+}
+
+// lineageOf copies everything DeriveDocument inherits from doc, so the
+// derived document never shares slices with its input
+func lineageOf(doc Document) *TextDocument {
+	meta := doc.GetMetadata()
+	meta.Tags = slices.Clone(meta.Tags)
+	if meta.Tags == nil {
+		meta.Tags = []string{}
+	}
+
+	if tb, ok := doc.(textBacked); ok {
+		src := tb.text()
+		return &TextDocument{
+			content:    src.content,
+			metadata:   meta,
+			version:    src.version,
+			history:    slices.Clone(src.history),
+			encrypted:  src.encrypted,
+			deltas:     slices.Clone(src.deltas),
+			provenance: slices.Clone(src.provenance),
+		}
+	}
+
+	// Documents from elsewhere (snapshots, plugins) start a history here
+	td := NewTextDocument(meta.Name, doc.GetContent(), meta.Author)
+	td.metadata = meta
+	td.encrypted = IsEncryptedContent(td.content)
+	if v, ok := doc.(interface{ Version() int }); ok {
+		td.history[0].Comment = fmt.Sprintf("Derived from version %d", v.Version())
+	}
+	if tr, ok := doc.(Traceable); ok && len(tr.Provenance()) > 0 {
+		td.provenance = tr.Provenance()
+	}
+	return td
+}
+
+// ============================================================================
+// DOCUMENT TRANSFORMERS
+// ============================================================================
+
+// UppercaseTransformer converts content to uppercase
+type UppercaseTransformer struct{}
+
+func (ut UppercaseTransformer) Transform(doc Document) (Document, error) {
+	content := strings.ToUpper(doc.GetContent())
+	return DeriveDocument(doc, ut.Name(), content, ""), nil
+}
+
+func (ut UppercaseTransformer) Name() string {
+	return "uppercase"
+}
+
+func (ut UppercaseTransformer) NewLineStage() LineStage {
+	return lineStageFunc(func(line string, emit func(string) error) error {
+		return emit(strings.ToUpper(line))
+	})
+}
+
+// TrimTransformer trims whitespace
+type TrimTransformer struct{}
+
+func (tt TrimTransformer) Transform(doc Document) (Document, error) {
+	lines := strings.Split(doc.GetContent(), "\n")
+	var trimmed []string
+	for _, line := range lines {
+		trimmed = append(trimmed, strings.TrimSpace(line))
+	}
+	content := strings.Join(trimmed, "\n")
+	return DeriveDocument(doc, tt.Name(), content, ""), nil
+}
+
+func (tt TrimTransformer) Name() string {
+	return "trim"
+}
+
+func (tt TrimTransformer) NewLineStage() LineStage {
+	return lineStageFunc(func(line string, emit func(string) error) error {
+		return emit(strings.TrimSpace(line))
+	})
+}
+
+// LineNumberTransformer adds line numbers
+type LineNumberTransformer struct{}
+
+func (ln LineNumberTransformer) Transform(doc Document) (Document, error) {
+	lines := strings.Split(doc.GetContent(), "\n")
+	var numbered []string
+	for i, line := range lines {
+		numbered = append(numbered, fmt.Sprintf("%3d: %s", i+1, line))
+	}
+	content := strings.Join(numbered, "\n")
+	out := DeriveDocument(doc, ln.Name(), content, "")
+	out.(textBacked).text().metadata.Name += "_numbered"
+	return out, nil
+}
+
+func (ln LineNumberTransformer) Name() string {
+	return "line-numbers"
+}
+
+func (ln LineNumberTransformer) NewLineStage() LineStage {
+	n := 0
+	return lineStageFunc(func(line string, emit func(string) error) error {
+		n++
+		return emit(fmt.Sprintf("%3d: %s", n, line))
+	})
+}
+
+// EncryptTransformer encrypts content as a pipeline step
+type EncryptTransformer struct {
+	Passphrase string
+}
+
+func (et EncryptTransformer) Transform(doc Document) (Document, error) {
+	envelope, err := EncryptContent(doc.GetContent(), et.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return DeriveDocument(doc, et.Name(), envelope, ""), nil
+}
+
+func (et EncryptTransformer) Name() string {
+	return "encrypt"
+}
+
+// DecryptTransformer decrypts envelope content as a pipeline step
+type DecryptTransformer struct {
+	Passphrase string
+}
+
+func (dt DecryptTransformer) Transform(doc Document) (Document, error) {
+	plaintext, err := DecryptContent(doc.GetContent(), dt.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return DeriveDocument(doc, dt.Name(), plaintext, ""), nil
+}
+
+func (dt DecryptTransformer) Name() string {
+	return "decrypt"
+}
+
+// MarkdownToHTMLTransformer renders Markdown as HTML
+type MarkdownToHTMLTransformer struct{}
+
+func (mt MarkdownToHTMLTransformer) Transform(doc Document) (Document, error) {
+	return DeriveDocument(doc, mt.Name(), markdownToHTML(doc.GetContent()), MimeHTML), nil
+}
+
+func (mt MarkdownToHTMLTransformer) Name() string {
+	return "markdown-to-html"
+}
+
+// HTMLToTextTransformer extracts the visible text of HTML
+type HTMLToTextTransformer struct{}
+
+func (ht HTMLToTextTransformer) Transform(doc Document) (Document, error) {
+	return DeriveDocument(doc, ht.Name(), htmlText(parseHTML(doc.GetContent())), MimeText), nil
+}
+
+func (ht HTMLToTextTransformer) Name() string {
+	return "html-to-text"
+}
+
+// JSONPrettyTransformer re-indents JSON
+type JSONPrettyTransformer struct {
+	Indent string // defaults to two spaces
+}
+
+func (jt JSONPrettyTransformer) Transform(doc Document) (Document, error) {
+	meta := doc.GetMetadata()
+	j, err := NewJSONDocument(meta.Name, doc.GetContent(), meta.Author)
+	if err != nil {
+		return nil, err
+	}
+	indent := jt.Indent
+	if indent == "" {
+		indent = "  "
+	}
+	content, err := j.Pretty(indent)
+	if err != nil {
+		return nil, err
+	}
+	return DeriveDocument(doc, jt.Name(), content, MimeJSON), nil
+}
+
+func (jt JSONPrettyTransformer) Name() string {
+	return "json-pretty"
+}
+
+func (jt JSONPrettyTransformer) ParamSpecs() []ParamSpec {
+	return []ParamSpec{{Name: "indent", Type: "string", Default: "  ", Description: "indentation per level"}}
+}
+
+func (jt JSONPrettyTransformer) WithParams(params Params) (DocumentTransformer, error) {
+	return JSONPrettyTransformer{Indent: params.String("indent")}, nil
+}
+
+// JSONMinifyTransformer strips insignificant whitespace from JSON
+type JSONMinifyTransformer struct{}
+
+func (jt JSONMinifyTransformer) Transform(doc Document) (Document, error) {
+	meta := doc.GetMetadata()
+	j, err := NewJSONDocument(meta.Name, doc.GetContent(), meta.Author)
+	if err != nil {
+		return nil, err
+	}
+	content, err := j.Minify()
+	if err != nil {
+		return nil, err
+	}
+	return DeriveDocument(doc, jt.Name(), content, MimeJSON), nil
+}
+
+func (jt JSONMinifyTransformer) Name() string {
+	return "json-minify"
+}
+
+// formatConversions are the direct MIME type conversions ConvertTransformer
+// can chain together
+var formatConversions = map[string]map[string]DocumentTransformer{
+	MimeMarkdown: {MimeHTML: MarkdownToHTMLTransformer{}},
+	MimeHTML:     {MimeText: HTMLToTextTransformer{}},
+}
+
+// conversionPath finds the shortest chain of conversions from one MIME
+// type to another
+func conversionPath(from, to string) ([]DocumentTransformer, bool) {
+	type step struct {
+		mime string
+		path []DocumentTransformer
+	}
+	visited := map[string]bool{from: true}
+	queue := []step{{mime: from}}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if cur.mime == to {
+			return cur.path, true
+		}
+		targets := make([]string, 0, len(formatConversions[cur.mime]))
+		for target := range formatConversions[cur.mime] {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			if !visited[target] {
+				visited[target] = true
+				path := append(append([]DocumentTransformer{}, cur.path...), formatConversions[cur.mime][target])
+				queue = append(queue, step{mime: target, path: path})
+			}
+		}
+	}
+	return nil, false
+}
+
+// ConvertTransformer converts a document to Target, choosing the
+// conversions from the document's Metadata.MimeType
+type ConvertTransformer struct {
+	Target string
+}
+
+func (ct ConvertTransformer) Transform(doc Document) (Document, error) {
+	from := doc.GetMetadata().MimeType
+	path, ok := conversionPath(from, ct.Target)
+	if !ok {
+		return nil, fmt.Errorf("no conversion from %s to %s", from, ct.Target)
+	}
+	for _, t := range path {
+		var err error
+		if doc, err = t.Transform(doc); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func (ct ConvertTransformer) Name() string {
+	switch ct.Target {
+	case MimeHTML:
+		return "to-html"
+	case MimeText:
+		return "to-text"
+	}
+	return "to-" + ct.Target
+}
+
+// ============================================================================
+// PARAMETERIZED TRANSFORMERS
+// ============================================================================
+
+// ParamSpec describes one option a transformer accepts
+type ParamSpec struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"` // "string", "int" or "bool"
+	Required    bool   `json:"required,omitempty"`
+	Default     any    `json:"default,omitempty"`
+	Description string `json:"description"`
+}
+
+// Params holds validated option values, normalised to the Go type named
+// by each ParamSpec, so the accessors below never fail
+type Params map[string]any
+
+func (p Params) String(name string) string { s, _ := p[name].(string); return s }
+func (p Params) Int(name string) int       { n, _ := p[name].(int); return n }
+func (p Params) Bool(name string) bool     { b, _ := p[name].(bool); return b }
+
+// ParameterizedTransformer is a transformer with options; WithParams
+// returns a configured copy
+type ParameterizedTransformer interface {
+	DocumentTransformer
+	ParamSpecs() []ParamSpec
+	WithParams(params Params) (DocumentTransformer, error)
+}
+
+// TransformerFactory is one entry of the engine's transformer registry
+type TransformerFactory struct {
+	Name   string
+	Params []ParamSpec
+	New    func(params Params) (DocumentTransformer, error)
+}
+
+// factoryFor wraps a transformer value as a registry entry
+func factoryFor(t DocumentTransformer) TransformerFactory {
+	if pt, ok := t.(ParameterizedTransformer); ok {
+		return TransformerFactory{Name: t.Name(), Params: pt.ParamSpecs(), New: pt.WithParams}
+	}
+	return TransformerFactory{
+		Name: t.Name(),
+		New:  func(Params) (DocumentTransformer, error) { return t, nil },
+	}
+}
+
+// validateParams checks raw values (typically decoded JSON) against specs,
+// converts them to their declared types and fills in defaults
+func validateParams(specs []ParamSpec, raw map[string]any) (Params, error) {
+	known := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		known[spec.Name] = true
+	}
+	var problems []string
+	for name := range raw {
+		if !known[name] {
+			problems = append(problems, fmt.Sprintf("unknown param %q", name))
+		}
+	}
+
+	params := make(Params, len(specs))
+	for _, spec := range specs {
+		value, ok := raw[spec.Name]
+		if !ok {
+			if spec.Required {
+				problems = append(problems, fmt.Sprintf("missing required param %q", spec.Name))
+			} else if spec.Default != nil {
+				params[spec.Name] = spec.Default
+			}
+			continue
+		}
+		converted, ok := convertParam(spec.Type, value)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("param %q must be %s, got %v", spec.Name, spec.Type, value))
+			continue
+		}
+		params[spec.Name] = converted
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	return params, nil
+}
+
+func convertParam(kind string, value any) (any, bool) {
+	switch kind {
+	case "string":
+		s, ok := value.(string)
+		return s, ok
+	case "bool":
+		b, ok := value.(bool)
+		return b, ok
+	case "int":
+		switch n := value.(type) {
+		case int:
+			return n, true
+		case int64:
+			return int(n), true
+		case float64:
+			if n == math.Trunc(n) {
+				return int(n), true
+			}
+		case json.Number:
+			if i, err := strconv.Atoi(n.String()); err == nil {
+				return i, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// mapLines applies the named transformer's fn to the content split into
+// lines
+func mapLines(doc Document, transformer string, fn func([]string) []string) Document {
+	content := strings.Join(fn(splitLines(doc.GetContent())), "\n")
+	return DeriveDocument(doc, transformer, content, "")
+}
+
+// RegexReplaceTransformer replaces every match of Pattern
+type RegexReplaceTransformer struct {
+	Pattern     *regexp.Regexp
+	Replacement string // may use $1-style group references
+}
+
+func (rt RegexReplaceTransformer) Transform(doc Document) (Document, error) {
+	if rt.Pattern == nil {
+		return nil, fmt.Errorf("regex-replace needs a pattern")
+	}
+	return DeriveDocument(doc, rt.Name(), rt.Pattern.ReplaceAllString(doc.GetContent(), rt.Replacement), ""), nil
+}
+
+func (rt RegexReplaceTransformer) Name() string { return "regex-replace" }
+
+// NewLineStage replaces within each line, so a streamed pattern cannot
+// match across a line break the way Transform's can
+func (rt RegexReplaceTransformer) NewLineStage() LineStage {
+	return lineStageFunc(func(line string, emit func(string) error) error {
+		if rt.Pattern == nil {
+			return fmt.Errorf("regex-replace needs a pattern")
+		}
+		return emit(rt.Pattern.ReplaceAllString(line, rt.Replacement))
+	})
+}
+
+func (rt RegexReplaceTransformer) ParamSpecs() []ParamSpec {
+	return []ParamSpec{
+		{Name: "pattern", Type: "string", Required: true, Description: "regular expression (RE2 syntax)"},
+		{Name: "replacement", Type: "string", Default: "", Description: "replacement text; $1 etc. refer to groups"},
+	}
+}
+
+func (rt RegexReplaceTransformer) WithParams(params Params) (DocumentTransformer, error) {
+	re, err := regexp.Compile(params.String("pattern"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return RegexReplaceTransformer{Pattern: re, Replacement: params.String("replacement")}, nil
+}
+
+// WrapTransformer word-wraps lines longer than Width runes
+type WrapTransformer struct {
+	Width int
+}
+
+func (wt WrapTransformer) Transform(doc Document) (Document, error) {
+	if wt.Width <= 0 {
+		return nil, fmt.Errorf("wrap width must be positive")
+	}
+	return mapLines(doc, wt.Name(), func(lines []string) []string {
+		var wrapped []string
+		for _, line := range lines {
+			wrapped = append(wrapped, wrapLine(line, wt.Width)...)
+		}
+		return wrapped
+	}), nil
+}
+
+// wrapLine splits one line into pieces of at most width runes, breaking
+// only between words
+func wrapLine(line string, width int) []string {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return []string{""}
+	}
+	var wrapped []string
+	current := words[0]
+	for _, w := range words[1:] {
+		if utf8.RuneCountInString(current)+1+utf8.RuneCountInString(w) > width {
+			wrapped = append(wrapped, current)
+			current = w
+		} else {
+			current += " " + w
+		}
+	}
+	return append(wrapped, current)
+}
+
+func (wt WrapTransformer) Name() string { return "wrap" }
+
+func (wt WrapTransformer) NewLineStage() LineStage {
+	return lineStageFunc(func(line string, emit func(string) error) error {
+		if wt.Width <= 0 {
+			return fmt.Errorf("wrap width must be positive")
+		}
+		for _, piece := range wrapLine(line, wt.Width) {
+			if err := emit(piece); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (wt WrapTransformer) ParamSpecs() []ParamSpec {
+	return []ParamSpec{{Name: "width", Type: "int", Default: 80, Description: "maximum line width in runes"}}
+}
+
+func (wt WrapTransformer) WithParams(params Params) (DocumentTransformer, error) {
+	if params.Int("width") <= 0 {
+		return nil, fmt.Errorf("width must be positive")
+	}
+	return WrapTransformer{Width: params.Int("width")}, nil
+}
+
+// HeadTransformer keeps the first Lines lines
+type HeadTransformer struct {
+	Lines int
+}
+
+func (ht HeadTransformer) Transform(doc Document) (Document, error) {
+	return mapLines(doc, ht.Name(), func(lines []string) []string {
+		return lines[:min(max(ht.Lines, 0), len(lines))]
+	}), nil
+}
+
+func (ht HeadTransformer) Name() string { return "head" }
+
+// NewLineStage asks the stream to stop once Lines lines have passed
+func (ht HeadTransformer) NewLineStage() LineStage {
+	n := 0
+	return lineStageFunc(func(line string, emit func(string) error) error {
+		if n >= ht.Lines {
+			return errStopStream
+		}
+		n++
+		if err := emit(line); err != nil {
+			return err
+		}
+		if n == ht.Lines {
+			return errStopStream
+		}
+		return nil
+	})
+}
+
+func (ht HeadTransformer) ParamSpecs() []ParamSpec {
+	return []ParamSpec{{Name: "lines", Type: "int", Default: 10, Description: "number of lines to keep"}}
+}
+
+func (ht HeadTransformer) WithParams(params Params) (DocumentTransformer, error) {
+	if params.Int("lines") < 0 {
+		return nil, fmt.Errorf("lines must not be negative")
+	}
+	return HeadTransformer{Lines: params.Int("lines")}, nil
+}
+
+// TailTransformer keeps the last Lines lines
+type TailTransformer struct {
+	Lines int
+}
+
+func (tt TailTransformer) Transform(doc Document) (Document, error) {
+	return mapLines(doc, tt.Name(), func(lines []string) []string {
+		return lines[len(lines)-min(max(tt.Lines, 0), len(lines)):]
+	}), nil
+}
+
+func (tt TailTransformer) Name() string { return "tail" }
+
+func (tt TailTransformer) NewLineStage() LineStage {
+	return &tailStage{n: tt.Lines}
+}
+
+func (tt TailTransformer) ParamSpecs() []ParamSpec {
+	return []ParamSpec{{Name: "lines", Type: "int", Default: 10, Description: "number of lines to keep"}}
+}
+
+func (tt TailTransformer) WithParams(params Params) (DocumentTransformer, error) {
+	if params.Int("lines") < 0 {
+		return nil, fmt.Errorf("lines must not be negative")
+	}
+	return TailTransformer{Lines: params.Int("lines")}, nil
+}
+
+// DedupeLinesTransformer drops repeated lines, keeping the first
+type DedupeLinesTransformer struct {
+	AdjacentOnly bool // like uniq(1): only collapse consecutive repeats
+}
+
+func (dt DedupeLinesTransformer) Transform(doc Document) (Document, error) {
+	return mapLines(doc, dt.Name(), func(lines []string) []string {
+		var kept []string
+		seen := make(map[string]bool)
+		for i, line := range lines {
+			if dt.AdjacentOnly {
+				if i > 0 && line == lines[i-1] {
+					continue
+				}
+			} else if seen[line] {
+				continue
+			}
+			seen[line] = true
+			kept = append(kept, line)
+		}
+		return kept
+	}), nil
+}
+
+func (dt DedupeLinesTransformer) Name() string { return "dedupe-lines" }
+
+// NewLineStage keeps only the previous line in adjacent mode; otherwise
+// it must remember every distinct line it has seen
+func (dt DedupeLinesTransformer) NewLineStage() LineStage {
+	seen := make(map[string]bool)
+	previous, first := "", true
+	return lineStageFunc(func(line string, emit func(string) error) error {
+		if dt.AdjacentOnly {
+			if !first && line == previous {
+				return nil
+			}
+			previous, first = line, false
+		} else {
+			if seen[line] {
+				return nil
+			}
+			seen[line] = true
+		}
+		return emit(line)
+	})
+}
+
+func (dt DedupeLinesTransformer) ParamSpecs() []ParamSpec {
+	return []ParamSpec{{Name: "adjacent", Type: "bool", Default: false, Description: "only remove consecutive duplicates"}}
+}
+
+func (dt DedupeLinesTransformer) WithParams(params Params) (DocumentTransformer, error) {
+	return DedupeLinesTransformer{AdjacentOnly: params.Bool("adjacent")}, nil
+}
+
+// SortLinesTransformer sorts lines
+type SortLinesTransformer struct {
+	Reverse    bool
+	IgnoreCase bool
+}
+
+func (st SortLinesTransformer) Transform(doc Document) (Document, error) {
+	return mapLines(doc, st.Name(), func(lines []string) []string {
+		sorted := append([]string(nil), lines...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			a, b := sorted[i], sorted[j]
+			if st.IgnoreCase {
+				a, b = strings.ToLower(a), strings.ToLower(b)
+			}
+			if st.Reverse {
+				return a > b
+			}
+			return a < b
+		})
+		return sorted
+	}), nil
+}
+
+func (st SortLinesTransformer) Name() string { return "sort-lines" }
+
+func (st SortLinesTransformer) ParamSpecs() []ParamSpec {
+	return []ParamSpec{
+		{Name: "reverse", Type: "bool", Default: false, Description: "sort descending"},
+		{Name: "ignore_case", Type: "bool", Default: false, Description: "compare case-insensitively"},
+	}
+}
+
+func (st SortLinesTransformer) WithParams(params Params) (DocumentTransformer, error) {
+	return SortLinesTransformer{Reverse: params.Bool("reverse"), IgnoreCase: params.Bool("ignore_case")}, nil
+}
+
+var (
+	htmlScriptOrStyle = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)\s*>`)
+	htmlTagOrComment  = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+)
+
+// StripHTMLTransformer removes tags, comments, scripts and styles but,
+// unlike html-to-text, keeps the original line layout
+type StripHTMLTransformer struct{}
+
+func (st StripHTMLTransformer) Transform(doc Document) (Document, error) {
+	content := htmlScriptOrStyle.ReplaceAllString(doc.GetContent(), "")
+	content = html.UnescapeString(htmlTagOrComment.ReplaceAllString(content, ""))
+	return DeriveDocument(doc, st.Name(), content, MimeText), nil
+}
+
+func (st StripHTMLTransformer) Name() string { return "strip-html" }
+
+// builtinTransformers are registered by every new engine
+var builtinTransformers = []DocumentTransformer{
+	RegexReplaceTransformer{},
+	WrapTransformer{Width: 80},
+	HeadTransformer{Lines: 10},
+	TailTransformer{Lines: 10},
+	DedupeLinesTransformer{},
+	SortLinesTransformer{},
+	StripHTMLTransformer{},
+}
+
+var _ ParameterizedTransformer = RegexReplaceTransformer{}
+var _ ParameterizedTransformer = WrapTransformer{}
+var _ ParameterizedTransformer = HeadTransformer{}
+var _ ParameterizedTransformer = TailTransformer{}
+var _ ParameterizedTransformer = DedupeLinesTransformer{}
+var _ ParameterizedTransformer = SortLinesTransformer{}
+
+var _ StreamTransformer = UppercaseTransformer{}
+var _ StreamTransformer = TrimTransformer{}
+var _ StreamTransformer = LineNumberTransformer{}
+var _ StreamTransformer = RegexReplaceTransformer{}
+var _ StreamTransformer = WrapTransformer{}
+var _ StreamTransformer = HeadTransformer{}
+var _ StreamTransformer = TailTransformer{}
+var _ StreamTransformer = DedupeLinesTransformer{}
+var _ ParameterizedTransformer = JSONPrettyTransformer{}
+
+// ============================================================================
+// PLUGIN SYSTEM
+// ============================================================================
+
+// TextToolsPlugin provides text transformation tools
+type TextToolsPlugin struct {
+	name    string
+	version string
+}
+
+func NewTextToolsPlugin() *TextToolsPlugin {
+	return &TextToolsPlugin{
+		name:    "TextTools",
+		version: "1.0.0",
+	}
+}
+
+func (p *TextToolsPlugin) Name() string {
+	return p.name
+}
+
+func (p *TextToolsPlugin) Version() string {
+	return p.version
+}
+
+func (p *TextToolsPlugin) Initialize() error {
+	fmt.Printf("Initializing plugin: %s v%s\n", p.name, p.version)
+	return nil
+}
+
+func (p *TextToolsPlugin) Shutdown() error {
+	return nil
+}
+
+func (p *TextToolsPlugin) GetTransformers() []DocumentTransformer {
+	return []DocumentTransformer{
+		UppercaseTransformer{},
+		TrimTransformer{},
+		LineNumberTransformer{},
+	}
+}
+
+// Verify plugin interfaces
+var _ Plugin = (*TextToolsPlugin)(nil)
+var _ TransformerPlugin = (*TextToolsPlugin)(nil)
+
+// FormatsPlugin provides conversions between the structured document types
+type FormatsPlugin struct{}
+
+func (p FormatsPlugin) Name() string    { return "Formats" }
+func (p FormatsPlugin) Version() string { return "1.0.0" }
+
+func (p FormatsPlugin) Initialize() error {
+	fmt.Printf("Initializing plugin: %s v%s\n", p.Name(), p.Version())
+	return nil
+}
+
+func (p FormatsPlugin) Shutdown() error {
+	return nil
+}
+
+func (p FormatsPlugin) Requires() []PluginRequirement {
+	return []PluginRequirement{{Name: EngineRequirement, Constraint: "^1.2.0"}}
+}
+
+func (p FormatsPlugin) GetTransformers() []DocumentTransformer {
+	return []DocumentTransformer{
+		MarkdownToHTMLTransformer{},
+		HTMLToTextTransformer{},
+		JSONPrettyTransformer{},
+		JSONMinifyTransformer{},
+		ConvertTransformer{Target: MimeHTML},
+		ConvertTransformer{Target: MimeText},
+	}
+}
+
+var _ TransformerPlugin = FormatsPlugin{}
+
+// MemoryStore keeps documents in memory under mem:// names
+type MemoryStore struct {
+	mu   sync.RWMutex
+	docs map[string]Document
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{docs: make(map[string]Document)}
+}
+
+func (m *MemoryStore) Read(source string) (Document, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	doc, ok := m.docs[source]
+	if !ok {
+		return nil, NotFoundError{Path: source}
+	}
+	return doc, nil
+}
+
+// Names lists the stored URIs in order
+func (m *MemoryStore) Names() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Sorted(maps.Keys(m.docs))
+}
+
+func (m *MemoryStore) SupportedSources() []string {
+	return []string{"mem://"}
+}
+
+func (m *MemoryStore) Write(doc Document, destination string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.docs[destination] = doc
+	return nil
+}
+
+func (m *MemoryStore) SupportedDestinations() []string {
+	return []string{"mem://"}
+}
+
+// Delete removes a stored document
+func (m *MemoryStore) Delete(uri string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.docs[uri]; !ok {
+		return NotFoundError{Path: uri}
+	}
+	delete(m.docs, uri)
+	return nil
+}
+
+// MemoryStorePlugin adds the mem:// scheme to the engine
+type MemoryStorePlugin struct {
+	store *MemoryStore
+}
+
+func NewMemoryStorePlugin() *MemoryStorePlugin {
+	return &MemoryStorePlugin{store: NewMemoryStore()}
+}
+
+func (p *MemoryStorePlugin) Name() string    { return "MemoryStore" }
+func (p *MemoryStorePlugin) Version() string { return "1.0.0" }
+
+func (p *MemoryStorePlugin) Initialize() error {
+	fmt.Printf("Initializing plugin: %s v%s\n", p.Name(), p.Version())
+	return nil
+}
+
+func (p *MemoryStorePlugin) Shutdown() error {
+	return nil
+}
+
+func (p *MemoryStorePlugin) GetReaders() map[string]DocumentReader {
+	return map[string]DocumentReader{"memory": p.store}
+}
+
+func (p *MemoryStorePlugin) GetWriters() map[string]DocumentWriter {
+	return map[string]DocumentWriter{"memory": p.store}
+}
+
+var _ DocumentProcessor = (*MemoryStore)(nil)
+var _ ReaderPlugin = (*MemoryStorePlugin)(nil)
+var _ WriterPlugin = (*MemoryStorePlugin)(nil)
+
+// ============================================================================
+// EXTERNAL PLUGINS
+// ============================================================================
+//
+// An external plugin is any executable that speaks newline-delimited
+// JSON-RPC 2.0 on stdin/stdout (see day10/plugins/wordstats for a sample):
+//
+//   handshake          -> {"name", "version", "protocol"}
+//   list_transformers  -> [{"name", "params": [ParamSpec...]}]
+//   transform          {"transformer", "params", "document"} -> {"document"}
+//   shutdown           -> true, then the process exits
+//
+// Document content is streamed: content longer than a chunk goes ahead
+// of the transform request, and of its response, as "chunk"
+// notifications {"id", "data"} carrying the call's id, and the document
+// itself holds only the last piece. No line grows with the document,
+// and other calls' messages interleave with the chunks.
+//
+// Calls are multiplexed by id over one long-lived process, so concurrent
+// Transform calls stream through the same pipes. A call that outlives the
+// timeout kills the process, as does a crash; either way the next call
+// starts a fresh process, up to MaxRestarts times.
+
+// externalProtocolVersion is the protocol version the engine speaks
+const externalProtocolVersion = 2
+
+// streamChunkSize is the most content one chunk carries, in bytes
+const streamChunkSize = 64 << 10
+
+// PluginProcessError reports that an external plugin process died or was
+// killed while a call was in flight
+type PluginProcessError struct {
+	Plugin string
+	Err    error
+}
+
+func (e PluginProcessError) Error() string {
+	return fmt.Sprintf("plugin %s stopped: %v", e.Plugin, e.Err)
+}
+
+func (e PluginProcessError) Unwrap() error { return e.Err }
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int64  `json:"id"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+// rpcNotification is a message that expects no answer, such as a chunk
+type rpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+// rpcChunk is one piece of the content of the call with the given id
+type rpcChunk struct {
+	ID   int64  `json:"id"`
+	Data string `json:"data"`
+}
+
+// rpcResponse is a response, or a chunk of one when Method is "chunk"
+type rpcResponse struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Method string    `json:"method"`
+	Params *rpcChunk `json:"params"`
+
+	streamed string // chunks that arrived ahead of the response
+}
+
+// wireDocument is how documents cross the process boundary
+type wireDocument struct {
+	Content  string   `json:"content"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// streamedParams is a request whose content can go ahead of it in
+// chunks. split returns the chunks and the request carrying the rest.
+type streamedParams interface {
+	split(size int) ([]string, any)
+}
+
+// streamedResult is a result whose content can arrive ahead of it in
+// chunks; prepend puts them back in front of the rest
+type streamedResult interface {
+	prepend(content string)
+}
+
+// splitContent cuts s into pieces of at most size bytes, never inside a
+// UTF-8 sequence, and returns all but the last piece and the last one
+func splitContent(s string, size int) ([]string, string) {
+	var chunks []string
+	for len(s) > size {
+		n := size
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		if n == 0 {
+			n = size
+		}
+		chunks = append(chunks, s[:n])
+		s = s[n:]
+	}
+	return chunks, s
+}
+
+// pluginProcess is one running instance of an external plugin
+type pluginProcess struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan rpcResponse
+
+	done chan struct{} // closed when the process has exited
+	err  error         // why it exited; valid once done is closed
+}
+
+func startPluginProcess(command []string) (*pluginProcess, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &pluginProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan rpcResponse),
+		done:    make(chan struct{}),
+	}
+	go p.readLoop(stdout)
+	return p, nil
+}
+
+// readLoop routes responses to their callers, with any chunks that came
+// ahead of them, until stdout closes, then fails every call still waiting
+func (p *pluginProcess) readLoop(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	partial := make(map[int64]*strings.Builder)
+	for scanner.Scan() {
+		var resp rpcResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			continue
+		}
+		if resp.Method == "chunk" && resp.Params != nil {
+			b, ok := partial[resp.Params.ID]
+			if !ok {
+				b = new(strings.Builder)
+				partial[resp.Params.ID] = b
+			}
+			b.WriteString(resp.Params.Data)
+			continue
+		}
+		if b, ok := partial[resp.ID]; ok {
+			resp.streamed = b.String()
+			delete(partial, resp.ID)
+		}
+		p.mu.Lock()
+		ch, ok := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+
+	err := p.cmd.Wait()
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err == nil {
+		err = errors.New("process exited")
+	}
+	p.err = err
+	close(p.done)
+}
+
+func (p *pluginProcess) alive() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *pluginProcess) kill() {
+	p.cmd.Process.Kill()
+	<-p.done
+}
+
+// call sends one request and waits for its response, ctx expiring or
+// the process dying
+func (p *pluginProcess) call(ctx context.Context, method string, params, result any) error {
+	p.mu.Lock()
+	p.nextID++
+	id := p.nextID
+	ch := make(chan rpcResponse, 1)
+	p.pending[id] = ch
+	p.mu.Unlock()
+	forget := func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}
+
+	var lines [][]byte
+	if sp, ok := params.(streamedParams); ok {
+		var chunks []string
+		chunks, params = sp.split(streamChunkSize)
+		for _, chunk := range chunks {
+			data, err := json.Marshal(rpcNotification{JSONRPC: "2.0", Method: "chunk", Params: rpcChunk{ID: id, Data: chunk}})
+			if err != nil {
+				forget()
+				return err
+			}
+			lines = append(lines, data)
+		}
+	}
+	data, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		forget()
+		return err
+	}
+	lines = append(lines, data)
+
+	// A plugin that stops reading blocks the write, so it runs aside
+	// and the call waits on it the way it waits for the answer
+	written := make(chan error, 1)
+	go func() {
+		for _, line := range lines {
+			p.writeMu.Lock()
+			_, err := p.stdin.Write(append(line, '\n'))
+			p.writeMu.Unlock()
+			if err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			forget()
+			p.kill()
+			return errProcessGone{p.err}
+		}
+	case <-p.done:
+		// The answer may already be in; the wait below sorts it out
+	case <-ctx.Done():
+		// The request may be half written, which leaves the pipe
+		// unusable for every call, so the process has to go
+		forget()
+		p.kill()
+		return errProcessGone{fmt.Errorf("%s timed out sending the request: %w", method, ctx.Err())}
+	}
+
+	var resp rpcResponse
+	select {
+	case resp = <-ch:
+	case <-p.done:
+		// A process that answers and exits, like one told to shut
+		// down, closes done right after delivering the answer
+		select {
+		case resp = <-ch:
+		default:
+			forget()
+			return errProcessGone{p.err}
+		}
+	case <-ctx.Done():
+		// Give up on this call only; a late answer is dropped. Calls
+		// still in flight may yet be answered, but with none left the
+		// plugin is wedged, so kill it and let the next call restart it
+		p.mu.Lock()
+		delete(p.pending, id)
+		idle := len(p.pending) == 0
+		p.mu.Unlock()
+		err := fmt.Errorf("%s timed out: %w", method, ctx.Err())
+		if idle {
+			p.kill()
+			return errProcessGone{err}
+		}
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("%s: %s", method, resp.Error.Message)
+	}
+	if result != nil {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return err
+		}
+		if sr, ok := result.(streamedResult); ok && resp.streamed != "" {
+			sr.prepend(resp.streamed)
+		}
+	}
+	return nil
+}
+
+// errProcessGone marks call failures caused by the process ending
+type errProcessGone struct{ err error }
+
+func (e errProcessGone) Error() string { return e.err.Error() }
+func (e errProcessGone) Unwrap() error { return e.err }
+
+// ExternalPlugin runs a transformer plugin in a separate process
+type ExternalPlugin struct {
+	Command       []string
+	Timeout       time.Duration // per call; defaults to 10s
+	MaxRestarts   int           // restarts allowed within RestartWindow
+	RestartWindow time.Duration // defaults to a minute
+
+	mu           sync.Mutex
+	proc         *pluginProcess
+	restarts     int         // in total
+	recent       []time.Time // restarts within the window
+	name         string
+	version      string
+	transformers []remoteTransformerInfo
+}
+
+type remoteTransformerInfo struct {
+	Name   string      `json:"name"`
+	Params []ParamSpec `json:"params"`
+}
+
+func NewExternalPlugin(command ...string) *ExternalPlugin {
+	return &ExternalPlugin{Command: command, Timeout: 10 * time.Second, MaxRestarts: 3}
+}
+
+// Name is the command's base name until the first handshake, then the
+// name the plugin reported. It does not change after that.
+func (p *ExternalPlugin) Name() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.nameLocked()
+}
+
+func (p *ExternalPlugin) nameLocked() string {
+	if p.name == "" && len(p.Command) > 0 {
+		return filepath.Base(p.Command[0])
+	}
+	return p.name
+}
+
+func (p *ExternalPlugin) Version() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version
+}
+
+// Initialize starts the process, checks the handshake and fetches the
+// transformer list
+func (p *ExternalPlugin) Initialize() error {
+	if len(p.Command) == 0 {
+		return fmt.Errorf("external plugin has no command")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.processLocked(); err != nil {
+		return err
+	}
+	fmt.Printf("Initializing plugin: %s v%s (pid %d)\n", p.name, p.version, p.proc.cmd.Process.Pid)
+	return nil
+}
+
+// processLocked returns the running process, starting one if needed.
+// p.mu must be held.
+func (p *ExternalPlugin) processLocked() (*pluginProcess, error) {
+	if p.proc != nil && p.proc.alive() {
+		return p.proc, nil
+	}
+	if p.proc != nil {
+		// Only restarts within the window count, so a plugin that
+		// crashes now and then keeps being restarted
+		now := time.Now()
+		p.recent = slices.DeleteFunc(p.recent, func(t time.Time) bool {
+			return now.Sub(t) >= p.restartWindow()
+		})
+		if len(p.recent) >= p.MaxRestarts {
+			return nil, PluginProcessError{Plugin: p.nameLocked(), Err: fmt.Errorf("gave up after %d restarts in %s: %w",
+				len(p.recent), p.restartWindow(), p.proc.err)}
+		}
+		p.recent = append(p.recent, now)
+		p.restarts++
+	}
+
+	proc, err := startPluginProcess(p.Command)
+	if err != nil {
+		return nil, fmt.Errorf("start plugin %s: %w", p.nameLocked(), err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+
+	var hello struct {
+		Name     string `json:"name"`
+		Version  string `json:"version"`
+		Protocol int    `json:"protocol"`
+	}
+	if err := proc.call(ctx, "handshake", map[string]any{"protocol": externalProtocolVersion}, &hello); err != nil {
+		proc.kill()
+		return nil, fmt.Errorf("plugin %s handshake: %w", p.nameLocked(), err)
+	}
+	if hello.Protocol != externalProtocolVersion {
+		proc.kill()
+		return nil, fmt.Errorf("plugin %s speaks protocol %d, engine speaks %d", hello.Name, hello.Protocol, externalProtocolVersion)
+	}
+	// The engine knows the plugin by its first name, so a restarted
+	// process must not come back as something else
+	if p.name != "" && hello.Name != p.name {
+		proc.kill()
+		return nil, PluginProcessError{Plugin: p.name, Err: fmt.Errorf("restarted as %q", hello.Name)}
+	}
+
+	var list []remoteTransformerInfo
+	if err := proc.call(ctx, "list_transformers", nil, &list); err != nil {
+		proc.kill()
+		return nil, fmt.Errorf("plugin %s list_transformers: %w", hello.Name, err)
+	}
+
+	p.proc, p.name, p.version, p.transformers = proc, hello.Name, hello.Version, list
+	return proc, nil
+}
+
+func (p *ExternalPlugin) restartWindow() time.Duration {
+	if p.RestartWindow <= 0 {
+		return time.Minute
+	}
+	return p.RestartWindow
+}
+
+func (p *ExternalPlugin) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return p.Timeout
+}
+
+// call runs one RPC, converting process failures into PluginProcessError
+func (p *ExternalPlugin) call(method string, params, result any) error {
+	p.mu.Lock()
+	proc, err := p.processLocked()
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+	err = proc.call(ctx, method, params, result)
+	var gone errProcessGone
+	if errors.As(err, &gone) {
+		return PluginProcessError{Plugin: p.Name(), Err: gone.err}
+	}
+	return err
+}
+
+// Restarts reports how many times the process has been restarted in all
+func (p *ExternalPlugin) Restarts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.restarts
+}
+
+func (p *ExternalPlugin) GetTransformers() []DocumentTransformer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ts []DocumentTransformer
+	for _, info := range p.transformers {
+		ts = append(ts, remoteTransformer{plugin: p, info: info})
+	}
+	return ts
+}
+
+// Shutdown asks the process to exit, killing it if it does not
+func (p *ExternalPlugin) Shutdown() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.proc == nil || !p.proc.alive() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+	err := p.proc.call(ctx, "shutdown", nil, nil)
+	p.proc.stdin.Close()
+	select {
+	case <-p.proc.done:
+	case <-time.After(time.Second):
+		p.proc.kill()
+	}
+	return err
+}
+
+// remoteTransformer forwards Transform calls to an external plugin
+type remoteTransformer struct {
+	plugin *ExternalPlugin
+	info   remoteTransformerInfo
+	params Params
+}
+
+// transformRequest is the params of a transform call
+type transformRequest struct {
+	Transformer string       `json:"transformer"`
+	Params      Params       `json:"params"`
+	Document    wireDocument `json:"document"`
+}
+
+func (r transformRequest) split(size int) ([]string, any) {
+	chunks, rest := splitContent(r.Document.Content, size)
+	r.Document.Content = rest
+	return chunks, r
+}
+
+// transformResult is the result of a transform call
+type transformResult struct {
+	Document wireDocument `json:"document"`
+}
+
+func (r *transformResult) prepend(content string) {
+	r.Document.Content = content + r.Document.Content
+}
+
+func (rt remoteTransformer) Transform(doc Document) (Document, error) {
+	var result transformResult
+	err := rt.plugin.call("transform", transformRequest{
+		Transformer: rt.info.Name,
+		Params:      rt.params,
+		Document:    wireDocument{Content: doc.GetContent(), Metadata: doc.GetMetadata()},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	// The plugin may rename, retag or retype the document; history and
+	// provenance stay ours, and fields it leaves empty keep their value
+	meta := result.Document.Metadata
+	out := DeriveDocument(doc, rt.info.Name, result.Document.Content, meta.MimeType)
+	td := out.(textBacked).text()
+	if meta.Name != "" {
+		td.metadata.Name = meta.Name
+	}
+	if meta.Author != "" {
+		td.metadata.Author = meta.Author
+	}
+	if meta.Tags != nil {
+		td.metadata.Tags = meta.Tags
+	}
+	return out, nil
+}
+
+func (rt remoteTransformer) Name() string            { return rt.info.Name }
+func (rt remoteTransformer) ParamSpecs() []ParamSpec { return rt.info.Params }
+
+func (rt remoteTransformer) WithParams(params Params) (DocumentTransformer, error) {
+	rt.params = params
+	return rt, nil
+}
+
+var _ TransformerPlugin = (*ExternalPlugin)(nil)
+var _ ParameterizedTransformer = remoteTransformer{}
+
+// ============================================================================
+// PLUGIN LIFECYCLE
+// ============================================================================
+
+// EngineVersion is what plugins' "engine" requirements are checked against
+const EngineVersion = "1.2.0"
+
+// EngineRequirement is the requirement name that refers to the engine
+const EngineRequirement = "engine"
+
+// PluginRequirement is a dependency on the engine or another plugin,
+// with a version constraint such as ">=1.2, <2" or "^1.0.0"
+type PluginRequirement struct {
+	Name       string
+	Constraint string
+}
+
+// DependentPlugin is a plugin that declares requirements
+type DependentPlugin interface {
+	Plugin
+	Requires() []PluginRequirement
+}
+
+// semver is a MAJOR.MINOR.PATCH version; pre-release and build suffixes
+// are accepted but ignored
+type semver struct {
+	major, minor, patch int
+}
+
+func parseSemver(s string) (semver, error) {
+	core := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if idx := strings.IndexAny(core, "-+"); idx >= 0 {
+		core = core[:idx]
+	}
+	parts := strings.Split(core, ".")
+	if core == "" || len(parts) > 3 {
+		return semver{}, fmt.Errorf("invalid version %q", s)
+	}
+	var nums [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}, fmt.Errorf("invalid version %q", s)
+		}
+		nums[i] = n
+	}
+	return semver{nums[0], nums[1], nums[2]}, nil
+}
+
+func (v semver) compare(o semver) int {
+	switch {
+	case v.major != o.major:
+		return cmp.Compare(v.major, o.major)
+	case v.minor != o.minor:
+		return cmp.Compare(v.minor, o.minor)
+	}
+	return cmp.Compare(v.patch, o.patch)
+}
+
+func (v semver) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+// versionComparator is one clause of a constraint, e.g. ">=1.2.0"
+type versionComparator struct {
+	op string
+	v  semver
+}
+
+// parseConstraint understands comma-separated clauses using =, !=, >,
+// >=, <, <=, ^ (same major) and ~ (same minor); "" and "*" allow anything
+func parseConstraint(s string) ([]versionComparator, error) {
+	var clauses []versionComparator
+	for _, clause := range strings.Split(s, ",") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" || clause == "*" {
+			continue
+		}
+		op := ""
+		for _, candidate := range []string{">=", "<=", "!=", ">", "<", "=", "^", "~"} {
+			if strings.HasPrefix(clause, candidate) {
+				op = candidate
+				break
+			}
+		}
+		v, err := parseSemver(strings.TrimPrefix(clause, op))
+		if err != nil {
+			return nil, fmt.Errorf("invalid constraint %q: %w", s, err)
+		}
+		switch op {
+		case "^":
+			upper := semver{v.major + 1, 0, 0}
+			if v.major == 0 {
+				upper = semver{0, v.minor + 1, 0}
+			}
+			clauses = append(clauses, versionComparator{">=", v}, versionComparator{"<", upper})
+		case "~":
+			clauses = append(clauses, versionComparator{">=", v}, versionComparator{"<", semver{v.major, v.minor + 1, 0}})
+		case "":
+			clauses = append(clauses, versionComparator{"=", v})
+		default:
+			clauses = append(clauses, versionComparator{op, v})
+		}
+	}
+	return clauses, nil
+}
+
+// versionSatisfies reports whether version meets constraint
+func versionSatisfies(version, constraint string) (bool, error) {
+	clauses, err := parseConstraint(constraint)
+	if err != nil {
+		return false, err
+	}
+	v, err := parseSemver(version)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range clauses {
+		diff := v.compare(c.v)
+		ok := map[string]bool{
+			"=": diff == 0, "!=": diff != 0,
+			">": diff > 0, ">=": diff >= 0,
+			"<": diff < 0, "<=": diff <= 0,
+		}[c.op]
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// pluginRequirements returns a plugin's requirements, if it declares any
+func pluginRequirements(p Plugin) []PluginRequirement {
+	if dp, ok := p.(DependentPlugin); ok {
+		return dp.Requires()
+	}
+	return nil
+}
+
+// checkRequirement verifies one requirement against a known version
+func checkRequirement(plugin string, req PluginRequirement, version string) error {
+	ok, err := versionSatisfies(version, req.Constraint)
+	if err != nil {
+		return fmt.Errorf("plugin %s: requirement %s: %w", plugin, req.Name, err)
+	}
+	if !ok {
+		return fmt.Errorf("plugin %s requires %s %s, found %s", plugin, req.Name, req.Constraint, version)
+	}
+	return nil
+}
+
+// orderPlugins sorts plugins so every plugin comes after the plugins it
+// requires, checking each requirement against the engine, the already
+// loaded plugins (loaded: name -> version) and the others in the set
+func orderPlugins(plugins []Plugin, loaded map[string]string) ([]Plugin, error) {
+	byName := make(map[string]Plugin, len(plugins))
+	for _, p := range plugins {
+		if _, dup := byName[p.Name()]; dup {
+			return nil, fmt.Errorf("plugin %s given twice", p.Name())
+		}
+		if _, dup := loaded[p.Name()]; dup {
+			return nil, fmt.Errorf("plugin already loaded: %s", p.Name())
+		}
+		byName[p.Name()] = p
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var order []Plugin
+	var stack []string
+
+	var visit func(p Plugin) error
+	visit = func(p Plugin) error {
+		name := p.Name()
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			start := slices.Index(stack, name)
+			return fmt.Errorf("plugin dependency cycle: %s", strings.Join(append(stack[start:], name), " -> "))
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+
+		for _, req := range pluginRequirements(p) {
+			var err error
+			switch dep, inSet := byName[req.Name]; {
+			case req.Name == EngineRequirement:
+				err = checkRequirement(name, req, EngineVersion)
+			case inSet:
+				if err = checkRequirement(name, req, dep.Version()); err == nil {
+					err = visit(dep)
+				}
+			default:
+				version, ok := loaded[req.Name]
+				if !ok {
+					return fmt.Errorf("plugin %s requires %s, which is not loaded", name, req.Name)
+				}
+				err = checkRequirement(name, req, version)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		order = append(order, p)
+		return nil
+	}
+
+	for _, p := range plugins {
+		if err := visit(p); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// loadedPlugin remembers what a plugin registered so it can be unloaded.
+// name is taken once Initialize has run, since an external plugin only
+// learns its name from the handshake.
+type loadedPlugin struct {
+	plugin       Plugin
+	name         string
+	transformers []string
+	readers      []string
+	writers      []string
+}
+
+// details describes what the plugin provides, for plugin events
+func (lp *loadedPlugin) details() map[string]any {
+	details := map[string]any{"version": lp.plugin.Version()}
+	if len(lp.transformers) > 0 {
+		details["transformers"] = lp.transformers
+	}
+	if len(lp.readers) > 0 {
+		details["readers"] = lp.readers
+	}
+	if len(lp.writers) > 0 {
+		details["writers"] = lp.writers
+	}
+	return details
+}
+
+// Plugins lists loaded plugins in load order
+func (e *ProcessingEngine) Plugins() []Plugin {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	plugins := make([]Plugin, len(e.plugins))
+	for i, lp := range e.plugins {
+		plugins[i] = lp.plugin
+	}
+	return plugins
+}
+
+// loadedVersions maps loaded plugin names to versions. e.mu must be held.
+func (e *ProcessingEngine) loadedVersionsLocked() map[string]string {
+	versions := make(map[string]string, len(e.plugins))
+	for _, lp := range e.plugins {
+		versions[lp.name] = lp.plugin.Version()
+	}
+	return versions
+}
+
+// LoadPlugins loads a set of plugins in dependency order. If any plugin
+// fails, the ones loaded by this call are unloaded again.
+func (e *ProcessingEngine) LoadPlugins(plugins ...Plugin) error {
+	e.pluginMu.Lock()
+	defer e.pluginMu.Unlock()
+
+	e.mu.RLock()
+	order, err := orderPlugins(plugins, e.loadedVersionsLocked())
+	e.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	var loaded []string
+	for _, p := range order {
+		lp, err := e.loadPluginLocked(p)
+		if err != nil {
+			for _, name := range slices.Backward(loaded) {
+				e.unloadPluginLocked(name)
+			}
+			return err
+		}
+		loaded = append(loaded, lp.name)
+	}
+	return nil
+}
+
+// UnloadPlugin shuts a plugin down and removes everything it registered.
+// It refuses while another loaded plugin requires it.
+func (e *ProcessingEngine) UnloadPlugin(name string) error {
+	e.pluginMu.Lock()
+	defer e.pluginMu.Unlock()
+
+	e.mu.RLock()
+	found := false
+	var dependents []string
+	for _, lp := range e.plugins {
+		if lp.name == name {
+			found = true
+		}
+		for _, req := range pluginRequirements(lp.plugin) {
+			if req.Name == name {
+				dependents = append(dependents, lp.name)
+			}
+		}
+	}
+	e.mu.RUnlock()
+
+	if !found {
+		return fmt.Errorf("plugin not loaded: %s", name)
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf("plugin %s is required by %s", name, strings.Join(dependents, ", "))
+	}
+	return e.unloadPluginLocked(name)
+}
+
+// unloadPluginLocked does the work of UnloadPlugin. e.pluginMu must be held.
+func (e *ProcessingEngine) unloadPluginLocked(name string) error {
+	e.mu.Lock()
+	idx := slices.IndexFunc(e.plugins, func(lp *loadedPlugin) bool { return lp.name == name })
+	if idx < 0 {
+		e.mu.Unlock()
+		return fmt.Errorf("plugin not loaded: %s", name)
+	}
+	lp := e.plugins[idx]
+	e.plugins = slices.Delete(e.plugins, idx, idx+1)
+	e.removeRegistrationsLocked(lp)
+	e.mu.Unlock()
+
+	start := time.Now()
+	if err := lp.plugin.Shutdown(); err != nil {
+		err = fmt.Errorf("plugin %s shutdown: %w", name, err)
+		e.emit(Event{Kind: EventPluginFailed, Name: name, Duration: time.Since(start), Err: err})
+		return err
+	}
+	e.emit(Event{Kind: EventPluginUnloaded, Name: name, Duration: time.Since(start), Details: lp.details()})
+	return nil
+}
+
+// removeRegistrationsLocked drops a plugin's transformers, readers and
+// writers, plus any routes pointing at them. Readers and writers that
+// were registered again since the plugin loaded belong to whoever did
+// that and are kept. e.mu must be held.
+func (e *ProcessingEngine) removeRegistrationsLocked(lp *loadedPlugin) {
+	for _, name := range lp.transformers {
+		delete(e.transformers, name)
+	}
+	for _, name := range lp.readers {
+		if e.readerOwners[name] != lp {
+			continue
+		}
+		delete(e.readers, name)
+		delete(e.readerOwners, name)
+		for scheme, target := range e.sourceRoutes {
+			if target == name {
+				delete(e.sourceRoutes, scheme)
+			}
+		}
+	}
+	for _, name := range lp.writers {
+		if e.writerOwners[name] != lp {
+			continue
+		}
+		delete(e.writers, name)
+		delete(e.writerOwners, name)
+		for scheme, target := range e.destinationRoutes {
+			if target == name {
+				delete(e.destinationRoutes, scheme)
+			}
+		}
+	}
+}
+
+// ShutdownPlugins unloads every plugin, most recently loaded first
+func (e *ProcessingEngine) ShutdownPlugins() error {
+	e.pluginMu.Lock()
+	defer e.pluginMu.Unlock()
+
+	var errs []error
+	for {
+		e.mu.RLock()
+		n := len(e.plugins)
+		var name string
+		if n > 0 {
+			name = e.plugins[n-1].name
+		}
+		e.mu.RUnlock()
+		if n == 0 {
+			return errors.Join(errs...)
+		}
+		if err := e.unloadPluginLocked(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+}
+
+// BundlePlugin packages a fixed set of transformers as a plugin
+type BundlePlugin struct {
+	PluginName    string
+	PluginVersion string
+	Requirements  []PluginRequirement
+	Transformers  []DocumentTransformer
+}
+
+func (b BundlePlugin) Name() string                           { return b.PluginName }
+func (b BundlePlugin) Version() string                        { return b.PluginVersion }
+func (b BundlePlugin) Initialize() error                      { return nil }
+func (b BundlePlugin) Shutdown() error                        { return nil }
+func (b BundlePlugin) Requires() []PluginRequirement          { return b.Requirements }
+func (b BundlePlugin) GetTransformers() []DocumentTransformer { return b.Transformers }
+
+var _ DependentPlugin = BundlePlugin{}
+var _ TransformerPlugin = BundlePlugin{}
+
+// ============================================================================
+// DOCUMENT PROCESSING ENGINE
+// ============================================================================
+
+// ProcessingEngine orchestrates document processing
+type ProcessingEngine struct {
+	pluginMu sync.Mutex   // serializes plugin loads and unloads
+	mu       sync.RWMutex // guards every map and slice below
+
+	readers      map[string]DocumentReader
+	writers      map[string]DocumentWriter
+	transformers map[string]TransformerFactory
+	plugins      []*loadedPlugin // in load order
+
+	// The plugin each reader and writer came from, if any
+	readerOwners map[string]*loadedPlugin
+	writerOwners map[string]*loadedPlugin
+
+	// Explicit scheme -> name bindings that override (and disambiguate)
+	// the schemes readers and writers advertise
+	sourceRoutes      map[string]string
+	destinationRoutes map[string]string
+
+	index *DocumentIndex // documents read or written, by URI
+
+	observers []Observer // replaced, never appended to in place
+
+	retryPolicies    map[string]RetryPolicy // by stage
+	deadLetterWriter string
+	deadLetterPrefix string
+	deadLetterSeq    int
+}
+
+func NewProcessingEngine() *ProcessingEngine {
+	e := &ProcessingEngine{
+		readers:           make(map[string]DocumentReader),
+		writers:           make(map[string]DocumentWriter),
+		transformers:      make(map[string]TransformerFactory),
+		plugins:           []*loadedPlugin{},
+		readerOwners:      make(map[string]*loadedPlugin),
+		writerOwners:      make(map[string]*loadedPlugin),
+		sourceRoutes:      make(map[string]string),
+		destinationRoutes: make(map[string]string),
+		index:             NewDocumentIndex(),
+		observers:         []Observer{SlogObserver{}},
+		retryPolicies:     make(map[string]RetryPolicy),
+	}
+	for _, t := range builtinTransformers {
+		e.RegisterTransformer(t)
+	}
+	return e
+}
+
+// Index returns the full-text index of the documents the engine has
+// read and written, except through an IndexPolicy that opts out
+func (e *ProcessingEngine) Index() *DocumentIndex {
+	return e.index
+}
+
+func (e *ProcessingEngine) RegisterReader(name string, reader DocumentReader) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.readers[name] = reader
+	delete(e.readerOwners, name)
+}
+
+func (e *ProcessingEngine) RegisterWriter(name string, writer DocumentWriter) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writers[name] = writer
+	delete(e.writerOwners, name)
+}
+
+// RegisterTransformer adds a transformer under its Name. Transformers
+// implementing ParameterizedTransformer become configurable factories.
+func (e *ProcessingEngine) RegisterTransformer(transformer DocumentTransformer) error {
+	return e.RegisterTransformerFactory(factoryFor(transformer))
+}
+
+// RegisterTransformerFactory adds a factory, rejecting duplicate names
+func (e *ProcessingEngine) RegisterTransformerFactory(factory TransformerFactory) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, exists := e.transformers[factory.Name]; exists {
+		return fmt.Errorf("transformer already registered: %s", factory.Name)
+	}
+	e.transformers[factory.Name] = factory
+	return nil
+}
+
+// Transformers lists the registered transformer factories by name
+func (e *ProcessingEngine) Transformers() []TransformerFactory {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	factories := make([]TransformerFactory, 0, len(e.transformers))
+	for _, f := range e.transformers {
+		factories = append(factories, f)
+	}
+	sort.Slice(factories, func(i, j int) bool { return factories[i].Name < factories[j].Name })
+	return factories
+}
+
+// Registration is a named reader or writer with the schemes it claims
+type Registration struct {
+	Name    string   `json:"name"`
+	Schemes []string `json:"schemes"`
+}
+
+// Readers lists the registered readers by name
+func (e *ProcessingEngine) Readers() []Registration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	regs := make([]Registration, 0, len(e.readers))
+	for name, r := range e.readers {
+		regs = append(regs, Registration{Name: name, Schemes: r.SupportedSources()})
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].Name < regs[j].Name })
+	return regs
+}
+
+// Writers lists the registered writers by name
+func (e *ProcessingEngine) Writers() []Registration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	regs := make([]Registration, 0, len(e.writers))
+	for name, w := range e.writers {
+		regs = append(regs, Registration{Name: name, Schemes: w.SupportedDestinations()})
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].Name < regs[j].Name })
+	return regs
+}
+
+// NewTransformer builds a configured transformer from the registry,
+// validating params against its schema
+func (e *ProcessingEngine) NewTransformer(name string, params map[string]any) (DocumentTransformer, error) {
+	e.mu.RLock()
+	factory, ok := e.transformers[name]
+	e.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("transformer not found: %s", name)
+	}
+	validated, err := validateParams(factory.Params, params)
+	if err != nil {
+		return nil, fmt.Errorf("transformer %s: %w", name, err)
+	}
+	t, err := factory.New(validated)
+	if err != nil {
+		return nil, fmt.Errorf("transformer %s: %w", name, err)
+	}
+	return t, nil
+}
+
+// reader and writer look up registrations under the read lock
+func (e *ProcessingEngine) reader(name string) (DocumentReader, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	r, ok := e.readers[name]
+	return r, ok
+}
+
+func (e *ProcessingEngine) writer(name string) (DocumentWriter, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	w, ok := e.writers[name]
+	return w, ok
+}
+
+// LoadPlugin checks a plugin's requirements against the engine and the
+// loaded plugins, initializes it and registers what it provides
+func (e *ProcessingEngine) LoadPlugin(plugin Plugin) error {
+	e.pluginMu.Lock()
+	defer e.pluginMu.Unlock()
+
+	e.mu.RLock()
+	_, err := orderPlugins([]Plugin{plugin}, e.loadedVersionsLocked())
+	e.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = e.loadPluginLocked(plugin)
+	return err
+}
+
+// loadPluginLocked initializes and registers a plugin whose requirements
+// have been checked. If any registration fails, the ones already made are
+// removed and the plugin is shut down. e.pluginMu must be held.
+func (e *ProcessingEngine) loadPluginLocked(plugin Plugin) (*loadedPlugin, error) {
+	start := time.Now()
+	if err := plugin.Initialize(); err != nil {
+		err = fmt.Errorf("failed to initialize plugin %s: %w", plugin.Name(), err)
+		e.emit(Event{Kind: EventPluginFailed, Name: plugin.Name(), Duration: time.Since(start), Err: err})
+		return nil, err
+	}
+
+	lp := &loadedPlugin{plugin: plugin, name: plugin.Name()}
+	fail := func(err error) (*loadedPlugin, error) {
+		e.mu.Lock()
+		e.removeRegistrationsLocked(lp)
+		e.mu.Unlock()
+		plugin.Shutdown()
+		err = fmt.Errorf("plugin %s: %w", lp.name, err)
+		e.emit(Event{Kind: EventPluginFailed, Name: lp.name, Duration: time.Since(start), Err: err})
+		return nil, err
+	}
+
+	// The name may only be known now, so check it again
+	e.mu.RLock()
+	_, dup := e.loadedVersionsLocked()[lp.name]
+	e.mu.RUnlock()
+	if dup {
+		return fail(fmt.Errorf("already loaded"))
+	}
+
+	// Check if plugin provides transformers
+	if tp, ok := plugin.(TransformerPlugin); ok {
+		for _, t := range tp.GetTransformers() {
+			if err := e.RegisterTransformer(t); err != nil {
+				return fail(err)
+			}
+			lp.transformers = append(lp.transformers, t.Name())
+		}
+	}
+
+	// Check if plugin provides readers or writers for new schemes. Unlike
+	// RegisterReader/RegisterWriter, plugins may not replace existing ones.
+	if rp, ok := plugin.(ReaderPlugin); ok {
+		for name, r := range rp.GetReaders() {
+			e.mu.Lock()
+			_, exists := e.readers[name]
+			if !exists {
+				e.readers[name] = r
+				e.readerOwners[name] = lp
+			}
+			e.mu.Unlock()
+			if exists {
+				return fail(fmt.Errorf("reader already registered: %s", name))
+			}
+			lp.readers = append(lp.readers, name)
+		}
+	}
+	if wp, ok := plugin.(WriterPlugin); ok {
+		for name, w := range wp.GetWriters() {
+			e.mu.Lock()
+			_, exists := e.writers[name]
+			if !exists {
+				e.writers[name] = w
+				e.writerOwners[name] = lp
+			}
+			e.mu.Unlock()
+			if exists {
+				return fail(fmt.Errorf("writer already registered: %s", name))
+			}
+			lp.writers = append(lp.writers, name)
+		}
+	}
+
+	e.mu.Lock()
+	e.plugins = append(e.plugins, lp)
+	e.mu.Unlock()
+	e.emit(Event{Kind: EventPluginLoaded, Name: lp.name, Duration: time.Since(start), Details: lp.details()})
+	return lp, nil
+}
+
+func (e *ProcessingEngine) Process(readerName, source string, transformerNames []string, writerName, destination string) error {
+	return e.ProcessContext(context.Background(), readerName, source, transformerNames, writerName, destination)
+}
+
+// ProcessContext is Process with cancellation: ctx is checked before
+// every stage, so a cancelled job stops at the next stage boundary
+func (e *ProcessingEngine) ProcessContext(ctx context.Context, readerName, source string, transformerNames []string, writerName, destination string) error {
+	// Resolve everything up front so a typo fails before any I/O
+	reader, ok := e.reader(readerName)
+	if !ok {
+		return fmt.Errorf("reader not found: %s", readerName)
+	}
+	var transformers []DocumentTransformer
+	for _, name := range transformerNames {
+		t, err := e.NewTransformer(name, nil)
+		if err != nil {
+			return err
+		}
+		transformers = append(transformers, t)
+	}
+	writer, ok := e.writer(writerName)
+	if !ok {
+		return fmt.Errorf("writer not found: %s", writerName)
+	}
+
+	return e.run(ctx, readerName, reader, source, transformers, writerName, writer, destination)
+}
+
+// run executes one read -> transform -> write pass with resolved stages,
+// retrying each stage under its RetryPolicy and reporting it to the
+// observers. A run that still fails goes to the dead-letter writer.
+func (e *ProcessingEngine) run(ctx context.Context, readerName string, reader DocumentReader, source string, transformers []DocumentTransformer, writerName string, writer DocumentWriter, destination string) error {
+	var doc Document
+	fail := func(stage, name string, attempts int, err error) error {
+		if ctx.Err() != nil {
+			// Cancelled runs did not fail; they were stopped
+			return err
+		}
+		letter := DeadLetter{Source: source, Destination: destination, Stage: stage, Name: name, Attempts: attempts}
+		return e.deadLetter(letter, doc, err)
+	}
+	attemptsNote := func(attempts int) string {
+		if attempts > 1 {
+			return fmt.Sprintf(" after %d attempts", attempts)
+		}
+		return ""
+	}
+
+	// Read document
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e.emit(Event{Kind: EventReadStarted, Name: readerName, URI: source})
+	start := time.Now()
+	contextReader, stoppable := reader.(ContextReader)
+	read, attempts, err := retryStage(ctx, e, StageRead, readerName, source, stoppable, func(ctx context.Context) (Document, error) {
+		if stoppable {
+			return contextReader.ReadContext(ctx, source)
+		}
+		return reader.Read(source)
+	})
+	if err != nil {
+		err = fmt.Errorf("read error%s: %w", attemptsNote(attempts), err)
+		e.emit(Event{Kind: EventReadFailed, Name: readerName, URI: source, Duration: time.Since(start), Err: err})
+		return fail(StageRead, readerName, attempts, err)
+	}
+	doc = read
+	e.emit(Event{Kind: EventReadFinished, Name: readerName, URI: source, Bytes: len(doc.GetContent()), Duration: time.Since(start)})
+	if indexed(reader) {
+		e.index.Add(indexKey(source), doc)
+	}
+
+	// Apply transformers. Plaintext a step decrypted stays out of the
+	// index, and so out of any index file saved from it.
+	decrypted := false
+	for _, t := range transformers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		start = time.Now()
+		in := doc
+		out, attempts, err := retryStage(ctx, e, StageTransform, t.Name(), source, false, func(context.Context) (Document, error) {
+			return t.Transform(in)
+		})
+		if err != nil {
+			err = fmt.Errorf("transform error (%s)%s: %w", t.Name(), attemptsNote(attempts), err)
+			e.emit(Event{Kind: EventTransformFailed, Name: t.Name(), URI: source, Duration: time.Since(start), Err: err})
+			return fail(StageTransform, t.Name(), attempts, err)
+		}
+		decrypted = decrypted || sealed(in) && !sealed(out)
+		doc = out
+		e.emit(Event{Kind: EventTransformApplied, Name: t.Name(), URI: source, Bytes: len(doc.GetContent()), Duration: time.Since(start)})
+	}
+
+	// Write document
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e.emit(Event{Kind: EventWriteStarted, Name: writerName, URI: destination})
+	start = time.Now()
+	final := doc
+	contextWriter, stoppable := writer.(ContextWriter)
+	_, attempts, err = retryStage(ctx, e, StageWrite, writerName, destination, stoppable, func(ctx context.Context) (struct{}, error) {
+		if stoppable {
+			return struct{}{}, contextWriter.WriteContext(ctx, final, destination)
+		}
+		return struct{}{}, writer.Write(final, destination)
+	})
+	if err != nil {
+		err = fmt.Errorf("write error%s: %w", attemptsNote(attempts), err)
+		e.emit(Event{Kind: EventWriteFailed, Name: writerName, URI: destination, Duration: time.Since(start), Err: err})
+		return fail(StageWrite, writerName, attempts, err)
+	}
+	e.emit(Event{Kind: EventWriteFinished, Name: writerName, URI: destination, Bytes: len(doc.GetContent()), Duration: time.Since(start)})
+	if indexed(writer) && !decrypted {
+		e.index.Add(indexKey(destination), doc)
+	}
+
+	return nil
+}
+
+// ============================================================================
+// OBSERVABILITY
+// ============================================================================
+//
+// The engine reports what it does as Events to its Observers instead of
+// printing. By default events are logged through log/slog; a Metrics
+// observer turns them into Prometheus counters and histograms.
+
+// EventKind names an event as "<stage>.<outcome>"
+type EventKind string
+
+const (
+	EventReadStarted      EventKind = "read.started"
+	EventReadFinished     EventKind = "read.finished"
+	EventReadFailed       EventKind = "read.failed"
+	EventReadRetried      EventKind = "read.retried"
+	EventTransformApplied EventKind = "transform.applied"
+	EventTransformFailed  EventKind = "transform.failed"
+	EventTransformRetried EventKind = "transform.retried"
+	EventWriteStarted     EventKind = "write.started"
+	EventWriteFinished    EventKind = "write.finished"
+	EventWriteFailed      EventKind = "write.failed"
+	EventWriteRetried     EventKind = "write.retried"
+	EventStreamFinished   EventKind = "stream.finished"
+	EventStreamFailed     EventKind = "stream.failed"
+	EventPluginLoaded     EventKind = "plugin.loaded"
+	EventPluginUnloaded   EventKind = "plugin.unloaded"
+	EventPluginFailed     EventKind = "plugin.failed"
+	EventDeadLettered     EventKind = "deadletter.written"
+	EventDeadLetterFailed EventKind = "deadletter.failed"
+)
+
+// Stage is the part before the dot, e.g. "read"
+func (k EventKind) Stage() string {
+	stage, _, _ := strings.Cut(string(k), ".")
+	return stage
+}
+
+// Outcome is the part after the dot, e.g. "finished"
+func (k EventKind) Outcome() string {
+	_, outcome, _ := strings.Cut(string(k), ".")
+	return outcome
+}
+
+// Event is one thing the engine did
+type Event struct {
+	Kind     EventKind
+	Time     time.Time
+	Name     string         // reader, transformer, writer or plugin
+	URI      string         // source or destination, if any
+	Bytes    int            // document size after the stage
+	Duration time.Duration  // zero for *.started events
+	Err      error          // set for *.failed and *.retried events
+	Details  map[string]any // kind-specific extras
+}
+
+// Observer receives engine events. Observe is called synchronously from
+// whichever goroutine ran the stage, so it must be quick and safe for
+// concurrent use.
+type Observer interface {
+	Observe(ev Event)
+}
+
+// ObserverFunc adapts a function to Observer
+type ObserverFunc func(ev Event)
+
+func (f ObserverFunc) Observe(ev Event) { f(ev) }
+
+// AddObserver adds o to the observers notified of every event
+func (e *ProcessingEngine) AddObserver(o Observer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.observers = append(slices.Clip(e.observers), o)
+}
+
+// SetObservers replaces all observers, including the default slog one;
+// with no arguments the engine runs silently
+func (e *ProcessingEngine) SetObservers(observers ...Observer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.observers = slices.Clone(observers)
+}
+
+func (e *ProcessingEngine) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.mu.RLock()
+	observers := e.observers
+	e.mu.RUnlock()
+	for _, o := range observers {
+		o.Observe(ev)
+	}
+}
+
+// SlogObserver logs events: failures at error level, retries at warn
+// level, *.started at debug level and everything else at info level
+type SlogObserver struct {
+	Logger *slog.Logger // slog.Default() when nil
+}
+
+func (so SlogObserver) Observe(ev Event) {
+	logger := so.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	level := slog.LevelInfo
+	switch {
+	case ev.Kind.Outcome() == "retried":
+		level = slog.LevelWarn
+	case ev.Err != nil:
+		level = slog.LevelError
+	case ev.Kind.Outcome() == "started":
+		level = slog.LevelDebug
+	}
+	ctx := context.Background()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{slog.String("name", ev.Name)}
+	if ev.URI != "" {
+		attrs = append(attrs, slog.String("uri", ev.URI))
+	}
+	if ev.Bytes > 0 {
+		attrs = append(attrs, slog.Int("bytes", ev.Bytes))
+	}
+	if ev.Duration > 0 {
+		attrs = append(attrs, slog.Duration("duration", ev.Duration))
+	}
+	for _, key := range slices.Sorted(maps.Keys(ev.Details)) {
+		attrs = append(attrs, slog.Any(key, ev.Details[key]))
+	}
+	if ev.Err != nil {
+		attrs = append(attrs, slog.Any("error", ev.Err))
+	}
+	logger.LogAttrs(ctx, level, string(ev.Kind), attrs...)
+}
+
+// durationBuckets are the histogram upper bounds, in seconds
+var durationBuckets = []float64{0.0001, 0.001, 0.01, 0.1, 1, 10}
+
+type metricKey struct {
+	stage, name, outcome string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	total  uint64
+}
+
+// Metrics is an Observer that counts operations, bytes and durations per
+// stage. It is an http.Handler serving the Prometheus text format.
+type Metrics struct {
+	mu        sync.Mutex
+	ops       map[metricKey]uint64     // by stage, name and outcome
+	bytes     map[metricKey]uint64     // by stage and name
+	durations map[metricKey]*histogram // by stage
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ops:       make(map[metricKey]uint64),
+		bytes:     make(map[metricKey]uint64),
+		durations: make(map[metricKey]*histogram),
+	}
+}
+
+// Observe records finished and failed operations; *.started events only
+// mark a beginning and are not counted
+func (m *Metrics) Observe(ev Event) {
+	stage, outcome := ev.Kind.Stage(), ev.Kind.Outcome()
+	if outcome == "started" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ops[metricKey{stage, ev.Name, outcome}]++
+	if ev.Err == nil && ev.Bytes > 0 {
+		m.bytes[metricKey{stage: stage, name: ev.Name}] += uint64(ev.Bytes)
+	}
+	if ev.Duration > 0 {
+		h := m.durations[metricKey{stage: stage}]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(durationBuckets)+1)}
+			m.durations[metricKey{stage: stage}] = h
+		}
+		seconds := ev.Duration.Seconds()
+		i, _ := slices.BinarySearch(durationBuckets, seconds)
+		h.counts[i]++
+		h.sum += seconds
+		h.total++
+	}
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition
+// format, with series sorted so the output is stable
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP docproc_operations_total Pipeline operations by stage, name and outcome.\n")
+	b.WriteString("# TYPE docproc_operations_total counter\n")
+	for _, k := range sortedKeys(m.ops) {
+		fmt.Fprintf(&b, "docproc_operations_total{stage=%s,name=%s,outcome=%s} %d\n",
+			promLabel(k.stage), promLabel(k.name), promLabel(k.outcome), m.ops[k])
+	}
+	b.WriteString("# HELP docproc_bytes_total Bytes produced by successful operations.\n")
+	b.WriteString("# TYPE docproc_bytes_total counter\n")
+	for _, k := range sortedKeys(m.bytes) {
+		fmt.Fprintf(&b, "docproc_bytes_total{stage=%s,name=%s} %d\n", promLabel(k.stage), promLabel(k.name), m.bytes[k])
+	}
+	b.WriteString("# HELP docproc_operation_duration_seconds Time spent per operation.\n")
+	b.WriteString("# TYPE docproc_operation_duration_seconds histogram\n")
+	for _, k := range sortedKeys(m.durations) {
+		h, stage := m.durations[k], promLabel(k.stage)
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "docproc_operation_duration_seconds_bucket{stage=%s,le=\"%s\"} %d\n",
+				stage, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&b, "docproc_operation_duration_seconds_bucket{stage=%s,le=\"+Inf\"} %d\n", stage, h.total)
+		fmt.Fprintf(&b, "docproc_operation_duration_seconds_sum{stage=%s} %s\n", stage, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "docproc_operation_duration_seconds_count{stage=%s} %d\n", stage, h.total)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+func sortedKeys[V any](series map[metricKey]V) []metricKey {
+	keys := slices.Collect(maps.Keys(series))
+	slices.SortFunc(keys, func(a, b metricKey) int {
+		return cmp.Or(cmp.Compare(a.stage, b.stage), cmp.Compare(a.name, b.name), cmp.Compare(a.outcome, b.outcome))
+	})
+	return keys
+}
+
+// promLabel quotes a label value, escaping as the text format requires
+func promLabel(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+var _ Observer = SlogObserver{}
+var _ Observer = (*Metrics)(nil)
+var _ http.Handler = (*Metrics)(nil)
+
+// ============================================================================
+// RETRIES AND DEAD LETTERS
+// ============================================================================
+//
+// Each stage of a run (read, each transform, write) can have a
+// RetryPolicy: how often to try, how long one attempt may take and how
+// long to wait in between. Only retryable errors are retried. A document
+// that still fails is handed to the dead-letter writer, if one is set,
+// together with its error chain.
+
+// Stage names for retry policies; they match the event stages
+const (
+	StageRead      = "read"
+	StageTransform = "transform"
+	StageWrite     = "write"
+)
+
+// ContextReader is a reader that stops when ctx is done. Attempts that
+// time out are cancelled rather than left running.
+type ContextReader interface {
+	ReadContext(ctx context.Context, source string) (Document, error)
+}
+
+// ContextWriter is a writer that stops when ctx is done, so a write that
+// timed out cannot land after its retry
+type ContextWriter interface {
+	WriteContext(ctx context.Context, doc Document, destination string) error
+}
+
+// IndexPolicy is a reader or writer that can keep the documents passing
+// through it out of the engine's index, such as a store that decides
+// itself how long documents live. Others are indexed.
+type IndexPolicy interface {
+	Indexed() bool
+}
+
+// indexed reports whether documents read or written by stage, a reader
+// or writer, belong in the index
+func indexed(stage any) bool {
+	p, ok := stage.(IndexPolicy)
+	return !ok || p.Indexed()
+}
+
+// RetryPolicy controls attempts at one stage. The zero value makes a
+// single attempt with no timeout, which is how stages behave by default.
+//
+// A timed-out write to a writer that is not a ContextWriter keeps running
+// in the background and may still land, so it is only retried if
+// RetryAbandonedWrites says the writer can safely write twice.
+type RetryPolicy struct {
+	MaxAttempts          int           // total attempts; <= 1 means no retries
+	Timeout              time.Duration // per attempt; 0 means none
+	InitialBackoff       time.Duration // wait before the second attempt
+	MaxBackoff           time.Duration // cap on the wait; 0 means no cap
+	Multiplier           float64       // backoff growth per attempt; defaults to 2
+	Jitter               float64       // 0-1: fraction of the wait randomized away
+	RetryAbandonedWrites bool          // retry writes that timed out but may finish
+}
+
+// Backoff returns how long to wait after the given failed attempt
+// (1-based), before jitter
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	wait := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	return time.Duration(wait)
+}
+
+// jittered spreads retries out so failing jobs do not retry in lockstep
+func (p RetryPolicy) jittered(attempt int) time.Duration {
+	wait := p.Backoff(attempt)
+	jitter := min(max(p.Jitter, 0), 1)
+	return wait - time.Duration(jitter*mathrand.Float64()*float64(wait))
+}
+
+// RetryableError marks an error as transient, worth another attempt
+type RetryableError struct {
+	Err error
+}
+
+func (e RetryableError) Error() string   { return e.Err.Error() }
+func (e RetryableError) Unwrap() error   { return e.Err }
+func (e RetryableError) Retryable() bool { return true }
+
+// PermanentError marks an error as final even if it wraps a transient one
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string   { return e.Err.Error() }
+func (e PermanentError) Unwrap() error   { return e.Err }
+func (e PermanentError) Retryable() bool { return false }
+
+// StageTimeoutError is returned when one attempt exceeds its policy's
+// Timeout. It is retryable; retryStage holds back abandoned writes.
+type StageTimeoutError struct {
+	Stage     string
+	Name      string
+	Timeout   time.Duration
+	Abandoned bool // the attempt could not be stopped and is still running
+}
+
+func (e StageTimeoutError) Error() string {
+	if e.Abandoned {
+		return fmt.Sprintf("%s %s timed out after %v and may still finish", e.Stage, e.Name, e.Timeout)
+	}
+	return fmt.Sprintf("%s %s timed out after %v", e.Stage, e.Name, e.Timeout)
+}
+
+func (e StageTimeoutError) Unwrap() error   { return context.DeadlineExceeded }
+func (e StageTimeoutError) Retryable() bool { return true }
+
+// IsRetryable classifies err. The outermost error with a Retryable()
+// method decides; otherwise timeouts, dropped connections and crashed
+// plugins (which restart on the next call) are retryable and everything
+// else, including missing files and bad input, is permanent.
+func IsRetryable(err error) bool {
+	var marked interface{ Retryable() bool }
+	if errors.As(err, &marked) {
+		return marked.Retryable()
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	for _, transient := range []error{context.DeadlineExceeded, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EAGAIN, syscall.ETIMEDOUT} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var pluginErr PluginProcessError
+	return errors.As(err, &pluginErr)
+}
+
+// SetRetryPolicy sets the policy for StageRead, StageTransform or
+// StageWrite
+func (e *ProcessingEngine) SetRetryPolicy(stage string, policy RetryPolicy) error {
+	switch stage {
+	case StageRead, StageTransform, StageWrite:
+	default:
+		return fmt.Errorf("unknown stage %q (want %s, %s or %s)", stage, StageRead, StageTransform, StageWrite)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.retryPolicies[stage] = policy
+	return nil
+}
+
+func (e *ProcessingEngine) retryPolicy(stage string) RetryPolicy {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.retryPolicies[stage]
+}
+
+// retryStage runs fn under the stage's policy and reports how many
+// attempts it took. If stoppable, fn honours its context and each attempt
+// is cancelled at the policy's Timeout. Otherwise an attempt that times
+// out is abandoned: it finishes in the background and its result is
+// dropped.
+func retryStage[T any](ctx context.Context, e *ProcessingEngine, stage, name, uri string, stoppable bool, fn func(ctx context.Context) (T, error)) (T, int, error) {
+	policy := e.retryPolicy(stage)
+	timeoutErr := StageTimeoutError{Stage: stage, Name: name, Timeout: policy.Timeout, Abandoned: !stoppable}
+	for attempt := 1; ; attempt++ {
+		var v T
+		var err error
+		if stoppable {
+			v, err = callWithDeadline(ctx, policy.Timeout, timeoutErr, fn)
+		} else {
+			v, err = callWithTimeout(ctx, policy.Timeout, timeoutErr, func() (T, error) { return fn(ctx) })
+		}
+		if err == nil {
+			return v, attempt, nil
+		}
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil || !IsRetryable(err) {
+			return v, attempt, err
+		}
+		var timeout StageTimeoutError
+		if stage == StageWrite && !policy.RetryAbandonedWrites && errors.As(err, &timeout) && timeout.Abandoned {
+			return v, attempt, err
+		}
+
+		wait := policy.jittered(attempt)
+		e.emit(Event{
+			Kind:    EventKind(stage + ".retried"),
+			Name:    name,
+			URI:     uri,
+			Err:     err,
+			Details: map[string]any{"attempt": attempt, "backoff": wait},
+		})
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return v, attempt, ctx.Err()
+		}
+	}
+}
+
+// callWithTimeout runs fn, giving up on it with timeoutErr after timeout
+// if that is positive
+func callWithTimeout[T any](ctx context.Context, timeout time.Duration, timeoutErr error, fn func() (T, error)) (T, error) {
+	if timeout <= 0 {
+		return fn()
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := fn()
+		done <- result{v, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var zero T
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-timer.C:
+		return zero, timeoutErr
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// callWithDeadline runs fn with a context that expires after timeout, if
+// that is positive, and waits for it to return
+func callWithDeadline[T any](ctx context.Context, timeout time.Duration, timeoutErr error, fn func(ctx context.Context) (T, error)) (T, error) {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	v, err := fn(attemptCtx)
+	if err != nil && ctx.Err() == nil && attemptCtx.Err() != nil {
+		return v, timeoutErr
+	}
+	return v, err
+}
+
+// DeadLetter is what the dead-letter writer receives, as a JSON document
+type DeadLetter struct {
+	Source      string        `json:"source"`
+	Destination string        `json:"destination"`
+	Stage       string        `json:"stage"`
+	Name        string        `json:"name"` // reader, transformer or writer that failed
+	Attempts    int           `json:"attempts"`
+	Errors      []string      `json:"errors"` // the error chain, outermost first
+	FailedAt    time.Time     `json:"failed_at"`
+	Document    *wireDocument `json:"document,omitempty"` // last good version, if the read succeeded
+}
+
+// SetDeadLetter sends documents that ultimately fail to the named writer,
+// at prefix followed by a generated name. An empty writerName turns dead
+// lettering off.
+func (e *ProcessingEngine) SetDeadLetter(writerName, prefix string) error {
+	if writerName != "" {
+		if _, ok := e.writer(writerName); !ok {
+			return fmt.Errorf("writer not found: %s", writerName)
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.deadLetterWriter, e.deadLetterPrefix = writerName, prefix
+	return nil
+}
+
+// DeadLetteredError is a failed run's error once its dead letter has
+// been written, telling where to find it
+type DeadLetteredError struct {
+	Err         error
+	Destination string
+}
+
+func (e DeadLetteredError) Error() string { return e.Err.Error() }
+func (e DeadLetteredError) Unwrap() error { return e.Err }
+
+// deadLetter records a failed run if a dead-letter writer is set. It
+// returns err as a DeadLetteredError, or joined with the dead-letter
+// failure if recording failed.
+func (e *ProcessingEngine) deadLetter(letter DeadLetter, doc Document, err error) error {
+	e.mu.Lock()
+	writerName, prefix := e.deadLetterWriter, e.deadLetterPrefix
+	if writerName == "" {
+		e.mu.Unlock()
+		return err
+	}
+	e.deadLetterSeq++
+	seq := e.deadLetterSeq
+	e.mu.Unlock()
+
+	letter.Errors = errorChain(err)
+	letter.FailedAt = time.Now()
+	if doc != nil {
+		letter.Document = &wireDocument{Content: doc.GetContent(), Metadata: doc.GetMetadata()}
+	}
+	data, jsonErr := json.MarshalIndent(letter, "", "  ")
+	if jsonErr != nil {
+		return errors.Join(err, fmt.Errorf("dead letter: %w", jsonErr))
+	}
+	destination := fmt.Sprintf("%s%06d-%s.json", prefix, seq, deadLetterName(letter.Source))
+
+	writeErr := errors.New("dead-letter writer not found: " + writerName)
+	if w, ok := e.writer(writerName); ok {
+		writeErr = w.Write(NewTextDocument(destination, string(data), "DeadLetter"), destination)
+	}
+	if writeErr != nil {
+		writeErr = fmt.Errorf("dead letter: %w", writeErr)
+		e.emit(Event{Kind: EventDeadLetterFailed, Name: writerName, URI: destination, Err: writeErr})
+		return errors.Join(err, writeErr)
+	}
+	e.emit(Event{Kind: EventDeadLettered, Name: writerName, URI: destination, Bytes: len(data), Details: map[string]any{"source": letter.Source, "stage": letter.Stage}})
+	return DeadLetteredError{Err: err, Destination: destination}
+}
+
+// errorChain lists err and everything it wraps, depth first
+func errorChain(err error) []string {
+	var chain []string
+	var walk func(err error)
+	walk = func(err error) {
+		for err != nil {
+			chain = append(chain, err.Error())
+			if joined, ok := err.(interface{ Unwrap() []error }); ok {
+				for _, inner := range joined.Unwrap() {
+					walk(inner)
+				}
+				return
+			}
+			err = errors.Unwrap(err)
+		}
+	}
+	walk(err)
+	return chain
+}
+
+// deadLetterName turns a source URI into a short, path-safe name
+func deadLetterName(source string) string {
+	base := path.Base(strings.TrimRight(filepath.ToSlash(source), "/"))
+	name := strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, base)
+	if name == "" || name == "." {
+		return "document"
+	}
+	return name
+}
+
+// ============================================================================
+// SCHEME-BASED ROUTING
+// ============================================================================
+
+// localPathScheme is what readers and writers advertise when they accept
+// plain paths with no scheme
+const localPathScheme = "local path"
+
+// SchemeError reports a URI whose scheme cannot be routed to exactly one
+// reader or writer
+type SchemeError struct {
+	Kind       string // "source" or "destination"
+	URI        string
+	Scheme     string
+	Candidates []string
+}
+
+func (e SchemeError) Error() string {
+	scheme := e.Scheme
+	if scheme == "" {
+		scheme = localPathScheme
+	}
+	role := "reader"
+	if e.Kind == "destination" {
+		role = "writer"
+	}
+	if len(e.Candidates) == 0 {
+		return fmt.Sprintf("no %s registered for %s scheme %q (%s)", role, e.Kind, scheme, e.URI)
+	}
+	return fmt.Sprintf("ambiguous %s scheme %q (%s): claimed by %ss %s",
+		e.Kind, scheme, e.URI, role, strings.Join(e.Candidates, ", "))
+}
+
+// uriScheme returns the lower-cased "scheme://" prefix of uri, or "" for
+// plain paths
+func uriScheme(uri string) string {
+	if idx := strings.Index(uri, "://"); idx > 0 {
+		return strings.ToLower(uri[:idx+3])
+	}
+	return ""
+}
+
+// claimScore reports how specifically a list of advertised patterns
+// accepts uri: 0 means not at all. Patterns are a literal alias such as
+// "stdout" (most specific), a scheme such as "file://", or the catch-all
+// localPathScheme for plain paths.
+func claimScore(patterns []string, uri string) int {
+	scheme := uriScheme(uri)
+	best := 0
+	for _, p := range patterns {
+		score := 0
+		switch {
+		case p == uri:
+			score = 3
+		case strings.HasSuffix(p, "://"):
+			if scheme != "" && strings.EqualFold(p, scheme) {
+				score = 2
+			}
+		case p == localPathScheme:
+			if scheme == "" {
+				score = 1
+			}
+		}
+		if score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// mostSpecific returns the names with the highest non-zero score
+func mostSpecific(scores map[string]int) []string {
+	best := 0
+	var names []string
+	for name, score := range scores {
+		switch {
+		case score == 0 || score < best:
+		case score > best:
+			best = score
+			names = []string{name}
+		default:
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RouteSource binds a source scheme (e.g. "s3://") to a named reader,
+// taking precedence over what readers advertise
+func (e *ProcessingEngine) RouteSource(scheme, readerName string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.readers[readerName]; !ok {
+		return fmt.Errorf("reader not found: %s", readerName)
+	}
+	e.sourceRoutes[strings.ToLower(scheme)] = readerName
+	return nil
+}
+
+// RouteDestination binds a destination scheme to a named writer
+func (e *ProcessingEngine) RouteDestination(scheme, writerName string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.writers[writerName]; !ok {
+		return fmt.Errorf("writer not found: %s", writerName)
+	}
+	e.destinationRoutes[strings.ToLower(scheme)] = writerName
+	return nil
+}
+
+// ResolveReader picks the reader for a source URI
+func (e *ProcessingEngine) ResolveReader(source string) (string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	scheme := uriScheme(source)
+	if name, ok := e.sourceRoutes[scheme]; ok {
+		return name, nil
+	}
+
+	scores := make(map[string]int)
+	for name, r := range e.readers {
+		scores[name] = claimScore(r.SupportedSources(), source)
+	}
+	candidates := mostSpecific(scores)
+	if len(candidates) != 1 {
+		return "", SchemeError{Kind: "source", URI: source, Scheme: scheme, Candidates: candidates}
+	}
+	return candidates[0], nil
+}
+
+// ResolveWriter picks the writer for a destination URI
+func (e *ProcessingEngine) ResolveWriter(destination string) (string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	scheme := uriScheme(destination)
+	if name, ok := e.destinationRoutes[scheme]; ok {
+		return name, nil
+	}
+
+	scores := make(map[string]int)
+	for name, w := range e.writers {
+		scores[name] = claimScore(w.SupportedDestinations(), destination)
+	}
+	candidates := mostSpecific(scores)
+	if len(candidates) != 1 {
+		return "", SchemeError{Kind: "destination", URI: destination, Scheme: scheme, Candidates: candidates}
+	}
+	return candidates[0], nil
+}
+
+// ProcessURI is like Process but picks the reader and writer from the
+// source and destination URI schemes
+func (e *ProcessingEngine) ProcessURI(source string, transformerNames []string, destination string) error {
+	return e.ProcessURIContext(context.Background(), source, transformerNames, destination)
+}
+
+// ProcessURIContext is ProcessURI with cancellation
+func (e *ProcessingEngine) ProcessURIContext(ctx context.Context, source string, transformerNames []string, destination string) error {
+	readerName, err := e.ResolveReader(source)
+	if err != nil {
+		return err
+	}
+	writerName, err := e.ResolveWriter(destination)
+	if err != nil {
+		return err
+	}
+	return e.ProcessContext(ctx, readerName, source, transformerNames, writerName, destination)
+}
+
+// ============================================================================
+// BATCH PROCESSING
+// ============================================================================
+
+// BatchJob is one source -> transformers -> destination run
+type BatchJob struct {
+	Source       string
+	Transformers []string
+	Destination  string
+}
+
+// BatchResult is the outcome of one BatchJob
+type BatchResult struct {
+	Index    int // position of the job in the submitted batch
+	Job      BatchJob
+	Err      error
+	Duration time.Duration
+}
+
+// BatchError aggregates the failed jobs of a batch
+type BatchError struct {
+	Total  int
+	Failed []BatchResult
+}
+
+func (e *BatchError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%d of %d documents failed", len(e.Failed), e.Total))
+	for _, r := range e.Failed {
+		sb.WriteString(fmt.Sprintf("\n  [%d] %s -> %s: %v", r.Index, r.Job.Source, r.Job.Destination, r.Err))
+	}
+	return sb.String()
+}
+
+// Unwrap exposes every job error to errors.Is / errors.As
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, r := range e.Failed {
+		errs[i] = r.Err
+	}
+	return errs
+}
+
+// ProcessBatch runs jobs on a pool of at most workers goroutines, routing
+// each one by URI scheme. Results come back in job order. Jobs that have
+// not started when ctx is done fail with ctx.Err(). The returned error is
+// a *BatchError when any job failed.
+func (e *ProcessingEngine) ProcessBatch(ctx context.Context, jobs []BatchJob, workers int) ([]BatchResult, error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	results := make([]BatchResult, len(jobs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				job := jobs[i]
+				start := time.Now()
+				err := ctx.Err()
+				if err == nil {
+					err = e.ProcessURIContext(ctx, job.Source, job.Transformers, job.Destination)
+				}
+				results[i] = BatchResult{Index: i, Job: job, Err: err, Duration: time.Since(start)}
+			}
+		}()
+	}
+
+feed:
+	for i := range jobs {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			// Mark everything not yet handed out as cancelled
+			for j := i; j < len(jobs); j++ {
+				results[j] = BatchResult{Index: j, Job: jobs[j], Err: ctx.Err()}
+			}
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	report := &BatchError{Total: len(jobs)}
+	for _, r := range results {
+		if r.Err != nil {
+			report.Failed = append(report.Failed, r)
+		}
+	}
+	if len(report.Failed) > 0 {
+		return results, report
+	}
+	return results, nil
+}
+
+// ============================================================================
+// STREAMING PIPELINES
+// ============================================================================
+//
+// Process holds a whole document in memory. ProcessStream instead pipes
+// lines from an io.Reader through per-line stages into an io.Writer, so
+// a multi-gigabyte log needs only as much memory as its longest line
+// (plus whatever state a stage keeps, e.g. tail's last N lines).
+//
+// Transformers opt in by implementing StreamTransformer. Any other
+// transformer is adapted automatically by buffering the stream into a
+// document, which is correct but not constant-memory.
+
+// errStopStream is returned by a stage that needs no more input (head)
+var errStopStream = errors.New("stop stream")
+
+// LineStage is one per-stream instance of a line transformer. Line may
+// emit zero or more lines; Flush emits anything held back at the end.
+type LineStage interface {
+	Line(line string, emit func(string) error) error
+	Flush(emit func(string) error) error
+}
+
+// StreamTransformer is a transformer that can also work line by line
+type StreamTransformer interface {
+	DocumentTransformer
+	NewLineStage() LineStage
+}
+
+// StreamReader is a reader that can open a source as a stream
+type StreamReader interface {
+	OpenStream(source string) (io.ReadCloser, Metadata, error)
+}
+
+// StreamWriter is a writer that can write a destination as a stream.
+// Closing the returned writer commits it; if it also has an Abort method
+// that is called instead when the pipeline fails.
+type StreamWriter interface {
+	CreateStream(destination string, meta Metadata) (io.WriteCloser, error)
+}
+
+// lineStageFunc adapts a stateless per-line function to LineStage
+type lineStageFunc func(line string, emit func(string) error) error
+
+func (f lineStageFunc) Line(line string, emit func(string) error) error { return f(line, emit) }
+func (f lineStageFunc) Flush(emit func(string) error) error             { return nil }
+
+// bufferedStage adapts a whole-document transformer by collecting the
+// stream and transforming it at the end
+type bufferedStage struct {
+	transformer DocumentTransformer
+	meta        Metadata
+	lines       []string
+}
+
+func (b *bufferedStage) Line(line string, emit func(string) error) error {
+	b.lines = append(b.lines, line)
+	return nil
+}
+
+func (b *bufferedStage) Flush(emit func(string) error) error {
+	doc := NewTypedDocument(b.meta.Name, strings.Join(b.lines, "\n"), b.meta.Author, b.meta.MimeType)
+	out, err := b.transformer.Transform(doc)
+	if err != nil {
+		return err
+	}
+	for _, line := range splitLines(out.GetContent()) {
+		if err := emit(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newLineStage returns t's streaming stage, adapting it if needed
+func newLineStage(t DocumentTransformer, meta Metadata) LineStage {
+	if st, ok := t.(StreamTransformer); ok {
+		return st.NewLineStage()
+	}
+	return &bufferedStage{transformer: t, meta: meta}
+}
+
+// tailStage keeps the last n lines in a ring buffer
+type tailStage struct {
+	n     int
+	ring  []string
+	count int
+}
+
+func (t *tailStage) Line(line string, emit func(string) error) error {
+	if t.n <= 0 {
+		return nil
+	}
+	if len(t.ring) < t.n {
+		t.ring = append(t.ring, line)
+	} else {
+		t.ring[t.count%t.n] = line
+	}
+	t.count++
+	return nil
+}
+
+func (t *tailStage) Flush(emit func(string) error) error {
+	start := 0
+	if t.count > t.n {
+		start = t.count % t.n
+	}
+	for i := range t.ring {
+		if err := emit(t.ring[(start+i)%len(t.ring)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamStats summarises one streaming run. Lines are counted as
+// splitLines counts them, so a trailing newline adds an empty last line.
+type StreamStats struct {
+	LinesIn  int
+	LinesOut int
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+}
+
+// countingWriter counts bytes on their way to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ProcessStream runs source -> transformers -> destination line by line.
+// The reader and writer are routed by scheme and must support streaming.
+// Streamed documents are not added to the full-text index.
+func (e *ProcessingEngine) ProcessStream(ctx context.Context, source string, transformerNames []string, destination string) (StreamStats, error) {
+	start := time.Now()
+	var stats StreamStats
+
+	readerName, err := e.ResolveReader(source)
+	if err != nil {
+		return stats, err
+	}
+	writerName, err := e.ResolveWriter(destination)
+	if err != nil {
+		return stats, err
+	}
+	r, _ := e.reader(readerName)
+	w, _ := e.writer(writerName)
+	sr, ok := r.(StreamReader)
+	if !ok {
+		return stats, fmt.Errorf("reader %s does not support streaming", readerName)
+	}
+	sw, ok := w.(StreamWriter)
+	if !ok {
+		return stats, fmt.Errorf("writer %s does not support streaming", writerName)
+	}
+	var transformers []DocumentTransformer
+	for _, name := range transformerNames {
+		t, err := e.NewTransformer(name, nil)
+		if err != nil {
+			return stats, err
+		}
+		transformers = append(transformers, t)
+	}
+
+	name := readerName + "->" + writerName
+	fail := func(err error) (StreamStats, error) {
+		stats.Duration = time.Since(start)
+		e.emit(Event{Kind: EventStreamFailed, Name: name, URI: destination, Duration: stats.Duration, Err: err})
+		return stats, err
+	}
+
+	in, meta, err := sr.OpenStream(source)
+	if err != nil {
+		return fail(fmt.Errorf("read error: %w", err))
+	}
+	defer in.Close()
+	out, err := sw.CreateStream(destination, meta)
+	if err != nil {
+		return fail(fmt.Errorf("write error: %w", err))
+	}
+
+	err = runLineStages(ctx, in, out, transformers, meta, &stats)
+	if err != nil {
+		if a, ok := out.(interface{ Abort() error }); ok {
+			a.Abort()
+		} else {
+			out.Close()
+		}
+		return fail(err)
+	}
+	if err := out.Close(); err != nil {
+		return fail(fmt.Errorf("write error: %w", err))
+	}
+	stats.Duration = time.Since(start)
+	e.emit(Event{
+		Kind:     EventStreamFinished,
+		Name:     name,
+		URI:      destination,
+		Bytes:    int(stats.BytesOut),
+		Duration: stats.Duration,
+		Details:  map[string]any{"source": source, "lines_in": stats.LinesIn, "lines_out": stats.LinesOut, "bytes_in": stats.BytesIn},
+	})
+	return stats, nil
+}
+
+// runLineStages wires the stages together so each emitted line flows
+// straight into the next stage and finally into out. Lines are split the
+// way splitLines splits content, so streaming and Process agree.
+func runLineStages(ctx context.Context, in io.Reader, out io.Writer, transformers []DocumentTransformer, meta Metadata, stats *StreamStats) error {
+	counter := &countingWriter{w: out}
+	buffered := bufio.NewWriter(counter)
+
+	// emits[i] feeds stage i; the last one writes to out
+	emits := make([]func(string) error, len(transformers)+1)
+	emits[len(transformers)] = func(line string) error {
+		if stats.LinesOut > 0 {
+			if err := buffered.WriteByte('\n'); err != nil {
+				return err
+			}
+		}
+		stats.LinesOut++
+		_, err := buffered.WriteString(line)
+		return err
+	}
+	stages := make([]LineStage, len(transformers))
+	for i := len(transformers) - 1; i >= 0; i-- {
+		stage, next := newLineStage(transformers[i], meta), emits[i+1]
+		stages[i] = stage
+		emits[i] = func(line string) error { return stage.Line(line, next) }
+	}
+
+	lines := bufio.NewReaderSize(in, 64*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, readErr := lines.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("read error: %w", readErr)
+		}
+		stats.LinesIn++
+		stats.BytesIn += int64(len(line))
+		err := emits[0](strings.TrimSuffix(line, "\n"))
+		if errors.Is(err, errStopStream) {
+			// A stage downstream has all it needs
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	// Flush in order; what a stage flushes still passes through the
+	// stages after it before they are flushed themselves
+	for i, stage := range stages {
+		if err := stage.Flush(emits[i+1]); err != nil && !errors.Is(err, errStopStream) {
+			return err
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	stats.BytesOut = counter.n
+	return nil
+}
+
+// ============================================================================
+// FULL-TEXT INDEX
+// ============================================================================
+
+// BM25 tuning constants (the usual defaults)
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// termPosition locates one occurrence of a term
+type termPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"col"`    // 1-based, in runes
+	Offset int `json:"offset"` // in bytes, into the document text
+}
+
+// indexedDocument is what the index keeps per document. The text is
+// kept once so SearchResult.Context can be cut from it at each
+// position's offset.
+type indexedDocument struct {
+	Length int      `json:"length"` // number of tokens
+	Text   string   `json:"text"`
+	Terms  []string `json:"-"` // distinct terms, so removal skips the rest
+}
+
+// lineAt returns the line of d.Text containing byte offset
+func (d *indexedDocument) lineAt(offset int) string {
+	start := strings.LastIndexByte(d.Text[:offset], '\n') + 1
+	end := strings.IndexByte(d.Text[offset:], '\n')
+	if end < 0 {
+		return d.Text[start:]
+	}
+	return d.Text[start : offset+end]
+}
+
+// IndexHit is one ranked document returned by DocumentIndex.Search
+type IndexHit struct {
+	Name    string
+	Score   float64
+	Matches []SearchResult
+}
+
+// DocumentIndex is an inverted index with term frequencies, ranked with
+// BM25. It is safe for concurrent use.
+type DocumentIndex struct {
+	mu       sync.RWMutex
+	docs     map[string]*indexedDocument
+	postings map[string]map[string][]termPosition // term -> doc -> hits
+}
+
+func NewDocumentIndex() *DocumentIndex {
+	return &DocumentIndex{
+		docs:     make(map[string]*indexedDocument),
+		postings: make(map[string]map[string][]termPosition),
+	}
+}
+
+// indexToken is a normalised term with its position
+type indexToken struct {
+	Term string
+	Pos  termPosition
+}
+
+// tokenize splits text into lower-cased runs of letters and digits
+func tokenize(text string) []indexToken {
+	var tokens []indexToken
+	lineOffset := 0
+	for i, line := range splitLines(text) {
+		var word []rune
+		col, start, offset := 0, 0, 0
+		flush := func() {
+			if len(word) > 0 {
+				tokens = append(tokens, indexToken{
+					Term: strings.ToLower(string(word)),
+					Pos:  termPosition{Line: i + 1, Column: start, Offset: lineOffset + offset},
+				})
+				word = word[:0]
+			}
+		}
+		for b, r := range line {
+			col++
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				if len(word) == 0 {
+					start, offset = col, b
+				}
+				word = append(word, r)
+			} else {
+				flush()
+			}
+		}
+		flush()
+		lineOffset += len(line) + 1
+	}
+	return tokens
+}
+
+// sealed reports whether doc is encrypted, or holds an envelope read
+// from somewhere as it is
+func sealed(doc Document) bool {
+	if enc, ok := doc.(Encryptable); ok && enc.IsEncrypted() {
+		return true
+	}
+	return IsEncryptedContent(doc.GetContent())
+}
+
+// indexKey normalises a URI so file://x and the plain path x share one
+// index entry
+func indexKey(uri string) string {
+	if scheme := uriScheme(uri); scheme == "" || scheme == "file://" {
+		if path, err := resolveFilePath(uri); err == nil {
+			return path
+		}
+	}
+	return uri
+}
+
+// Add indexes doc under name, replacing any earlier version. Encrypted
+// documents are skipped since their content is ciphertext.
+func (ix *DocumentIndex) Add(name string, doc Document) {
+	if sealed(doc) {
+		return
+	}
+	content := doc.GetContent()
+	tokens := tokenize(content)
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.removeLocked(name)
+	indexed := &indexedDocument{Length: len(tokens), Text: content}
+	ix.docs[name] = indexed
+	for _, tok := range tokens {
+		docs, ok := ix.postings[tok.Term]
+		if !ok {
+			docs = make(map[string][]termPosition)
+			ix.postings[tok.Term] = docs
+		}
+		if _, ok := docs[name]; !ok {
+			indexed.Terms = append(indexed.Terms, tok.Term)
+		}
+		docs[name] = append(docs[name], tok.Pos)
+	}
+}
+
+// Remove drops a document from the index
+func (ix *DocumentIndex) Remove(name string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.removeLocked(name)
+}
+
+func (ix *DocumentIndex) removeLocked(name string) {
+	indexed, ok := ix.docs[name]
+	if !ok {
+		return
+	}
+	delete(ix.docs, name)
+	for _, term := range indexed.Terms {
+		docs := ix.postings[term]
+		delete(docs, name)
+		if len(docs) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+}
+
+// Len returns the number of indexed documents
+func (ix *DocumentIndex) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Search ranks documents containing any of the query terms by BM25 and
+// returns at most limit hits (all when limit <= 0), best first
+func (ix *DocumentIndex) Search(query string, limit int) []IndexHit {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if len(ix.docs) == 0 {
+		return nil
+	}
+	totalLength := 0
+	for _, d := range ix.docs {
+		totalLength += d.Length
+	}
+	avgLength := float64(totalLength) / float64(len(ix.docs))
+	n := float64(len(ix.docs))
+
+	hits := make(map[string]*IndexHit)
+	seen := make(map[string]bool)
+	for _, tok := range tokenize(query) {
+		if seen[tok.Term] {
+			continue
+		}
+		seen[tok.Term] = true
+
+		docs := ix.postings[tok.Term]
+		df := float64(len(docs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for name, positions := range docs {
+			tf := float64(len(positions))
+			length := float64(ix.docs[name].Length)
+			score := idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/avgLength))
+
+			hit, ok := hits[name]
+			if !ok {
+				hit = &IndexHit{Name: name}
+				hits[name] = hit
+			}
+			hit.Score += score
+			indexed := ix.docs[name]
+			for _, pos := range positions {
+				hit.Matches = append(hit.Matches, SearchResult{
+					Line:    pos.Line,
+					Column:  pos.Column,
+					Context: indexed.lineAt(pos.Offset),
+					Match:   tok.Term,
+				})
+			}
+		}
+	}
+
+	ranked := make([]IndexHit, 0, len(hits))
+	for _, hit := range hits {
+		sort.Slice(hit.Matches, func(a, b int) bool {
+			ma, mb := hit.Matches[a], hit.Matches[b]
+			return ma.Line < mb.Line || (ma.Line == mb.Line && ma.Column < mb.Column)
+		})
+		ranked = append(ranked, *hit)
+	}
+	sort.Slice(ranked, func(a, b int) bool {
+		if ranked[a].Score != ranked[b].Score {
+			return ranked[a].Score > ranked[b].Score
+		}
+		return ranked[a].Name < ranked[b].Name
+	})
+	if limit > 0 && len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked
+}
+
+// indexFile is the on-disk form of a DocumentIndex
+type indexFile struct {
+	Version  int                                  `json:"version"`
+	Docs     map[string]*indexedDocument          `json:"docs"`
+	Postings map[string]map[string][]termPosition `json:"postings"`
+}
+
+const indexFileVersion = 2
+
+// Save writes the index to path as JSON
+func (ix *DocumentIndex) Save(path string) error {
+	ix.mu.RLock()
+	data, err := json.Marshal(indexFile{Version: indexFileVersion, Docs: ix.docs, Postings: ix.postings})
+	ix.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return FileWriter{}.Write(NewTextDocument(path, string(data), "Index"), path)
+}
+
+// validate checks every posting refers to an indexed document and
+// points inside its text, and rebuilds each document's term list
+func (f *indexFile) validate() error {
+	counts := make(map[string]int)
+	for name, d := range f.Docs {
+		if d == nil || d.Length < 0 {
+			return fmt.Errorf("document %q is malformed", name)
+		}
+	}
+	for _, term := range slices.Sorted(maps.Keys(f.Postings)) {
+		for name, positions := range f.Postings[term] {
+			d, ok := f.Docs[name]
+			if !ok {
+				return fmt.Errorf("term %q refers to unknown document %q", term, name)
+			}
+			for _, pos := range positions {
+				if pos.Line < 1 || pos.Column < 1 || pos.Offset < 0 || pos.Offset > len(d.Text) {
+					return fmt.Errorf("term %q has an invalid position in %q", term, name)
+				}
+			}
+			d.Terms = append(d.Terms, term)
+			counts[name] += len(positions)
+		}
+	}
+	for name, d := range f.Docs {
+		if d.Length < counts[name] {
+			return fmt.Errorf("document %q has %d tokens but %d postings", name, d.Length, counts[name])
+		}
+	}
+	return nil
+}
+
+// Load replaces the index contents with those saved at path
+func (ix *DocumentIndex) Load(path string) error {
+	doc, err := FileReader{}.Read(path)
+	if err != nil {
+		return err
+	}
+	var f indexFile
+	if err := json.Unmarshal([]byte(doc.GetContent()), &f); err != nil {
+		return fmt.Errorf("load index %s: %w", path, err)
+	}
+	if f.Version != indexFileVersion {
+		return fmt.Errorf("load index %s: unsupported version %d", path, f.Version)
+	}
+	if f.Docs == nil {
+		f.Docs = make(map[string]*indexedDocument)
+	}
+	if f.Postings == nil {
+		f.Postings = make(map[string]map[string][]termPosition)
+	}
+	if err := f.validate(); err != nil {
+		return fmt.Errorf("load index %s: %w", path, err)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.docs = f.Docs
+	ix.postings = f.Postings
+	return nil
+}
+
+// ============================================================================
+// PIPELINE FILES
+// ============================================================================
+//
+// A pipeline file is JSON:
+//
+//   {
+//     "name": "publish-readme",
+//     "source": "file://docs/README.md",
+//     "reader": "file",                     (optional, else routed by scheme)
+//     "transformers": [
+//       {"name": "to-html"},
+//       {"name": "json-pretty", "params": {"indent": "\t"}}
+//     ],
+//     "destination": "out/README.html",
+//     "writer": "file"                      (optional)
+//   }
+
+// TransformerStep is one transformer in a pipeline file
+type TransformerStep struct {
+	Name   string         `json:"name"`
+	Params map[string]any `json:"params,omitempty"`
+}
+
+// PipelineSpec is a pipeline as written in a pipeline file
+type PipelineSpec struct {
+	Name         string            `json:"name"`
+	Source       string            `json:"source"`
+	Reader       string            `json:"reader,omitempty"`
+	Transformers []TransformerStep `json:"transformers"`
+	Destination  string            `json:"destination"`
+	Writer       string            `json:"writer,omitempty"`
+}
+
+// PipelineError lists every problem found while validating a pipeline
+type PipelineError struct {
+	Pipeline string
+	Problems []string
+}
+
+func (e PipelineError) Error() string {
+	return fmt.Sprintf("invalid pipeline %q:\n  - %s", e.Pipeline, strings.Join(e.Problems, "\n  - "))
+}
+
+// ParsePipeline decodes a pipeline file, rejecting unknown fields
+func ParsePipeline(data []byte) (*PipelineSpec, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var spec PipelineSpec
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("parse pipeline: %w", err)
+	}
+	return &spec, nil
+}
+
+// LoadPipeline reads and decodes a pipeline file
+func LoadPipeline(path string) (*PipelineSpec, error) {
+	doc, err := FileReader{}.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePipeline([]byte(doc.GetContent()))
+}
+
+// PipelinePlan is a validated pipeline with every stage resolved
+type PipelinePlan struct {
+	Spec       PipelineSpec
+	ReaderName string
+	WriterName string
+
+	reader       DocumentReader
+	transformers []DocumentTransformer
+	writer       DocumentWriter
+}
+
+// String renders the plan for dry runs
+func (p *PipelinePlan) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Pipeline %q\n", p.Spec.Name))
+	sb.WriteString(fmt.Sprintf("  1. read  %s using reader %q\n", p.Spec.Source, p.ReaderName))
+	for i, step := range p.Spec.Transformers {
+		sb.WriteString(fmt.Sprintf("  %d. apply %s", i+2, step.Name))
+		if len(step.Params) > 0 {
+			keys := make([]string, 0, len(step.Params))
+			for k := range step.Params {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			var params []string
+			for _, k := range keys {
+				if text, ok := step.Params[k].(string); ok {
+					params = append(params, fmt.Sprintf("%s=%q", k, text))
+				} else {
+					params = append(params, fmt.Sprintf("%s=%v", k, step.Params[k]))
+				}
+			}
+			sb.WriteString(" (" + strings.Join(params, ", ") + ")")
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString(fmt.Sprintf("  %d. write %s using writer %q\n", len(p.Spec.Transformers)+2, p.Spec.Destination, p.WriterName))
+	return sb.String()
+}
+
+// PlanPipeline validates spec against the engine's registrations and
+// resolves every stage, reporting all problems at once
+func (e *ProcessingEngine) PlanPipeline(spec *PipelineSpec) (*PipelinePlan, error) {
+	plan := &PipelinePlan{Spec: *spec}
+	var problems []string
+
+	if spec.Source == "" {
+		problems = append(problems, "source is required")
+	} else if spec.Reader != "" {
+		plan.ReaderName = spec.Reader
+	} else if name, err := e.ResolveReader(spec.Source); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		plan.ReaderName = name
+	}
+	if plan.ReaderName != "" {
+		if r, ok := e.reader(plan.ReaderName); ok {
+			plan.reader = r
+		} else {
+			problems = append(problems, fmt.Sprintf("reader not found: %s", plan.ReaderName))
+		}
+	}
+
+	for i, step := range spec.Transformers {
+		t, err := e.NewTransformer(step.Name, step.Params)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("transformers[%d]: %v", i, err))
+			continue
+		}
+		plan.transformers = append(plan.transformers, t)
+	}
+
+	if spec.Destination == "" {
+		problems = append(problems, "destination is required")
+	} else if spec.Writer != "" {
+		plan.WriterName = spec.Writer
+	} else if name, err := e.ResolveWriter(spec.Destination); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		plan.WriterName = name
+	}
+	if plan.WriterName != "" {
+		if w, ok := e.writer(plan.WriterName); ok {
+			plan.writer = w
+		} else {
+			problems = append(problems, fmt.Sprintf("writer not found: %s", plan.WriterName))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, PipelineError{Pipeline: spec.Name, Problems: problems}
+	}
+	return plan, nil
+}
+
+// RunPipeline validates and executes spec, returning the resolved plan.
+// With dryRun it stops once the plan is made, for the caller to show.
+func (e *ProcessingEngine) RunPipeline(ctx context.Context, spec *PipelineSpec, dryRun bool) (*PipelinePlan, error) {
+	plan, err := e.PlanPipeline(spec)
+	if err != nil || dryRun {
+		return plan, err
+	}
+	return plan, e.run(ctx, plan.ReaderName, plan.reader, spec.Source, plan.transformers, plan.WriterName, plan.writer, spec.Destination)
+}
+
+// Capabilities reports which optional interfaces a document implements
+type Capabilities struct {
+	Name           string `json:"name"`
+	MimeType       string `json:"mime_type"`
+	Searchable     bool   `json:"searchable"`
+	Query          string `json:"query,omitempty"`
+	Matches        int    `json:"matches,omitempty"`
+	Versionable    bool   `json:"versionable"`
+	Version        int    `json:"version,omitempty"`
+	HistoryEntries int    `json:"history_entries,omitempty"`
+	DiffLines      int    `json:"diff_lines,omitempty"` // changes since v1
+	Encryptable    bool   `json:"encryptable"`
+	Encrypted      bool   `json:"encrypted"`
+}
+
+// DetectCapabilities probes doc for Searchable, Versionable and
+// Encryptable, searching for query if it is searchable
+func DetectCapabilities(doc Document, query string) Capabilities {
+	meta := doc.GetMetadata()
+	caps := Capabilities{Name: meta.Name, MimeType: meta.MimeType}
+	if searchable, ok := doc.(Searchable); ok {
+		caps.Searchable = true
+		caps.Query = query
+		caps.Matches = len(searchable.Search(query))
+	}
+	if versionable, ok := doc.(Versionable); ok {
+		caps.Versionable = true
+		caps.Version = versionable.GetVersion()
+		caps.HistoryEntries = len(versionable.GetHistory())
+		if caps.Version > 1 {
+			diff, _ := versionable.Diff(1, caps.Version)
+			caps.DiffLines = strings.Count(diff, "\n")
+		}
+	}
+	if encryptable, ok := doc.(Encryptable); ok {
+		caps.Encryptable = true
+		caps.Encrypted = encryptable.IsEncrypted()
+	}
+	return caps
+}
+
+// ProcessWithCapabilities checks for optional document capabilities
+func (e *ProcessingEngine) ProcessWithCapabilities(doc Document) {
+	fmt.Println("\n--- Document Capabilities ---")
+	caps := DetectCapabilities(doc, "content")
+	fmt.Printf("Document: %s\n", caps.Name)
+
+	if caps.Searchable {
+		fmt.Println("  [x] Searchable")
+		if caps.Matches > 0 {
+			fmt.Printf("      Found %d matches for 'content'\n", caps.Matches)
+		}
+	} else {
+		fmt.Println("  [ ] Searchable")
+	}
+
+	if caps.Versionable {
+		fmt.Println("  [x] Versionable")
+		fmt.Printf("      Current version: %d\n", caps.Version)
+		fmt.Printf("      History entries: %d\n", caps.HistoryEntries)
+		if caps.Version > 1 {
+			fmt.Printf("      Changes since v1: %d diff lines\n", caps.DiffLines)
+		}
+	} else {
+		fmt.Println("  [ ] Versionable")
+	}
+
+	if caps.Encryptable {
+		fmt.Println("  [x] Encryptable")
+		fmt.Printf("      Currently encrypted: %v\n", caps.Encrypted)
+	} else {
+		fmt.Println("  [ ] Encryptable")
+	}
+}
+
+// ============================================================================
+// HTTP SERVICE
+// ============================================================================
+//
+// Server runs the engine behind a JSON REST API:
+//
+//   GET  /v1/readers | /v1/writers | /v1/transformers | /v1/plugins
+//   POST /v1/documents?name=report.txt       upload (body is the content)
+//   GET  /v1/documents                       list uploads and results
+//   GET  /v1/documents/{id}                  download
+//   DELETE /v1/documents/{id}                delete
+//   GET  /v1/documents/{id}/capabilities     what ProcessWithCapabilities sees
+//   POST /v1/jobs                            submit a pipeline (PipelineSpec)
+//   GET  /v1/jobs, /v1/jobs/{id}             poll status
+//   GET  /v1/jobs/{id}/result                download the output
+//
+// Uploads live in the engine under docs://<id>, so pipelines can read
+// them. A job without a destination writes its output to a new docs://
+// document.
+//
+// Jobs come from clients, so they may only use the readers and writers
+// the server allows (just docs by default) and may not name a reader or
+// writer themselves. Otherwise a job could read the server's files or
+// make it fetch URLs on the client's behalf.
+
+// DocsScheme is where the service keeps uploaded and produced documents
+const DocsScheme = "docs://"
+
+var (
+	ErrStoreFull   = errors.New("document store is full")
+	ErrTooManyJobs = errors.New("too many unfinished jobs")
+)
+
+// Job statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job is one submitted pipeline run
+type Job struct {
+	ID       string       `json:"id"`
+	Status   string       `json:"status"`
+	Pipeline PipelineSpec `json:"pipeline"`
+	Result   string       `json:"result,omitempty"` // docs:// id of the output, if kept by the service
+	Error    string       `json:"error,omitempty"`
+	Created  time.Time    `json:"created"`
+	Started  *time.Time   `json:"started,omitempty"`
+	Finished *time.Time   `json:"finished,omitempty"`
+}
+
+// docsStore is a MemoryStore answering for the docs:// scheme, holding
+// at most the server's MaxDocuments
+type docsStore struct {
+	*MemoryStore
+	server *Server
+}
+
+func (d docsStore) Write(doc Document, destination string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.docs[destination]; !exists && len(d.docs) >= d.server.maxDocuments() {
+		return ErrStoreFull
+	}
+	d.docs[destination] = doc
+	return nil
+}
+
+func (docsStore) SupportedSources() []string      { return []string{DocsScheme} }
+func (docsStore) SupportedDestinations() []string { return []string{DocsScheme} }
+
+// Indexed keeps uploads and job results out of the engine's index,
+// which would hold on to them past MaxDocuments and their deletion
+func (docsStore) Indexed() bool { return false }
+
+// Server is an http.Handler exposing a ProcessingEngine
+type Server struct {
+	MaxUploadBytes int64    // 10 MiB when zero
+	MaxDocuments   int      // documents kept under docs://; 1000 when zero
+	MaxJobs        int      // jobs remembered; 1000 when zero
+	Readers        []string // readers jobs may use; only docs when empty
+	Writers        []string // writers jobs may use; only docs when empty
+
+	engine *ProcessingEngine
+	docs   docsStore
+	mux    *http.ServeMux
+
+	ctx    context.Context // cancelled by Close
+	cancel context.CancelFunc
+	slots  chan struct{} // bounds concurrently running jobs
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	jobs   map[string]*Job
+	nextID int
+}
+
+// NewServer registers the docs:// store on engine and runs at most
+// workers jobs at once
+func NewServer(engine *ProcessingEngine, workers int) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		engine: engine,
+		mux:    http.NewServeMux(),
+		ctx:    ctx,
+		cancel: cancel,
+		slots:  make(chan struct{}, max(workers, 1)),
+		jobs:   make(map[string]*Job),
+	}
+	s.docs = docsStore{MemoryStore: NewMemoryStore(), server: s}
+	engine.RegisterReader("docs", s.docs)
+	engine.RegisterWriter("docs", s.docs)
+
+	s.mux.HandleFunc("GET /v1/readers", s.listReaders)
+	s.mux.HandleFunc("GET /v1/writers", s.listWriters)
+	s.mux.HandleFunc("GET /v1/transformers", s.listTransformers)
+	s.mux.HandleFunc("GET /v1/plugins", s.listPlugins)
+	s.mux.HandleFunc("POST /v1/documents", s.uploadDocument)
+	s.mux.HandleFunc("GET /v1/documents", s.listDocuments)
+	s.mux.HandleFunc("GET /v1/documents/{id}", s.downloadDocument)
+	s.mux.HandleFunc("DELETE /v1/documents/{id}", s.deleteDocument)
+	s.mux.HandleFunc("GET /v1/documents/{id}/capabilities", s.documentCapabilities)
+	s.mux.HandleFunc("POST /v1/jobs", s.submitJob)
+	s.mux.HandleFunc("GET /v1/jobs", s.listJobs)
+	s.mux.HandleFunc("GET /v1/jobs/{id}", s.getJob)
+	s.mux.HandleFunc("GET /v1/jobs/{id}/result", s.jobResult)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close cancels running jobs and waits for them to stop
+func (s *Server) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *Server) maxDocuments() int { return cmp.Or(s.MaxDocuments, 1000) }
+func (s *Server) maxJobs() int      { return cmp.Or(s.MaxJobs, 1000) }
+
+// allowed reports whether jobs may use the named reader or writer
+func allowed(names []string, name string) bool {
+	if len(names) == 0 {
+		return name == "docs"
+	}
+	return slices.Contains(names, name)
+}
+
+// newID hands out short sequential ids; s.mu must be held
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%d", prefix, s.nextID)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError maps err onto a status code and a JSON body
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	body := map[string]any{"error": err.Error()}
+	var pipelineErr PipelineError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &pipelineErr):
+		status = http.StatusBadRequest
+		body["problems"] = pipelineErr.Problems
+	case errors.As(err, &maxBytesErr):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, fs.ErrNotExist), errors.As(err, new(NotFoundError)):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrStoreFull):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, ErrTooManyJobs):
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, body)
+}
+
+func (s *Server) listReaders(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.engine.Readers())
+}
+
+func (s *Server) listWriters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.engine.Writers())
+}
+
+func (s *Server) listTransformers(w http.ResponseWriter, r *http.Request) {
+	type transformer struct {
+		Name   string      `json:"name"`
+		Params []ParamSpec `json:"params"`
+	}
+	var list []transformer
+	for _, f := range s.engine.Transformers() {
+		params := f.Params
+		if params == nil {
+			params = []ParamSpec{}
+		}
+		list = append(list, transformer{f.Name, params})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) listPlugins(w http.ResponseWriter, r *http.Request) {
+	type plugin struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	list := []plugin{}
+	for _, p := range s.engine.Plugins() {
+		list = append(list, plugin{p.Name(), p.Version()})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// documentInfo describes a stored document in listings and uploads
+type documentInfo struct {
+	ID       string `json:"id"`
+	URI      string `json:"uri"`
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	Size     int    `json:"size"`
+}
+
+func describeDocument(uri string, doc Document) documentInfo {
+	meta := doc.GetMetadata()
+	return documentInfo{
+		ID:       strings.TrimPrefix(uri, DocsScheme),
+		URI:      uri,
+		Name:     meta.Name,
+		MimeType: meta.MimeType,
+		Size:     len(doc.GetContent()),
+	}
+}
+
+func (s *Server) uploadDocument(w http.ResponseWriter, r *http.Request) {
+	limit := s.MaxUploadBytes
+	if limit <= 0 {
+		limit = 10 << 20
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.mu.Lock()
+	id := s.newID("doc-")
+	s.mu.Unlock()
+	name := cmp.Or(r.URL.Query().Get("name"), id)
+	mimeType := detectMimeType(name, data)
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil &&
+		mediaType != "application/octet-stream" && mediaType != "application/x-www-form-urlencoded" {
+		mimeType = mediaType
+	}
+
+	doc := NewTypedDocument(name, string(data), cmp.Or(r.Header.Get("X-Author"), "Upload"), mimeType)
+	uri := DocsScheme + id
+	if err := s.docs.Write(doc, uri); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/v1/documents/"+id)
+	writeJSON(w, http.StatusCreated, describeDocument(uri, doc))
+}
+
+func (s *Server) listDocuments(w http.ResponseWriter, r *http.Request) {
+	list := []documentInfo{}
+	for _, uri := range s.docs.Names() {
+		if doc, err := s.docs.Read(uri); err == nil {
+			list = append(list, describeDocument(uri, doc))
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) document(r *http.Request) (Document, error) {
+	return s.docs.Read(DocsScheme + r.PathValue("id"))
+}
+
+func (s *Server) downloadDocument(w http.ResponseWriter, r *http.Request) {
+	doc, err := s.document(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	serveDocument(w, doc)
+}
+
+func serveDocument(w http.ResponseWriter, doc Document) {
+	meta := doc.GetMetadata()
+	contentType := cmp.Or(meta.MimeType, MimeText)
+	if strings.HasPrefix(contentType, "text/") || contentType == MimeJSON {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": path.Base(meta.Name)}))
+	io.WriteString(w, doc.GetContent())
+}
+
+func (s *Server) deleteDocument(w http.ResponseWriter, r *http.Request) {
+	if err := s.docs.Delete(DocsScheme + r.PathValue("id")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) documentCapabilities(w http.ResponseWriter, r *http.Request) {
+	doc, err := s.document(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, DetectCapabilities(doc, cmp.Or(r.URL.Query().Get("q"), "content")))
+}
+
+// submitJob validates the pipeline up front, so a bad spec is a 400
+// rather than a failed job, then runs it in the background
+func (s *Server) submitJob(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	spec, err := ParsePipeline(data)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if spec.Reader != "" || spec.Writer != "" {
+		writeError(w, PipelineError{Pipeline: spec.Name, Problems: []string{"jobs may not choose a reader or writer"}})
+		return
+	}
+
+	s.mu.Lock()
+	id := s.newID("job-")
+	s.mu.Unlock()
+	job := &Job{ID: id, Status: JobQueued, Created: time.Now()}
+	if spec.Destination == "" {
+		spec.Destination = DocsScheme + id + "-result"
+	}
+	if strings.HasPrefix(spec.Destination, DocsScheme) {
+		job.Result = strings.TrimPrefix(spec.Destination, DocsScheme)
+	}
+	plan, err := s.engine.PlanPipeline(spec)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var problems []string
+	if !allowed(s.Readers, plan.ReaderName) {
+		problems = append(problems, fmt.Sprintf("source %s: reader %s is not available to jobs", spec.Source, plan.ReaderName))
+	}
+	if !allowed(s.Writers, plan.WriterName) {
+		problems = append(problems, fmt.Sprintf("destination %s: writer %s is not available to jobs", spec.Destination, plan.WriterName))
+	}
+	if len(problems) > 0 {
+		writeError(w, PipelineError{Pipeline: spec.Name, Problems: problems})
+		return
+	}
+	// Pin what was checked, so a later route change cannot redirect the job
+	spec.Reader, spec.Writer = plan.ReaderName, plan.WriterName
+	job.Pipeline = *spec
+
+	s.mu.Lock()
+	if !s.pruneJobsLocked() {
+		s.mu.Unlock()
+		writeError(w, ErrTooManyJobs)
+		return
+	}
+	s.jobs[id] = job
+	queued := *job
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.runJob(job)
+	w.Header().Set("Location", "/v1/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, queued)
+}
+
+// pruneJobsLocked forgets the oldest finished jobs until there is room
+// for one more, reporting false if the rest are all unfinished. s.mu
+// must be held.
+func (s *Server) pruneJobsLocked() bool {
+	for len(s.jobs) >= s.maxJobs() {
+		var oldest *Job
+		for _, job := range s.jobs {
+			if job.Finished != nil && (oldest == nil || job.Created.Before(oldest.Created)) {
+				oldest = job
+			}
+		}
+		if oldest == nil {
+			return false
+		}
+		delete(s.jobs, oldest.ID)
+	}
+	return true
+}
+
+func (s *Server) runJob(job *Job) {
+	defer s.wg.Done()
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-s.ctx.Done():
+		s.finishJob(job, s.ctx.Err())
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	job.Status, job.Started = JobRunning, &now
+	spec := job.Pipeline
+	s.mu.Unlock()
+
+	_, err := s.engine.RunPipeline(s.ctx, &spec, false)
+	s.finishJob(job, err)
+}
+
+func (s *Server) finishJob(job *Job, err error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.Finished = &now
+	job.Status = JobSucceeded
+	if err != nil {
+		job.Status, job.Error = JobFailed, err.Error()
+	}
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	list := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		list = append(list, *job)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(list, func(a, b Job) int { return a.Created.Compare(b.Created) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) job(r *http.Request) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[r.PathValue("id")]
+	if !ok {
+		return Job{}, fmt.Errorf("no job %s: %w", r.PathValue("id"), fs.ErrNotExist)
+	}
+	return *job, nil
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.job(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) jobResult(w http.ResponseWriter, r *http.Request) {
+	job, err := s.job(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch {
+	case job.Status != JobSucceeded:
+		writeJSON(w, http.StatusConflict, map[string]any{"error": "job is " + job.Status, "status": job.Status})
+		return
+	case job.Result == "":
+		writeJSON(w, http.StatusNotFound, map[string]any{"error": "output went to " + job.Pipeline.Destination})
+		return
+	}
+	doc, err := s.docs.Read(DocsScheme + job.Result)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	serveDocument(w, doc)
+}
+
+var _ http.Handler = (*Server)(nil)
+var _ DocumentProcessor = docsStore{}
+
+// ============================================================================
+// COMMAND-LINE INTERFACE
+// ============================================================================
+//
+// Run with arguments, this program is the docproc tool:
+//
+//   docproc run [-t name[:key=value,...]]... [-o dest] [-pipeline file] [inputs...]
+//   docproc list [readers|writers|transformers|plugins]...
+//   docproc search [-index file] [-n limit] query [inputs...]
+//   docproc history [-t name]... source
+//   docproc encrypt|decrypt [-key-file path] [-o dest] [inputs...]
+//
+// Inputs may be globs ("logs/*.txt"); "-" is stdin and is the default
+// when there are none, and may be given only once. The destination "-"
+// (the default) is stdout.
+// Every command takes -json for machine-readable output and -v to log
+// engine events to stderr. Flags go before arguments.
+//
+// Environment: DOCPROC_KEY is the passphrase for encrypt/decrypt steps
+// (there is no flag taking the passphrase itself, since command lines
+// show up in ps and shell history),
+// DOCPROC_DB the database behind db:// URIs. db:// is only available in
+// builds that link in a SQLite driver.
+
+// Exit codes
+const (
+	ExitOK       = 0
+	ExitFailure  = 1 // a document could not be processed
+	ExitUsage    = 2 // bad flags, arguments or pipeline
+	ExitNotFound = 3 // an input does not exist or a glob matched nothing
+	ExitNoMatch  = 4 // search found nothing
+)
+
+// StdioURI names stdin as a source and stdout as a destination
+const StdioURI = "-"
+
+var errNoMatch = errors.New("no matches")
+
+// UsageError is a mistake on the command line
+type UsageError struct {
+	Msg      string
+	reported bool // already printed by the flag package
+}
+
+func (e UsageError) Error() string { return e.Msg }
+
+// ExitCode maps an error onto the exit code docproc reports for it
+func ExitCode(err error) int {
+	var usageErr UsageError
+	var pipelineErr PipelineError
+	var schemeErr SchemeError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, errNoMatch):
+		return ExitNoMatch
+	case errors.As(err, &usageErr), errors.As(err, &pipelineErr), errors.As(err, &schemeErr):
+		return ExitUsage
+	case errors.Is(err, fs.ErrNotExist), errors.As(err, new(NotFoundError)):
+		return ExitNotFound
+	}
+	return ExitFailure
+}
+
+// stdioStore reads documents from stdin and writes them to stdout. With
+// capture set, written documents are held for the -json report instead.
+type stdioStore struct {
+	in      io.Reader
+	out     io.Writer
+	capture bool
+
+	mu       sync.Mutex
+	captured Document
+}
+
+func (s *stdioStore) Read(source string) (Document, error) {
+	data, err := io.ReadAll(s.in)
+	if err != nil {
+		return nil, fmt.Errorf("read stdin: %w", err)
+	}
+	return NewTypedDocument("stdin", string(data), "Stdin", detectMimeType("", data)), nil
+}
+
+func (s *stdioStore) SupportedSources() []string {
+	return []string{StdioURI}
+}
+
+func (s *stdioStore) Write(doc Document, destination string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.capture {
+		s.captured = doc
+		return nil
+	}
+	content := doc.GetContent()
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	_, err := io.WriteString(s.out, content)
+	return err
+}
+
+func (s *stdioStore) SupportedDestinations() []string {
+	return []string{StdioURI}
+}
+
+// Indexed keeps stdin and stdout out of the index; "-" names no document
+func (s *stdioStore) Indexed() bool { return false }
+
+// take returns and forgets the last captured document
+func (s *stdioStore) take() Document {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc := s.captured
+	s.captured = nil
+	return doc
+}
+
+// stringsFlag is a repeatable string flag
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// cliOptions are the flags every command accepts
+type cliOptions struct {
+	json    bool
+	verbose bool
+}
+
+// CLI runs docproc commands against the given standard streams
+type CLI struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Getenv func(key string) string // os.Getenv; no environment when nil
+}
+
+const cliUsage = `usage: docproc <command> [flags] [args]
+
+commands:
+  run       process inputs through transformers into a destination
+  list      show registered readers, writers, transformers and plugins
+  search    rank documents by relevance to a query
+  history   show a document's versions and provenance
+  encrypt   encrypt documents with a passphrase
+  decrypt   decrypt documents with a passphrase
+
+Run "docproc <command> -h" for a command's flags.
+`
+
+// Run executes one command and returns its exit code
+func (c CLI) Run(args []string) int {
+	commands := map[string]func([]string) error{
+		"run":     c.run,
+		"list":    c.list,
+		"search":  c.search,
+		"history": c.history,
+		"encrypt": func(args []string) error { return c.crypt("encrypt", args) },
+		"decrypt": func(args []string) error { return c.crypt("decrypt", args) },
+	}
+	if len(args) == 0 {
+		fmt.Fprint(c.Stderr, cliUsage)
+		return ExitUsage
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(c.Stdout, cliUsage)
+		return ExitOK
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(c.Stderr, "docproc: unknown command %q\n\n%s", args[0], cliUsage)
+		return ExitUsage
+	}
+
+	err := command(args[1:])
+	var usageErr UsageError
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return ExitOK
+	case errors.As(err, &usageErr) && usageErr.reported:
+	case err != nil:
+		fmt.Fprintf(c.Stderr, "docproc %s: %v\n", args[0], err)
+	}
+	return ExitCode(err)
+}
+
+func (c CLI) getenv(key string) string {
+	if c.Getenv == nil {
+		return ""
+	}
+	return c.Getenv(key)
+}
+
+func (c CLI) flags(command, usage string) (*flag.FlagSet, *cliOptions) {
+	flags := flag.NewFlagSet("docproc "+command, flag.ContinueOnError)
+	flags.SetOutput(c.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(c.Stderr, "usage: docproc %s %s\n", command, usage)
+		flags.PrintDefaults()
+	}
+	opts := &cliOptions{}
+	flags.BoolVar(&opts.json, "json", false, "print machine-readable JSON")
+	flags.BoolVar(&opts.verbose, "v", false, "log engine events to stderr")
+	return flags, opts
+}
+
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return UsageError{Msg: err.Error(), reported: true}
+	}
+	return nil
+}
+
+// engine builds the engine a command runs against. Plugin transformers
+// are registered directly since plugins announce themselves on stdout,
+// which belongs to the documents here. encrypt and decrypt are only
+// available when there is a passphrase.
+func (c CLI) engine(opts *cliOptions, passphrase string) (*ProcessingEngine, *stdioStore) {
+	engine := NewProcessingEngine()
+	engine.SetObservers()
+	if opts.verbose {
+		engine.SetObservers(SlogObserver{Logger: slog.New(slog.NewTextHandler(c.Stderr, nil))})
+	}
+
+	dbPath := cmp.Or(c.getenv("DOCPROC_DB"), "docproc.db")
+	stdio := &stdioStore{in: c.Stdin, out: c.Stdout, capture: opts.json}
+	engine.RegisterReader("file", FileReader{})
+	engine.RegisterReader("url", URLReader{})
+	engine.RegisterReader("stdio", stdio)
+	engine.RegisterWriter("file", FileWriter{})
+	engine.RegisterWriter("stdio", stdio)
+	if SQLiteLinked("") {
+		engine.RegisterReader("db", DatabaseReader{ConnectionString: dbPath})
+		engine.RegisterWriter("db", DatabaseWriter{ConnectionString: dbPath})
+	}
+
+	for _, t := range slices.Concat(NewTextToolsPlugin().GetTransformers(), FormatsPlugin{}.GetTransformers()) {
+		engine.RegisterTransformer(t)
+	}
+	if passphrase != "" {
+		engine.RegisterTransformer(EncryptTransformer{Passphrase: passphrase})
+		engine.RegisterTransformer(DecryptTransformer{Passphrase: passphrase})
+	}
+	return engine, stdio
+}
+
+func (c CLI) printJSON(v any) error {
+	enc := json.NewEncoder(c.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// parseStep turns a -t value into a pipeline step: "name",
+// "name:key=value,..." with values typed by the transformer's ParamSpecs,
+// or "name:{json}"
+func parseStep(engine *ProcessingEngine, arg string) (TransformerStep, error) {
+	name, rest, _ := strings.Cut(arg, ":")
+	step := TransformerStep{Name: name}
+	if rest == "" {
+		return step, nil
+	}
+	if strings.HasPrefix(rest, "{") {
+		if err := json.Unmarshal([]byte(rest), &step.Params); err != nil {
+			return step, UsageError{Msg: fmt.Sprintf("-t %s: %v", arg, err)}
+		}
+		return step, nil
+	}
+
+	types := make(map[string]string)
+	for _, f := range engine.Transformers() {
+		if f.Name == name {
+			for _, spec := range f.Params {
+				types[spec.Name] = spec.Type
+			}
+		}
+	}
+	step.Params = make(map[string]any)
+	for _, pair := range strings.Split(rest, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return step, UsageError{Msg: fmt.Sprintf("-t %s: want key=value, got %q", arg, pair)}
+		}
+		// Values that don't parse stay strings for validation to reject
+		step.Params[key] = value
+		switch types[key] {
+		case "int":
+			if n, err := strconv.Atoi(value); err == nil {
+				step.Params[key] = n
+			}
+		case "bool":
+			if b, err := strconv.ParseBool(value); err == nil {
+				step.Params[key] = b
+			}
+		}
+	}
+	return step, nil
+}
+
+// expandInputs expands glob patterns among local inputs. A pattern that
+// matches nothing is an error rather than a literal file name.
+func expandInputs(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return []string{StdioURI}, nil
+	}
+	var inputs []string
+	for i, arg := range args {
+		if arg == StdioURI && slices.Contains(args[:i], StdioURI) {
+			return nil, UsageError{Msg: "stdin (-) can only be read once"}
+		}
+		if uriScheme(arg) != "" || !strings.ContainsAny(arg, "*?[") {
+			inputs = append(inputs, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, UsageError{Msg: fmt.Sprintf("bad pattern %q: %v", arg, err)}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no inputs match %s: %w", arg, fs.ErrNotExist)
+		}
+		inputs = append(inputs, matches...)
+	}
+	return inputs, nil
+}
+
+// outputFor picks where input goes. Several inputs need a directory
+// destination (an existing one, or one ending in "/"), which each input
+// is written into under its base name; see outputsFor.
+func outputFor(input, destination string, many bool) (string, error) {
+	if !many || destination == StdioURI {
+		return destination, nil
+	}
+	info, err := os.Stat(destination)
+	if !strings.HasSuffix(destination, "/") && (err != nil || !info.IsDir()) {
+		return "", UsageError{Msg: fmt.Sprintf("destination %s must be a directory when there are several inputs", destination)}
+	}
+	name := path.Base(filepath.ToSlash(input))
+	if input == StdioURI {
+		name = "stdin"
+	}
+	return strings.TrimSuffix(destination, "/") + "/" + name, nil
+}
+
+// outputsFor picks where each input goes, refusing to run inputs that
+// share a base name into one directory, where one would overwrite the
+// other
+func outputsFor(inputs []string, destination string) ([]string, error) {
+	dests := make([]string, len(inputs))
+	claimed := make(map[string]string) // destination -> input
+	for i, input := range inputs {
+		dest, err := outputFor(input, destination, len(inputs) > 1)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := claimed[dest]; ok && dest != StdioURI {
+			return nil, UsageError{Msg: fmt.Sprintf("%s and %s would both be written to %s", other, input, dest)}
+		}
+		claimed[dest] = input
+		dests[i] = dest
+	}
+	return dests, nil
+}
+
+// readDocument reads source with whichever reader its scheme routes to
+func readDocument(engine *ProcessingEngine, source string) (Document, error) {
+	name, err := engine.ResolveReader(source)
+	if err != nil {
+		return nil, err
+	}
+	reader, ok := engine.reader(name)
+	if !ok {
+		return nil, fmt.Errorf("reader not found: %s", name)
+	}
+	return reader.Read(source)
+}
+
+// runRecord is one input's entry in the -json report of run, encrypt
+// and decrypt
+type runRecord struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Status      string  `json:"status"` // "ok" or "failed"
+	Error       string  `json:"error,omitempty"`
+	DurationMS  float64 `json:"duration_ms"`
+	Content     *string `json:"content,omitempty"` // the output, when it went to stdout
+}
+
+// process runs spec once per input. Inputs run one at a time so output
+// on stdout keeps their order. A failed input doesn't stop the rest; an
+// invalid pipeline does, since it fails the same way for every input.
+func (c CLI) process(engine *ProcessingEngine, stdio *stdioStore, opts *cliOptions, spec PipelineSpec, inputs []string) error {
+	var names []string
+	for _, step := range spec.Transformers {
+		names = append(names, step.Name)
+	}
+
+	// Every destination is settled before anything is written
+	dests, err := outputsFor(inputs, spec.Destination)
+	if err != nil {
+		return err
+	}
+	report := &BatchError{Total: len(inputs)}
+	records := []runRecord{}
+	for i, input := range inputs {
+		run := spec
+		run.Name = cmp.Or(spec.Name, input)
+		run.Source = input
+		run.Destination = dests[i]
+		start := time.Now()
+		_, err := engine.RunPipeline(context.Background(), &run, false)
+		if errors.As(err, new(PipelineError)) || errors.As(err, new(UsageError)) {
+			return err
+		}
+
+		record := runRecord{Source: input, Destination: run.Destination, Status: "ok", DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+		if doc := stdio.take(); doc != nil {
+			content := doc.GetContent()
+			record.Content = &content
+		}
+		if err != nil {
+			record.Status, record.Error = "failed", err.Error()
+			report.Failed = append(report.Failed, BatchResult{
+				Index:    i,
+				Job:      BatchJob{Source: input, Transformers: names, Destination: run.Destination},
+				Err:      err,
+				Duration: time.Since(start),
+			})
+		}
+		records = append(records, record)
+	}
+
+	if opts.json {
+		if err := c.printJSON(records); err != nil {
+			return err
+		}
+	}
+	switch {
+	case len(report.Failed) == 0:
+		return nil
+	case len(inputs) == 1:
+		return report.Failed[0].Err
+	}
+	return report
+}
+
+func (c CLI) run(args []string) error {
+	flags, opts := c.flags("run", "[flags] [inputs...]")
+	var steps stringsFlag
+	flags.Var(&steps, "t", "apply a transformer: name, name:key=value,... or name:{json} (repeatable)")
+	destination := flags.String("o", StdioURI, "destination; a directory when there are several inputs")
+	readerName := flags.String("reader", "", "reader to use instead of routing by scheme")
+	writerName := flags.String("writer", "", "writer to use instead of routing by scheme")
+	pipelinePath := flags.String("pipeline", "", "pipeline file to start from; -t steps are appended to its transformers")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	engine, stdio := c.engine(opts, c.getenv("DOCPROC_KEY"))
+	spec := PipelineSpec{Destination: StdioURI}
+	inputArgs := flags.Args()
+	if *pipelinePath != "" {
+		loaded, err := LoadPipeline(*pipelinePath)
+		if err != nil {
+			return err
+		}
+		spec = *loaded
+		if len(inputArgs) == 0 && spec.Source != "" {
+			inputArgs = []string{spec.Source}
+		}
+	}
+	if set["o"] || spec.Destination == "" {
+		spec.Destination = *destination
+	}
+	spec.Reader = cmp.Or(*readerName, spec.Reader)
+	spec.Writer = cmp.Or(*writerName, spec.Writer)
+	for _, arg := range steps {
+		step, err := parseStep(engine, arg)
+		if err != nil {
+			return err
+		}
+		spec.Transformers = append(spec.Transformers, step)
+	}
+
+	inputs, err := expandInputs(inputArgs)
+	if err != nil {
+		return err
+	}
+	return c.process(engine, stdio, opts, spec, inputs)
+}
+
+func (c CLI) crypt(command string, args []string) error {
+	flags, opts := c.flags(command, "[flags] [inputs...]")
+	keyFile := flags.String("key-file", "", "file whose first line is the passphrase (default $DOCPROC_KEY)")
+	destination := flags.String("o", StdioURI, "destination; a directory when there are several inputs")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	passphrase := c.getenv("DOCPROC_KEY")
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return fmt.Errorf("read key file: %w", err)
+		}
+		passphrase, _, _ = strings.Cut(string(data), "\n")
+		passphrase = strings.TrimSuffix(passphrase, "\r")
+	}
+	if passphrase == "" {
+		return UsageError{Msg: "a passphrase is required: set DOCPROC_KEY or use -key-file"}
+	}
+
+	engine, stdio := c.engine(opts, passphrase)
+	inputs, err := expandInputs(flags.Args())
+	if err != nil {
+		return err
+	}
+	spec := PipelineSpec{Name: command, Transformers: []TransformerStep{{Name: command}}, Destination: *destination}
+	return c.process(engine, stdio, opts, spec, inputs)
+}
+
+func (c CLI) list(args []string) error {
+	flags, opts := c.flags("list", "[readers|writers|transformers|plugins]...")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	kinds := flags.Args()
+	if len(kinds) == 0 {
+		kinds = []string{"readers", "writers", "transformers", "plugins"}
+	}
+
+	engine, _ := c.engine(opts, c.getenv("DOCPROC_KEY"))
+	type entry struct {
+		Name    string      `json:"name"`
+		Detail  string      `json:"-"` // the text form of the fields below
+		Schemes []string    `json:"schemes,omitempty"`
+		Params  []ParamSpec `json:"params,omitempty"`
+		Version string      `json:"version,omitempty"`
+	}
+	listing := make(map[string][]entry)
+	for _, kind := range kinds {
+		entries := []entry{}
+		switch kind {
+		case "readers", "writers":
+			regs := engine.Readers()
+			if kind == "writers" {
+				regs = engine.Writers()
+			}
+			for _, reg := range regs {
+				entries = append(entries, entry{Name: reg.Name, Detail: strings.Join(reg.Schemes, ", "), Schemes: reg.Schemes})
+			}
+		case "transformers":
+			for _, f := range engine.Transformers() {
+				var params []string
+				for _, spec := range f.Params {
+					params = append(params, fmt.Sprintf("%s=%s", spec.Name, spec.Type))
+				}
+				entries = append(entries, entry{Name: f.Name, Detail: strings.Join(params, " "), Params: f.Params})
+			}
+		case "plugins":
+			for _, p := range engine.Plugins() {
+				entries = append(entries, entry{Name: p.Name(), Detail: "v" + p.Version(), Version: p.Version()})
+			}
+		default:
+			return UsageError{Msg: fmt.Sprintf("cannot list %q: want readers, writers, transformers or plugins", kind)}
+		}
+		listing[kind] = entries
+	}
+
+	if opts.json {
+		return c.printJSON(listing)
+	}
+	for _, kind := range kinds {
+		fmt.Fprintf(c.Stdout, "%s:\n", kind)
+		if len(listing[kind]) == 0 {
+			fmt.Fprintln(c.Stdout, "  (none)")
+		}
+		for _, e := range listing[kind] {
+			fmt.Fprintf(c.Stdout, "  %-14s %s\n", e.Name, e.Detail)
+		}
+	}
+	return nil
+}
+
+func (c CLI) search(args []string) error {
+	flags, opts := c.flags("search", "[flags] query [inputs...]")
+	indexPath := flags.String("index", "", "search a saved index; inputs are added to it")
+	limit := flags.Int("n", 10, "maximum number of hits (0 for all)")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return UsageError{Msg: "a query is required"}
+	}
+	query := flags.Arg(0)
+
+	engine, _ := c.engine(opts, "")
+	index := engine.Index()
+	if *indexPath != "" {
+		if err := index.Load(*indexPath); err != nil {
+			return err
+		}
+	}
+	if flags.NArg() > 1 || *indexPath == "" {
+		inputs, err := expandInputs(flags.Args()[1:])
+		if err != nil {
+			return err
+		}
+		for _, input := range inputs {
+			doc, err := readDocument(engine, input)
+			if err != nil {
+				return err
+			}
+			index.Add(input, doc)
+		}
+	}
+
+	type match struct {
+		Line    int    `json:"line"`
+		Column  int    `json:"column"`
+		Context string `json:"context"`
+	}
+	type hit struct {
+		Name    string  `json:"name"`
+		Score   float64 `json:"score"`
+		Matches []match `json:"matches"`
+	}
+	hits := []hit{}
+	for _, h := range index.Search(query, *limit) {
+		found := hit{Name: h.Name, Score: h.Score, Matches: []match{}}
+		for _, m := range h.Matches {
+			found.Matches = append(found.Matches, match{m.Line, m.Column, m.Context})
+		}
+		hits = append(hits, found)
+	}
+
+	if opts.json {
+		if err := c.printJSON(hits); err != nil {
+			return err
+		}
+	} else {
+		for _, h := range hits {
+			fmt.Fprintf(c.Stdout, "%.3f %s\n", h.Score, h.Name)
+			for _, m := range h.Matches {
+				fmt.Fprintf(c.Stdout, "      %d:%d: %s\n", m.Line, m.Column, m.Context)
+			}
+		}
+	}
+	if len(hits) == 0 {
+		return fmt.Errorf("%q: %w", query, errNoMatch)
+	}
+	return nil
+}
+
+func (c CLI) history(args []string) error {
+	flags, opts := c.flags("history", "[flags] source")
+	var steps stringsFlag
+	flags.Var(&steps, "t", "apply a transformer first, to see the versions it adds (repeatable)")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return UsageError{Msg: "exactly one source is required"}
+	}
+
+	engine, _ := c.engine(opts, c.getenv("DOCPROC_KEY"))
+	doc, err := readDocument(engine, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for _, arg := range steps {
+		step, err := parseStep(engine, arg)
+		if err != nil {
+			return err
+		}
+		t, err := engine.NewTransformer(step.Name, step.Params)
+		if err != nil {
+			return UsageError{Msg: err.Error()}
+		}
+		if doc, err = t.Transform(doc); err != nil {
+			return fmt.Errorf("%s: %w", step.Name, err)
+		}
+	}
+
+	type version struct {
+		Version   int       `json:"version"`
+		Author    string    `json:"author"`
+		Comment   string    `json:"comment"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	type step struct {
+		Kind      string    `json:"kind"`
+		Name      string    `json:"name"`
+		Version   int       `json:"version"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	report := struct {
+		Name       string    `json:"name"`
+		Version    int       `json:"version"`
+		History    []version `json:"history"`
+		Provenance []step    `json:"provenance"`
+	}{Name: doc.GetMetadata().Name, History: []version{}, Provenance: []step{}}
+	if v, ok := doc.(Versionable); ok {
+		report.Version = v.GetVersion()
+		for _, info := range v.GetHistory() {
+			report.History = append(report.History, version{info.Version, info.Author, info.Comment, info.Timestamp})
+		}
+	}
+	if t, ok := doc.(Traceable); ok {
+		for _, p := range t.Provenance() {
+			report.Provenance = append(report.Provenance, step{p.Kind, p.Name, p.Version, p.Timestamp})
+		}
+	}
+
+	if opts.json {
+		return c.printJSON(report)
+	}
+	fmt.Fprintf(c.Stdout, "%s (version %d)\n", report.Name, report.Version)
+	for _, v := range report.History {
+		fmt.Fprintf(c.Stdout, "  v%-3d %s  %-12s %s\n", v.Version, v.Timestamp.Format(time.DateTime), v.Author, v.Comment)
+	}
+	if len(report.Provenance) > 0 {
+		fmt.Fprintln(c.Stdout, "provenance:")
+		for _, p := range report.Provenance {
+			fmt.Fprintf(c.Stdout, "  v%-3d %-9s %s\n", p.Version, p.Kind, p.Name)
+		}
+	}
+	return nil
+}
+
+var _ DocumentProcessor = (*stdioStore)(nil)
+var _ flag.Value = (*stringsFlag)(nil)
+
+// ============================================================================
+// DEMO HELPERS
+// ============================================================================
+
+// renamedTransformer exposes a transformer under another name
+type renamedTransformer struct {
+	DocumentTransformer
+	name string
+}
+
+func (r renamedTransformer) Name() string { return r.name }
+
+// flakyWriter fails its first failures writes with a retryable error,
+// standing in for a store that is briefly unavailable
+type flakyWriter struct {
+	DocumentWriter
+	mu       sync.Mutex
+	failures int
+}
+
+func (fw *flakyWriter) Write(doc Document, destination string) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.failures > 0 {
+		fw.failures--
+		return RetryableError{Err: errors.New("store temporarily unavailable")}
+	}
+	return fw.DocumentWriter.Write(doc, destination)
+}
+
+// SupportedDestinations claims nothing, so the writer is only used by
+// name and never competes with the file writer for plain paths
+func (fw *flakyWriter) SupportedDestinations() []string { return nil }
+
+// localServer serves a handler on a free loopback port for the demos
+type localServer struct {
+	URL    string
+	server *http.Server
+}
+
+func startLocalServer(handler http.Handler) (*localServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(ln)
+	return &localServer{URL: "http://" + ln.Addr().String(), server: server}, nil
+}
+
+func (s *localServer) Close() error { return s.server.Close() }
+
+// slowReader takes delay to read, standing in for a hung source
+type slowReader struct {
+	DocumentReader
+	delay time.Duration
+}
+
+func (sr slowReader) Read(source string) (Document, error) {
+	return sr.ReadContext(context.Background(), source)
+}
+
+func (sr slowReader) ReadContext(ctx context.Context, source string) (Document, error) {
+	select {
+	case <-time.After(sr.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return sr.DocumentReader.Read(source)
+}
+
+// SupportedSources claims nothing, like flakyWriter's destinations
+func (sr slowReader) SupportedSources() []string { return nil }
+
+// buildSamplePlugin compiles day10/plugins/wordstats into dir, acting as a
+// small harness that launches a real external plugin locally
+func buildSamplePlugin(dir string) (*ExternalPlugin, error) {
+	_, thisFile, _, ok := runtime.Caller(0)
+	if !ok {
+		return nil, fmt.Errorf("cannot locate source directory")
+	}
+	src := filepath.Join(filepath.Dir(thisFile), "plugins", "wordstats", "main.go")
+	bin := filepath.Join(dir, "wordstats-plugin")
+	if out, err := exec.Command("go", "build", "-o", bin, src).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("build %s: %v\n%s", src, err, out)
+	}
+	return NewExternalPlugin(bin), nil
+}
+
+// valueOrError renders a (value, error) pair for the demo: the value, or
+// the error as a line of output
+func valueOrError(value string, err error) string {
+	if err != nil {
+		return fmt.Sprintf("Error: %v\n", err)
+	}
+	return value
+}
+
+func main() {
+	// With arguments this is the docproc tool; without, the walkthrough
+	if len(os.Args) > 1 {
+		os.Exit(CLI{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr, Getenv: os.Getenv}.Run(os.Args[1:]))
+	}
+
+	fmt.Println("=== Document Processing System ===")
+	fmt.Println()
+
+	// Create processing engine, logging its events to stdout without
+	// timestamps and collecting metrics
+	engine := NewProcessingEngine()
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	metrics := NewMetrics()
+	engine.SetObservers(SlogObserver{Logger: logger}, metrics)
+
+	// Register readers
+	engine.RegisterReader("file", FileReader{})
+	engine.RegisterReader("url", URLReader{})
+	readers := "file, url"
+	if SQLiteLinked("") {
+		engine.RegisterReader("db", DatabaseReader{ConnectionString: "docproc.db"})
+		readers += ", db"
+	}
+	fmt.Println("Registered readers:", readers)
+
+	// Register writers
+	engine.RegisterWriter("file", FileWriter{})
+	engine.RegisterWriter("console", ConsoleWriter{Verbose: true})
+	fmt.Println("Registered writers: file, console")
+
+	fmt.Println()
+
+	// Load plugin
+	fmt.Println("--- Loading Plugins ---")
+	plugin := NewTextToolsPlugin()
+	engine.LoadPlugin(plugin)
+
+	fmt.Println()
+
+	// Prepare a small document tree on disk
+	workDir, err := os.MkdirTemp("", "docproc-")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	reportPath := filepath.Join(workDir, "report.txt")
+	os.WriteFile(reportPath, []byte("  Quarterly report  \n  Revenue is up.\n  Costs are down.  "), 0o644)
+
+	// Process a document
+	fmt.Println("--- Processing Document ---")
+	err = engine.Process(
+		"file", "file://"+reportPath,
+		[]string{"trim", "line-numbers"},
+		"console", "stdout",
+	)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	fmt.Println()
+
+	// Round-trip through the filesystem
+	fmt.Println("--- File Storage ---")
+	outPath := filepath.Join(workDir, "out", "report_upper.txt")
+	err = engine.Process("file", reportPath, []string{"uppercase"}, "file", outPath)
 	if err != nil {
-		return fmt.Errorf("read error: %w", err)
+		fmt.Printf("Error: %v\n", err)
+	}
+	if saved, err := (FileReader{}).Read("file://" + outPath); err == nil {
+		meta := saved.GetMetadata()
+		fmt.Printf("Saved %s (%d bytes, %s)\n", filepath.Base(meta.Name), meta.Size, meta.MimeType)
 	}
-	fmt.Printf("Read document: %s (%d bytes)\n", doc.GetMetadata().Name, len(doc.GetContent()))
 
-	// Apply transformers
-	for _, name := range transformerNames {
-		for _, t := range e.transformers {
-			if t.Name() == name {
-				doc, err = t.Transform(doc)
-				if err != nil {
-					return fmt.Errorf("transform error (%s): %w", name, err)
-				}
-				fmt.Printf("Applied transformer: %s\n", name)
-				break
-			}
+	for _, source := range []string{filepath.Join(workDir, "missing.txt"), workDir} {
+		_, err := (FileReader{}).Read(source)
+		switch e := err.(type) {
+		case NotFoundError:
+			fmt.Printf("Not found: %s\n", filepath.Base(e.Path))
+		case PermissionError:
+			fmt.Printf("No permission to %s %s\n", e.Op, e.Path)
+		case IsDirectoryError:
+			fmt.Printf("Refusing to read directory: %s\n", filepath.Base(e.Path))
 		}
 	}
 
-	// Get writer
-	writer, ok := e.writers[writerName]
-	if !ok {
-		return fmt.Errorf("writer not found: %s", writerName)
+	fmt.Println()
+
+	// Let the URI schemes pick the reader and writer
+	fmt.Println("--- Scheme Routing ---")
+	engine.LoadPlugin(NewMemoryStorePlugin())
+	if err := engine.ProcessURI("file://"+reportPath, []string{"trim"}, "mem://reports/q1"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	if err := engine.ProcessURI("mem://reports/q1", []string{"uppercase"}, "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	if err := engine.ProcessURI("ftp://example.com/a.txt", nil, "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
 	}
 
-	// Write document
-	if err := writer.Write(doc, destination); err != nil {
-		return fmt.Errorf("write error: %w", err)
+	// A second file reader makes file:// ambiguous until it is routed
+	engine.RegisterReader("file-mirror", FileReader{})
+	if err := engine.ProcessURI(reportPath, nil, "mem://reports/copy"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	engine.RouteSource("", "file")
+	engine.RouteSource("file://", "file")
+	if err := engine.ProcessURI(reportPath, nil, "mem://reports/copy"); err == nil {
+		fmt.Println("Routed local paths to reader: file")
 	}
 
-	return nil
-}
+	fmt.Println()
 
-// ProcessWithCapabilities checks for optional document capabilities
-func (e *ProcessingEngine) ProcessWithCapabilities(doc Document) {
-	fmt.Println("\n--- Document Capabilities ---")
-	meta := doc.GetMetadata()
-	fmt.Printf("Document: %s\n", meta.Name)
+	// Fan a batch of documents out over a worker pool
+	fmt.Println("--- Batch Processing ---")
+	var jobs []BatchJob
+	for i := 1; i <= 4; i++ {
+		path := filepath.Join(workDir, "batch", fmt.Sprintf("doc%d.txt", i))
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		os.WriteFile(path, []byte(fmt.Sprintf("batch document %d", i)), 0o644)
+		jobs = append(jobs, BatchJob{
+			Source:       path,
+			Transformers: []string{"uppercase"},
+			Destination:  fmt.Sprintf("mem://batch/doc%d", i),
+		})
+	}
+	jobs = append(jobs, BatchJob{Source: filepath.Join(workDir, "batch", "missing.txt"), Destination: "mem://batch/missing"})
 
-	// Check for Searchable
-	if searchable, ok := doc.(Searchable); ok {
-		fmt.Println("  [x] Searchable")
-		results := searchable.Search("content")
-		if len(results) > 0 {
-			fmt.Printf("      Found %d matches for 'content'\n", len(results))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	batchResults, err := engine.ProcessBatch(ctx, jobs, 3)
+	cancel()
+	succeeded := 0
+	for _, r := range batchResults {
+		if r.Err == nil {
+			succeeded++
+		}
+	}
+	fmt.Printf("Batch finished: %d/%d succeeded\n", succeeded, len(batchResults))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	fmt.Println()
+
+	// Stream a large log line by line instead of loading it
+	fmt.Println("--- Streaming ---")
+	bigLogPath := filepath.Join(workDir, "big.log")
+	if f, err := os.Create(bigLogPath); err == nil {
+		w := bufio.NewWriter(f)
+		for i := 0; i < 200000; i++ {
+			fmt.Fprintf(w, "   request %d served by node-%d  \n", i, i%4)
 		}
+		w.Flush()
+		f.Close()
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	stats, err := engine.ProcessStream(ctx, bigLogPath, []string{"trim", "uppercase", "tail"}, filepath.Join(workDir, "big-tail.log"))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
 	} else {
-		fmt.Println("  [ ] Searchable")
+		fmt.Printf("%d bytes in, %d bytes out\n", stats.BytesIn, stats.BytesOut)
+	}
+	// head stops reading as soon as it has its lines
+	stats, err = engine.ProcessStream(ctx, bigLogPath, []string{"trim", "head", "line-numbers"}, "console://")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	// sort-lines has no line stage, so it is buffered automatically
+	namesPath := filepath.Join(workDir, "names.txt")
+	os.WriteFile(namesPath, []byte("carol\nalice\nbob\nalice"), 0o644)
+	if _, err := engine.ProcessStream(ctx, namesPath, []string{"sort-lines", "dedupe-lines"}, "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	cancel()
+	if _, err := engine.ProcessStream(context.Background(), "mem://streamed", nil, "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
 	}
 
-	// Check for Versionable
-	if versionable, ok := doc.(Versionable); ok {
-		fmt.Println("  [x] Versionable")
-		fmt.Printf("      Current version: %d\n", versionable.GetVersion())
-		fmt.Printf("      History entries: %d\n", len(versionable.GetHistory()))
+	fmt.Println()
+
+	// Structured documents picked from the MIME type
+	fmt.Println("--- Structured Documents ---")
+	engine.LoadPlugin(FormatsPlugin{})
+	readmePath := filepath.Join(workDir, "README.md")
+	os.WriteFile(readmePath, []byte("# Docproc\n\nA **tiny** engine. See [Go](https://go.dev).\n\n## Usage\n\n- read\n- `transform`\n- write"), 0o644)
+	if doc, err := (FileReader{}).Read(readmePath); err == nil {
+		if md, ok := doc.(*MarkdownDocument); ok {
+			fmt.Printf("%s is %s with %d headings and links %v\n",
+				filepath.Base(md.GetMetadata().Name), md.GetMetadata().MimeType, len(md.Headings()), md.Links())
+		}
+	}
+	if err := engine.ProcessURI(readmePath, []string{"to-html"}, "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	if err := engine.ProcessURI(readmePath, []string{"to-text"}, "mem://readme.txt"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	page := NewHTMLDocument("page.html", `<html><head><title>News &amp; Notes</title><style>p{}</style></head>
+<body><h1>Hello</h1><p>First <b>bold</b> para.</p><ul><li><a href="/a">A</a></li><li>B</li></ul></body></html>`, "Web")
+	fmt.Printf("HTML title %q, headings %v, links %v\n", page.Title(), page.Headings(), page.Links())
+	fmt.Printf("HTML text: %q\n", page.Text())
+
+	jsonPath := filepath.Join(workDir, "config.json")
+	os.WriteFile(jsonPath, []byte(`{"name":"docproc","stages":[{"id":"trim"},{"id":"upper"}],"workers":4}`), 0o644)
+	if doc, err := (FileReader{}).Read(jsonPath); err == nil {
+		if j, ok := doc.(*JSONDocument); ok {
+			stage, _ := j.Get("stages[1].id")
+			paths, _ := j.Paths()
+			fmt.Printf("JSON stages[1].id = %v, paths %v\n", stage, paths)
+		}
+	}
+	if err := engine.ProcessURI(jsonPath, []string{"json-pretty"}, "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	fmt.Println()
+
+	// Pipelines loaded from a file
+	fmt.Println("--- Pipeline Files ---")
+	pipelinePath := filepath.Join(workDir, "pipeline.json")
+	os.WriteFile(pipelinePath, []byte(fmt.Sprintf(`{
+  "name": "minify-config",
+  "source": %q,
+  "transformers": [{"name": "json-pretty", "params": {"indent": "    "}}, {"name": "json-minify"}],
+  "destination": "stdout"
+}`, "file://"+jsonPath)), 0o644)
+	if spec, err := LoadPipeline(pipelinePath); err != nil {
+		fmt.Printf("Error: %v\n", err)
 	} else {
-		fmt.Println("  [ ] Versionable")
+		if plan, err := engine.RunPipeline(context.Background(), spec, true); err == nil {
+			fmt.Print(plan)
+		}
+		if _, err := engine.RunPipeline(context.Background(), spec, false); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	badSpec := &PipelineSpec{
+		Name:         "typos",
+		Source:       "ftp://nowhere/x.txt",
+		Transformers: []TransformerStep{{Name: "uppercsae"}, {Name: "trim", Params: map[string]any{"width": 80}}},
+	}
+	if _, err := engine.RunPipeline(context.Background(), badSpec, true); err != nil {
+		fmt.Printf("Error: %v\n", err)
 	}
 
-	// Check for Encryptable
-	if encryptable, ok := doc.(Encryptable); ok {
-		fmt.Println("  [x] Encryptable")
-		fmt.Printf("      Currently encrypted: %v\n", encryptable.IsEncrypted())
+	fmt.Println()
+
+	// Configurable transformers from the registry
+	fmt.Println("--- Parameterized Transformers ---")
+	for _, f := range engine.Transformers() {
+		if len(f.Params) == 0 {
+			continue
+		}
+		var opts []string
+		for _, p := range f.Params {
+			opts = append(opts, p.Name+":"+p.Type)
+		}
+		fmt.Printf("  %-14s %s\n", f.Name, strings.Join(opts, ", "))
+	}
+	if err := engine.RegisterTransformer(UppercaseTransformer{}); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	logPath := filepath.Join(workDir, "app.log")
+	os.WriteFile(logPath, []byte("b warn disk 91%\na info started\nb warn disk 91%\nc error timeout after 30s waiting for upstream service to respond"), 0o644)
+	logPipeline := &PipelineSpec{
+		Name:   "tidy-log",
+		Source: logPath,
+		Transformers: []TransformerStep{
+			{Name: "dedupe-lines"},
+			{Name: "sort-lines", Params: map[string]any{"reverse": true}},
+			{Name: "regex-replace", Params: map[string]any{"pattern": `(\d+)s\b`, "replacement": "${1} seconds"}},
+			{Name: "wrap", Params: map[string]any{"width": 40}},
+			{Name: "head", Params: map[string]any{"lines": 4}},
+		},
+		Destination: "stdout",
+	}
+	if _, err := engine.RunPipeline(context.Background(), logPipeline, false); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	if _, err := engine.NewTransformer("wrap", map[string]any{"width": "wide", "colour": true}); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	fmt.Println()
+
+	// Transformers served by a separate process
+	fmt.Println("--- External Plugins ---")
+	if external, err := buildSamplePlugin(workDir); err != nil {
+		fmt.Printf("Skipping external plugin demo: %v\n", err)
 	} else {
-		fmt.Println("  [ ] Encryptable")
+		external.Timeout = 500 * time.Millisecond
+		if err := engine.LoadPlugin(external); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+
+		// Several documents stream through the one plugin process at once
+		var streamJobs []BatchJob
+		for i := 1; i <= 3; i++ {
+			streamJobs = append(streamJobs, BatchJob{
+				Source:       filepath.Join(workDir, "batch", fmt.Sprintf("doc%d.txt", i)),
+				Transformers: []string{"title-case", "word-stats"},
+				Destination:  fmt.Sprintf("mem://stats/doc%d", i),
+			})
+		}
+		if _, err := engine.ProcessBatch(context.Background(), streamJobs, 3); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		engine.ProcessURI("mem://stats/doc2", nil, "stdout")
+
+		// A dead process is replaced on the next call; the tests cover
+		// crashes and timeouts with a deliberately faulty plugin
+		external.mu.Lock()
+		external.proc.kill()
+		external.mu.Unlock()
+		if err := engine.ProcessURI(reportPath, []string{"title-case"}, "mem://stats/after"); err == nil {
+			fmt.Printf("Plugin recovered after %d restarts\n", external.Restarts())
+		}
+		external.Shutdown()
 	}
-}
 
-func main() {
-	fmt.Println("=== Document Processing System ===")
 	fmt.Println()
 
-	// Create processing engine
-	engine := NewProcessingEngine()
+	// Dependencies, version constraints and unloading
+	fmt.Println("--- Plugin Lifecycle ---")
+	headlines := BundlePlugin{
+		PluginName:    "Headlines",
+		PluginVersion: "0.3.0",
+		Requirements:  []PluginRequirement{{Name: "Shouting", Constraint: "^1.1.0"}, {Name: "TextTools", Constraint: ">=1.0.0"}},
+		Transformers:  []DocumentTransformer{renamedTransformer{HeadTransformer{Lines: 1}, "headline"}},
+	}
+	shouting := BundlePlugin{
+		PluginName:    "Shouting",
+		PluginVersion: "1.4.2",
+		Requirements:  []PluginRequirement{{Name: EngineRequirement, Constraint: ">=1.0, <2"}},
+		Transformers:  []DocumentTransformer{renamedTransformer{UppercaseTransformer{}, "shout"}},
+	}
 
-	// Register readers
-	engine.RegisterReader("file", FileReader{})
-	engine.RegisterReader("url", URLReader{})
-	engine.RegisterReader("db", DatabaseReader{ConnectionString: "localhost:5432"})
-	fmt.Println("Registered readers: file, url, db")
+	if err := engine.LoadPlugins(headlines, shouting); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	for _, p := range engine.Plugins() {
+		fmt.Printf("  loaded %s v%s\n", p.Name(), p.Version())
+	}
+	if err := engine.ProcessURI(reportPath, []string{"trim", "headline", "shout"}, "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
 
-	// Register writers
-	engine.RegisterWriter("file", FileWriter{})
-	engine.RegisterWriter("console", ConsoleWriter{Verbose: true})
-	fmt.Println("Registered writers: file, console")
+	cycleA := BundlePlugin{PluginName: "A", PluginVersion: "1.0.0", Requirements: []PluginRequirement{{Name: "B", Constraint: "*"}}}
+	cycleB := BundlePlugin{PluginName: "B", PluginVersion: "1.0.0", Requirements: []PluginRequirement{{Name: "A", Constraint: "*"}}}
+	if err := engine.LoadPlugins(cycleA, cycleB); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	future := BundlePlugin{PluginName: "Future", PluginVersion: "1.0.0", Requirements: []PluginRequirement{{Name: EngineRequirement, Constraint: "^2.0.0"}}}
+	if err := engine.LoadPlugin(future); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	if err := engine.UnloadPlugin("Shouting"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	engine.UnloadPlugin("Headlines")
+	engine.UnloadPlugin("Shouting")
+	if err := engine.ProcessURI(reportPath, []string{"shout"}, "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
 
 	fmt.Println()
 
-	// Load plugin
-	fmt.Println("--- Loading Plugins ---")
-	plugin := NewTextToolsPlugin()
-	engine.LoadPlugin(plugin)
+	// Transforms derive documents instead of starting from scratch
+	fmt.Println("--- Lineage ---")
+	notes := NewMarkdownDocument("notes.md", "# Notes\n\n  keep **this**  ", "Ann")
+	notes.metadata.Tags = []string{"draft"}
+	var derived Document = notes
+	for _, t := range []DocumentTransformer{TrimTransformer{}, MarkdownToHTMLTransformer{}, EncryptTransformer{Passphrase: "pw"}, DecryptTransformer{Passphrase: "pw"}} {
+		next, err := t.Transform(derived)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			break
+		}
+		derived = next
+	}
+	derivedMeta := derived.GetMetadata()
+	fmt.Printf("%s is %T (%s), tags %v, same creation time: %v\n",
+		derivedMeta.Name, derived, derivedMeta.MimeType, derivedMeta.Tags, derivedMeta.Created.Equal(notes.GetMetadata().Created))
+	if v, ok := derived.(Versionable); ok {
+		for _, h := range v.GetHistory() {
+			fmt.Printf("  v%d by %-16s %s\n", h.Version, h.Author, h.Comment)
+		}
+		if diff, err := v.Diff(2, 3); err == nil {
+			fmt.Print(diff)
+		}
+	}
+	if tr, ok := derived.(Traceable); ok {
+		var chain []string
+		for _, step := range tr.Provenance() {
+			chain = append(chain, step.Name)
+		}
+		fmt.Println("Provenance:", strings.Join(chain, " -> "))
+	}
+	fmt.Println("Original untouched:", notes.GetVersion(), notes.GetMetadata().MimeType)
 
 	fmt.Println()
 
-	// Process a document
-	fmt.Println("--- Processing Document ---")
-	err := engine.Process(
-		"file", "report.txt",
-		[]string{"trim", "line-numbers"},
-		"console", "stdout",
-	)
+	// Fetch over HTTP from a local test server
+	fmt.Println("--- HTTP Fetching ---")
+	var pageHits, notModified atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /menu", func(w http.ResponseWriter, r *http.Request) {
+		pageHits.Add(1)
+		w.Header().Set("ETag", `"menu-v1"`)
+		w.Header().Set("Last-Modified", "Fri, 02 Jan 2026 15:04:05 GMT")
+		if r.Header.Get("If-None-Match") == `"menu-v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		w.Write([]byte("<html><head><title>Caf\xe9 menu</title></head><body><p>Cr\xe8me br\xfbl\xe9e</p></body></html>"))
+	})
+	mux.HandleFunc("GET /loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("GET /huge", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 64<<10))
+	})
+	mux.HandleFunc("GET /busy", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	})
+	site, err := startLocalServer(mux)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	web := URLReader{
+		Timeout:      2 * time.Second,
+		MaxRedirects: 3,
+		MaxBodyBytes: 16 << 10,
+		CacheDir:     filepath.Join(workDir, "http-cache"),
+		Limiter:      NewHostLimiter(50 * time.Millisecond),
+	}
+	engine.RegisterReader("url", web)
+	fetchStart := time.Now()
+	for range 2 {
+		if doc, err := web.Read(site.URL + "/menu"); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else if page, ok := doc.(*HTMLDocument); ok {
+			fmt.Printf("Fetched %q (%s, modified %s)\n", page.Title(), page.GetMetadata().MimeType, page.GetMetadata().Modified.Format(time.DateOnly))
+		}
+	}
+	fmt.Printf("Server hit %d times, %d answered 304 Not Modified; requests spaced out: %v\n",
+		pageHits.Load(), notModified.Load(), time.Since(fetchStart) >= 50*time.Millisecond)
+	for _, path := range []string{"/loop", "/huge", "/busy", "/missing"} {
+		if _, err := web.Read(site.URL + path); err != nil {
+			fmt.Printf("%s: retryable=%v: %v\n", path, IsRetryable(err), strings.ReplaceAll(err.Error(), site.URL, ""))
+		}
+	}
+	site.Close()
+
+	fmt.Println()
+
+	// Persist processed documents in SQLite and load them back
+	fmt.Println("--- Database Storage ---")
+	dbPath := filepath.Join(workDir, "docs.db")
+	if !SQLiteLinked("") {
+		fmt.Printf("Skipped: no %q database driver linked in (see DATABASE STORAGE)\n", DefaultSQLiteDriver)
+	} else {
+		engine.RegisterReader("db", DatabaseReader{ConnectionString: dbPath})
+		engine.RegisterWriter("db", DatabaseWriter{ConnectionString: dbPath})
+		if err := engine.ProcessURI(reportPath, []string{"trim"}, "db://reports/q1"); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else if err := engine.ProcessURI("db://reports/q1", []string{"uppercase"}, "db://reports/q1"); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else if doc, err := (DatabaseReader{ConnectionString: dbPath}).Read("db://reports?author=FileSystem"); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else if v, ok := doc.(Versionable); ok {
+			fmt.Printf("Reloaded %s at version %d\n", doc.GetMetadata().Name, v.GetVersion())
+			if diff, err := v.Diff(1, v.GetVersion()); err == nil {
+				fmt.Print(diff)
+			}
+		}
+	}
+	// URIs are checked before the database is opened
+	if _, err := (DatabaseReader{ConnectionString: dbPath}).Read("db://reports?owner=me"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	fmt.Println()
+
+	// Retry transient failures and dead-letter what still fails
+	fmt.Println("--- Retries and Dead Letters ---")
+	retrying := RetryPolicy{MaxAttempts: 3, Timeout: 50 * time.Millisecond, InitialBackoff: 10 * time.Millisecond, Multiplier: 2, Jitter: 0.5}
+	engine.SetRetryPolicy(StageRead, retrying)
+	engine.SetRetryPolicy(StageWrite, retrying)
+	fmt.Printf("Backoff: %v, %v, %v (before jitter)\n", retrying.Backoff(1), retrying.Backoff(2), retrying.Backoff(3))
+	if err := engine.SetDeadLetter("memory", "mem://dead-letters/"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	engine.RegisterWriter("flaky", &flakyWriter{DocumentWriter: FileWriter{}, failures: 2})
+	if err := engine.Process("file", reportPath, []string{"uppercase"}, "flaky", filepath.Join(workDir, "flaky.txt")); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	} else {
+		fmt.Println("Flaky write succeeded on the third attempt")
+	}
+	engine.RegisterReader("slow", slowReader{DocumentReader: FileReader{}, delay: 200 * time.Millisecond})
+	if err := engine.Process("slow", reportPath, nil, "console", "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	err = engine.Process("file", reportPath, []string{"json-minify"}, "console", "stdout")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	fmt.Println("Permanent errors are not retried:", !IsRetryable(NotFoundError{Path: "x"}))
+	var lettered DeadLetteredError
+	if memory, ok := engine.reader("memory"); ok && errors.As(err, &lettered) {
+		var letter DeadLetter
+		if doc, err := memory.Read(lettered.Destination); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else if err := json.Unmarshal([]byte(doc.GetContent()), &letter); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Dead letter: stage=%s name=%s attempts=%d has document=%v\n", letter.Stage, letter.Name, letter.Attempts, letter.Document != nil)
+			for _, msg := range letter.Errors {
+				fmt.Println("  caused by:", msg)
+			}
+		}
+	}
+	engine.SetRetryPolicy(StageRead, RetryPolicy{})
+	engine.SetRetryPolicy(StageWrite, RetryPolicy{})
+	engine.SetDeadLetter("", "")
+
+	fmt.Println()
+
+	// Scrape the metrics endpoint like Prometheus would
+	fmt.Println("--- Metrics ---")
+	if ln, err := net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	} else {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", metrics)
+		server := &http.Server{Handler: mux}
+		go server.Serve(ln)
+		resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			fmt.Println("Content-Type:", resp.Header.Get("Content-Type"))
+			for _, line := range strings.Split(string(body), "\n") {
+				if strings.HasPrefix(line, `docproc_operations_total{stage="read"`) ||
+					strings.HasPrefix(line, `docproc_operation_duration_seconds_count`) {
+					fmt.Println(line)
+				}
+			}
+		}
+		server.Close()
+	}
+
+	fmt.Println()
+
+	// Drive the engine through its REST API
+	fmt.Println("--- HTTP Service ---")
+	service := NewServer(engine, 2)
+	api, err := startLocalServer(service)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	call := func(method, target, contentType, body string) (int, string) {
+		req, _ := http.NewRequest(method, api.URL+target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	status, body := call("POST", "/v1/documents?name=notes.txt", "text/plain", "  some content worth shouting about  \n")
+	var uploaded documentInfo
+	json.Unmarshal([]byte(body), &uploaded)
+	fmt.Printf("Upload: %d %s (%s, %d bytes)\n", status, uploaded.URI, uploaded.MimeType, uploaded.Size)
+
+	var transformers []struct{ Name string }
+	_, body = call("GET", "/v1/transformers", "", "")
+	json.Unmarshal([]byte(body), &transformers)
+	fmt.Printf("Transformers available: %d\n", len(transformers))
+
+	status, body = call("POST", "/v1/jobs", "application/json",
+		`{"name": "shout", "source": "`+uploaded.URI+`", "transformers": [{"name": "trim"}, {"name": "uppercase"}]}`)
+	var job Job
+	json.Unmarshal([]byte(body), &job)
+	fmt.Printf("Submit: %d %s %s\n", status, job.ID, job.Status)
+	for job.Status == JobQueued || job.Status == JobRunning {
+		time.Sleep(10 * time.Millisecond)
+		_, body = call("GET", "/v1/jobs/"+job.ID, "", "")
+		json.Unmarshal([]byte(body), &job)
+	}
+	fmt.Printf("Poll: %s %s error=%q\n", job.ID, job.Status, job.Error)
+	status, body = call("GET", "/v1/jobs/"+job.ID+"/result", "", "")
+	fmt.Printf("Result: %d %q\n", status, body)
+
+	var caps Capabilities
+	_, body = call("GET", "/v1/documents/"+job.Result+"/capabilities?q=CONTENT", "", "")
+	json.Unmarshal([]byte(body), &caps)
+	fmt.Printf("Capabilities: searchable=%v matches=%d versionable=%v version=%d encryptable=%v\n",
+		caps.Searchable, caps.Matches, caps.Versionable, caps.Version, caps.Encryptable)
+
+	status, body = call("POST", "/v1/jobs", "application/json", `{"source": "docs://nope", "transformers": [{"name": "shout"}]}`)
+	var rejected struct{ Problems []string }
+	json.Unmarshal([]byte(body), &rejected)
+	fmt.Printf("Bad job: %d %v\n", status, rejected.Problems)
+	status, body = call("POST", "/v1/jobs", "application/json", `{"source": "/etc/hostname"}`)
+	json.Unmarshal([]byte(body), &rejected)
+	fmt.Printf("Local file job: %d %v\n", status, rejected.Problems)
+	status, _ = call("GET", "/v1/documents/nope", "", "")
+	fmt.Printf("Missing document: %d\n", status)
+	api.Close()
+	service.Close()
+
+	fmt.Println()
+
+	// The same engine as a command-line tool (go run 06_challenge.go run ...)
+	fmt.Println("--- Command Line ---")
+	cli := CLI{Stdin: strings.NewReader("  piped in from stdin  \n"), Stdout: os.Stdout, Stderr: os.Stdout}
+	notesDir := filepath.Join(workDir, "notes")
+	os.MkdirAll(notesDir, 0o755)
+	os.WriteFile(filepath.Join(notesDir, "a.txt"), []byte("revenue grew in the north\nrevenue fell in the south\n"), 0o644)
+	os.WriteFile(filepath.Join(notesDir, "b.txt"), []byte("costs grew everywhere\n"), 0o644)
+	shoutDir := filepath.Join(workDir, "shouted") + "/"
+	keyFile, wrongKeyFile := filepath.Join(workDir, "cli.key"), filepath.Join(workDir, "wrong.key")
+	os.WriteFile(keyFile, []byte("cli-key\n"), 0o600)
+	os.WriteFile(wrongKeyFile, []byte("wrong-key\n"), 0o600)
+	for _, args := range [][]string{
+		{"run", "-t", "trim", "-t", "uppercase"},
+		{"run", "-t", "uppercase", "-t", "head:lines=1", "-o", shoutDir, filepath.Join(notesDir, "*.txt")},
+		{"run", filepath.Join(shoutDir, "b.txt")},
+		{"search", "-n", "1", "revenue", filepath.Join(notesDir, "*.txt")},
+		{"search", "profit", filepath.Join(notesDir, "*.txt")},
+		{"encrypt", "-key-file", keyFile, "-o", filepath.Join(workDir, "b.enc"), filepath.Join(notesDir, "b.txt")},
+		{"decrypt", "-key-file", wrongKeyFile, filepath.Join(workDir, "b.enc")},
+		{"run", "-", "-"},
+		{"list", "-json", "plugins"},
+		{"run", "-t", "shout", filepath.Join(notesDir, "a.txt")},
+		{"run", filepath.Join(notesDir, "*.md")},
+	} {
+		fmt.Printf("$ docproc %s\n", strings.Join(args, " "))
+		if code := cli.Run(args); code != ExitOK {
+			fmt.Printf("exit %d\n", code)
+		}
+	}
+	var runReport []runRecord
+	var jsonOut bytes.Buffer
+	jsonCLI := CLI{Stdin: strings.NewReader(""), Stdout: &jsonOut, Stderr: os.Stdout, Getenv: func(string) string { return "cli-key" }}
+	jsonCLI.Run([]string{"decrypt", "-json", filepath.Join(workDir, "b.enc")})
+	json.Unmarshal(jsonOut.Bytes(), &runReport)
+	for _, r := range runReport {
+		fmt.Printf("JSON report: status=%s content=%q\n", r.Status, *r.Content)
+	}
+
+	fmt.Println()
+
+	// Query everything the engine has read or written so far
+	fmt.Println("--- Full-Text Index ---")
+	fmt.Printf("Indexed documents: %d\n", engine.Index().Len())
+	for _, hit := range engine.Index().Search("quarterly revenue", 3) {
+		fmt.Printf("  %.3f %s\n", hit.Score, hit.Name)
+		for _, m := range hit.Matches {
+			fmt.Printf("        Line %d, Col %d: %s\n", m.Line, m.Column, m.Context)
+		}
+	}
+	indexPath := filepath.Join(workDir, "index.json")
+	if err := engine.Index().Save(indexPath); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	reloaded := NewDocumentIndex()
+	if err := reloaded.Load(indexPath); err != nil {
+		fmt.Printf("Error: %v\n", err)
 	}
+	fmt.Printf("Reloaded index: %d documents, top hit for \"batch document 3\": %s\n",
+		reloaded.Len(), reloaded.Search("batch document 3", 1)[0].Name)
 
 	fmt.Println()
 
@@ -618,18 +9131,71 @@ func main() {
 
 	fmt.Println()
 
+	// Walk through the version history
+	fmt.Println("--- Version History Demo ---")
+	fmt.Print(valueOrError(doc.Diff(1, 2)))
+
+	if err := doc.Rollback(1, "Admin"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	for _, h := range doc.GetHistory() {
+		fmt.Printf("  v%d by %s: %s\n", h.Version, h.Author, h.Comment)
+	}
+	if snapshot, err := doc.Checkout(2); err == nil {
+		fmt.Printf("Checkout v2: %q\n", strings.SplitN(snapshot.GetContent(), "\n", 2)[0])
+	}
+	if _, err := doc.Checkout(7); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	fmt.Println()
+
 	// Demonstrate encryption
 	fmt.Println("--- Encryption Demo ---")
 	secret := NewTextDocument("secret.txt", "Top secret information!", "Agent")
 	fmt.Println("Original:", secret.GetContent())
 
-	secret.Encrypt("password123")
+	if err := secret.Encrypt("password123"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
 	fmt.Println("Encrypted:", secret.GetContent())
 	fmt.Println("Is encrypted:", secret.IsEncrypted())
 
-	secret.Decrypt("password123")
+	if err := secret.Decrypt("wrong-password"); err != nil {
+		fmt.Println("Wrong key:", err)
+	}
+
+	if err := secret.Decrypt("password123"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
 	fmt.Println("Decrypted:", secret.GetContent())
 
+	// Flip one ciphertext character to show tamper detection
+	tampered := NewTextDocument("tampered.txt", "Wire $100 to Bob", "Agent")
+	tampered.Encrypt("password123")
+	idx := strings.Index(tampered.content, `"data":"`) + len(`"data":"`)
+	flipped := []byte(tampered.content)
+	if flipped[idx] == 'A' {
+		flipped[idx] = 'B'
+	} else {
+		flipped[idx] = 'A'
+	}
+	tampered.content = string(flipped)
+	if err := tampered.Decrypt("password123"); err != nil {
+		fmt.Println("Tampered:", err)
+	}
+
+	// Encryption as pipeline steps
+	engine.RegisterTransformer(EncryptTransformer{Passphrase: "pipeline-key"})
+	engine.RegisterTransformer(DecryptTransformer{Passphrase: "pipeline-key"})
+	sealedPath := filepath.Join(workDir, "report.enc")
+	if err := engine.ProcessURI(reportPath, []string{"trim", "encrypt"}, sealedPath); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	if err := engine.ProcessURI(sealedPath, []string{"decrypt"}, "stdout"); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
 	fmt.Println()
 
 	// Show search capability
@@ -643,32 +9209,83 @@ func main() {
 	for _, r := range results {
 		fmt.Printf("  Line %d, Col %d: %s\n", r.Line, r.Column, r.Context)
 	}
+
+	queries := []struct {
+		query string
+		opts  SearchOptions
+	}{
+		{`go AND interfaces`, SearchOptions{}},
+		{`"are implicit" OR polymorphism`, SearchOptions{}},
+		{`interfaces -powerful`, SearchOptions{}},
+		{`Interfaces`, SearchOptions{CaseSensitive: true}},
+		{`/[Gg]o\b/`, SearchOptions{WholeWord: true, ContextLines: 1}},
+	}
+	for _, q := range queries {
+		hits, err := searchDoc.SearchQuery(q.query, q.opts)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		fmt.Printf("Query %s: %d matches\n", q.query, len(hits))
+		for _, r := range hits {
+			fmt.Printf("  Line %d, Col %d: %q", r.Line, r.Column, r.Match)
+			if len(r.Before)+len(r.After) > 0 {
+				fmt.Printf(" (context: %d before, %d after)", len(r.Before), len(r.After))
+			}
+			fmt.Println()
+		}
+	}
+	// Word boundaries follow Unicode letters, not just ASCII ones
+	menu := NewTextDocument("menu.txt", "Café au lait\nCafeteria coffee\nGröße: groß", "Author")
+	for _, word := range []string{"café", "groß"} {
+		hits, _ := menu.SearchQuery(word, SearchOptions{WholeWord: true})
+		fmt.Printf("Whole word %s: %d match(es)\n", word, len(hits))
+	}
+	if _, err := searchDoc.SearchQuery(`(go OR`, SearchOptions{}); err != nil {
+		fmt.Printf("Bad query: %v\n", err)
+	}
 }
 
 // ============================================================================
 // TO RUN:
 //   go run day10/06_challenge.go
 //
+// db:// storage needs a SQLite driver, which this file does not link in;
+// add a blank import of one (see DATABASE STORAGE) in a module that
+// requires it, and "db" joins the registered readers.
+//
 // EXPECTED OUTPUT:
 //   === Document Processing System ===
 //
-//   Registered readers: file, url, db
+//   Registered readers: file, url
 //   Registered writers: file, console
 //
 //   --- Loading Plugins ---
 //   Initializing plugin: TextTools v1.0.0
-//     Registered transformer: uppercase
-//     Registered transformer: trim
-//     Registered transformer: line-numbers
+//   level=INFO msg=plugin.loaded name=TextTools duration=... transformers="[uppercase trim line-numbers]" version=1.0.0
 //
 //   --- Processing Document ---
-//   Read document: report.txt (93 bytes)
-//   Applied transformer: trim
-//   Applied transformer: line-numbers
+//   level=INFO msg=read.finished name=file uri=file:///tmp/docproc-.../report.txt bytes=57 duration=...
+//   level=INFO msg=transform.applied name=trim uri=file:///tmp/docproc-.../report.txt bytes=47 duration=...
+//   level=INFO msg=transform.applied name=line-numbers uri=file:///tmp/docproc-.../report.txt bytes=62 duration=...
 //   === Console Output ===
-//   Name: report.txt_numbered
+//   Name: /tmp/docproc-.../report.txt_numbered
 //   ... (more output)
 //
+//   --- File Storage ---
+//   ...
+//   Saved report_upper.txt (57 bytes, text/plain)
+//   Not found: missing.txt
+//   Refusing to read directory: docproc-...
+//
+//   --- Scheme Routing ---
+//   Initializing plugin: MemoryStore v1.0.0
+//   level=INFO msg=plugin.loaded name=MemoryStore duration=... readers=[memory] version=1.0.0 writers=[memory]
+//   ...
+//   Error: no reader registered for source scheme "ftp://" (ftp://example.com/a.txt)
+//   Error: ambiguous source scheme "local path" (...): claimed by readers file, file-mirror
+//   ...
+//
 // EXERCISES:
 //   1. Add a MarkdownDocument type that implements Document and has
 //      a method ToHTML() string
@@ -0,0 +1,215 @@
+//go:build sqlite
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// ============================================================================
+// DAY 10: DATABASE STORAGE TESTS
+// ============================================================================
+//
+// DocumentDB needs a SQLite driver, which the challenge itself does not
+// link in, so these tests only build with the sqlite tag:
+//
+//   go test -tags sqlite day10/06_challenge.go day10/06_challenge_test.go day10/06_challenge_sqlite_test.go
+//
+// ============================================================================
+
+// openTestDB opens a fresh database in a temporary directory and
+// returns it with its path
+func openTestDB(t *testing.T) (*DocumentDB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "docs.db")
+	db, err := OpenDocumentDB("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path
+}
+
+// threeVersions returns a document edited twice after creation
+func threeVersions() *TextDocument {
+	doc := NewTextDocument("notes.txt", "one", "Ann")
+	doc.UpdateContent("one\ntwo", "Bob", "Add two")
+	doc.UpdateContent("one\ntwo\nthree", "Cy", "Add three")
+	return doc
+}
+
+// checkVersions fails unless doc has exactly the given contents as its
+// versions, oldest first
+func checkVersions(t *testing.T, doc Document, want ...string) {
+	t.Helper()
+	v := doc.(Versionable)
+	if v.GetVersion() != len(want) {
+		t.Fatalf("version = %d, want %d", v.GetVersion(), len(want))
+	}
+	for i, content := range want {
+		past, err := v.Checkout(i + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if past.GetContent() != content {
+			t.Errorf("version %d = %q, want %q", i+1, past.GetContent(), content)
+		}
+	}
+}
+
+func TestDocumentDBSavesEveryVersion(t *testing.T) {
+	db, _ := openTestDB(t)
+	version, err := db.Save("notes", "n1", threeVersions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 {
+		t.Errorf("Save returned version %d, want 3", version)
+	}
+
+	doc, err := db.Load("notes", "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, doc, "one", "one\ntwo", "one\ntwo\nthree")
+	var authors, comments []string
+	for _, h := range doc.(Versionable).GetHistory() {
+		authors = append(authors, h.Author)
+		comments = append(comments, h.Comment)
+	}
+	if !slices.Equal(authors, []string{"Ann", "Bob", "Cy"}) {
+		t.Errorf("authors = %q", authors)
+	}
+	if !slices.Equal(comments, []string{"Initial creation", "Add two", "Add three"}) {
+		t.Errorf("comments = %q", comments)
+	}
+}
+
+func TestDocumentDBSaveAppendsWhatIsNew(t *testing.T) {
+	db, _ := openTestDB(t)
+	if _, err := db.Save("notes", "n1", threeVersions()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A document loaded from the database and edited adds only its edits
+	loaded, err := db.Load("notes", "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.(*TextDocument).UpdateContent("four", "Dee", "Replace")
+	if version, err := db.Save("notes", "n1", loaded); err != nil || version != 4 {
+		t.Fatalf("Save = %d, %v; want 4", version, err)
+	}
+	// Saving it again has nothing new to add
+	if version, err := db.Save("notes", "n1", loaded); err != nil || version != 4 {
+		t.Fatalf("second Save = %d, %v; want 4", version, err)
+	}
+
+	// An unrelated document adds all of its versions after the stored ones
+	other := NewTextDocument("other.txt", "a", "Eve")
+	other.UpdateContent("b", "Eve", "Edit")
+	if version, err := db.Save("notes", "n1", other); err != nil || version != 6 {
+		t.Fatalf("unrelated Save = %d, %v; want 6", version, err)
+	}
+	doc, err := db.Load("notes", "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, doc, "one", "one\ntwo", "one\ntwo\nthree", "four", "a", "b")
+}
+
+func TestDocumentDBSavesEncryptedDocumentAsOneVersion(t *testing.T) {
+	db, _ := openTestDB(t)
+	doc := threeVersions()
+	if err := doc.Encrypt("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := db.Save("notes", "sealed", doc); err != nil || version != 1 {
+		t.Fatalf("Save = %d, %v; want 1", version, err)
+	}
+	loaded, err := db.Load("notes", "sealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.(Encryptable).IsEncrypted() {
+		t.Error("loaded document is not marked encrypted")
+	}
+	if loaded.GetContent() != doc.GetContent() {
+		t.Error("encrypted content changed on the way through the database")
+	}
+}
+
+func TestDocumentDBMigratesOnce(t *testing.T) {
+	db, path := openTestDB(t)
+	db.Close()
+
+	db, err := OpenDocumentDB("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var applied int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(dbMigrations) {
+		t.Errorf("%d migrations recorded, want %d", applied, len(dbMigrations))
+	}
+}
+
+func TestDatabaseWriterAndReader(t *testing.T) {
+	_, path := openTestDB(t)
+	w := DatabaseWriter{ConnectionString: path}
+	r := DatabaseReader{ConnectionString: path}
+
+	report := NewTextDocument("q1.txt", "first quarter", "Ann")
+	report.metadata.Tags = []string{"final", "finance", "final"}
+	if err := w.Write(report, "db://reports/q1"); err != nil {
+		t.Fatal(err)
+	}
+	draft := NewTextDocument("q2.txt", "second quarter", "Bob")
+	draft.metadata.Tags = []string{"draft"}
+	if err := w.Write(draft, "sql://reports/q2"); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := r.Read("db://reports/q1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.GetContent() != "first quarter" || doc.GetMetadata().Author != "Ann" {
+		t.Errorf("read back %q by %q", doc.GetContent(), doc.GetMetadata().Author)
+	}
+	if tags := doc.GetMetadata().Tags; !slices.Equal(tags, []string{"final", "finance"}) {
+		t.Errorf("tags = %q, want [final finance]", tags)
+	}
+
+	for source, want := range map[string]string{
+		"db://reports?tag=final&tag=finance": "first quarter",
+		"db://reports?author=Bob":            "second quarter",
+		"sql://reports?name=q2.txt":          "second quarter",
+	} {
+		doc, err := r.Read(source)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+		} else if doc.GetContent() != want {
+			t.Errorf("%s = %q, want %q", source, doc.GetContent(), want)
+		}
+	}
+
+	if _, err := r.Read("db://reports?tag=final&author=Bob"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("query matching nothing: got %v, want fs.ErrNotExist", err)
+	}
+	if _, err := r.Read("db://reports/q3"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing id: got %v, want fs.ErrNotExist", err)
+	}
+	if err := w.Write(report, "db://reports?tag=final"); err == nil {
+		t.Error("writing to a query succeeded")
+	}
+}
@@ -0,0 +1,935 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ============================================================================
+// DAY 10: TESTS FOR THE DOCUMENT PROCESSING CHALLENGE
+// ============================================================================
+//
+// The other files in this directory are separate programs, so name the
+// files explicitly:
+//
+//   go test day10/06_challenge.go day10/06_challenge_test.go
+//
+// ============================================================================
+
+// buildPlugin compiles the plugin program in dir (relative to this
+// file) and returns it unstarted
+func buildPlugin(t *testing.T, dir string) *ExternalPlugin {
+	t.Helper()
+	_, thisFile, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("cannot locate source directory")
+	}
+	src := filepath.Join(filepath.Dir(thisFile), dir, "main.go")
+	bin := filepath.Join(t.TempDir(), filepath.Base(dir))
+	if out, err := exec.Command("go", "build", "-o", bin, src).CombinedOutput(); err != nil {
+		t.Fatalf("build %s: %v\n%s", src, err, out)
+	}
+	p := NewExternalPlugin(bin)
+	t.Cleanup(func() { p.Shutdown() })
+	return p
+}
+
+// faultyPlugin starts testdata/faultyplugin
+func faultyPlugin(t *testing.T) *ExternalPlugin {
+	t.Helper()
+	p := buildPlugin(t, filepath.Join("testdata", "faultyplugin"))
+	p.Timeout = 500 * time.Millisecond
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// remote returns one of p's transformers
+func remote(t *testing.T, p *ExternalPlugin, name string) DocumentTransformer {
+	t.Helper()
+	for _, tr := range p.GetTransformers() {
+		if tr.Name() == name {
+			return tr
+		}
+	}
+	t.Fatalf("plugin has no transformer %q", name)
+	return nil
+}
+
+// run applies one of p's transformers to a small document
+func run(t *testing.T, p *ExternalPlugin, name string, params Params) error {
+	t.Helper()
+	tr := remote(t, p, name)
+	if params != nil {
+		var err error
+		if tr, err = tr.(ParameterizedTransformer).WithParams(params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := tr.Transform(NewTextDocument("test.txt", "some text", "Tester"))
+	return err
+}
+
+func TestExternalPluginRestartsAfterCrash(t *testing.T) {
+	p := faultyPlugin(t)
+
+	var procErr PluginProcessError
+	if err := run(t, p, "crash", nil); !errors.As(err, &procErr) {
+		t.Fatalf("crash: got %v, want PluginProcessError", err)
+	}
+	if err := run(t, p, "echo", nil); err != nil {
+		t.Fatalf("echo after crash: %v", err)
+	}
+	if got := p.Restarts(); got != 1 {
+		t.Errorf("Restarts() = %d, want 1", got)
+	}
+}
+
+func TestExternalPluginRestartLimitIsPerWindow(t *testing.T) {
+	p := faultyPlugin(t)
+	p.MaxRestarts = 1
+	p.RestartWindow = 300 * time.Millisecond
+
+	run(t, p, "crash", nil)
+	if err := run(t, p, "echo", nil); err != nil {
+		t.Fatalf("first restart: %v", err)
+	}
+	run(t, p, "crash", nil)
+	if err := run(t, p, "echo", nil); err == nil {
+		t.Fatal("second restart within the window succeeded, want an error")
+	}
+
+	time.Sleep(350 * time.Millisecond)
+	if err := run(t, p, "echo", nil); err != nil {
+		t.Fatalf("restart after the window: %v", err)
+	}
+	if got := p.Restarts(); got != 2 {
+		t.Errorf("Restarts() = %d, want 2", got)
+	}
+}
+
+func TestExternalPluginTimeoutSparesOtherCalls(t *testing.T) {
+	p := faultyPlugin(t)
+
+	var wg sync.WaitGroup
+	var slowErr, fastErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		slowErr = run(t, p, "sleep", Params{"ms": 3000})
+	}()
+	go func() {
+		defer wg.Done()
+		// Still waiting when the slow call times out at 500ms
+		time.Sleep(300 * time.Millisecond)
+		fastErr = run(t, p, "sleep", Params{"ms": 350})
+	}()
+	wg.Wait()
+
+	if !errors.Is(slowErr, context.DeadlineExceeded) {
+		t.Errorf("slow call: got %v, want a timeout", slowErr)
+	}
+	if fastErr != nil {
+		t.Errorf("call in flight during the timeout: %v", fastErr)
+	}
+	if got := p.Restarts(); got != 0 {
+		t.Errorf("Restarts() = %d, want 0", got)
+	}
+}
+
+func TestExternalPluginTimeoutRestartsWedgedProcess(t *testing.T) {
+	p := faultyPlugin(t)
+
+	var procErr PluginProcessError
+	if err := run(t, p, "sleep", Params{"ms": 3000}); !errors.As(err, &procErr) {
+		t.Fatalf("got %v, want PluginProcessError", err)
+	}
+	if err := run(t, p, "echo", nil); err != nil {
+		t.Fatalf("echo after timeout: %v", err)
+	}
+	if got := p.Restarts(); got != 1 {
+		t.Errorf("Restarts() = %d, want 1", got)
+	}
+}
+
+func TestExternalPluginNameDuringCalls(t *testing.T) {
+	p := faultyPlugin(t)
+
+	// Run with -race: Name and Version read what restarts write
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(t, p, "crash", nil)
+			run(t, p, "echo", nil)
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				_, _ = p.Name(), p.Version()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestExternalPluginStreamsLargeDocuments(t *testing.T) {
+	p := faultyPlugin(t)
+
+	// Several chunks each way, cut next to multi-byte runes
+	content := strings.Repeat("naïve café ", 40000)
+	out, err := remote(t, p, "echo").Transform(NewTextDocument("big.txt", content, "Tester"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.GetContent() != content {
+		t.Errorf("echoed %d bytes, sent %d", len(out.GetContent()), len(content))
+	}
+}
+
+func TestExternalPluginKeepsMetadataItLeavesEmpty(t *testing.T) {
+	p := faultyPlugin(t)
+
+	doc := NewTextDocument("notes.txt", "some text", "Tester")
+	doc.metadata.Tags = []string{"draft"}
+	out, err := remote(t, p, "blank").Transform(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := out.GetMetadata()
+	if meta.Name != "notes.txt" || meta.Author != "Tester" || len(meta.Tags) != 1 || meta.MimeType != doc.GetMetadata().MimeType {
+		t.Errorf("metadata %+v, want the input's name, author, tags and type", meta)
+	}
+}
+
+func TestExternalPluginThatStopsReadingTimesOut(t *testing.T) {
+	p := faultyPlugin(t)
+	if err := run(t, p, "stall", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Far more than the pipe holds, so the write itself blocks
+	done := make(chan error, 1)
+	go func() {
+		_, err := remote(t, p, "echo").Transform(NewTextDocument("big.txt", strings.Repeat("x", 4<<20), "Tester"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var procErr PluginProcessError
+		if !errors.As(err, &procErr) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want a PluginProcessError for the timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transform still blocked writing to a plugin that stopped reading")
+	}
+
+	if err := run(t, p, "echo", nil); err != nil {
+		t.Fatalf("echo after the stall: %v", err)
+	}
+	if got := p.Restarts(); got != 1 {
+		t.Errorf("Restarts() = %d, want 1", got)
+	}
+}
+
+func TestWordStatsPlugin(t *testing.T) {
+	p := buildPlugin(t, filepath.Join("plugins", "wordstats"))
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Name() != "WordStats" || p.Version() != "0.1.0" {
+		t.Errorf("loaded %s v%s, want WordStats v0.1.0", p.Name(), p.Version())
+	}
+
+	e := NewProcessingEngine()
+	if err := e.LoadPlugin(p); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		transformer string
+		in, want    string
+	}{
+		{"word-stats", "one two\nthree", "one two\nthree\n---\nlines: 2, words: 3, characters: 13"},
+		{"title-case", "hello, wide-world. again", "Hello, Wide-world. Again"},
+		{"title-case", strings.Repeat("élan vital ", 20000), strings.Repeat("Élan Vital ", 20000)},
+	} {
+		tr, err := e.NewTransformer(tt.transformer, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := NewTextDocument("notes.txt", tt.in, "Tester")
+		out, err := tr.Transform(doc)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.transformer, err)
+		}
+		if out.GetContent() != tt.want {
+			got := out.GetContent()
+			if len(got) > 80 {
+				got = got[:80] + "..."
+			}
+			t.Errorf("%s: got %q", tt.transformer, got)
+		}
+		if meta := out.GetMetadata(); meta.Name != "notes.txt" || meta.Author != "Tester" {
+			t.Errorf("%s: metadata %+v, want the input's name and author", tt.transformer, meta)
+		}
+	}
+}
+
+func TestUnloadPluginKeepsReplacedReaders(t *testing.T) {
+	e := NewProcessingEngine()
+	if err := e.LoadPlugin(NewMemoryStorePlugin()); err != nil {
+		t.Fatal(err)
+	}
+	e.RegisterReader("memory", FileReader{})
+
+	if err := e.UnloadPlugin("MemoryStore"); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := e.reader("memory"); !ok {
+		t.Error("reader registered after the plugin was removed with it")
+	} else if _, isFile := r.(FileReader); !isFile {
+		t.Errorf("reader is %T, want FileReader", r)
+	}
+	if _, ok := e.writer("memory"); ok {
+		t.Error("plugin's writer still registered after unload")
+	}
+}
+
+func TestExternalPluginUnloadsByHandshakeName(t *testing.T) {
+	p := buildPlugin(t, filepath.Join("testdata", "faultyplugin"))
+	before := p.Name()
+
+	e := NewProcessingEngine()
+	if err := e.LoadPlugin(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Name() == before {
+		t.Fatalf("test needs a plugin whose handshake name differs from %q", before)
+	}
+	if err := e.UnloadPlugin(p.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Plugins()) != 0 {
+		t.Errorf("plugins still loaded: %v", e.Plugins())
+	}
+	if err := e.LoadPlugin(p); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if err := e.LoadPlugin(p); err == nil {
+		t.Error("loading the same plugin twice succeeded")
+	}
+}
+
+func TestUpdateContentRewriteStaysFast(t *testing.T) {
+	lines := make([]string, 100_000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	original := strings.Join(lines, "\n")
+	doc := NewTextDocument("big.txt", original, "Tester")
+
+	// Rewriting every line is too much to diff and is stored whole; a
+	// one-line edit is still a small delta
+	start := time.Now()
+	shouted := strings.ToUpper(original)
+	doc.UpdateContent(shouted, "Tester", "shout")
+	edited := splitLines(shouted)
+	edited[50_000] = "EDITED"
+	doc.UpdateContent(strings.Join(edited, "\n"), "Tester", "edit")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("two updates took %s", elapsed)
+	}
+
+	if got, err := doc.contentAt(1); err != nil || got != original {
+		t.Errorf("version 1 not restored (err %v)", err)
+	}
+	if got, err := doc.contentAt(2); err != nil || got != shouted {
+		t.Errorf("version 2 not restored (err %v)", err)
+	}
+	stored := 0
+	for _, h := range doc.deltas[1] {
+		stored += len(h.Insert)
+	}
+	if stored != 1 {
+		t.Errorf("one-line edit stored %d lines, want 1", stored)
+	}
+}
+
+// hangingWriter blocks its first write for delay, then records writes
+type hangingWriter struct {
+	mu     sync.Mutex
+	delay  time.Duration
+	calls  int
+	landed int
+}
+
+func (w *hangingWriter) Write(doc Document, destination string) error {
+	w.mu.Lock()
+	w.calls++
+	first := w.calls == 1
+	w.mu.Unlock()
+	if first {
+		time.Sleep(w.delay)
+	}
+	w.mu.Lock()
+	w.landed++
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *hangingWriter) SupportedDestinations() []string { return nil }
+
+func (w *hangingWriter) counts() (calls, landed int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.calls, w.landed
+}
+
+// cancellableWriter is a hangingWriter that gives up when ctx is done
+type cancellableWriter struct{ hangingWriter }
+
+func (w *cancellableWriter) WriteContext(ctx context.Context, doc Document, destination string) error {
+	w.mu.Lock()
+	w.calls++
+	first := w.calls == 1
+	w.mu.Unlock()
+	if first {
+		select {
+		case <-time.After(w.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	w.mu.Lock()
+	w.landed++
+	w.mu.Unlock()
+	return nil
+}
+
+// processWith writes one document through writer under the write policy
+// and returns the error after the writer has had time to finish
+func processWith(t *testing.T, policy RetryPolicy, writer DocumentWriter) error {
+	t.Helper()
+	store := NewMemoryStore()
+	store.Write(NewTextDocument("in.txt", "hello", "Tester"), "mem://in.txt")
+
+	e := NewProcessingEngine()
+	e.SetObservers()
+	e.RegisterReader("memory", store)
+	e.RegisterWriter("out", writer)
+	if err := e.SetRetryPolicy(StageWrite, policy); err != nil {
+		t.Fatal(err)
+	}
+	err := e.Process("memory", "mem://in.txt", nil, "out", "out.txt")
+	time.Sleep(300 * time.Millisecond)
+	return err
+}
+
+func TestMarkdownEmphasisLeavesLinkTargetsAlone(t *testing.T) {
+	for in, want := range map[string]string{
+		"see [the *docs*](http://x.test/a*b*c)":  `<p>see <a href="http://x.test/a*b*c">the <em>docs</em></a></p>`,
+		"**[a](http://x.test/**b**)** and *c*":   `<p><strong><a href="http://x.test/**b**">a</a></strong> and <em>c</em></p>`,
+		"![*star*](img*1*.png)":                  `<p><img src="img*1*.png" alt="*star*"></p>`,
+		"*see [x](http://x.test/) and [y](/y*)*": `<p><em>see <a href="http://x.test/">x</a> and <a href="/y*">y</a></em></p>`,
+		"[bad](javascript:alert) *still* works":  `<p>bad <em>still</em> works</p>`,
+	} {
+		if got := markdownToHTML(in); got != want {
+			t.Errorf("%s\n got %s\nwant %s", in, got, want)
+		}
+	}
+}
+
+func TestAbandonedWriteIsNotRetried(t *testing.T) {
+	w := &hangingWriter{delay: 200 * time.Millisecond}
+	policy := RetryPolicy{MaxAttempts: 3, Timeout: 50 * time.Millisecond}
+
+	var timeout StageTimeoutError
+	if err := processWith(t, policy, w); !errors.As(err, &timeout) || !timeout.Abandoned {
+		t.Fatalf("got %v, want an abandoned StageTimeoutError", err)
+	}
+	if calls, landed := w.counts(); calls != 1 || landed != 1 {
+		t.Errorf("calls = %d, landed = %d; want 1 and 1", calls, landed)
+	}
+}
+
+func TestAbandonedWriteRetriedWhenAllowed(t *testing.T) {
+	w := &hangingWriter{delay: 200 * time.Millisecond}
+	policy := RetryPolicy{MaxAttempts: 3, Timeout: 50 * time.Millisecond, RetryAbandonedWrites: true}
+
+	if err := processWith(t, policy, w); err != nil {
+		t.Fatal(err)
+	}
+	if calls, landed := w.counts(); calls != 2 || landed != 2 {
+		t.Errorf("calls = %d, landed = %d; want 2 and 2", calls, landed)
+	}
+}
+
+func TestContextWriterIsCancelledAndRetried(t *testing.T) {
+	w := &cancellableWriter{hangingWriter{delay: 200 * time.Millisecond}}
+	policy := RetryPolicy{MaxAttempts: 3, Timeout: 50 * time.Millisecond}
+
+	if err := processWith(t, policy, w); err != nil {
+		t.Fatal(err)
+	}
+	if calls, landed := w.counts(); calls != 2 || landed != 1 {
+		t.Errorf("calls = %d, landed = %d; want 2 and 1", calls, landed)
+	}
+}
+
+func TestDeadLetteredErrorNamesTheLetter(t *testing.T) {
+	store := NewMemoryStore()
+	e := NewProcessingEngine()
+	e.SetObservers()
+	e.RegisterReader("memory", store)
+	e.RegisterWriter("memory", store)
+	if err := e.SetDeadLetter("memory", "mem://dead/"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := e.Process("memory", "mem://missing.txt", nil, "memory", "mem://out.txt")
+	var lettered DeadLetteredError
+	if !errors.As(err, &lettered) {
+		t.Fatalf("got %v, want a DeadLetteredError", err)
+	}
+	var notFound NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("dead-lettered error lost its cause: %v", err)
+	}
+	if _, err := store.Read(lettered.Destination); err != nil {
+		t.Errorf("dead letter not at %s: %v", lettered.Destination, err)
+	}
+}
+
+func TestHostLimiterZeroValue(t *testing.T) {
+	ctx := context.Background()
+	var l HostLimiter
+	if wait, _ := l.Wait(ctx, "example.com"); wait != 0 {
+		t.Errorf("first wait = %s, want 0", wait)
+	}
+
+	l = HostLimiter{Interval: 50 * time.Millisecond}
+	l.Wait(ctx, "a.example")
+	if wait, _ := l.Wait(ctx, "a.example"); wait <= 0 {
+		t.Errorf("second wait for the same host = %s, want > 0", wait)
+	}
+	if wait, _ := l.Wait(ctx, "b.example"); wait != 0 {
+		t.Errorf("wait for another host = %s, want 0", wait)
+	}
+}
+
+func TestHostLimiterStopsWithContext(t *testing.T) {
+	l := NewHostLimiter(time.Hour)
+	l.Wait(context.Background(), "example.com")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := l.Wait(ctx, "example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled wait took %s", elapsed)
+	}
+
+	// The cancelled wait gave its slot back, so the next one is due an
+	// hour after the first request, not two
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	l.Wait(ctx, "example.com")
+	l.mu.Lock()
+	next := l.next["example.com"]
+	l.mu.Unlock()
+	if until := time.Until(next); until > time.Hour+time.Minute {
+		t.Errorf("next slot in %s, want about an hour", until)
+	}
+}
+
+func TestURLReaderRevalidatesCachedPages(t *testing.T) {
+	var hits, notModified int
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("fresh"))
+	}))
+	defer site.Close()
+
+	reader := URLReader{CacheDir: t.TempDir()}
+	for range 2 {
+		doc, err := reader.Read(site.URL + "/page")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := doc.GetContent(); got != "fresh" {
+			t.Errorf("content = %q, want %q", got, "fresh")
+		}
+	}
+	if hits != 2 || notModified != 1 {
+		t.Errorf("hits = %d, not modified = %d; want 2 and 1", hits, notModified)
+	}
+}
+
+func TestURLReaderFailures(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("GET /huge", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 64<<10))
+	})
+	mux.HandleFunc("GET /busy", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	})
+	site := httptest.NewServer(mux)
+	defer site.Close()
+	reader := URLReader{MaxRedirects: 3, MaxBodyBytes: 16 << 10}
+
+	if _, err := reader.Read(site.URL + "/loop"); err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+		t.Errorf("redirect loop: %v", err)
+	}
+	if _, err := reader.Read(site.URL + "/huge"); err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+		t.Errorf("oversized body: %v", err)
+	}
+	if _, err := reader.Read(site.URL + "/busy"); !IsRetryable(err) {
+		t.Errorf("503 should be retryable: %v", err)
+	}
+	if _, err := reader.Read(site.URL + "/missing"); !errors.Is(err, fs.ErrNotExist) || IsRetryable(err) {
+		t.Errorf("404 should be permanent and not found: %v", err)
+	}
+}
+
+func TestURLReaderStopsWithContext(t *testing.T) {
+	release := make(chan struct{})
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer site.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := (URLReader{}).ReadContext(ctx, site.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read returned after %s", elapsed)
+	}
+}
+
+func TestResolveFilePath(t *testing.T) {
+	for source, want := range map[string]string{
+		"notes.txt":                      "notes.txt",
+		"file:///tmp/notes.txt":          "/tmp/notes.txt",
+		"file://localhost/tmp/notes.txt": "/tmp/notes.txt",
+		"file://docs/notes.txt":          "docs/notes.txt",
+		"file:///tmp/issue#12.txt":       "/tmp/issue#12.txt",
+		"file:///tmp/what?.txt":          "/tmp/what?.txt",
+		"file:///tmp/a?b#c/../d.txt":     "/tmp/d.txt",
+		"file:///tmp/my%20notes.txt":     "/tmp/my notes.txt",
+		"file:///tmp/100%.txt":           "/tmp/100%.txt",
+		"file://localhost.example/x.txt": "localhost.example/x.txt",
+	} {
+		got, err := resolveFilePath(source)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+		} else if got != filepath.FromSlash(want) {
+			t.Errorf("%s = %q, want %q", source, got, want)
+		}
+	}
+	for _, source := range []string{"", "file://", "file://localhost"} {
+		if _, err := resolveFilePath(source); err == nil {
+			t.Errorf("%q resolved without error", source)
+		}
+	}
+}
+
+func TestDatabaseWithoutDriver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docs.db")
+	r := DatabaseReader{ConnectionString: path, Driver: "no-such-driver"}
+	if _, err := r.Read("db://reports/q1"); err == nil || !strings.Contains(err.Error(), "no-such-driver") {
+		t.Errorf("read without a driver: got %v, want an error naming the driver", err)
+	}
+	w := DatabaseWriter{ConnectionString: path, Driver: "no-such-driver"}
+	if err := w.Write(NewTextDocument("q1.txt", "text", "Ann"), "db://reports/q1"); err == nil {
+		t.Error("write without a driver succeeded")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("database file created without a driver: %v", err)
+	}
+}
+
+// serve sends one request straight to s
+func serve(s *Server, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	e := NewProcessingEngine()
+	e.SetObservers()
+	e.RegisterReader("file", FileReader{})
+	e.RegisterReader("url", URLReader{})
+	e.RegisterWriter("file", FileWriter{})
+	s := NewServer(e, 1)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestServerJobsStayInDocs(t *testing.T) {
+	s := newTestServer(t)
+	serve(s, "POST", "/v1/documents?name=a.txt", "hello")
+	out := filepath.Join(t.TempDir(), "out.txt")
+
+	for name, spec := range map[string]string{
+		"file source":      `{"source": "/etc/hostname"}`,
+		"url source":       `{"source": "http://169.254.169.254/latest/meta-data"}`,
+		"file destination": `{"source": "docs://doc-1", "destination": "` + out + `"}`,
+		"reader override":  `{"source": "docs://doc-1", "reader": "docs"}`,
+		"writer override":  `{"source": "docs://doc-1", "writer": "file", "destination": "docs://x"}`,
+	} {
+		if rec := serve(s, "POST", "/v1/jobs", spec); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400: %s", name, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(s, "POST", "/v1/jobs", `{"source": "docs://doc-1"}`); rec.Code != http.StatusAccepted {
+		t.Errorf("docs job: status %d, want 202: %s", rec.Code, rec.Body)
+	}
+
+	s.Readers = []string{"docs", "file"}
+	if rec := serve(s, "POST", "/v1/jobs", `{"source": "/etc/hostname"}`); rec.Code != http.StatusAccepted {
+		t.Errorf("allowed file source: status %d, want 202: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestServerDocumentsStayOutOfTheIndex(t *testing.T) {
+	s := newTestServer(t)
+	serve(s, "POST", "/v1/documents?name=a.txt", "quarterly revenue")
+	rec := serve(s, "POST", "/v1/jobs", `{"source": "docs://doc-1", "transformers": [{"name": "sort-lines"}]}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("job: status %d: %s", rec.Code, rec.Body)
+	}
+	var job Job
+	json.Unmarshal(rec.Body.Bytes(), &job)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		json.Unmarshal(serve(s, "GET", "/v1/jobs/"+job.ID, "").Body.Bytes(), &job)
+		if job.Status == JobSucceeded {
+			break
+		}
+		if job.Status == JobFailed || time.Now().After(deadline) {
+			t.Fatalf("job %s: %s", job.Status, job.Error)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := s.engine.Index().Len(); n != 0 {
+		t.Errorf("%d documents indexed, want none", n)
+	}
+}
+
+func TestIndexSkipsStdioAndDecryptedDocuments(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.txt")
+	os.WriteFile(plain, []byte("top secret plans\n"), 0o644)
+	sealedPath, opened := filepath.Join(dir, "sealed.enc"), filepath.Join(dir, "opened.txt")
+
+	e := NewProcessingEngine()
+	e.SetObservers()
+	e.RegisterReader("file", FileReader{})
+	e.RegisterWriter("file", FileWriter{})
+	e.RegisterWriter("stdio", &stdioStore{capture: true})
+	e.RegisterTransformer(EncryptTransformer{Passphrase: "pw"})
+	e.RegisterTransformer(DecryptTransformer{Passphrase: "pw"})
+
+	if err := e.Process("file", plain, []string{"encrypt"}, "file", sealedPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Process("file", sealedPath, []string{"decrypt"}, "file", opened); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Process("file", sealedPath, []string{"decrypt"}, "stdio", StdioURI); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the plaintext input itself: not the ciphertext, not the
+	// decrypted copy and not what went to stdout
+	if n := e.Index().Len(); n != 1 {
+		t.Errorf("%d documents indexed, want 1", n)
+	}
+	for _, hit := range e.Index().Search("secret", 0) {
+		if hit.Name != indexKey(plain) {
+			t.Errorf("indexed %s", hit.Name)
+		}
+	}
+	if indexed(ConsoleWriter{}) {
+		t.Error("console output is indexed")
+	}
+}
+
+func TestDryRunReturnsThePlan(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in.txt"), filepath.Join(dir, "out.txt")
+	os.WriteFile(in, []byte("b\na\n"), 0o644)
+	e := NewProcessingEngine()
+	e.SetObservers()
+	e.RegisterReader("file", FileReader{})
+	e.RegisterWriter("file", FileWriter{})
+
+	spec := &PipelineSpec{Source: in, Transformers: []TransformerStep{{Name: "sort-lines"}}, Destination: out}
+	plan, err := e.RunPipeline(context.Background(), spec, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.ReaderName != "file" || plan.WriterName != "file" || !strings.Contains(plan.String(), "sort-lines") {
+		t.Errorf("plan:\n%s", plan)
+	}
+	if _, err := os.Stat(out); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("dry run wrote %s: %v", out, err)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	s := newTestServer(t)
+	s.MaxDocuments = 2
+	s.MaxJobs = 1
+
+	serve(s, "POST", "/v1/documents", "one")
+	serve(s, "POST", "/v1/documents", "two")
+	if rec := serve(s, "POST", "/v1/documents", "three"); rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("third upload: status %d, want 507", rec.Code)
+	}
+	if rec := serve(s, "DELETE", "/v1/documents/doc-2", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d, want 204", rec.Code)
+	}
+
+	// Hold the only worker slot so the job stays queued
+	s.slots <- struct{}{}
+	if rec := serve(s, "POST", "/v1/jobs", `{"source": "docs://doc-1"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("first job: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, "POST", "/v1/jobs", `{"source": "docs://doc-1"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("job over the limit: status %d, want 503", rec.Code)
+	}
+	<-s.slots
+
+	// Once it finishes, it makes room for the next
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var jobs []Job
+		json.Unmarshal(serve(s, "GET", "/v1/jobs", "").Body.Bytes(), &jobs)
+		if len(jobs) == 1 && jobs[0].Status != JobQueued && jobs[0].Status != JobRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec := serve(s, "POST", "/v1/jobs", `{"source": "docs://doc-1"}`); rec.Code != http.StatusAccepted {
+		t.Errorf("job after the first finished: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCLIPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.txt")
+	sealed := filepath.Join(dir, "sealed.enc")
+	keyFile := filepath.Join(dir, "key")
+	os.WriteFile(plain, []byte("secret notes\n"), 0o644)
+	os.WriteFile(keyFile, []byte("from-file\r\nignored\n"), 0o600)
+
+	var out, errOut bytes.Buffer
+	cli := CLI{Stdin: strings.NewReader(""), Stdout: &out, Stderr: &errOut}
+	if code := cli.Run([]string{"encrypt", "-key", "x", plain}); code != ExitUsage {
+		t.Errorf("-key: exit %d, want %d", code, ExitUsage)
+	}
+	if code := cli.Run([]string{"encrypt", plain}); code != ExitUsage {
+		t.Errorf("no passphrase: exit %d, want %d", code, ExitUsage)
+	}
+	if code := cli.Run([]string{"encrypt", "-key-file", keyFile, "-o", sealed, plain}); code != ExitOK {
+		t.Fatalf("encrypt: exit %d: %s", code, errOut.String())
+	}
+
+	cli.Getenv = func(key string) string {
+		if key == "DOCPROC_KEY" {
+			return "from-file"
+		}
+		return ""
+	}
+	out.Reset()
+	if code := cli.Run([]string{"decrypt", sealed}); code != ExitOK || out.String() != "secret notes\n" {
+		t.Errorf("decrypt with DOCPROC_KEY: exit %d, output %q", code, out.String())
+	}
+}
+
+func TestCLIRefusesInputsWithOneOutputName(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"a", "b", "out"} {
+		os.Mkdir(filepath.Join(dir, sub), 0o755)
+	}
+	first, second := filepath.Join(dir, "a", "x.txt"), filepath.Join(dir, "b", "x.txt")
+	os.WriteFile(first, []byte("first\n"), 0o644)
+	os.WriteFile(second, []byte("second\n"), 0o644)
+	other := filepath.Join(dir, "b", "y.txt")
+	os.WriteFile(other, []byte("other\n"), 0o644)
+
+	var out, errOut bytes.Buffer
+	cli := CLI{Stdin: strings.NewReader(""), Stdout: &out, Stderr: &errOut}
+	outDir := filepath.Join(dir, "out")
+	if code := cli.Run([]string{"run", "-o", outDir, other, first, second}); code != ExitUsage {
+		t.Errorf("exit %d, want %d", code, ExitUsage)
+	}
+	if !strings.Contains(errOut.String(), "would both be written to") {
+		t.Errorf("stderr %q does not name the clash", errOut.String())
+	}
+	if entries, _ := os.ReadDir(outDir); len(entries) != 0 {
+		t.Errorf("%d files written before the clash was found", len(entries))
+	}
+
+	// Different names are fine, and so is stdout
+	if code := cli.Run([]string{"run", "-o", outDir, first, other}); code != ExitOK {
+		t.Errorf("distinct names: exit %d: %s", code, errOut.String())
+	}
+	if code := cli.Run([]string{"run", first, second}); code != ExitOK || out.String() != "first\nsecond\n" {
+		t.Errorf("to stdout: exit %d, output %q", code, out.String())
+	}
+}
+
+func TestCLIReadsStdinOnce(t *testing.T) {
+	var out, errOut bytes.Buffer
+	cli := CLI{Stdin: strings.NewReader("once\n"), Stdout: &out, Stderr: &errOut}
+	if code := cli.Run([]string{"run", "-", "-"}); code != ExitUsage {
+		t.Errorf("exit %d, want %d", code, ExitUsage)
+	}
+	if code := cli.Run([]string{"run", "-"}); code != ExitOK || out.String() != "once\n" {
+		t.Errorf("single -: exit %d, output %q", code, out.String())
+	}
+}
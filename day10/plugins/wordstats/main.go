@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// DAY 10: INTERFACES IN GO
+// Sample External Plugin for the Document Processing Challenge
+// ============================================================================
+//
+// This program is a transformer plugin that runs in its own process. The
+// engine in day10/06_challenge.go starts it and talks to it over
+// stdin/stdout with newline-delimited JSON-RPC 2.0:
+//
+//   -> {"jsonrpc":"2.0","id":1,"method":"handshake","params":{"protocol":2}}
+//   <- {"jsonrpc":"2.0","id":1,"result":{"name":"WordStats","version":"0.1.0","protocol":2}}
+//
+// Methods:
+//   handshake          name, version and protocol version
+//   list_transformers  the transformers and their params
+//   transform          apply one transformer to one document
+//   shutdown           exit after answering
+//
+// Requests may be pipelined: each one is handled on its own goroutine
+// and answered with the same id, in whatever order they finish.
+//
+// Long document content is streamed both ways: "chunk" notifications
+//
+//   {"jsonrpc":"2.0","method":"chunk","params":{"id":7,"data":"..."}}
+//
+// carry the content of call 7 ahead of its request or response, whose
+// document holds only the last piece.
+//
+// The tests exercise crash isolation and timeouts with a separate
+// plugin, day10/testdata/faultyplugin.
+//
+// ============================================================================
+
+const protocolVersion = 2
+
+// chunkSize is the most content one chunk carries, in bytes
+const chunkSize = 64 << 10
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      int64           `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type response struct {
+	JSONRPC string    `json:"jsonrpc"`
+	ID      int64     `json:"id"`
+	Result  any       `json:"result,omitempty"`
+	Error   *rpcError `json:"error,omitempty"`
+}
+
+type notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  chunk  `json:"params"`
+}
+
+// chunk is one piece of the content of the call with the given id
+type chunk struct {
+	ID   int64  `json:"id"`
+	Data string `json:"data"`
+}
+
+// document mirrors the engine's wire format; metadata is passed through
+// untouched apart from the fields a transformer changes
+type document struct {
+	Content  string         `json:"content"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+type transformParams struct {
+	Transformer string         `json:"transformer"`
+	Params      map[string]any `json:"params"`
+	Document    document       `json:"document"`
+}
+
+type transformResult struct {
+	Document document `json:"document"`
+}
+
+type paramSpec struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Default     any    `json:"default,omitempty"`
+	Description string `json:"description"`
+}
+
+type transformerInfo struct {
+	Name   string      `json:"name"`
+	Params []paramSpec `json:"params,omitempty"`
+}
+
+var transformers = []transformerInfo{
+	{Name: "word-stats"},
+	{Name: "title-case"},
+}
+
+func wordStats(content string) string {
+	lines := strings.Count(content, "\n") + 1
+	words := len(strings.Fields(content))
+	return fmt.Sprintf("%s\n---\nlines: %d, words: %d, characters: %d",
+		content, lines, words, len([]rune(content)))
+}
+
+func titleCase(content string) string {
+	runes := []rune(content)
+	start := true
+	for i, r := range runes {
+		if unicode.IsLetter(r) {
+			if start {
+				runes[i] = unicode.ToUpper(r)
+			}
+			start = false
+		} else {
+			start = unicode.IsSpace(r)
+		}
+	}
+	return string(runes)
+}
+
+func transform(p transformParams) (document, error) {
+	doc := p.Document
+	switch p.Transformer {
+	case "word-stats":
+		doc.Content = wordStats(doc.Content)
+	case "title-case":
+		doc.Content = titleCase(doc.Content)
+	default:
+		return doc, fmt.Errorf("unknown transformer: %s", p.Transformer)
+	}
+	return doc, nil
+}
+
+// split cuts s into pieces of at most size bytes, never inside a UTF-8
+// sequence, and returns all but the last piece and the last one
+func split(s string, size int) ([]string, string) {
+	var chunks []string
+	for len(s) > size {
+		n := size
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		if n == 0 {
+			n = size
+		}
+		chunks = append(chunks, s[:n])
+		s = s[n:]
+	}
+	return chunks, s
+}
+
+// handle answers one request; streamed is the content that came ahead
+// of it in chunks
+func handle(req request, streamed string) response {
+	resp := response{JSONRPC: "2.0", ID: req.ID}
+	switch req.Method {
+	case "handshake":
+		resp.Result = map[string]any{"name": "WordStats", "version": "0.1.0", "protocol": protocolVersion}
+	case "list_transformers":
+		resp.Result = transformers
+	case "transform":
+		var p transformParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			resp.Error = &rpcError{Code: -32602, Message: err.Error()}
+			break
+		}
+		p.Document.Content = streamed + p.Document.Content
+		doc, err := transform(p)
+		if err != nil {
+			resp.Error = &rpcError{Code: 1, Message: err.Error()}
+			break
+		}
+		resp.Result = transformResult{Document: doc}
+	case "shutdown":
+		resp.Result = true
+	default:
+		resp.Error = &rpcError{Code: -32601, Message: "method not found: " + req.Method}
+	}
+	return resp
+}
+
+func main() {
+	var writeMu sync.Mutex
+	out := json.NewEncoder(os.Stdout)
+	write := func(msg any) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		out.Encode(msg)
+	}
+	// send streams a transformed document's content ahead of the
+	// response, one chunk per message, so other answers interleave
+	send := func(resp response) {
+		if result, ok := resp.Result.(transformResult); ok {
+			var chunks []string
+			chunks, result.Document.Content = split(result.Document.Content, chunkSize)
+			for _, data := range chunks {
+				write(notification{JSONRPC: "2.0", Method: "chunk", Params: chunk{ID: resp.ID, Data: data}})
+			}
+			resp.Result = result
+		}
+		write(resp)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	streamed := make(map[int64]*strings.Builder) // content received ahead of requests, by id
+	var wg sync.WaitGroup
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			send(response{JSONRPC: "2.0", Error: &rpcError{Code: -32700, Message: err.Error()}})
+			continue
+		}
+		if req.Method == "chunk" {
+			var c chunk
+			if err := json.Unmarshal(req.Params, &c); err != nil {
+				continue
+			}
+			if streamed[c.ID] == nil {
+				streamed[c.ID] = new(strings.Builder)
+			}
+			streamed[c.ID].WriteString(c.Data)
+			continue
+		}
+		var content string
+		if b, ok := streamed[req.ID]; ok {
+			content = b.String()
+			delete(streamed, req.ID)
+		}
+		if req.Method == "shutdown" {
+			wg.Wait()
+			send(handle(req, content))
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(handle(req, content))
+		}()
+	}
+	wg.Wait()
+}
+
+// ============================================================================
+// TO RUN:
+//   The engine builds and starts this plugin itself:
+//     go run day10/06_challenge.go
+//
+//   To talk to it by hand:
+//     echo '{"jsonrpc":"2.0","id":1,"method":"list_transformers"}' | \
+//       go run day10/plugins/wordstats/main.go
+// ============================================================================
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// Test-only External Plugin
+// ============================================================================
+//
+// A plugin that misbehaves on request, used by day10/06_challenge_test.go
+// to exercise crash isolation, restarts and timeouts. It speaks the same
+// newline-delimited JSON-RPC 2.0 as day10/plugins/wordstats:
+//
+//   echo   returns the document unchanged
+//   crash  exits the process without answering
+//   sleep  answers after params.ms milliseconds
+//   stall  answers, then never reads another request
+//   blank  returns the content with empty metadata
+//
+// Living under testdata keeps it out of the go tool's package patterns.
+//
+// ============================================================================
+
+const protocolVersion = 2
+
+// chunkSize is the most content one chunk carries, in bytes
+const chunkSize = 64 << 10
+
+type request struct {
+	ID     int64           `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type response struct {
+	JSONRPC string    `json:"jsonrpc"`
+	ID      int64     `json:"id"`
+	Result  any       `json:"result,omitempty"`
+	Error   *rpcError `json:"error,omitempty"`
+}
+
+type notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  chunk  `json:"params"`
+}
+
+// chunk is one piece of the content of the call with the given id
+type chunk struct {
+	ID   int64  `json:"id"`
+	Data string `json:"data"`
+}
+
+type document struct {
+	Content  string         `json:"content"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+type transformParams struct {
+	Transformer string         `json:"transformer"`
+	Params      map[string]any `json:"params"`
+	Document    document       `json:"document"`
+}
+
+type transformResult struct {
+	Document document `json:"document"`
+}
+
+// split cuts s into pieces of at most size bytes, never inside a UTF-8
+// sequence, and returns all but the last piece and the last one
+func split(s string, size int) ([]string, string) {
+	var chunks []string
+	for len(s) > size {
+		n := size
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		if n == 0 {
+			n = size
+		}
+		chunks = append(chunks, s[:n])
+		s = s[n:]
+	}
+	return chunks, s
+}
+
+// transformer names the transformer a transform request asks for
+func transformer(req request) string {
+	var p transformParams
+	json.Unmarshal(req.Params, &p)
+	return p.Transformer
+}
+
+// handle answers one request; streamed is the content that came ahead
+// of it in chunks
+func handle(req request, streamed string) response {
+	resp := response{JSONRPC: "2.0", ID: req.ID}
+	switch req.Method {
+	case "handshake":
+		resp.Result = map[string]any{"name": "Faulty", "version": "0.0.1", "protocol": protocolVersion}
+	case "list_transformers":
+		resp.Result = []map[string]any{{"name": "echo"}, {"name": "crash"}, {"name": "sleep"}, {"name": "stall"}, {"name": "blank"}}
+	case "transform":
+		var p transformParams
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			resp.Error = &rpcError{Code: -32602, Message: err.Error()}
+			break
+		}
+		switch p.Transformer {
+		case "crash":
+			fmt.Fprintln(os.Stderr, "faultyplugin: crashing on purpose")
+			os.Exit(3)
+		case "sleep":
+			ms, _ := p.Params["ms"].(float64)
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+		case "blank":
+			p.Document.Metadata = nil
+		}
+		p.Document.Content = streamed + p.Document.Content
+		resp.Result = transformResult{Document: p.Document}
+	case "shutdown":
+		resp.Result = true
+	default:
+		resp.Error = &rpcError{Code: -32601, Message: "method not found: " + req.Method}
+	}
+	return resp
+}
+
+func main() {
+	var writeMu sync.Mutex
+	out := json.NewEncoder(os.Stdout)
+	write := func(msg any) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		out.Encode(msg)
+	}
+	send := func(resp response) {
+		if result, ok := resp.Result.(transformResult); ok {
+			var chunks []string
+			chunks, result.Document.Content = split(result.Document.Content, chunkSize)
+			for _, data := range chunks {
+				write(notification{JSONRPC: "2.0", Method: "chunk", Params: chunk{ID: resp.ID, Data: data}})
+			}
+			resp.Result = result
+		}
+		write(resp)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	streamed := make(map[int64]*strings.Builder) // by id
+	var wg sync.WaitGroup
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			continue
+		}
+		if req.Method == "chunk" {
+			var c chunk
+			if err := json.Unmarshal(req.Params, &c); err != nil {
+				continue
+			}
+			if streamed[c.ID] == nil {
+				streamed[c.ID] = new(strings.Builder)
+			}
+			streamed[c.ID].WriteString(c.Data)
+			continue
+		}
+		var content string
+		if b, ok := streamed[req.ID]; ok {
+			content = b.String()
+			delete(streamed, req.ID)
+		}
+		if req.Method == "shutdown" {
+			wg.Wait()
+			send(handle(req, content))
+			return
+		}
+		if req.Method == "transform" && transformer(req) == "stall" {
+			// Stdin fills up behind this; sleeping rather than blocking
+			// for good keeps the runtime from calling it a deadlock
+			send(handle(req, content))
+			time.Sleep(time.Hour)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(handle(req, content))
+		}()
+	}
+	wg.Wait()
+}
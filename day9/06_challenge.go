@@ -12,8 +12,23 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,39 +36,312 @@ import (
 // Value Objects (validated on creation)
 // ========================================
 
-// Money represents a monetary value
+// Currency is an ISO 4217 currency
+type Currency struct {
+	Code       string
+	Name       string
+	MinorUnits int // digits after the decimal point: 2 for USD, 0 for JPY
+}
+
+// currencies is the part of the ISO 4217 table the shop trades in
+var currencies = map[string]Currency{
+	"AUD": {"AUD", "Australian Dollar", 2},
+	"BHD": {"BHD", "Bahraini Dinar", 3},
+	"BRL": {"BRL", "Brazilian Real", 2},
+	"CAD": {"CAD", "Canadian Dollar", 2},
+	"CHF": {"CHF", "Swiss Franc", 2},
+	"CLP": {"CLP", "Chilean Peso", 0},
+	"CNY": {"CNY", "Yuan Renminbi", 2},
+	"EUR": {"EUR", "Euro", 2},
+	"GBP": {"GBP", "Pound Sterling", 2},
+	"HKD": {"HKD", "Hong Kong Dollar", 2},
+	"INR": {"INR", "Indian Rupee", 2},
+	"ISK": {"ISK", "Iceland Krona", 0},
+	"JOD": {"JOD", "Jordanian Dinar", 3},
+	"JPY": {"JPY", "Yen", 0},
+	"KRW": {"KRW", "Won", 0},
+	"KWD": {"KWD", "Kuwaiti Dinar", 3},
+	"MXN": {"MXN", "Mexican Peso", 2},
+	"NOK": {"NOK", "Norwegian Krone", 2},
+	"NZD": {"NZD", "New Zealand Dollar", 2},
+	"OMR": {"OMR", "Rial Omani", 3},
+	"SEK": {"SEK", "Swedish Krona", 2},
+	"SGD": {"SGD", "Singapore Dollar", 2},
+	"USD": {"USD", "US Dollar", 2},
+	"ZAR": {"ZAR", "Rand", 2},
+}
+
+// LookupCurrency finds a currency by its 3-letter code
+func LookupCurrency(code string) (Currency, error) {
+	if len(code) != 3 {
+		return Currency{}, fmt.Errorf("currency must be 3-letter code")
+	}
+	c, ok := currencies[strings.ToUpper(code)]
+	if !ok {
+		return Currency{}, fmt.Errorf("unknown currency %q", code)
+	}
+	return c, nil
+}
+
+// scale is the number of minor units in one major unit
+func (c Currency) scale() int64 {
+	s := int64(1)
+	for range c.MinorUnits {
+		s *= 10
+	}
+	return s
+}
+
+// RoundingMode decides what happens to fractions of a minor unit
+type RoundingMode int
+
+const (
+	RoundHalfUp   RoundingMode = iota // ties away from zero
+	RoundHalfEven                     // ties to the even neighbour (banker's rounding)
+	RoundDown                         // towards zero
+	RoundUp                           // away from zero
+)
+
+// roundQuo divides num by a positive den, rounding as mode says
+func roundQuo(num, den *big.Int, mode RoundingMode) *big.Int {
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		return q
+	}
+	step := big.NewInt(int64(num.Sign()))
+	half := new(big.Int).Abs(rem)
+	half.Lsh(half, 1)
+	cmp := half.Cmp(den)
+	switch mode {
+	case RoundUp:
+		q.Add(q, step)
+	case RoundHalfUp:
+		if cmp >= 0 {
+			q.Add(q, step)
+		}
+	case RoundHalfEven:
+		if cmp > 0 || (cmp == 0 && q.Bit(0) == 1) {
+			q.Add(q, step)
+		}
+	}
+	return q
+}
+
+// toMinor rounds an amount in major units to c's minor units
+func toMinor(amount *big.Rat, c Currency, mode RoundingMode) (int64, error) {
+	num := new(big.Int).Mul(amount.Num(), big.NewInt(c.scale()))
+	minor := roundQuo(num, amount.Denom(), mode)
+	if !minor.IsInt64() {
+		return 0, errMoneyRange
+	}
+	return minor.Int64(), nil
+}
+
+var decimalPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// Money is an exact amount in a currency's minor units (cents, yen, fils)
 type Money struct {
-	cents    int64
-	currency string
+	minor    int64
+	currency Currency
 }
 
+// NewMoney converts a float, rounding half up to the currency's minor
+// units. The float is read through its shortest decimal form, so 1.005
+// is 1.01 rather than whatever 1.005*100 happens to be. Use ParseMoney
+// for amounts that arrive as text.
 func NewMoney(amount float64, currency string) (*Money, error) {
 	if amount < 0 {
 		return nil, fmt.Errorf("amount cannot be negative")
 	}
-	if len(currency) != 3 {
-		return nil, fmt.Errorf("currency must be 3-letter code")
+	if math.IsInf(amount, 0) || math.IsNaN(amount) {
+		return nil, fmt.Errorf("amount must be a finite number")
 	}
-	return &Money{
-		cents:    int64(amount*100 + 0.5),
-		currency: strings.ToUpper(currency),
-	}, nil
+	c, err := LookupCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	exact, _ := new(big.Rat).SetString(strconv.FormatFloat(amount, 'f', -1, 64))
+	minor, err := toMinor(exact, c, RoundHalfUp)
+	if err != nil {
+		return nil, err
+	}
+	return &Money{minor: minor, currency: c}, nil
+}
+
+// ParseMoney reads a decimal amount such as "19.99" exactly. Digits
+// beyond the currency's minor units are an error, not rounded away.
+func ParseMoney(amount, currency string) (*Money, error) {
+	c, err := LookupCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	amount = strings.TrimSpace(amount)
+	if !decimalPattern.MatchString(amount) {
+		return nil, fmt.Errorf("invalid amount %q", amount)
+	}
+	if _, frac, ok := strings.Cut(amount, "."); ok && len(frac) > c.MinorUnits {
+		if c.MinorUnits == 0 {
+			return nil, fmt.Errorf("invalid amount %q: %s has no minor units", amount, c.Code)
+		}
+		return nil, fmt.Errorf("invalid amount %q: %s has %d decimal places", amount, c.Code, c.MinorUnits)
+	}
+	exact, _ := new(big.Rat).SetString(amount)
+	minor, err := toMinor(exact, c, RoundDown)
+	if err != nil {
+		return nil, err
+	}
+	return &Money{minor: minor, currency: c}, nil
+}
+
+// NewMoneyFromMinor builds an amount from minor units (cents for USD)
+func NewMoneyFromMinor(minor int64, currency string) (*Money, error) {
+	if minor < 0 {
+		return nil, fmt.Errorf("amount cannot be negative")
+	}
+	c, err := LookupCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	return &Money{minor: minor, currency: c}, nil
+}
+
+func (m *Money) Amount() float64  { return float64(m.minor) / float64(m.currency.scale()) }
+func (m *Money) Currency() string { return m.currency.Code }
+func (m *Money) Minor() int64     { return m.minor }
+
+// Cents is Minor under its historical name; it is yen for JPY
+func (m *Money) Cents() int64 { return m.minor }
+
+func (m *Money) String() string { return m.Decimal() + " " + m.currency.Code }
+
+// Decimal formats the amount without its currency, e.g. "19.99"
+func (m *Money) Decimal() string {
+	if m.currency.MinorUnits == 0 {
+		return strconv.FormatInt(m.minor, 10)
+	}
+	scale := m.currency.scale()
+	return fmt.Sprintf("%d.%0*d", m.minor/scale, m.currency.MinorUnits, m.minor%scale)
+}
+
+// MarshalJSON writes {"amount": "19.99", "currency": "USD"}, keeping the
+// amount a string so it is never read back as a float
+func (m *Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.Decimal(), m.currency.Code})
+}
+
+// UnmarshalJSON reads what MarshalJSON writes, exactly
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	parsed, err := ParseMoney(v.Amount, v.Currency)
+	if err != nil {
+		return err
+	}
+	*m = *parsed
+	return nil
+}
+
+// CurrencyMismatchError is returned when combining different currencies
+type CurrencyMismatchError struct {
+	Left, Right string
+}
+
+func (e *CurrencyMismatchError) Error() string {
+	return fmt.Sprintf("cannot add different currencies: %s and %s", e.Left, e.Right)
 }
 
-func (m *Money) Amount() float64   { return float64(m.cents) / 100 }
-func (m *Money) Currency() string  { return m.currency }
-func (m *Money) Cents() int64      { return m.cents }
-func (m *Money) String() string    { return fmt.Sprintf("%.2f %s", m.Amount(), m.currency) }
+// errMoneyRange is returned when an amount does not fit in int64 minor
+// units
+var errMoneyRange = errors.New("amount out of range")
 
 func (m *Money) Add(other *Money) (*Money, error) {
-	if m.currency != other.currency {
-		return nil, fmt.Errorf("cannot add different currencies")
+	if m.currency.Code != other.currency.Code {
+		return nil, &CurrencyMismatchError{Left: m.currency.Code, Right: other.currency.Code}
 	}
-	return &Money{cents: m.cents + other.cents, currency: m.currency}, nil
+	if other.minor > math.MaxInt64-m.minor {
+		return nil, errMoneyRange
+	}
+	return &Money{minor: m.minor + other.minor, currency: m.currency}, nil
+}
+
+// Subtract fails rather than go below zero
+func (m *Money) Subtract(other *Money) (*Money, error) {
+	if m.currency.Code != other.currency.Code {
+		return nil, &CurrencyMismatchError{Left: m.currency.Code, Right: other.currency.Code}
+	}
+	if other.minor > m.minor {
+		return nil, fmt.Errorf("cannot subtract %s from %s", other, m)
+	}
+	return &Money{minor: m.minor - other.minor, currency: m.currency}, nil
+}
+
+// Multiply scales m by a quantity, failing rather than overflow
+func (m *Money) Multiply(qty int) (*Money, error) {
+	if qty < 0 {
+		return nil, fmt.Errorf("quantity cannot be negative")
+	}
+	if qty > 0 && m.minor > math.MaxInt64/int64(qty) {
+		return nil, errMoneyRange
+	}
+	return &Money{minor: m.minor * int64(qty), currency: m.currency}, nil
+}
+
+// MulRat scales m by an exact factor such as a tax rate, rounding to
+// minor units. It fails rather than overflow.
+func (m *Money) MulRat(factor *big.Rat, mode RoundingMode) (*Money, error) {
+	num := new(big.Int).Mul(big.NewInt(m.minor), factor.Num())
+	minor := roundQuo(num, factor.Denom(), mode)
+	if !minor.IsInt64() {
+		return nil, errMoneyRange
+	}
+	return &Money{minor: minor.Int64(), currency: m.currency}, nil
 }
 
-func (m *Money) Multiply(qty int) *Money {
-	return &Money{cents: m.cents * int64(qty), currency: m.currency}
+// Allocate splits m in proportion to ratios without losing or inventing
+// a minor unit: every share gets its rounded-down portion, then the
+// leftover units go one each to the shares with the largest remainders,
+// earlier shares winning ties
+func (m *Money) Allocate(ratios ...int) ([]*Money, error) {
+	var sum int64
+	for _, r := range ratios {
+		if r < 0 {
+			return nil, fmt.Errorf("ratios cannot be negative")
+		}
+		sum += int64(r)
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("ratios must add up to more than zero")
+	}
+
+	total := big.NewInt(sum)
+	shares := make([]*Money, len(ratios))
+	remainders := make([]*big.Int, len(ratios))
+	leftover := m.minor
+	for i, r := range ratios {
+		portion := new(big.Int).Mul(big.NewInt(m.minor), big.NewInt(int64(r)))
+		quo, rem := portion.QuoRem(portion, total, new(big.Int))
+		shares[i] = &Money{minor: quo.Int64(), currency: m.currency}
+		remainders[i] = rem
+		leftover -= quo.Int64()
+	}
+
+	order := make([]int, len(ratios))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]].Cmp(remainders[order[b]]) > 0 })
+	for _, i := range order[:leftover] {
+		shares[i].minor++
+	}
+	return shares, nil
 }
 
 // Email is a validated email address
@@ -71,6 +359,142 @@ func NewEmail(addr string) (*Email, error) {
 
 func (e *Email) String() string { return e.address }
 
+// ========================================
+// Exchange Rates (pluggable providers)
+// ========================================
+
+// ExchangeRateProvider supplies the factor that turns an amount in one
+// currency into the other
+type ExchangeRateProvider interface {
+	Rate(from, to string) (*big.Rat, error)
+}
+
+// StaticRates is an in-memory rate table. Inverse rates are derived, and
+// a pair with no rate of its own is crossed through a currency both
+// sides are quoted against.
+type StaticRates struct {
+	mu    sync.RWMutex
+	rates map[[2]string]*big.Rat
+}
+
+func NewStaticRates() *StaticRates {
+	return &StaticRates{rates: make(map[[2]string]*big.Rat)}
+}
+
+// Set records that one unit of from buys rate units of to
+func (s *StaticRates) Set(from, to, rate string) error {
+	f, err := LookupCurrency(from)
+	if err != nil {
+		return err
+	}
+	t, err := LookupCurrency(to)
+	if err != nil {
+		return err
+	}
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(rate))
+	if !ok || r.Sign() <= 0 {
+		return fmt.Errorf("invalid rate %q for %s/%s", rate, f.Code, t.Code)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rates[[2]string{f.Code, t.Code}] = r
+	return nil
+}
+
+// lookup finds a direct or inverse rate; s.mu must be held
+func (s *StaticRates) lookup(from, to string) (*big.Rat, bool) {
+	if r, ok := s.rates[[2]string{from, to}]; ok {
+		return r, true
+	}
+	if r, ok := s.rates[[2]string{to, from}]; ok {
+		return new(big.Rat).Inv(r), true
+	}
+	return nil, false
+}
+
+func (s *StaticRates) Rate(from, to string) (*big.Rat, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	if from == to {
+		return big.NewRat(1, 1), nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if r, ok := s.lookup(from, to); ok {
+		return r, nil
+	}
+
+	// Cross through the first quoted currency, in code order, that
+	// links both sides
+	var via []string
+	for pair := range s.rates {
+		via = append(via, pair[0], pair[1])
+	}
+	sort.Strings(via)
+	for _, c := range via {
+		left, ok := s.lookup(from, c)
+		if !ok {
+			continue
+		}
+		if right, ok := s.lookup(c, to); ok {
+			return new(big.Rat).Mul(left, right), nil
+		}
+	}
+	return nil, fmt.Errorf("no exchange rate from %s to %s", from, to)
+}
+
+// LoadRatesCSV reads "from,to,rate" rows such as "USD,EUR,0.92". A
+// header row and lines starting with # are skipped.
+func LoadRatesCSV(r io.Reader) (*StaticRates, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	rates := NewStaticRates()
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rates, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read rates: %w", err)
+		}
+		if line == 1 && strings.EqualFold(record[0], "from") {
+			continue
+		}
+		if err := rates.Set(record[0], record[1], record[2]); err != nil {
+			return nil, fmt.Errorf("read rates: line %d: %w", line, err)
+		}
+	}
+}
+
+// Converter converts Money between currencies
+type Converter struct {
+	Rates    ExchangeRateProvider
+	Rounding RoundingMode // applied to the converted amount's minor units
+}
+
+func (c *Converter) Convert(m *Money, to string) (*Money, error) {
+	target, err := LookupCurrency(to)
+	if err != nil {
+		return nil, err
+	}
+	if target.Code == m.currency.Code {
+		return m, nil
+	}
+	rate, err := c.Rates.Rate(m.currency.Code, target.Code)
+	if err != nil {
+		return nil, fmt.Errorf("convert %s to %s: %w", m, target.Code, err)
+	}
+	amount := new(big.Rat).SetFrac(big.NewInt(m.minor), big.NewInt(m.currency.scale()))
+	minor, err := toMinor(amount.Mul(amount, rate), target, c.Rounding)
+	if err != nil {
+		return nil, fmt.Errorf("convert %s to %s: %w", m, target.Code, err)
+	}
+	return &Money{minor: minor, currency: target}, nil
+}
+
+var _ ExchangeRateProvider = (*StaticRates)(nil)
+
 // ========================================
 // Domain Objects (encapsulated)
 // ========================================
@@ -97,6 +521,9 @@ func NewAddress(street, city, state, zipCode, country string) (*Address, error)
 	}, nil
 }
 
+func (a *Address) Country() string { return a.country }
+func (a *Address) State() string   { return a.state }
+
 func (a *Address) String() string {
 	return fmt.Sprintf("%s, %s, %s %s, %s", a.street, a.city, a.state, a.zipCode, a.country)
 }
@@ -142,7 +569,15 @@ type Product struct {
 	name        string
 	description string
 	price       *Money
-	inStock     int
+	weightGrams int
+
+	mu       sync.Mutex // guards the stock counts below
+	inStock  int        // units on hand, reserved ones included
+	reserved int        // units held for orders not yet confirmed
+
+	// Inventories that have held the product's stock; they expire
+	// lapsed holds before the counts are read
+	inventories []*Inventory
 }
 
 func NewProduct(sku, name string, price *Money) *Product {
@@ -157,234 +592,2831 @@ func NewProduct(sku, name string, price *Money) *Product {
 func (p *Product) SKU() string         { return p.sku }
 func (p *Product) Name() string        { return p.name }
 func (p *Product) Price() *Money       { return p.price }
-func (p *Product) InStock() int        { return p.inStock }
 func (p *Product) Description() string { return p.description }
 
 func (p *Product) SetDescription(desc string) { p.description = desc }
-func (p *Product) AddStock(qty int)           { p.inStock += qty }
 
+// WeightGrams is the shipping weight of one unit
+func (p *Product) WeightGrams() int         { return p.weightGrams }
+func (p *Product) SetWeightGrams(grams int) { p.weightGrams = grams }
+
+// InStock is the number of units on hand, reserved ones included
+func (p *Product) InStock() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inStock
+}
+
+// Reserved is the number of units held for pending orders
+func (p *Product) Reserved() int {
+	p.sweep()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reserved
+}
+
+// Available is what new orders can still reserve
+func (p *Product) Available() int {
+	p.sweep()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inStock - p.reserved
+}
+
+func (p *Product) AddStock(qty int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inStock += qty
+}
+
+// RemoveStock takes units off the shelf; reserved units can't be removed
 func (p *Product) RemoveStock(qty int) error {
-	if qty > p.inStock {
-		return fmt.Errorf("insufficient stock: have %d, need %d", p.inStock, qty)
+	p.sweep()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if available := p.inStock - p.reserved; qty > available {
+		return fmt.Errorf("insufficient stock: have %d available, need %d", available, qty)
 	}
 	p.inStock -= qty
 	return nil
 }
 
+// sweep releases lapsed holds on the product's stock. It must be called
+// without p.mu held, as inventories lock their products.
+func (p *Product) sweep() {
+	p.mu.Lock()
+	inventories := slices.Clone(p.inventories)
+	p.mu.Unlock()
+	for _, inv := range inventories {
+		inv.ExpireReservations()
+	}
+}
+
 // ========================================
-// Order (composition + builder)
+// Inventory (stock reservations)
 // ========================================
 
-// OrderItem composes Product with quantity
-type OrderItem struct {
-	product  *Product
-	quantity int
-	subtotal *Money
+// InsufficientStockError reports one line item that cannot be filled
+type InsufficientStockError struct {
+	SKU       string
+	Name      string
+	Requested int
+	Available int
 }
 
-func NewOrderItem(product *Product, quantity int) (*OrderItem, error) {
-	if quantity <= 0 {
-		return nil, fmt.Errorf("quantity must be positive")
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("%s (%s): insufficient stock: requested %d, available %d",
+		e.SKU, e.Name, e.Requested, e.Available)
+}
+
+// ReservationError lists every line item of an order that is short
+type ReservationError struct {
+	OrderID   string
+	Shortages []*InsufficientStockError
+}
+
+func (e *ReservationError) Error() string {
+	lines := make([]string, len(e.Shortages))
+	for i, s := range e.Shortages {
+		lines[i] = s.Error()
 	}
-	return &OrderItem{
-		product:  product,
-		quantity: quantity,
-		subtotal: product.Price().Multiply(quantity),
-	}, nil
+	return fmt.Sprintf("cannot reserve stock for order %s: %s", e.OrderID, strings.Join(lines, "; "))
 }
 
-func (i *OrderItem) Product() *Product { return i.product }
-func (i *OrderItem) Quantity() int     { return i.quantity }
-func (i *OrderItem) Subtotal() *Money  { return i.subtotal }
+func (e *ReservationError) Unwrap() []error {
+	errs := make([]error, len(e.Shortages))
+	for i, s := range e.Shortages {
+		errs[i] = s
+	}
+	return errs
+}
 
-// OrderStatus represents order lifecycle
-type OrderStatus string
+// ErrReservationExpired is returned when confirming an order whose hold
+// on stock has lapsed
+var ErrReservationExpired = errors.New("stock reservation expired")
+
+// ReservationStatus tracks a reservation from hold to commit or release
+type ReservationStatus string
 
 const (
-	StatusPending    OrderStatus = "pending"
-	StatusConfirmed  OrderStatus = "confirmed"
-	StatusShipped    OrderStatus = "shipped"
-	StatusDelivered  OrderStatus = "delivered"
-	StatusCancelled  OrderStatus = "cancelled"
+	ReservationHeld      ReservationStatus = "held"
+	ReservationCommitted ReservationStatus = "committed"
+	ReservationReleased  ReservationStatus = "released"
+	ReservationExpired   ReservationStatus = "expired"
 )
 
-// Order composes multiple types
-type Order struct {
-	id              string
-	customer        *Customer
-	items           []*OrderItem
-	shippingAddress *Address
-	billingAddress  *Address
-	status          OrderStatus
-	total           *Money
-	createdAt       time.Time
-	updatedAt       time.Time
-	notes           string
+// ReservationLine is stock held for one product
+type ReservationLine struct {
+	Product  *Product
+	Quantity int
 }
 
-// Getters
-func (o *Order) ID() string              { return o.id }
-func (o *Order) Customer() *Customer     { return o.customer }
-func (o *Order) Status() OrderStatus     { return o.status }
-func (o *Order) Total() *Money           { return o.total }
-func (o *Order) CreatedAt() time.Time    { return o.createdAt }
-func (o *Order) Notes() string           { return o.notes }
-func (o *Order) ShippingAddress() *Address { return o.shippingAddress }
-
-func (o *Order) Items() []*OrderItem {
-	result := make([]*OrderItem, len(o.items))
-	copy(result, o.items)
-	return result
+// Reservation is the stock held for one order
+type Reservation struct {
+	orderID   string
+	lines     []ReservationLine
+	status    ReservationStatus
+	expiresAt time.Time
 }
 
-// Status transitions with validation
-func (o *Order) Confirm() error {
-	if o.status != StatusPending {
-		return fmt.Errorf("can only confirm pending orders")
-	}
-	o.status = StatusConfirmed
-	o.updatedAt = time.Now()
-	return nil
+func (r Reservation) OrderID() string           { return r.orderID }
+func (r Reservation) Status() ReservationStatus { return r.status }
+func (r Reservation) ExpiresAt() time.Time      { return r.expiresAt }
+
+// Inventory reserves stock for orders. A reservation is all-or-nothing:
+// every line is held, or none is. Held stock is committed (taken off
+// the shelf) when the order is confirmed and released when it is
+// cancelled or the hold expires. Products are locked in SKU order, so
+// concurrent orders for the same SKUs never oversell or deadlock.
+// Lapsed holds are released whenever the inventory is used or one of
+// its products' reserved or available counts is read.
+//
+// Only live reservations are kept: released ones are dropped at once,
+// expired ones a ttl later, committed ones when the order ships.
+type Inventory struct {
+	mu           sync.Mutex // guards everything below
+	ttl          time.Duration
+	reservations map[string]*Reservation
+
+	// Reservations in the order they were made, which with a fixed ttl
+	// is the order they expire in, so expiring never scans live holds
+	holds   []*Reservation
+	expired []*Reservation // dropped a ttl after expiring
 }
 
-func (o *Order) Ship() error {
-	if o.status != StatusConfirmed {
-		return fmt.Errorf("can only ship confirmed orders")
+// NewInventory creates an inventory whose holds last ttl
+func NewInventory(ttl time.Duration) *Inventory {
+	return &Inventory{
+		ttl:          ttl,
+		reservations: make(map[string]*Reservation),
 	}
-	o.status = StatusShipped
-	o.updatedAt = time.Now()
-	return nil
 }
 
-func (o *Order) Deliver() error {
-	if o.status != StatusShipped {
-		return fmt.Errorf("can only deliver shipped orders")
+// lockProducts locks the products of lines in SKU order and returns the
+// matching unlock. Reserve rejects two products with one SKU, so the
+// order is the same for every caller.
+func lockProducts(lines []ReservationLine) func() {
+	products := make([]*Product, len(lines))
+	for i, line := range lines {
+		products[i] = line.Product
 	}
-	o.status = StatusDelivered
-	o.updatedAt = time.Now()
-	return nil
-}
-
-func (o *Order) Cancel() error {
-	if o.status == StatusDelivered {
-		return fmt.Errorf("cannot cancel delivered orders")
+	sort.Slice(products, func(i, j int) bool { return products[i].sku < products[j].sku })
+	for _, p := range products {
+		p.mu.Lock()
 	}
-	if o.status == StatusCancelled {
-		return fmt.Errorf("order already cancelled")
+	return func() {
+		for _, p := range products {
+			p.mu.Unlock()
+		}
 	}
-	o.status = StatusCancelled
-	o.updatedAt = time.Now()
-	return nil
 }
 
-func (o *Order) String() string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("Order #%s\n", o.id))
-	sb.WriteString(fmt.Sprintf("Customer: %s (%s)\n", o.customer.Name(), o.customer.Email()))
-	sb.WriteString(fmt.Sprintf("Status: %s\n", o.status))
-	sb.WriteString("Items:\n")
-	for _, item := range o.items {
-		sb.WriteString(fmt.Sprintf("  - %s x%d = %s\n",
-			item.Product().Name(), item.Quantity(), item.Subtotal()))
+// Reserve holds stock for every item of an order, merging items for the
+// same product. If any line is short nothing is held and the error is a
+// *ReservationError naming each short line.
+func (inv *Inventory) Reserve(orderID string, items []*OrderItem) (Reservation, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.expireLocked(time.Now())
+	if r, ok := inv.reservations[orderID]; ok && r.status != ReservationReleased && r.status != ReservationExpired {
+		return Reservation{}, fmt.Errorf("order %s already has a %s reservation", orderID, r.status)
 	}
-	sb.WriteString(fmt.Sprintf("Total: %s\n", o.total))
-	sb.WriteString(fmt.Sprintf("Ship to: %s\n", o.shippingAddress))
-	if o.notes != "" {
-		sb.WriteString(fmt.Sprintf("Notes: %s\n", o.notes))
+	lines, err := reservationLines(orderID, items)
+	if err != nil {
+		return Reservation{}, err
 	}
-	return sb.String()
-}
 
-// ========================================
-// Order Builder
-// ========================================
+	unlock := lockProducts(lines)
+	defer unlock()
+	rerr := &ReservationError{OrderID: orderID}
+	for _, line := range lines {
+		p := line.Product
+		if available := p.inStock - p.reserved; line.Quantity > available {
+			rerr.Shortages = append(rerr.Shortages, &InsufficientStockError{
+				SKU: p.sku, Name: p.name, Requested: line.Quantity, Available: available,
+			})
+		}
+	}
+	if len(rerr.Shortages) > 0 {
+		return Reservation{}, rerr
+	}
+	for _, line := range lines {
+		line.Product.reserved += line.Quantity
+		if !slices.Contains(line.Product.inventories, inv) {
+			line.Product.inventories = append(line.Product.inventories, inv)
+		}
+	}
 
-type OrderBuilder struct {
-	order  Order
-	errors []string
+	r := &Reservation{
+		orderID:   orderID,
+		lines:     lines,
+		status:    ReservationHeld,
+		expiresAt: time.Now().Add(inv.ttl),
+	}
+	inv.reservations[orderID] = r
+	inv.holds = append(inv.holds, r)
+	return *r, nil
 }
 
-func NewOrderBuilder(id string) *OrderBuilder {
-	return &OrderBuilder{
-		order: Order{
-			id:        id,
-			items:     []*OrderItem{},
-			status:    StatusPending,
-			createdAt: time.Now(),
-			updatedAt: time.Now(),
-		},
+// reservationLines merges an order's items into one line per product
+func reservationLines(orderID string, items []*OrderItem) ([]ReservationLine, error) {
+	var lines []ReservationLine
+	index := make(map[string]int) // by SKU
+	for _, item := range items {
+		if i, ok := index[item.Product().SKU()]; ok {
+			if lines[i].Product != item.Product() {
+				return nil, fmt.Errorf("order %s has two different products with SKU %s", orderID, item.Product().SKU())
+			}
+			lines[i].Quantity += item.Quantity()
+			continue
+		}
+		index[item.Product().SKU()] = len(lines)
+		lines = append(lines, ReservationLine{Product: item.Product(), Quantity: item.Quantity()})
 	}
+	return lines, nil
 }
 
-func (b *OrderBuilder) Customer(c *Customer) *OrderBuilder {
-	if c == nil {
-		b.errors = append(b.errors, "customer is required")
+// adopt records stock an order committed before this inventory knew
+// about it, such as one read back from storage, so cancelling the
+// order still returns the stock to the shelf
+func (inv *Inventory) adopt(orderID string, items []*OrderItem) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if r, ok := inv.reservations[orderID]; ok && r.status != ReservationReleased && r.status != ReservationExpired {
+		return fmt.Errorf("order %s already has a %s reservation", orderID, r.status)
 	}
-	b.order.customer = c
-	return b
+	lines, err := reservationLines(orderID, items)
+	if err != nil {
+		return err
+	}
+	inv.reservations[orderID] = &Reservation{orderID: orderID, lines: lines, status: ReservationCommitted}
+	return nil
 }
 
-func (b *OrderBuilder) AddItem(product *Product, quantity int) *OrderBuilder {
-	item, err := NewOrderItem(product, quantity)
+// lapse records a hold an order could not take again, such as one read
+// back from storage after its stock went to other orders, as already
+// expired, so confirming the order says so
+func (inv *Inventory) lapse(orderID string, items []*OrderItem) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if r, ok := inv.reservations[orderID]; ok && r.status != ReservationReleased && r.status != ReservationExpired {
+		return fmt.Errorf("order %s already has a %s reservation", orderID, r.status)
+	}
+	lines, err := reservationLines(orderID, items)
+	if err != nil {
+		return err
+	}
+	r := &Reservation{orderID: orderID, lines: lines, status: ReservationExpired, expiresAt: time.Now()}
+	inv.reservations[orderID] = r
+	inv.expired = append(inv.expired, r)
+	return nil
+}
+
+// Commit takes an order's held stock off the shelf
+func (inv *Inventory) Commit(orderID string) error {
+	return inv.commit(orderID, nil)
+}
+
+// commit is Commit that first calls record, if not nil, once the hold
+// is known to be committable, and commits only if record succeeds.
+// Nothing can change the reservation in between.
+func (inv *Inventory) commit(orderID string, record func() error) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.expireLocked(time.Now())
+	r, ok := inv.reservations[orderID]
+	switch {
+	case !ok:
+		return fmt.Errorf("no stock reserved for order %s", orderID)
+	case r.status == ReservationExpired:
+		return ErrReservationExpired
+	case r.status != ReservationHeld:
+		return fmt.Errorf("reservation for order %s is %s", orderID, r.status)
+	}
+	if record != nil {
+		if err := record(); err != nil {
+			return err
+		}
+	}
+
+	unlock := lockProducts(r.lines)
+	defer unlock()
+	for _, line := range r.lines {
+		line.Product.reserved -= line.Quantity
+		line.Product.inStock -= line.Quantity
+	}
+	r.status = ReservationCommitted
+	return nil
+}
+
+// Release gives an order's stock back: held units become available
+// again and committed units return to the shelf. Releasing an order
+// with nothing held is a no-op.
+func (inv *Inventory) Release(orderID string) error {
+	return inv.release(orderID, nil)
+}
+
+// release is Release that first calls record, if not nil, and releases
+// only if record succeeds
+func (inv *Inventory) release(orderID string, record func() error) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if record != nil {
+		if err := record(); err != nil {
+			return err
+		}
+	}
+	r, ok := inv.reservations[orderID]
+	if !ok || r.status == ReservationReleased || r.status == ReservationExpired {
+		return nil
+	}
+
+	unlock := lockProducts(r.lines)
+	defer unlock()
+	for _, line := range r.lines {
+		if r.status == ReservationHeld {
+			line.Product.reserved -= line.Quantity
+		} else {
+			line.Product.inStock += line.Quantity
+		}
+	}
+	r.status = ReservationReleased
+	delete(inv.reservations, orderID)
+	return nil
+}
+
+// Settle forgets an order's committed stock once it has shipped and
+// can no longer be released
+func (inv *Inventory) Settle(orderID string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if r, ok := inv.reservations[orderID]; ok && r.status == ReservationCommitted {
+		delete(inv.reservations, orderID)
+	}
+}
+
+// ExpireReservations releases holds that have outlived the inventory's
+// ttl and returns how many it released
+func (inv *Inventory) ExpireReservations() int {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.expireLocked(time.Now())
+}
+
+// expireLocked releases lapsed holds and drops expired reservations
+// nobody has asked about for a ttl. inv.mu must be held.
+func (inv *Inventory) expireLocked(now time.Time) int {
+	expired := 0
+	for len(inv.holds) > 0 {
+		r := inv.holds[0]
+		if r.status == ReservationHeld {
+			if now.Before(r.expiresAt) {
+				break
+			}
+			unlock := lockProducts(r.lines)
+			for _, line := range r.lines {
+				line.Product.reserved -= line.Quantity
+			}
+			unlock()
+			r.status = ReservationExpired
+			inv.expired = append(inv.expired, r)
+			expired++
+		}
+		inv.holds[0] = nil
+		inv.holds = inv.holds[1:]
+	}
+
+	// Kept a while so confirming says the hold expired
+	for len(inv.expired) > 0 && !now.Before(inv.expired[0].expiresAt.Add(inv.ttl)) {
+		r := inv.expired[0]
+		if inv.reservations[r.orderID] == r {
+			delete(inv.reservations, r.orderID)
+		}
+		inv.expired[0] = nil
+		inv.expired = inv.expired[1:]
+	}
+	return expired
+}
+
+// Reservation returns a snapshot of an order's reservation, if any
+func (inv *Inventory) Reservation(orderID string) (Reservation, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	r, ok := inv.reservations[orderID]
+	if !ok {
+		return Reservation{}, false
+	}
+	return *r, true
+}
+
+// ========================================
+// Pricing (coupons, tax, shipping)
+// ========================================
+
+// PricedLine is an order item with its subtotal in the order currency
+type PricedLine struct {
+	Item   *OrderItem
+	Amount *Money
+}
+
+// Adjustment is one labelled line of a price breakdown
+type Adjustment struct {
+	Label  string `json:"label"`
+	Amount *Money `json:"amount"`
+}
+
+// PriceBreakdown itemizes how an order's total was reached:
+// subtotal - discounts + shipping + tax
+type PriceBreakdown struct {
+	Subtotal  *Money       `json:"subtotal"`
+	Discounts []Adjustment `json:"discounts,omitempty"`
+	Shipping  *Adjustment  `json:"shipping,omitempty"`
+	Tax       *Adjustment  `json:"tax,omitempty"`
+	Total     *Money       `json:"total"`
+}
+
+// Coupon is a discount code. Discount is given the order lines and what
+// is left of the subtotal after the coupons applied before it.
+type Coupon interface {
+	Code() string
+	Describe() string
+	Discount(lines []PricedLine, remaining *Money) (*Money, error)
+}
+
+// PercentCoupon takes a percentage off the remaining subtotal
+type PercentCoupon struct {
+	code    string
+	percent int
+}
+
+func NewPercentCoupon(code string, percent int) (*PercentCoupon, error) {
+	if percent <= 0 || percent > 100 {
+		return nil, fmt.Errorf("percent must be between 1 and 100")
+	}
+	return &PercentCoupon{code: strings.ToUpper(code), percent: percent}, nil
+}
+
+func (c *PercentCoupon) Code() string     { return c.code }
+func (c *PercentCoupon) Describe() string { return fmt.Sprintf("%d%% off", c.percent) }
+
+func (c *PercentCoupon) Discount(lines []PricedLine, remaining *Money) (*Money, error) {
+	return remaining.MulRat(big.NewRat(int64(c.percent), 100), RoundHalfUp)
+}
+
+// FixedCoupon takes a fixed amount off, in the order currency
+type FixedCoupon struct {
+	code   string
+	amount *Money
+}
+
+func NewFixedCoupon(code string, amount *Money) *FixedCoupon {
+	return &FixedCoupon{code: strings.ToUpper(code), amount: amount}
+}
+
+func (c *FixedCoupon) Code() string     { return c.code }
+func (c *FixedCoupon) Describe() string { return fmt.Sprintf("%s off", c.amount) }
+
+func (c *FixedCoupon) Discount(lines []PricedLine, remaining *Money) (*Money, error) {
+	if c.amount.Currency() != remaining.Currency() {
+		return nil, fmt.Errorf("coupon %s is in %s but the order is in %s", c.code, c.amount.Currency(), remaining.Currency())
+	}
+	return c.amount, nil
+}
+
+// BuyXGetYCoupon makes get units of a product free for every buy units
+// bought, e.g. buy 2 get 1 takes one unit off in every three
+type BuyXGetYCoupon struct {
+	code string
+	sku  string
+	buy  int
+	get  int
+}
+
+func NewBuyXGetYCoupon(code, sku string, buy, get int) (*BuyXGetYCoupon, error) {
+	if buy <= 0 || get <= 0 {
+		return nil, fmt.Errorf("buy and get must be positive")
+	}
+	return &BuyXGetYCoupon{code: strings.ToUpper(code), sku: sku, buy: buy, get: get}, nil
+}
+
+func (c *BuyXGetYCoupon) Code() string { return c.code }
+
+func (c *BuyXGetYCoupon) Describe() string {
+	return fmt.Sprintf("buy %d get %d free on %s", c.buy, c.get, c.sku)
+}
+
+func (c *BuyXGetYCoupon) Discount(lines []PricedLine, remaining *Money) (*Money, error) {
+	discount := &Money{currency: remaining.currency}
+	for _, line := range lines {
+		if line.Item.Product().SKU() != c.sku {
+			continue
+		}
+		qty := line.Item.Quantity()
+		free := qty / (c.buy + c.get) * c.get
+		if free > 0 {
+			off, err := line.Amount.MulRat(big.NewRat(int64(free), int64(qty)), RoundHalfUp)
+			if err != nil {
+				return nil, err
+			}
+			if discount, err = discount.Add(off); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return discount, nil
+}
+
+// TaxRule is the tax charged on orders shipped to a country, or to one
+// state of it
+type TaxRule struct {
+	Country     string
+	State       string // empty for a country-wide rule
+	Name        string
+	Rate        string // percent, e.g. "6.25"
+	TaxShipping bool   // whether shipping is taxed too
+}
+
+// TaxTable finds the tax rule for a shipping address. A state rule wins
+// over its country's rule.
+type TaxTable struct {
+	rules map[string]TaxRule
+	rates map[string]*big.Rat // fraction, by the same key as rules
+}
+
+func NewTaxTable() *TaxTable {
+	return &TaxTable{rules: make(map[string]TaxRule), rates: make(map[string]*big.Rat)}
+}
+
+func taxKey(country, state string) string {
+	return strings.ToUpper(country) + "/" + strings.ToUpper(state)
+}
+
+func (t *TaxTable) AddRule(rule TaxRule) error {
+	if rule.Country == "" {
+		return fmt.Errorf("tax rule needs a country")
+	}
+	rate, ok := new(big.Rat).SetString(rule.Rate)
+	if !ok || rate.Sign() < 0 {
+		return fmt.Errorf("invalid tax rate %q", rule.Rate)
+	}
+	key := taxKey(rule.Country, rule.State)
+	t.rules[key] = rule
+	t.rates[key] = rate.Quo(rate, big.NewRat(100, 1))
+	return nil
+}
+
+// Lookup returns the rule for addr and its rate as a fraction
+func (t *TaxTable) Lookup(addr *Address) (TaxRule, *big.Rat, bool) {
+	for _, key := range []string{taxKey(addr.country, addr.state), taxKey(addr.country, "")} {
+		if rule, ok := t.rules[key]; ok {
+			return rule, t.rates[key], true
+		}
+	}
+	return TaxRule{}, nil, false
+}
+
+// ShippingRate is the price of parcels up to a weight
+type ShippingRate struct {
+	UpToGrams int
+	Price     *Money
+}
+
+// ShippingTable prices parcels by destination zone and weight
+type ShippingTable struct {
+	zones map[string]string         // country -> zone; "*" for the rest
+	rates map[string][]ShippingRate // zone -> rates, lightest first
+}
+
+func NewShippingTable() *ShippingTable {
+	return &ShippingTable{zones: make(map[string]string), rates: make(map[string][]ShippingRate)}
+}
+
+// AddZone puts countries in a zone; the country "*" matches any country
+// without a zone of its own
+func (t *ShippingTable) AddZone(zone string, countries ...string) {
+	for _, c := range countries {
+		t.zones[strings.ToUpper(c)] = zone
+	}
+}
+
+func (t *ShippingTable) AddRate(zone string, upToGrams int, price *Money) {
+	rates := append(t.rates[zone], ShippingRate{UpToGrams: upToGrams, Price: price})
+	sort.Slice(rates, func(i, j int) bool { return rates[i].UpToGrams < rates[j].UpToGrams })
+	t.rates[zone] = rates
+}
+
+// Quote prices a parcel of grams shipped to addr
+func (t *ShippingTable) Quote(addr *Address, grams int) (string, *Money, error) {
+	zone, ok := t.zones[strings.ToUpper(addr.country)]
+	if !ok {
+		if zone, ok = t.zones["*"]; !ok {
+			return "", nil, fmt.Errorf("no shipping to %s", addr.country)
+		}
+	}
+	for _, rate := range t.rates[zone] {
+		if grams <= rate.UpToGrams {
+			return zone, rate.Price, nil
+		}
+	}
+	return "", nil, fmt.Errorf("parcel of %d g is too heavy for zone %s", grams, zone)
+}
+
+// Pricing turns order lines into a PriceBreakdown. Taxes and Shipping
+// are optional.
+type Pricing struct {
+	Taxes    *TaxTable
+	Shipping *ShippingTable
+	coupons  map[string]Coupon
+}
+
+func NewPricing(taxes *TaxTable, shipping *ShippingTable) *Pricing {
+	return &Pricing{Taxes: taxes, Shipping: shipping, coupons: make(map[string]Coupon)}
+}
+
+// AddCoupon registers a coupon; codes are case-insensitive
+func (p *Pricing) AddCoupon(c Coupon) { p.coupons[strings.ToUpper(c.Code())] = c }
+
+// Price applies coupons in the given order, then shipping, then tax.
+// Each coupon applies at most once, however its code is written.
+// Amounts in other currencies (shipping rates) go through conv.
+func (p *Pricing) Price(lines []PricedLine, subtotal *Money, shipTo *Address, codes []string, conv *Converter) (*PriceBreakdown, error) {
+	breakdown := &PriceBreakdown{Subtotal: subtotal}
+	remaining := subtotal
+	used := make(map[string]bool)
+	for _, code := range codes {
+		key := strings.ToUpper(code)
+		coupon, ok := p.coupons[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown coupon code %q", code)
+		}
+		if used[key] {
+			return nil, fmt.Errorf("coupon %s applied more than once", coupon.Code())
+		}
+		used[key] = true
+		discount, err := coupon.Discount(lines, remaining)
+		if err != nil {
+			return nil, err
+		}
+		if discount.minor > remaining.minor {
+			discount = remaining
+		}
+		remaining, _ = remaining.Subtract(discount)
+		breakdown.Discounts = append(breakdown.Discounts, Adjustment{
+			Label:  fmt.Sprintf("Coupon %s (%s)", coupon.Code(), coupon.Describe()),
+			Amount: discount,
+		})
+	}
+	total := remaining
+
+	var shipping *Money
+	if p.Shipping != nil {
+		grams := 0
+		for _, line := range lines {
+			grams += line.Item.Product().WeightGrams() * line.Item.Quantity()
+		}
+		zone, price, err := p.Shipping.Quote(shipTo, grams)
+		if err != nil {
+			return nil, err
+		}
+		if price.Currency() != total.Currency() {
+			if conv == nil {
+				return nil, fmt.Errorf("shipping is priced in %s but the order is in %s", price.Currency(), total.Currency())
+			}
+			if price, err = conv.Convert(price, total.Currency()); err != nil {
+				return nil, err
+			}
+		}
+		shipping = price
+		breakdown.Shipping = &Adjustment{Label: fmt.Sprintf("Shipping (%s, %.1f kg)", zone, float64(grams)/1000), Amount: price}
+		if total, err = total.Add(price); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Taxes != nil {
+		if rule, rate, ok := p.Taxes.Lookup(shipTo); ok {
+			taxable := remaining
+			if rule.TaxShipping && shipping != nil {
+				var err error
+				if taxable, err = taxable.Add(shipping); err != nil {
+					return nil, err
+				}
+			}
+			tax, err := taxable.MulRat(rate, RoundHalfUp)
+			if err != nil {
+				return nil, err
+			}
+			breakdown.Tax = &Adjustment{Label: fmt.Sprintf("%s %s%%", rule.Name, rule.Rate), Amount: tax}
+			if total, err = total.Add(tax); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	breakdown.Total = total
+	return breakdown, nil
+}
+
+var _ Coupon = (*PercentCoupon)(nil)
+var _ Coupon = (*FixedCoupon)(nil)
+var _ Coupon = (*BuyXGetYCoupon)(nil)
+
+// ========================================
+// Order (composition + builder)
+// ========================================
+
+// OrderItem composes Product with quantity
+type OrderItem struct {
+	product  *Product
+	quantity int
+	subtotal *Money
+}
+
+func NewOrderItem(product *Product, quantity int) (*OrderItem, error) {
+	if quantity <= 0 {
+		return nil, fmt.Errorf("quantity must be positive")
+	}
+	subtotal, err := product.Price().Multiply(quantity)
+	if err != nil {
+		return nil, fmt.Errorf("%d of %s: %w", quantity, product.SKU(), err)
+	}
+	return &OrderItem{
+		product:  product,
+		quantity: quantity,
+		subtotal: subtotal,
+	}, nil
+}
+
+func (i *OrderItem) Product() *Product { return i.product }
+func (i *OrderItem) Quantity() int     { return i.quantity }
+func (i *OrderItem) Subtotal() *Money  { return i.subtotal }
+
+// OrderStatus represents order lifecycle
+type OrderStatus string
+
+const (
+	StatusPending          OrderStatus = "pending"
+	StatusConfirmed        OrderStatus = "confirmed"
+	StatusPartiallyShipped OrderStatus = "partially_shipped"
+	StatusShipped          OrderStatus = "shipped"
+	StatusDelivered        OrderStatus = "delivered"
+	StatusCancelled        OrderStatus = "cancelled"
+	StatusReturned         OrderStatus = "returned"
+	StatusRefunded         OrderStatus = "refunded"
+)
+
+// Order composes multiple types
+type Order struct {
+	id              string
+	customer        *Customer
+	items           []*OrderItem
+	shippingAddress *Address
+	billingAddress  *Address
+	status          OrderStatus
+	total           *Money
+	breakdown       *PriceBreakdown
+	createdAt       time.Time
+	updatedAt       time.Time
+	notes           string
+	inventory       *Inventory // holds the order's stock; nil when untracked
+
+	// Lifecycle state, derived from history. mu serializes transitions
+	// and guards the fields below it.
+	mu       sync.Mutex
+	machine  *OrderMachine
+	history  []OrderEvent
+	shipped  map[string]int // SKU -> quantity shipped
+	returned map[string]int // SKU -> quantity returned
+	refunded *Money
+}
+
+// Getters
+func (o *Order) ID() string              { return o.id }
+func (o *Order) Customer() *Customer     { return o.customer }
+func (o *Order) Total() *Money           { return o.total }
+func (o *Order) CreatedAt() time.Time    { return o.createdAt }
+func (o *Order) Notes() string           { return o.notes }
+func (o *Order) ShippingAddress() *Address { return o.shippingAddress }
+
+// Status is where the order is in its lifecycle
+func (o *Order) Status() OrderStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.status
+}
+
+// Breakdown itemizes the total: subtotal, discounts, shipping and tax
+func (o *Order) Breakdown() *PriceBreakdown { return o.breakdown }
+
+func (o *Order) Items() []*OrderItem {
+	result := make([]*OrderItem, len(o.items))
+	copy(result, o.items)
+	return result
+}
+
+// UpdatedAt is when the order last changed state
+func (o *Order) UpdatedAt() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.updatedAt
+}
+
+// History returns every transition the order went through, oldest first
+func (o *Order) History() []OrderEvent {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	result := make([]OrderEvent, len(o.history))
+	copy(result, o.history)
+	return result
+}
+
+// Refunded is how much of the total has been paid back
+func (o *Order) Refunded() *Money {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.refundedSoFar()
+}
+
+// refundedSoFar is Refunded for callers holding o.mu
+func (o *Order) refundedSoFar() *Money {
+	if o.refunded == nil {
+		zero, _ := NewMoneyFromMinor(0, o.total.Currency())
+		return zero
+	}
+	return o.refunded
+}
+
+// Shipped returns the quantity shipped so far per SKU
+func (o *Order) Shipped() map[string]int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	result := make(map[string]int, len(o.shipped))
+	for sku, qty := range o.shipped {
+		result[sku] = qty
+	}
+	return result
+}
+
+// quantities returns the ordered quantity per SKU
+func (o *Order) quantities() map[string]int {
+	result := make(map[string]int)
+	for _, item := range o.items {
+		result[item.Product().SKU()] += item.Quantity()
+	}
+	return result
+}
+
+// unshipped returns the quantity per SKU still waiting to ship
+func (o *Order) unshipped() map[string]int {
+	result := o.quantities()
+	for sku, qty := range o.shipped {
+		if result[sku] -= qty; result[sku] <= 0 {
+			delete(result, sku)
+		}
+	}
+	return result
+}
+
+// Status transitions, recorded by the system. Use Transition to record
+// who made a change and why.
+func (o *Order) Confirm() error {
+	return o.Transition(OrderEvent{Type: EventConfirmed})
+}
+
+// Ship sends everything not yet shipped
+func (o *Order) Ship() error {
+	return o.transition(func() OrderEvent {
+		return OrderEvent{Type: EventShipped, Items: o.unshipped()}
+	})
+}
+
+// ShipItems sends some of the order; the order is shipped once every
+// unit has gone out, and partially shipped until then
+func (o *Order) ShipItems(items map[string]int) error {
+	return o.transition(func() OrderEvent {
+		return OrderEvent{Type: shipmentEvent(o, items), Items: items}
+	})
+}
+
+func (o *Order) Deliver() error {
+	return o.Transition(OrderEvent{Type: EventDelivered})
+}
+
+func (o *Order) Cancel() error {
+	return o.Transition(OrderEvent{Type: EventCancelled})
+}
+
+// Return takes delivered items back; nil items returns everything not
+// returned yet
+func (o *Order) Return(items map[string]int, reason string) error {
+	return o.transition(func() OrderEvent {
+		if items == nil {
+			items = o.returnable()
+		}
+		return OrderEvent{Type: EventReturned, Items: items, Reason: reason}
+	})
+}
+
+// Refund pays back part or all of the total
+func (o *Order) Refund(amount *Money, reason string) error {
+	return o.Transition(OrderEvent{Type: EventRefunded, Amount: amount, Reason: reason})
+}
+
+// Transition moves the order through its state machine. The event's
+// Type, Actor, Reason, Items and Amount are taken from e; the rest is
+// filled in when the event is recorded. Transitions of one order run
+// one at a time.
+func (o *Order) Transition(e OrderEvent) error {
+	return o.transition(func() OrderEvent { return e })
+}
+
+// transition builds an event from the order's current state and fires
+// it with the order locked. Hooks run once it is unlocked, so they can
+// read the order.
+func (o *Order) transition(event func() OrderEvent) error {
+	o.mu.Lock()
+	e, err := o.machine.fire(o, event())
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	o.machine.runHooks(o, e)
+	return nil
+}
+
+// shipmentEvent picks shipped or partially shipped for a shipment
+func shipmentEvent(o *Order, items map[string]int) OrderEventType {
+	left := o.unshipped()
+	for sku, qty := range items {
+		left[sku] -= qty
+	}
+	for _, qty := range left {
+		if qty > 0 {
+			return EventPartiallyShipped
+		}
+	}
+	return EventShipped
+}
+
+func (o *Order) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Order #%s\n", o.id))
+	sb.WriteString(fmt.Sprintf("Customer: %s (%s)\n", o.customer.Name(), o.customer.Email()))
+	sb.WriteString(fmt.Sprintf("Status: %s\n", o.status))
+	sb.WriteString("Items:\n")
+	for _, item := range o.items {
+		sb.WriteString(fmt.Sprintf("  - %s x%d = %s\n",
+			item.Product().Name(), item.Quantity(), item.Subtotal()))
+	}
+	if b := o.breakdown; b != nil && (len(b.Discounts) > 0 || b.Shipping != nil || b.Tax != nil) {
+		sb.WriteString(fmt.Sprintf("Subtotal: %s\n", b.Subtotal))
+		for _, d := range b.Discounts {
+			sb.WriteString(fmt.Sprintf("  %s: -%s\n", d.Label, d.Amount))
+		}
+		for _, adj := range []*Adjustment{b.Shipping, b.Tax} {
+			if adj != nil {
+				sb.WriteString(fmt.Sprintf("  %s: %s\n", adj.Label, adj.Amount))
+			}
+		}
+	}
+	sb.WriteString(fmt.Sprintf("Total: %s\n", o.total))
+	if o.refunded != nil {
+		sb.WriteString(fmt.Sprintf("Refunded: %s\n", o.refunded))
+	}
+	sb.WriteString(fmt.Sprintf("Ship to: %s\n", o.shippingAddress))
+	if o.notes != "" {
+		sb.WriteString(fmt.Sprintf("Notes: %s\n", o.notes))
+	}
+	return sb.String()
+}
+
+// MarshalJSON exports the order with its price breakdown
+func (o *Order) MarshalJSON() ([]byte, error) {
+	type item struct {
+		SKU       string `json:"sku"`
+		Name      string `json:"name"`
+		Quantity  int    `json:"quantity"`
+		UnitPrice *Money `json:"unit_price"`
+		Subtotal  *Money `json:"subtotal"`
+	}
+	items := make([]item, len(o.items))
+	for i, it := range o.items {
+		p := it.Product()
+		items[i] = item{p.SKU(), p.Name(), it.Quantity(), p.Price(), it.Subtotal()}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return json.Marshal(struct {
+		ID        string          `json:"id"`
+		Customer  string          `json:"customer"`
+		Email     string          `json:"email"`
+		Status    OrderStatus     `json:"status"`
+		Items     []item          `json:"items"`
+		Pricing   *PriceBreakdown `json:"pricing"`
+		ShipTo    string          `json:"ship_to"`
+		Notes     string          `json:"notes,omitempty"`
+		CreatedAt time.Time       `json:"created_at"`
+	}{o.id, o.customer.ID(), o.customer.Email(), o.status, items, o.breakdown, o.shippingAddress.String(), o.notes, o.createdAt})
+}
+
+// ========================================
+// Order Lifecycle (state machine + event log)
+// ========================================
+
+// OrderEventType names a transition of the order state machine
+type OrderEventType string
+
+const (
+	EventCreated          OrderEventType = "created"
+	EventConfirmed        OrderEventType = "confirmed"
+	EventPartiallyShipped OrderEventType = "partially_shipped"
+	EventShipped          OrderEventType = "shipped"
+	EventDelivered        OrderEventType = "delivered"
+	EventCancelled        OrderEventType = "cancelled"
+	EventReturned         OrderEventType = "returned"
+	EventRefunded         OrderEventType = "refunded"
+)
+
+// SystemActor is recorded for transitions made without a named actor
+const SystemActor = "system"
+
+// OrderEvent records one transition: what happened, who did it, when
+// and why. An order's lifecycle state is the result of replaying its
+// events in sequence.
+type OrderEvent struct {
+	OrderID string         `json:"order_id"`
+	Seq     int            `json:"seq"`
+	Type    OrderEventType `json:"type"`
+	From    OrderStatus    `json:"from,omitempty"`
+	To      OrderStatus    `json:"to"`
+	Actor   string         `json:"actor"`
+	Reason  string         `json:"reason,omitempty"`
+	At      time.Time      `json:"at"`
+	Items   map[string]int `json:"items,omitempty"`  // SKU -> quantity ordered, shipped or returned
+	Amount  *Money         `json:"amount,omitempty"` // total when created, amount when refunded
+}
+
+func (e OrderEvent) String() string {
+	var sb strings.Builder
+	from := e.From
+	if from == "" {
+		from = "new"
+	}
+	sb.WriteString(fmt.Sprintf("#%d %s: %s -> %s by %s", e.Seq, e.Type, from, e.To, e.Actor))
+	skus := make([]string, 0, len(e.Items))
+	for sku := range e.Items {
+		skus = append(skus, sku)
+	}
+	sort.Strings(skus)
+	for _, sku := range skus {
+		sb.WriteString(fmt.Sprintf(" %s x%d", sku, e.Items[sku]))
+	}
+	if e.Amount != nil {
+		sb.WriteString(" " + e.Amount.String())
+	}
+	if e.Reason != "" {
+		sb.WriteString(fmt.Sprintf(" (%s)", e.Reason))
+	}
+	return sb.String()
+}
+
+// TransitionError is returned for an event the order's status does not
+// allow
+type TransitionError struct {
+	OrderID string
+	Status  OrderStatus
+	Event   OrderEventType
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order %s is %s and cannot be %s", e.OrderID,
+		strings.ReplaceAll(string(e.Status), "_", " "), strings.ReplaceAll(string(e.Event), "_", " "))
+}
+
+// Transition is one row of the state machine: Event moves an order in
+// any From status to To. Guard can reject the event; Action performs
+// its side effects, such as moving stock. The action is handed record,
+// which stores the event: it must call it once it has checked it can
+// succeed, make its changes only if record succeeds, and return
+// record's error. Guards run again when events are replayed, actions
+// never do.
+type Transition struct {
+	Event  OrderEventType
+	From   []OrderStatus
+	To     OrderStatus
+	Guard  func(o *Order, e OrderEvent) error
+	Action func(o *Order, e OrderEvent, record func() error) error
+}
+
+// OrderTransitions is the standard order lifecycle. The empty status is
+// an order that has not been created yet.
+var OrderTransitions = []Transition{
+	{Event: EventCreated, From: []OrderStatus{""}, To: StatusPending, Guard: guardCreated},
+	{Event: EventConfirmed, From: []OrderStatus{StatusPending}, To: StatusConfirmed, Action: commitStock},
+	{Event: EventPartiallyShipped, From: []OrderStatus{StatusConfirmed, StatusPartiallyShipped}, To: StatusPartiallyShipped, Guard: guardShipment, Action: settleStock},
+	{Event: EventShipped, From: []OrderStatus{StatusConfirmed, StatusPartiallyShipped}, To: StatusShipped, Guard: guardShipment, Action: settleStock},
+	{Event: EventDelivered, From: []OrderStatus{StatusShipped}, To: StatusDelivered},
+	{Event: EventCancelled, From: []OrderStatus{StatusPending, StatusConfirmed}, To: StatusCancelled, Action: releaseStock},
+	{Event: EventReturned, From: []OrderStatus{StatusDelivered, StatusReturned, StatusRefunded}, To: StatusReturned, Guard: guardReturn, Action: restock},
+	{Event: EventRefunded, From: []OrderStatus{StatusCancelled, StatusDelivered, StatusReturned, StatusRefunded}, To: StatusRefunded, Guard: guardRefund},
+}
+
+// guardCreated checks a creation event describes this order
+func guardCreated(o *Order, e OrderEvent) error {
+	ordered := o.quantities()
+	if len(e.Items) != len(ordered) {
+		return fmt.Errorf("event lists %d products, order has %d", len(e.Items), len(ordered))
+	}
+	for sku, qty := range ordered {
+		if e.Items[sku] != qty {
+			return fmt.Errorf("event lists %d of %s, order has %d", e.Items[sku], sku, qty)
+		}
+	}
+	if e.Amount == nil || e.Amount.Currency() != o.total.Currency() || e.Amount.Minor() != o.total.Minor() {
+		return fmt.Errorf("event total %v does not match order total %s", e.Amount, o.total)
+	}
+	return nil
+}
+
+// guardShipment checks a shipment only sends what is still unshipped,
+// and that it completes the order exactly when the event says so
+func guardShipment(o *Order, e OrderEvent) error {
+	if len(e.Items) == 0 {
+		return fmt.Errorf("shipment has no items")
+	}
+	left := o.unshipped()
+	for sku, qty := range e.Items {
+		if qty <= 0 || qty > left[sku] {
+			return fmt.Errorf("cannot ship %d of %s, %d left to ship", qty, sku, left[sku])
+		}
+	}
+	if shipmentEvent(o, e.Items) != e.Type {
+		if e.Type == EventShipped {
+			return fmt.Errorf("shipment leaves items unshipped")
+		}
+		return fmt.Errorf("shipment sends every remaining item")
+	}
+	return nil
+}
+
+// guardReturn checks only shipped, not yet returned units come back
+func guardReturn(o *Order, e OrderEvent) error {
+	if len(e.Items) == 0 {
+		return fmt.Errorf("return has no items")
+	}
+	left := o.returnable()
+	for sku, qty := range e.Items {
+		if qty <= 0 || qty > left[sku] {
+			return fmt.Errorf("cannot return %d of %s, %d returnable", qty, sku, left[sku])
+		}
+	}
+	return nil
+}
+
+// guardRefund checks a refund never pays back more than the total
+func guardRefund(o *Order, e OrderEvent) error {
+	if e.Amount == nil || e.Amount.Minor() <= 0 {
+		return fmt.Errorf("refund amount must be positive")
+	}
+	left, err := o.total.Subtract(o.refundedSoFar())
+	if err != nil {
+		return err
+	}
+	if e.Amount.Currency() != left.Currency() {
+		return &CurrencyMismatchError{Left: left.Currency(), Right: e.Amount.Currency()}
+	}
+	if e.Amount.Minor() > left.Minor() {
+		return fmt.Errorf("refund of %s exceeds the %s left to refund", e.Amount, left)
+	}
+	return nil
+}
+
+// commitStock takes the order's held stock off the shelf
+func commitStock(o *Order, e OrderEvent, record func() error) error {
+	if o.inventory == nil {
+		return record()
+	}
+	if err := o.inventory.commit(o.id, record); err != nil {
+		return fmt.Errorf("cannot confirm order: %w", err)
+	}
+	return nil
+}
+
+// releaseStock gives the order's stock back
+func releaseStock(o *Order, e OrderEvent, record func() error) error {
+	if o.inventory == nil {
+		return record()
+	}
+	if err := o.inventory.release(o.id, record); err != nil {
+		return fmt.Errorf("cannot cancel order: %w", err)
+	}
+	return nil
+}
+
+// settleStock lets the inventory forget stock that has started shipping
+func settleStock(o *Order, e OrderEvent, record func() error) error {
+	if err := record(); err != nil {
+		return err
+	}
+	if o.inventory != nil {
+		o.inventory.Settle(o.id)
+	}
+	return nil
+}
+
+// restock puts returned units back on the shelf
+func restock(o *Order, e OrderEvent, record func() error) error {
+	if err := record(); err != nil {
+		return err
+	}
+	if o.inventory == nil {
+		return nil
+	}
+	products := make(map[string]*Product)
+	for _, item := range o.items {
+		products[item.Product().SKU()] = item.Product()
+	}
+	for sku, qty := range e.Items {
+		products[sku].AddStock(qty)
+	}
+	return nil
+}
+
+// rehold gives a restored order back its place in the inventory: a
+// pending order reserves its stock again and a confirmed one has the
+// stock it committed adopted, so it can still be confirmed or cancelled.
+// A pending order whose stock has gone to others is left with an
+// expired hold.
+func (o *Order) rehold() error {
+	if o.inventory == nil {
+		return nil
+	}
+	switch o.status {
+	case StatusPending:
+		_, err := o.inventory.Reserve(o.id, o.items)
+		var short *ReservationError
+		if errors.As(err, &short) {
+			return o.inventory.lapse(o.id, o.items)
+		}
+		return err
+	case StatusConfirmed:
+		return o.inventory.adopt(o.id, o.items)
+	}
+	return nil
+}
+
+// returnable returns the quantity per SKU shipped and not yet returned
+func (o *Order) returnable() map[string]int {
+	result := maps.Clone(o.shipped)
+	for sku, qty := range o.returned {
+		if result[sku] -= qty; result[sku] <= 0 {
+			delete(result, sku)
+		}
+	}
+	return result
+}
+
+// apply folds one recorded event into the order's state
+func (o *Order) apply(e OrderEvent) {
+	switch e.Type {
+	case EventPartiallyShipped, EventShipped:
+		if o.shipped == nil {
+			o.shipped = make(map[string]int)
+		}
+		for sku, qty := range e.Items {
+			o.shipped[sku] += qty
+		}
+	case EventReturned:
+		if o.returned == nil {
+			o.returned = make(map[string]int)
+		}
+		for sku, qty := range e.Items {
+			o.returned[sku] += qty
+		}
+	case EventRefunded:
+		o.refunded, _ = o.refundedSoFar().Add(e.Amount)
+	}
+	o.status = e.To
+	o.updatedAt = e.At
+	o.history = append(o.history, e)
+}
+
+// EventStore persists order events
+type EventStore interface {
+	Append(e OrderEvent) error
+	Events(orderID string) ([]OrderEvent, error)
+}
+
+// MemoryEventStore keeps events in memory
+type MemoryEventStore struct {
+	mu     sync.Mutex
+	events map[string][]OrderEvent
+}
+
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{events: make(map[string][]OrderEvent)}
+}
+
+func (s *MemoryEventStore) Append(e OrderEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[e.OrderID] = append(s.events[e.OrderID], e)
+	return nil
+}
+
+func (s *MemoryEventStore) Events(orderID string) ([]OrderEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]OrderEvent, len(s.events[orderID]))
+	copy(result, s.events[orderID])
+	return result, nil
+}
+
+// FileEventStore appends events to a file, one JSON object per line
+type FileEventStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileEventStore(path string) *FileEventStore {
+	return &FileEventStore{path: path}
+}
+
+func (s *FileEventStore) Append(e OrderEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Events reads back an order's events; a missing file has none
+func (s *FileEventStore) Events(orderID string) ([]OrderEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var result []OrderEvent
+	dec := json.NewDecoder(f)
+	for {
+		var e OrderEvent
+		if err := dec.Decode(&e); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", s.path, err)
+		}
+		if e.OrderID == orderID {
+			result = append(result, e)
+		}
+	}
+}
+
+// OrderMachine moves orders through a transition table, records each
+// transition in an event store and then runs its hooks
+type OrderMachine struct {
+	transitions []Transition
+	store       EventStore
+	hooks       []func(o *Order, e OrderEvent)
+}
+
+// NewOrderMachine creates a machine recording events in store
+func NewOrderMachine(store EventStore, transitions []Transition) *OrderMachine {
+	return &OrderMachine{transitions: transitions, store: store}
+}
+
+func (m *OrderMachine) Store() EventStore { return m.store }
+
+// OnTransition registers a hook run after every recorded transition.
+// Register hooks before the machine is in use.
+func (m *OrderMachine) OnTransition(hook func(o *Order, e OrderEvent)) {
+	m.hooks = append(m.hooks, hook)
+}
+
+// lookup finds the transition event takes from status
+func (m *OrderMachine) lookup(status OrderStatus, event OrderEventType) (Transition, bool) {
+	for _, t := range m.transitions {
+		if t.Event == event && slices.Contains(t.From, status) {
+			return t, true
+		}
+	}
+	return Transition{}, false
+}
+
+// fire runs one transition: guard, then the action around recording
+// the event, then apply. It returns the recorded event for the caller
+// to run hooks on. o.mu must be held.
+func (m *OrderMachine) fire(o *Order, e OrderEvent) (OrderEvent, error) {
+	t, ok := m.lookup(o.status, e.Type)
+	if !ok {
+		return e, &TransitionError{OrderID: o.id, Status: o.status, Event: e.Type}
+	}
+	if e.Actor == "" {
+		e.Actor = SystemActor
+	}
+	e.OrderID, e.Seq, e.From, e.To, e.At = o.id, len(o.history)+1, o.status, t.To, time.Now()
+	e.Items = maps.Clone(e.Items)
+
+	if t.Guard != nil {
+		if err := t.Guard(o, e); err != nil {
+			return e, fmt.Errorf("order %s: %w", o.id, err)
+		}
+	}
+	recorded := false
+	record := func() error {
+		if recorded {
+			return fmt.Errorf("%s event for order %s recorded twice", e.Type, o.id)
+		}
+		if err := m.store.Append(e); err != nil {
+			return fmt.Errorf("recording %s event for order %s: %w", e.Type, o.id, err)
+		}
+		recorded = true
+		return nil
+	}
+	var err error
+	if t.Action != nil {
+		err = t.Action(o, e, record)
+	} else {
+		err = record()
+	}
+	if err != nil {
+		return e, err
+	}
+	if !recorded {
+		return e, fmt.Errorf("%s action for order %s did not record its event", e.Type, o.id)
+	}
+	o.apply(e)
+	return e, nil
+}
+
+// runHooks runs the transition hooks for a recorded event
+func (m *OrderMachine) runHooks(o *Order, e OrderEvent) {
+	for _, hook := range m.hooks {
+		hook(o, e)
+	}
+}
+
+// replay rebuilds an order's state from recorded events, checking each
+// against the transition table and its guard but running no actions
+func (m *OrderMachine) replay(o *Order, events []OrderEvent) error {
+	for i, e := range events {
+		if e.OrderID != o.id || e.Seq != i+1 {
+			return fmt.Errorf("event %s #%d does not belong at position %d of order %s", e.OrderID, e.Seq, i+1, o.id)
+		}
+		t, ok := m.lookup(o.status, e.Type)
+		if !ok || t.To != e.To {
+			return &TransitionError{OrderID: o.id, Status: o.status, Event: e.Type}
+		}
+		if t.Guard != nil {
+			if err := t.Guard(o, e); err != nil {
+				return fmt.Errorf("order %s event #%d: %w", o.id, e.Seq, err)
+			}
+		}
+		o.apply(e)
+	}
+	return nil
+}
+
+// ========================================
+// Order Builder
+// ========================================
+
+type OrderBuilder struct {
+	order        Order
+	inventorySet bool // Inventory was called, so a nil one is meant
+	errors       []string
+	currency     string     // of the total; the first item's when empty
+	converter    *Converter // for items priced in another currency
+	pricing      *Pricing
+	coupons      []string
+}
+
+func NewOrderBuilder(id string) *OrderBuilder {
+	return &OrderBuilder{
+		order: Order{
+			id:        id,
+			items:     []*OrderItem{},
+			createdAt: time.Now(),
+			updatedAt: time.Now(),
+		},
+	}
+}
+
+func (b *OrderBuilder) Customer(c *Customer) *OrderBuilder {
+	if c == nil {
+		b.errors = append(b.errors, "customer is required")
+	}
+	b.order.customer = c
+	return b
+}
+
+func (b *OrderBuilder) AddItem(product *Product, quantity int) *OrderBuilder {
+	item, err := NewOrderItem(product, quantity)
+	if err != nil {
+		b.errors = append(b.errors, err.Error())
+		return b
+	}
+	b.order.items = append(b.order.items, item)
+	return b
+}
+
+func (b *OrderBuilder) ShipTo(addr *Address) *OrderBuilder {
+	if addr == nil {
+		b.errors = append(b.errors, "shipping address is required")
+	}
+	b.order.shippingAddress = addr
+	return b
+}
+
+func (b *OrderBuilder) BillTo(addr *Address) *OrderBuilder {
+	b.order.billingAddress = addr
+	return b
+}
+
+// Currency sets the currency of the order total
+func (b *OrderBuilder) Currency(code string) *OrderBuilder {
+	c, err := LookupCurrency(code)
 	if err != nil {
 		b.errors = append(b.errors, err.Error())
 		return b
 	}
-	b.order.items = append(b.order.items, item)
-	return b
+	b.currency = c.Code
+	return b
+}
+
+// ConvertWith lets the order hold items priced in other currencies,
+// converting their subtotals into the order currency
+func (b *OrderBuilder) ConvertWith(conv *Converter) *OrderBuilder {
+	b.converter = conv
+	return b
+}
+
+// Pricing sets the coupons, tax and shipping rules the order is priced
+// with; without it the total is the sum of the items
+func (b *OrderBuilder) Pricing(p *Pricing) *OrderBuilder {
+	b.pricing = p
+	return b
+}
+
+// Coupon applies a coupon code; codes apply in the order given
+func (b *OrderBuilder) Coupon(code string) *OrderBuilder {
+	b.coupons = append(b.coupons, code)
+	return b
+}
+
+// Inventory sets where the order reserves its stock; nil builds an
+// order that does not track stock. It is required.
+func (b *OrderBuilder) Inventory(inv *Inventory) *OrderBuilder {
+	b.order.inventory = inv
+	b.inventorySet = true
+	return b
+}
+
+// Machine sets the state machine the order's lifecycle runs on and is
+// recorded by. It is required.
+func (b *OrderBuilder) Machine(m *OrderMachine) *OrderBuilder {
+	if m == nil {
+		b.errors = append(b.errors, "state machine is required")
+	}
+	b.order.machine = m
+	return b
+}
+
+func (b *OrderBuilder) Notes(notes string) *OrderBuilder {
+	b.order.notes = notes
+	return b
+}
+
+// Build places the order: it holds stock and records the order's
+// creation, placed by its customer
+func (b *OrderBuilder) Build() (*Order, error) {
+	if err := b.assemble(); err != nil {
+		return nil, err
+	}
+
+	// Hold stock for every line before handing out the order
+	if b.order.inventory != nil {
+		if _, err := b.order.inventory.Reserve(b.order.id, b.order.items); err != nil {
+			return nil, err
+		}
+	}
+
+	created := OrderEvent{
+		Type:   EventCreated,
+		Actor:  b.order.customer.ID(),
+		Items:  b.order.quantities(),
+		Amount: b.order.total,
+	}
+	created, err := b.order.machine.fire(&b.order, created)
+	if err != nil {
+		if b.order.inventory != nil {
+			b.order.inventory.Release(b.order.id)
+		}
+		return nil, err
+	}
+	b.order.machine.runHooks(&b.order, created)
+	return &b.order, nil
+}
+
+// Restore rebuilds an order placed earlier from its recorded events:
+// the builder supplies what was ordered, the events its lifecycle.
+// Nothing is recorded and no actions run, except that the order holds
+// its stock again (see rehold).
+func (b *OrderBuilder) Restore(events []OrderEvent) (*Order, error) {
+	if err := b.assemble(); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events recorded for order %s", b.order.id)
+	}
+	if err := b.order.machine.replay(&b.order, events); err != nil {
+		return nil, fmt.Errorf("cannot restore order: %w", err)
+	}
+	b.order.createdAt = events[0].At
+	if err := b.order.rehold(); err != nil {
+		return nil, err
+	}
+	return &b.order, nil
+}
+
+// assemble validates the order and works out its total
+func (b *OrderBuilder) assemble() error {
+	// Validate required fields
+	if b.order.customer == nil {
+		b.errors = append(b.errors, "customer is required")
+	}
+	if len(b.order.items) == 0 {
+		b.errors = append(b.errors, "order must have at least one item")
+	}
+	if b.order.shippingAddress == nil {
+		b.errors = append(b.errors, "shipping address is required")
+	}
+	if !b.inventorySet {
+		b.errors = append(b.errors, "inventory is required (nil for none)")
+	}
+	if b.order.machine == nil {
+		b.errors = append(b.errors, "state machine is required")
+	}
+
+	if len(b.errors) > 0 {
+		return fmt.Errorf("order validation failed: %s", strings.Join(b.errors, "; "))
+	}
+
+	// Calculate total in the order currency
+	currency := b.currency
+	if currency == "" {
+		currency = b.order.items[0].Subtotal().Currency()
+	}
+	total, err := NewMoneyFromMinor(0, currency)
+	if err != nil {
+		return err
+	}
+	lines := make([]PricedLine, 0, len(b.order.items))
+	for _, item := range b.order.items {
+		subtotal := item.Subtotal()
+		if subtotal.Currency() != currency {
+			if b.converter == nil {
+				return fmt.Errorf("order validation failed: %s is priced in %s but the order is in %s",
+					item.Product().Name(), subtotal.Currency(), currency)
+			}
+			if subtotal, err = b.converter.Convert(subtotal, currency); err != nil {
+				return fmt.Errorf("order validation failed: %w", err)
+			}
+		}
+		if total, err = total.Add(subtotal); err != nil {
+			return fmt.Errorf("order validation failed: %w", err)
+		}
+		lines = append(lines, PricedLine{Item: item, Amount: subtotal})
+	}
+
+	// Apply coupons, shipping and tax
+	b.order.breakdown = &PriceBreakdown{Subtotal: total, Total: total}
+	if b.pricing != nil {
+		if b.order.breakdown, err = b.pricing.Price(lines, total, b.order.shippingAddress, b.coupons, b.converter); err != nil {
+			return fmt.Errorf("order pricing failed: %w", err)
+		}
+	} else if len(b.coupons) > 0 {
+		return fmt.Errorf("order pricing failed: coupons need pricing rules")
+	}
+	b.order.total = b.order.breakdown.Total
+
+	// Use shipping as billing if not specified
+	if b.order.billingAddress == nil {
+		b.order.billingAddress = b.order.shippingAddress
+	}
+
+	return nil
+}
+
+// ========================================
+// Repositories (memory, JSON file, SQLite)
+// ========================================
+
+// ErrNotFound is returned when a repository has nothing under an ID
+var ErrNotFound = errors.New("not found")
+
+// Page selects part of a listing; a zero Limit means no limit
+type Page struct {
+	Offset int
+	Limit  int
+}
+
+// paginate applies p to items already in listing order
+func paginate[T any](items []T, p Page) []T {
+	items = items[min(max(p.Offset, 0), len(items)):]
+	if p.Limit > 0 && p.Limit < len(items) {
+		items = items[:p.Limit]
+	}
+	return items
+}
+
+// OrderFilter selects orders; zero fields match every order. Orders
+// are listed oldest first.
+type OrderFilter struct {
+	Status     OrderStatus
+	CustomerID string
+	From       time.Time // created at or after
+	To         time.Time // created before
+	Page
+}
+
+func (f OrderFilter) matches(status OrderStatus, customerID string, createdAt time.Time) bool {
+	return (f.Status == "" || f.Status == status) &&
+		(f.CustomerID == "" || f.CustomerID == customerID) &&
+		(f.From.IsZero() || !createdAt.Before(f.From)) &&
+		(f.To.IsZero() || createdAt.Before(f.To))
+}
+
+// CustomerRepository stores customers by ID, listed in ID order
+type CustomerRepository interface {
+	SaveCustomer(c *Customer) error
+	FindCustomer(id string) (*Customer, error)
+	ListCustomers(p Page) ([]*Customer, error)
+}
+
+// ProductRepository stores products and their stock by SKU, listed in
+// SKU order. Reservations are not stored.
+type ProductRepository interface {
+	SaveProduct(p *Product) error
+	FindProduct(sku string) (*Product, error)
+	ListProducts(p Page) ([]*Product, error)
+}
+
+// OrderRepository stores orders with their event history. An order's
+// customer and products must be saved first, and the order saved again
+// after each transition; the stock of its products is saved with it.
+// Orders read back hold their stock again, and every lookup of one
+// order returns the same *Order.
+type OrderRepository interface {
+	SaveOrder(o *Order) error
+	FindOrder(id string) (*Order, error)
+	ListOrders(f OrderFilter) ([]*Order, error)
+}
+
+// Repository stores everything the order system needs across restarts
+type Repository interface {
+	CustomerRepository
+	ProductRepository
+	OrderRepository
+}
+
+// Records are what the file and database repositories store
+
+type addressRecord struct {
+	Street  string `json:"street"`
+	City    string `json:"city"`
+	State   string `json:"state,omitempty"`
+	ZipCode string `json:"zip_code,omitempty"`
+	Country string `json:"country"`
+}
+
+func newAddressRecord(a *Address) addressRecord {
+	return addressRecord{a.street, a.city, a.state, a.zipCode, a.country}
+}
+
+func (r addressRecord) address() (*Address, error) {
+	return NewAddress(r.Street, r.City, r.State, r.ZipCode, r.Country)
+}
+
+type customerRecord struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Email     string          `json:"email"`
+	Addresses []addressRecord `json:"addresses"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func newCustomerRecord(c *Customer) customerRecord {
+	r := customerRecord{ID: c.id, Name: c.name, Email: c.Email(), CreatedAt: c.createdAt}
+	r.Addresses = make([]addressRecord, len(c.addresses))
+	for i, a := range c.addresses {
+		r.Addresses[i] = newAddressRecord(a)
+	}
+	return r
+}
+
+func (r customerRecord) customer() (*Customer, error) {
+	email, err := NewEmail(r.Email)
+	if err != nil {
+		return nil, fmt.Errorf("customer %s: %w", r.ID, err)
+	}
+	c := NewCustomer(r.ID, r.Name, email)
+	c.createdAt = r.CreatedAt
+	for _, ar := range r.Addresses {
+		a, err := ar.address()
+		if err != nil {
+			return nil, fmt.Errorf("customer %s: %w", r.ID, err)
+		}
+		c.AddAddress(a)
+	}
+	return c, nil
+}
+
+type productRecord struct {
+	SKU         string `json:"sku"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Price       *Money `json:"price"`
+	WeightGrams int    `json:"weight_grams,omitempty"`
+	InStock     int    `json:"in_stock"`
+}
+
+func newProductRecord(p *Product) productRecord {
+	return productRecord{p.sku, p.name, p.description, p.price, p.weightGrams, p.InStock()}
+}
+
+func (r productRecord) product() *Product {
+	p := NewProduct(r.SKU, r.Name, r.Price)
+	p.SetDescription(r.Description)
+	p.SetWeightGrams(r.WeightGrams)
+	p.AddStock(r.InStock)
+	return p
+}
+
+type orderItemRecord struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+	Subtotal *Money `json:"subtotal"`
+}
+
+type orderRecord struct {
+	ID         string            `json:"id"`
+	CustomerID string            `json:"customer_id"`
+	Status     OrderStatus       `json:"status"`
+	Items      []orderItemRecord `json:"items"`
+	ShipTo     addressRecord     `json:"ship_to"`
+	BillTo     addressRecord     `json:"bill_to"`
+	Total      *Money            `json:"total"`
+	Pricing    *PriceBreakdown   `json:"pricing"`
+	Notes      string            `json:"notes,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Events     []OrderEvent      `json:"events,omitempty"`
+
+	stock []productRecord // the order's products as they stood, saved with it
+}
+
+func newOrderRecord(o *Order) orderRecord {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r := orderRecord{
+		ID:         o.id,
+		CustomerID: o.customer.ID(),
+		Status:     o.status,
+		ShipTo:     newAddressRecord(o.shippingAddress),
+		BillTo:     newAddressRecord(o.billingAddress),
+		Total:      o.total,
+		Pricing:    o.breakdown,
+		Notes:      o.notes,
+		CreatedAt:  o.createdAt,
+		UpdatedAt:  o.updatedAt,
+		Events:     slices.Clone(o.history),
+	}
+	for _, item := range o.items {
+		r.Items = append(r.Items, orderItemRecord{item.Product().SKU(), item.Quantity(), item.Subtotal()})
+		if !slices.ContainsFunc(r.stock, func(pr productRecord) bool { return pr.SKU == item.Product().SKU() }) {
+			r.stock = append(r.stock, newProductRecord(item.Product()))
+		}
+	}
+	return r
+}
+
+// skus lists the products an order record refers to
+func (r orderRecord) skus() []string {
+	skus := make([]string, len(r.Items))
+	for i, item := range r.Items {
+		skus[i] = item.SKU
+	}
+	return skus
+}
+
+// order rebuilds an order from its record by replaying its events on
+// machine, then holds its stock in inv again. Items keep the subtotals
+// they were ordered at.
+func (r orderRecord) order(customer *Customer, products map[string]*Product, inv *Inventory, machine *OrderMachine) (*Order, error) {
+	o := &Order{
+		id:        r.ID,
+		customer:  customer,
+		total:     r.Total,
+		breakdown: r.Pricing,
+		notes:     r.Notes,
+		createdAt: r.CreatedAt,
+		inventory: inv,
+		machine:   machine,
+	}
+	for _, ir := range r.Items {
+		product, ok := products[ir.SKU]
+		if !ok {
+			return nil, fmt.Errorf("order %s: product %s: %w", r.ID, ir.SKU, ErrNotFound)
+		}
+		o.items = append(o.items, &OrderItem{product: product, quantity: ir.Quantity, subtotal: ir.Subtotal})
+	}
+	var err error
+	if o.shippingAddress, err = r.ShipTo.address(); err != nil {
+		return nil, fmt.Errorf("order %s: %w", r.ID, err)
+	}
+	if o.billingAddress, err = r.BillTo.address(); err != nil {
+		return nil, fmt.Errorf("order %s: %w", r.ID, err)
+	}
+	if err := o.machine.replay(o, r.Events); err != nil {
+		return nil, err
+	}
+	if o.status != r.Status {
+		return nil, fmt.Errorf("order %s is stored as %s but its events lead to %s", r.ID, r.Status, o.status)
+	}
+	if err := o.rehold(); err != nil {
+		return nil, fmt.Errorf("order %s: %w", r.ID, err)
+	}
+	return o, nil
+}
+
+// shared returns the instance cached under key, loading it on first
+// use. The file and database repositories hand out one instance per
+// product and order this way, so stock is counted in one place and an
+// order is only restored, and holds its stock, once.
+func shared[T any](cache map[string]T, key string, load func() (T, error)) (T, error) {
+	if v, ok := cache[key]; ok {
+		return v, nil
+	}
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+	cache[key] = v
+	return v, nil
+}
+
+// sortOrders puts orders in listing order: oldest first, then by ID
+func sortOrders[T any](orders []T, key func(T) (time.Time, string)) {
+	sort.Slice(orders, func(i, j int) bool {
+		ti, idi := key(orders[i])
+		tj, idj := key(orders[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return idi < idj
+	})
+}
+
+// MemoryRepository keeps everything in memory; what it returns is what
+// was saved
+type MemoryRepository struct {
+	mu        sync.Mutex
+	customers map[string]*Customer
+	products  map[string]*Product
+	orders    map[string]*Order
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		customers: make(map[string]*Customer),
+		products:  make(map[string]*Product),
+		orders:    make(map[string]*Order),
+	}
+}
+
+func (r *MemoryRepository) SaveCustomer(c *Customer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.customers[c.ID()] = c
+	return nil
+}
+
+func (r *MemoryRepository) FindCustomer(id string) (*Customer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.customers[id]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("customer %s: %w", id, ErrNotFound)
+}
+
+func (r *MemoryRepository) ListCustomers(p Page) ([]*Customer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := slices.Sorted(maps.Keys(r.customers))
+	result := make([]*Customer, 0, len(ids))
+	for _, id := range paginate(ids, p) {
+		result = append(result, r.customers[id])
+	}
+	return result, nil
+}
+
+func (r *MemoryRepository) SaveProduct(p *Product) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.products[p.SKU()] = p
+	return nil
+}
+
+func (r *MemoryRepository) FindProduct(sku string) (*Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.products[sku]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("product %s: %w", sku, ErrNotFound)
+}
+
+func (r *MemoryRepository) ListProducts(p Page) ([]*Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	skus := slices.Sorted(maps.Keys(r.products))
+	result := make([]*Product, 0, len(skus))
+	for _, sku := range paginate(skus, p) {
+		result = append(result, r.products[sku])
+	}
+	return result, nil
+}
+
+func (r *MemoryRepository) SaveOrder(o *Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.customers[o.customer.ID()]; !ok {
+		return fmt.Errorf("saving order %s: customer %s: %w", o.id, o.customer.ID(), ErrNotFound)
+	}
+	for _, item := range o.items {
+		if _, ok := r.products[item.Product().SKU()]; !ok {
+			return fmt.Errorf("saving order %s: product %s: %w", o.id, item.Product().SKU(), ErrNotFound)
+		}
+	}
+	r.orders[o.id] = o
+	return nil
+}
+
+func (r *MemoryRepository) FindOrder(id string) (*Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if o, ok := r.orders[id]; ok {
+		return o, nil
+	}
+	return nil, fmt.Errorf("order %s: %w", id, ErrNotFound)
+}
+
+func (r *MemoryRepository) ListOrders(f OrderFilter) ([]*Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []*Order
+	for _, o := range r.orders {
+		if f.matches(o.Status(), o.customer.ID(), o.createdAt) {
+			result = append(result, o)
+		}
+	}
+	sortOrders(result, func(o *Order) (time.Time, string) { return o.createdAt, o.id })
+	return paginate(result, f.Page), nil
+}
+
+// JSONRepository keeps everything in one JSON file. The file is read
+// when the repository is opened and rewritten on every save.
+type JSONRepository struct {
+	mu        sync.Mutex
+	path      string
+	inventory *Inventory    // orders read back hold their stock here
+	machine   *OrderMachine // and run on this
+	data      struct {
+		Customers map[string]customerRecord `json:"customers"`
+		Products  map[string]productRecord  `json:"products"`
+		Orders    map[string]orderRecord    `json:"orders"`
+	}
+	products map[string]*Product // handed out, by SKU
+	orders   map[string]*Order   // handed out, by ID
+}
+
+// OpenJSONRepository opens the repository in path, starting empty if
+// the file does not exist yet. Orders read back hold their stock in inv
+// (nil for none) and run on machine.
+func OpenJSONRepository(path string, inv *Inventory, machine *OrderMachine) (*JSONRepository, error) {
+	if machine == nil {
+		return nil, errors.New("opening repository: state machine is required")
+	}
+	r := &JSONRepository{
+		path:      path,
+		inventory: inv,
+		machine:   machine,
+		products:  make(map[string]*Product),
+		orders:    make(map[string]*Order),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &r.data); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	if r.data.Customers == nil {
+		r.data.Customers = make(map[string]customerRecord)
+	}
+	if r.data.Products == nil {
+		r.data.Products = make(map[string]productRecord)
+	}
+	if r.data.Orders == nil {
+		r.data.Orders = make(map[string]orderRecord)
+	}
+	if err := r.holdActive(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// holdActive restores every pending and confirmed order, oldest first,
+// so their stock is held again before new orders can take it
+func (r *JSONRepository) holdActive() error {
+	var active []orderRecord
+	for _, rec := range r.data.Orders {
+		if rec.Status == StatusPending || rec.Status == StatusConfirmed {
+			active = append(active, rec)
+		}
+	}
+	sortOrders(active, func(rec orderRecord) (time.Time, string) { return rec.CreatedAt, rec.ID })
+	for _, rec := range active {
+		if _, err := r.order(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the file to a temporary name first, so a failed write
+// never leaves it half written
+func (r *JSONRepository) flush() error {
+	data, err := json.MarshalIndent(r.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// save stores value under key and flushes, undoing the change if the
+// flush fails
+func save[T any](r *JSONRepository, records map[string]T, key string, value T) error {
+	old, existed := records[key]
+	records[key] = value
+	if err := r.flush(); err != nil {
+		if existed {
+			records[key] = old
+		} else {
+			delete(records, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *JSONRepository) SaveCustomer(c *Customer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return save(r, r.data.Customers, c.ID(), newCustomerRecord(c))
+}
+
+func (r *JSONRepository) FindCustomer(id string) (*Customer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cr, ok := r.data.Customers[id]
+	if !ok {
+		return nil, fmt.Errorf("customer %s: %w", id, ErrNotFound)
+	}
+	return cr.customer()
+}
+
+func (r *JSONRepository) ListCustomers(p Page) ([]*Customer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []*Customer
+	for _, id := range paginate(slices.Sorted(maps.Keys(r.data.Customers)), p) {
+		c, err := r.data.Customers[id].customer()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func (r *JSONRepository) SaveProduct(p *Product) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := save(r, r.data.Products, p.SKU(), newProductRecord(p)); err != nil {
+		return err
+	}
+	r.products[p.SKU()] = p
+	return nil
+}
+
+func (r *JSONRepository) FindProduct(sku string) (*Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.product(sku)
+}
+
+// product returns the shared instance of a stored product
+func (r *JSONRepository) product(sku string) (*Product, error) {
+	return shared(r.products, sku, func() (*Product, error) {
+		pr, ok := r.data.Products[sku]
+		if !ok {
+			return nil, fmt.Errorf("product %s: %w", sku, ErrNotFound)
+		}
+		return pr.product(), nil
+	})
+}
+
+func (r *JSONRepository) ListProducts(p Page) ([]*Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []*Product
+	for _, sku := range paginate(slices.Sorted(maps.Keys(r.data.Products)), p) {
+		product, err := r.product(sku)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, product)
+	}
+	return result, nil
+}
+
+func (r *JSONRepository) SaveOrder(o *Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := newOrderRecord(o)
+	if _, ok := r.data.Customers[rec.CustomerID]; !ok {
+		return fmt.Errorf("saving order %s: customer %s: %w", o.id, rec.CustomerID, ErrNotFound)
+	}
+	for _, sku := range rec.skus() {
+		if _, ok := r.data.Products[sku]; !ok {
+			return fmt.Errorf("saving order %s: product %s: %w", o.id, sku, ErrNotFound)
+		}
+	}
+	previous := make([]productRecord, len(rec.stock))
+	for i, pr := range rec.stock {
+		previous[i] = r.data.Products[pr.SKU]
+		r.data.Products[pr.SKU] = pr
+	}
+	if err := save(r, r.data.Orders, o.id, rec); err != nil {
+		for _, pr := range previous {
+			r.data.Products[pr.SKU] = pr
+		}
+		return err
+	}
+	for _, item := range o.items {
+		r.products[item.Product().SKU()] = item.Product()
+	}
+	r.orders[o.id] = o
+	return nil
+}
+
+func (r *JSONRepository) FindOrder(id string) (*Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.data.Orders[id]
+	if !ok {
+		return nil, fmt.Errorf("order %s: %w", id, ErrNotFound)
+	}
+	return r.order(rec)
+}
+
+// order returns the shared instance of a stored order, restoring it
+// with the customer and products it refers to on first use
+func (r *JSONRepository) order(rec orderRecord) (*Order, error) {
+	return shared(r.orders, rec.ID, func() (*Order, error) {
+		cr, ok := r.data.Customers[rec.CustomerID]
+		if !ok {
+			return nil, fmt.Errorf("order %s: customer %s: %w", rec.ID, rec.CustomerID, ErrNotFound)
+		}
+		customer, err := cr.customer()
+		if err != nil {
+			return nil, err
+		}
+		products := make(map[string]*Product)
+		for _, sku := range rec.skus() {
+			if p, err := r.product(sku); err == nil {
+				products[sku] = p
+			}
+		}
+		return rec.order(customer, products, r.inventory, r.machine)
+	})
+}
+
+func (r *JSONRepository) ListOrders(f OrderFilter) ([]*Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matched []orderRecord
+	for _, rec := range r.data.Orders {
+		if f.matches(rec.Status, rec.CustomerID, rec.CreatedAt) {
+			matched = append(matched, rec)
+		}
+	}
+	sortOrders(matched, func(rec orderRecord) (time.Time, string) { return rec.CreatedAt, rec.ID })
+	var result []*Order
+	for _, rec := range paginate(matched, f.Page) {
+		o, err := r.order(rec)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, o)
+	}
+	return result, nil
+}
+
+// SQLiteDriver is the database/sql driver SQLite databases are opened
+// with. The program links none itself; import one registering this
+// name, such as modernc.org/sqlite, to enable SQLiteRepository.
+const SQLiteDriver = "sqlite"
+
+// sqliteTime stores times in UTC at a fixed width, so they sort as text
+const sqliteTime = "2006-01-02T15:04:05.000000000Z"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS customers (
+	id         TEXT PRIMARY KEY,
+	name       TEXT NOT NULL,
+	email      TEXT NOT NULL,
+	addresses  TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS products (
+	sku          TEXT PRIMARY KEY,
+	name         TEXT NOT NULL,
+	description  TEXT NOT NULL,
+	price_minor  INTEGER NOT NULL,
+	currency     TEXT NOT NULL,
+	weight_grams INTEGER NOT NULL,
+	in_stock     INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS orders (
+	id          TEXT PRIMARY KEY,
+	customer_id TEXT NOT NULL REFERENCES customers (id),
+	status      TEXT NOT NULL,
+	created_at  TEXT NOT NULL,
+	updated_at  TEXT NOT NULL,
+	record      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS orders_by_customer ON orders (customer_id, created_at);
+CREATE INDEX IF NOT EXISTS orders_by_status ON orders (status, created_at);
+CREATE TABLE IF NOT EXISTS order_events (
+	order_id    TEXT NOT NULL REFERENCES orders (id),
+	seq         INTEGER NOT NULL,
+	type        TEXT NOT NULL,
+	from_status TEXT NOT NULL,
+	to_status   TEXT NOT NULL,
+	actor       TEXT NOT NULL,
+	reason      TEXT NOT NULL,
+	at          TEXT NOT NULL,
+	items       TEXT,
+	amount      TEXT,
+	PRIMARY KEY (order_id, seq)
+);`
+
+// SQLiteRepository stores everything in an SQLite database. Orders keep
+// their filterable fields in columns and the rest as a JSON record;
+// their events go to an append-only order_events table.
+type SQLiteRepository struct {
+	db        *sql.DB
+	inventory *Inventory    // orders read back hold their stock here
+	machine   *OrderMachine // and run on this
+
+	mu       sync.Mutex          // guards the instances handed out
+	products map[string]*Product // by SKU
+	orders   map[string]*Order   // by ID
+}
+
+// OpenSQLiteRepository opens the database at dsn, creating its tables
+// if needed. Orders read back hold their stock in inv (nil for none)
+// and run on machine. It fails unless a driver for SQLiteDriver is
+// linked in.
+func OpenSQLiteRepository(dsn string, inv *Inventory, machine *OrderMachine) (*SQLiteRepository, error) {
+	if machine == nil {
+		return nil, errors.New("opening repository: state machine is required")
+	}
+	if !slices.Contains(sql.Drivers(), SQLiteDriver) {
+		return nil, fmt.Errorf("no %q database driver linked in; import a SQLite driver such as modernc.org/sqlite", SQLiteDriver)
+	}
+	db, err := sql.Open(SQLiteDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating tables: %w", err)
+	}
+	r := &SQLiteRepository{
+		db:        db,
+		inventory: inv,
+		machine:   machine,
+		products:  make(map[string]*Product),
+		orders:    make(map[string]*Order),
+	}
+	if err := r.holdActive(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// holdActive restores every pending and confirmed order, oldest first,
+// so their stock is held again before new orders can take it
+func (r *SQLiteRepository) holdActive() error {
+	rows, err := r.db.Query(`SELECT id FROM orders WHERE status IN (?, ?) ORDER BY created_at, id`,
+		StatusPending, StatusConfirmed)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := r.FindOrder(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) Close() error { return r.db.Close() }
+
+func (r *SQLiteRepository) SaveCustomer(c *Customer) error {
+	rec := newCustomerRecord(c)
+	addresses, err := json.Marshal(rec.Addresses)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`INSERT INTO customers (id, name, email, addresses, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, email = excluded.email, addresses = excluded.addresses`,
+		rec.ID, rec.Name, rec.Email, string(addresses), rec.CreatedAt.UTC().Format(sqliteTime))
+	return err
 }
 
-func (b *OrderBuilder) ShipTo(addr *Address) *OrderBuilder {
-	if addr == nil {
-		b.errors = append(b.errors, "shipping address is required")
+func (r *SQLiteRepository) FindCustomer(id string) (*Customer, error) {
+	customers, err := r.queryCustomers(`WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
 	}
-	b.order.shippingAddress = addr
-	return b
+	if len(customers) == 0 {
+		return nil, fmt.Errorf("customer %s: %w", id, ErrNotFound)
+	}
+	return customers[0], nil
 }
 
-func (b *OrderBuilder) BillTo(addr *Address) *OrderBuilder {
-	b.order.billingAddress = addr
-	return b
+func (r *SQLiteRepository) ListCustomers(p Page) ([]*Customer, error) {
+	return r.queryCustomers(`ORDER BY id LIMIT ? OFFSET ?`, sqliteLimit(p), max(p.Offset, 0))
 }
 
-func (b *OrderBuilder) Notes(notes string) *OrderBuilder {
-	b.order.notes = notes
-	return b
+func (r *SQLiteRepository) queryCustomers(where string, args ...any) ([]*Customer, error) {
+	rows, err := r.db.Query(`SELECT id, name, email, addresses, created_at FROM customers `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*Customer
+	for rows.Next() {
+		var rec customerRecord
+		var addresses, createdAt string
+		if err := rows.Scan(&rec.ID, &rec.Name, &rec.Email, &addresses, &createdAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(addresses), &rec.Addresses); err != nil {
+			return nil, fmt.Errorf("customer %s: %w", rec.ID, err)
+		}
+		if rec.CreatedAt, err = time.Parse(sqliteTime, createdAt); err != nil {
+			return nil, fmt.Errorf("customer %s: %w", rec.ID, err)
+		}
+		c, err := rec.customer()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
 }
 
-func (b *OrderBuilder) Build() (*Order, error) {
-	// Validate required fields
-	if b.order.customer == nil {
-		b.errors = append(b.errors, "customer is required")
+func (r *SQLiteRepository) SaveProduct(p *Product) error {
+	rec := newProductRecord(p)
+	_, err := r.db.Exec(`INSERT INTO products (sku, name, description, price_minor, currency, weight_grams, in_stock)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (sku) DO UPDATE SET name = excluded.name, description = excluded.description,
+			price_minor = excluded.price_minor, currency = excluded.currency,
+			weight_grams = excluded.weight_grams, in_stock = excluded.in_stock`,
+		rec.SKU, rec.Name, rec.Description, rec.Price.Minor(), rec.Price.Currency(), rec.WeightGrams, rec.InStock)
+	if err != nil {
+		return err
 	}
-	if len(b.order.items) == 0 {
-		b.errors = append(b.errors, "order must have at least one item")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.products[p.SKU()] = p
+	return nil
+}
+
+func (r *SQLiteRepository) FindProduct(sku string) (*Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.product(sku)
+}
+
+// product returns the shared instance of a stored product. r.mu must
+// be held.
+func (r *SQLiteRepository) product(sku string) (*Product, error) {
+	if p, ok := r.products[sku]; ok {
+		return p, nil
 	}
-	if b.order.shippingAddress == nil {
-		b.errors = append(b.errors, "shipping address is required")
+	products, err := r.queryProducts(`WHERE sku = ?`, sku)
+	if err != nil {
+		return nil, err
+	}
+	if len(products) == 0 {
+		return nil, fmt.Errorf("product %s: %w", sku, ErrNotFound)
 	}
+	return products[0], nil
+}
 
-	if len(b.errors) > 0 {
-		return nil, fmt.Errorf("order validation failed: %s", strings.Join(b.errors, "; "))
+func (r *SQLiteRepository) ListProducts(p Page) ([]*Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queryProducts(`ORDER BY sku LIMIT ? OFFSET ?`, sqliteLimit(p), max(p.Offset, 0))
+}
+
+// queryProducts returns the shared instances of the products a query
+// finds. r.mu must be held.
+func (r *SQLiteRepository) queryProducts(where string, args ...any) ([]*Product, error) {
+	rows, err := r.db.Query(`SELECT sku, name, description, price_minor, currency, weight_grams, in_stock
+		FROM products `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*Product
+	for rows.Next() {
+		var rec productRecord
+		var minor int64
+		var currency string
+		if err := rows.Scan(&rec.SKU, &rec.Name, &rec.Description, &minor, &currency, &rec.WeightGrams, &rec.InStock); err != nil {
+			return nil, err
+		}
+		if rec.Price, err = NewMoneyFromMinor(minor, currency); err != nil {
+			return nil, fmt.Errorf("product %s: %w", rec.SKU, err)
+		}
+		p, _ := shared(r.products, rec.SKU, func() (*Product, error) { return rec.product(), nil })
+		result = append(result, p)
 	}
+	return result, rows.Err()
+}
 
-	// Calculate total
-	var totalCents int64
-	currency := ""
-	for _, item := range b.order.items {
-		if currency == "" {
-			currency = item.Subtotal().Currency()
+// SaveOrder upserts the order row, appends the events not stored yet
+// and updates the stock of its products, in one transaction
+func (r *SQLiteRepository) SaveOrder(o *Order) error {
+	rec := newOrderRecord(o)
+	events := rec.Events
+	rec.Events = nil
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var found int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM customers WHERE id = ?`, rec.CustomerID).Scan(&found); err != nil {
+		return err
+	} else if found == 0 {
+		return fmt.Errorf("saving order %s: customer %s: %w", o.id, rec.CustomerID, ErrNotFound)
+	}
+	for _, pr := range rec.stock {
+		res, err := tx.Exec(`UPDATE products SET in_stock = ? WHERE sku = ?`, pr.InStock, pr.SKU)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("saving order %s: product %s: %w", o.id, pr.SKU, ErrNotFound)
 		}
-		totalCents += item.Subtotal().Cents()
 	}
-	b.order.total = &Money{cents: totalCents, currency: currency}
 
-	// Use shipping as billing if not specified
-	if b.order.billingAddress == nil {
-		b.order.billingAddress = b.order.shippingAddress
+	if _, err := tx.Exec(`INSERT INTO orders (id, customer_id, status, created_at, updated_at, record) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, updated_at = excluded.updated_at, record = excluded.record`,
+		rec.ID, rec.CustomerID, rec.Status, rec.CreatedAt.UTC().Format(sqliteTime),
+		rec.UpdatedAt.UTC().Format(sqliteTime), string(data)); err != nil {
+		return err
+	}
+	for _, e := range events {
+		var items, amount []byte
+		if e.Items != nil {
+			if items, err = json.Marshal(e.Items); err != nil {
+				return err
+			}
+		}
+		if e.Amount != nil {
+			if amount, err = json.Marshal(e.Amount); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO order_events (order_id, seq, type, from_status, to_status, actor, reason, at, items, amount)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (order_id, seq) DO NOTHING`,
+			e.OrderID, e.Seq, e.Type, e.From, e.To, e.Actor, e.Reason, e.At.UTC().Format(sqliteTime),
+			nullString(items), nullString(amount)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, item := range o.items {
+		r.products[item.Product().SKU()] = item.Product()
 	}
+	r.orders[o.id] = o
+	return nil
+}
 
-	return &b.order, nil
+func (r *SQLiteRepository) FindOrder(id string) (*Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return shared(r.orders, id, func() (*Order, error) { return r.loadOrder(id) })
+}
+
+// loadOrder restores an order from the database. r.mu must be held.
+func (r *SQLiteRepository) loadOrder(id string) (*Order, error) {
+	var data string
+	err := r.db.QueryRow(`SELECT record FROM orders WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("order %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec orderRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return nil, fmt.Errorf("order %s: %w", id, err)
+	}
+	if rec.Events, err = r.events(id); err != nil {
+		return nil, err
+	}
+
+	customer, err := r.FindCustomer(rec.CustomerID)
+	if err != nil {
+		return nil, fmt.Errorf("order %s: %w", id, err)
+	}
+	products := make(map[string]*Product)
+	for _, sku := range rec.skus() {
+		if products[sku], err = r.product(sku); err != nil {
+			return nil, fmt.Errorf("order %s: %w", id, err)
+		}
+	}
+	return rec.order(customer, products, r.inventory, r.machine)
+}
+
+// events reads an order's events in sequence
+func (r *SQLiteRepository) events(orderID string) ([]OrderEvent, error) {
+	rows, err := r.db.Query(`SELECT seq, type, from_status, to_status, actor, reason, at, items, amount
+		FROM order_events WHERE order_id = ? ORDER BY seq`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []OrderEvent
+	for rows.Next() {
+		e := OrderEvent{OrderID: orderID}
+		var at string
+		var items, amount sql.NullString
+		if err := rows.Scan(&e.Seq, &e.Type, &e.From, &e.To, &e.Actor, &e.Reason, &at, &items, &amount); err != nil {
+			return nil, err
+		}
+		if e.At, err = time.Parse(sqliteTime, at); err != nil {
+			return nil, fmt.Errorf("order %s event #%d: %w", orderID, e.Seq, err)
+		}
+		if items.Valid {
+			if err := json.Unmarshal([]byte(items.String), &e.Items); err != nil {
+				return nil, fmt.Errorf("order %s event #%d: %w", orderID, e.Seq, err)
+			}
+		}
+		if amount.Valid {
+			e.Amount = new(Money)
+			if err := json.Unmarshal([]byte(amount.String), e.Amount); err != nil {
+				return nil, fmt.Errorf("order %s event #%d: %w", orderID, e.Seq, err)
+			}
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+func (r *SQLiteRepository) ListOrders(f OrderFilter) ([]*Order, error) {
+	var where []string
+	var args []any
+	if f.Status != "" {
+		where, args = append(where, "status = ?"), append(args, f.Status)
+	}
+	if f.CustomerID != "" {
+		where, args = append(where, "customer_id = ?"), append(args, f.CustomerID)
+	}
+	if !f.From.IsZero() {
+		where, args = append(where, "created_at >= ?"), append(args, f.From.UTC().Format(sqliteTime))
+	}
+	if !f.To.IsZero() {
+		where, args = append(where, "created_at < ?"), append(args, f.To.UTC().Format(sqliteTime))
+	}
+	query := `SELECT id FROM orders`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY created_at, id LIMIT ? OFFSET ?`
+	args = append(args, sqliteLimit(f.Page), max(f.Offset, 0))
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]*Order, 0, len(ids))
+	for _, id := range ids {
+		o, err := r.FindOrder(id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, o)
+	}
+	return result, nil
+}
+
+// sqliteLimit is p's LIMIT; SQLite takes -1 as no limit
+func sqliteLimit(p Page) int {
+	if p.Limit <= 0 {
+		return -1
+	}
+	return p.Limit
+}
+
+// nullString stores empty JSON as NULL
+func nullString(data []byte) sql.NullString {
+	return sql.NullString{String: string(data), Valid: data != nil}
 }
 
 // ========================================
@@ -392,7 +3424,7 @@ func (b *OrderBuilder) Build() (*Order, error) {
 // ========================================
 
 func main() {
-	fmt.Println("=== E-Commerce Order System ===\n")
+	fmt.Print("=== E-Commerce Order System ===\n\n")
 
 	// Create products
 	fmt.Println("Creating products...")
@@ -427,9 +3459,24 @@ func main() {
 	fmt.Printf("  Customer: %s (%s)\n", customer.Name(), customer.Email())
 	fmt.Printf("  Addresses: %d registered\n", len(customer.Addresses()))
 
+	// Orders hold their stock in one inventory and run on one machine,
+	// which appends every transition to a log file
+	logFile, err := os.CreateTemp("", "order-events-*.jsonl")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+	eventLog := NewFileEventStore(logFile.Name())
+	inventory := NewInventory(15 * time.Minute)
+	lifecycle := NewOrderMachine(eventLog, OrderTransitions)
+
 	// Build an order using the builder
 	fmt.Println("\nBuilding order...")
 	order, err := NewOrderBuilder("ORD-2024-001").
+		Inventory(inventory).
+		Machine(lifecycle).
 		Customer(customer).
 		AddItem(laptop, 1).
 		AddItem(mouse, 2).
@@ -481,38 +3528,476 @@ func main() {
 	fmt.Println("\n=== Validation Demo ===")
 
 	_, err = NewOrderBuilder("ORD-BAD").
+		Inventory(inventory).
+		Machine(lifecycle).
 		Build() // Missing customer, items, address
 
 	if err != nil {
 		fmt.Println("Invalid order rejected:", err)
 	}
 
+	// Stock is reserved on Build, committed on Confirm, released on Cancel
+	fmt.Println("\n=== Inventory Demo ===")
+	fmt.Printf("Laptop after delivery: %d on hand, %d reserved\n", laptop.InStock(), laptop.Reserved())
+
+	held, err := NewOrderBuilder("ORD-2024-002").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(customer).
+		AddItem(laptop, 2).
+		ShipTo(workAddr).
+		Build()
+	if err != nil {
+		fmt.Println("Error:", err)
+	} else {
+		fmt.Printf("Built %s: laptop %d reserved, %d available\n", held.ID(), laptop.Reserved(), laptop.Available())
+		held.Cancel()
+		fmt.Printf("Cancelled %s: laptop %d reserved, %d available\n", held.ID(), laptop.Reserved(), laptop.Available())
+	}
+
+	// Every short line item is reported and nothing is held
+	_, err = NewOrderBuilder("ORD-2024-003").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(customer).
+		AddItem(laptop, 60).
+		AddItem(mouse, 1).
+		AddItem(keyboard, 500).
+		ShipTo(homeAddr).
+		Build()
+	var reservationErr *ReservationError
+	if errors.As(err, &reservationErr) {
+		fmt.Println("Oversell rejected:")
+		for _, shortage := range reservationErr.Shortages {
+			fmt.Println("  -", shortage)
+		}
+		fmt.Printf("Mouse reserved after rejection: %d\n", mouse.Reserved())
+	}
+
+	// Concurrent orders for the same SKU never oversell
+	gpuPrice, _ := NewMoney(1599.00, "USD")
+	gpu := NewProduct("SKU-004", "Graphics Card", gpuPrice)
+	gpu.AddStock(3)
+	var wg sync.WaitGroup
+	var soldMu sync.Mutex
+	sold := 0
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			order, err := NewOrderBuilder(fmt.Sprintf("ORD-GPU-%02d", i)).
+				Inventory(inventory).
+				Machine(lifecycle).
+				Customer(customer).
+				AddItem(gpu, 1).
+				ShipTo(homeAddr).
+				Build()
+			if err == nil && order.Confirm() == nil {
+				soldMu.Lock()
+				sold++
+				soldMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("10 buyers raced for 3 graphics cards: %d sold, %d left\n", sold, gpu.InStock())
+
+	// Holds that are never confirmed lapse
+	quick := NewInventory(20 * time.Millisecond)
+	expiring, err := NewOrderBuilder("ORD-2024-004").
+		Inventory(quick).
+		Machine(lifecycle).
+		Customer(customer).
+		AddItem(keyboard, 5).
+		ShipTo(homeAddr).
+		Build()
+	if err != nil {
+		fmt.Println("Error:", err)
+	} else {
+		fmt.Printf("Keyboards available while held: %d\n", keyboard.Available())
+		time.Sleep(30 * time.Millisecond)
+		fmt.Printf("Expired holds released: %d, keyboards available: %d\n", quick.ExpireReservations(), keyboard.Available())
+		if err := expiring.Confirm(); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+
+	// Exact amounts per currency, conversion and fair splits
+	fmt.Println("\n=== Money Demo ===")
+	for _, in := range []struct{ amount, currency string }{
+		{"19.99", "usd"}, {"1500", "JPY"}, {"0.125", "KWD"}, {"1.5", "JPY"}, {"9.999", "EUR"},
+	} {
+		if m, err := ParseMoney(in.amount, in.currency); err != nil {
+			fmt.Println("  Error:", err)
+		} else {
+			fmt.Printf("  Parsed %s %s as %s (%d minor units)\n", in.amount, in.currency, m, m.Minor())
+		}
+	}
+	price := 1.005
+	rounded, _ := NewMoney(price, "USD")
+	fmt.Printf("  NewMoney(%v) = %s, float math gave %d cents\n", price, rounded, int64(price*100+0.5))
+
+	rates, err := LoadRatesCSV(strings.NewReader("from,to,rate\nUSD,EUR,0.92\nUSD,JPY,151.37\nGBP,USD,1.27\n"))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	converter := &Converter{Rates: rates}
+	hundred, _ := ParseMoney("100", "USD")
+	tenPounds, _ := ParseMoney("10", "GBP")
+	fiftyEuros, _ := ParseMoney("50", "EUR")
+	for _, conv := range []struct {
+		from *Money
+		to   string
+	}{{hundred, "EUR"}, {hundred, "JPY"}, {tenPounds, "JPY"}, {fiftyEuros, "USD"}, {hundred, "CHF"}} {
+		if converted, err := converter.Convert(conv.from, conv.to); err != nil {
+			fmt.Println("  Error:", err)
+		} else {
+			fmt.Printf("  %s = %s\n", conv.from, converted)
+		}
+	}
+	down := &Converter{Rates: rates, Rounding: RoundDown}
+	truncated, _ := down.Convert(fiftyEuros, "USD")
+	fmt.Printf("  %s = %s rounding down\n", fiftyEuros, truncated)
+
+	for _, split := range []struct {
+		amount *Money
+		ratios []int
+	}{{hundred, []int{1, 1, 1}}, {rounded, []int{3, 7}}} {
+		shares, _ := split.amount.Allocate(split.ratios...)
+		fmt.Printf("  %s split %v: %v\n", split.amount, split.ratios, shares)
+	}
+
+	// Orders total in one currency
+	adapterPrice, _ := ParseMoney("12.50", "EUR")
+	adapter := NewProduct("SKU-005", "Travel Adapter", adapterPrice)
+	adapter.AddStock(10)
+	_, err = NewOrderBuilder("ORD-2024-005").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(customer).
+		AddItem(mouse, 1).
+		AddItem(adapter, 2).
+		ShipTo(homeAddr).
+		Build()
+	fmt.Println("  Mixed currencies without a converter:", err)
+	mixed, err := NewOrderBuilder("ORD-2024-006").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(customer).
+		Currency("USD").
+		ConvertWith(converter).
+		AddItem(mouse, 1).
+		AddItem(adapter, 2).
+		ShipTo(homeAddr).
+		Build()
+	if err != nil {
+		fmt.Println("Error:", err)
+	} else {
+		fmt.Printf("  %s total: %s (%d adapters reserved)\n", mixed.ID(), mixed.Total(), adapter.Reserved())
+	}
+
+	// Coupons, tax by region and shipping by weight and zone
+	fmt.Println("\n=== Pricing Demo ===")
+	laptop.SetWeightGrams(2500)
+	mouse.SetWeightGrams(100)
+	keyboard.SetWeightGrams(900)
+
+	taxes := NewTaxTable()
+	taxes.AddRule(TaxRule{Country: "USA", State: "MA", Name: "Massachusetts sales tax", Rate: "6.25"})
+	taxes.AddRule(TaxRule{Country: "USA", State: "CA", Name: "California sales tax", Rate: "7.25"})
+	taxes.AddRule(TaxRule{Country: "GBR", Name: "UK VAT", Rate: "20", TaxShipping: true})
+
+	shipping := NewShippingTable()
+	shipping.AddZone("domestic", "USA")
+	shipping.AddZone("international", "*")
+	for _, rate := range []struct {
+		zone   string
+		grams  int
+		amount string
+	}{
+		{"domestic", 1000, "5.99"}, {"domestic", 5000, "12.99"}, {"domestic", 20000, "24.99"},
+		{"international", 2000, "19.99"}, {"international", 10000, "49.99"},
+	} {
+		price, _ := ParseMoney(rate.amount, "USD")
+		shipping.AddRate(rate.zone, rate.grams, price)
+	}
+
+	pricing := NewPricing(taxes, shipping)
+	save10, _ := NewPercentCoupon("SAVE10", 10)
+	mice, _ := NewBuyXGetYCoupon("MICE3FOR2", mouse.SKU(), 2, 1)
+	fiver, _ := ParseMoney("5", "USD")
+	pricing.AddCoupon(save10)
+	pricing.AddCoupon(mice)
+	pricing.AddCoupon(NewFixedCoupon("WELCOME5", fiver))
+
+	priced, err := NewOrderBuilder("ORD-2024-007").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(customer).
+		Pricing(pricing).
+		Coupon("MICE3FOR2").
+		Coupon("save10").
+		AddItem(laptop, 1).
+		AddItem(mouse, 3).
+		ShipTo(homeAddr).
+		Build()
+	if err != nil {
+		fmt.Println("Error:", err)
+	} else {
+		fmt.Println(priced)
+		data, _ := json.Marshal(priced.Breakdown())
+		fmt.Println("JSON pricing:", string(data))
+	}
+
+	londonAddr, _ := NewAddress("10 Downing St", "London", "", "SW1A 2AA", "GBR")
+	abroad, err := NewOrderBuilder("ORD-2024-008").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(customer).
+		Pricing(pricing).
+		Coupon("WELCOME5").
+		AddItem(keyboard, 1).
+		ShipTo(londonAddr).
+		Build()
+	if err != nil {
+		fmt.Println("Error:", err)
+	} else {
+		b := abroad.Breakdown()
+		fmt.Printf("%s to London: %s, %s shipping, %s VAT (shipping taxed), total %s\n",
+			abroad.ID(), b.Subtotal, b.Shipping.Amount, b.Tax.Amount, abroad.Total())
+	}
+
+	_, err = NewOrderBuilder("ORD-2024-009").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(customer).
+		Pricing(pricing).
+		Coupon("FREESTUFF").
+		AddItem(mouse, 1).
+		ShipTo(homeAddr).
+		Build()
+	fmt.Println("Unknown coupon:", err)
+	_, err = NewOrderBuilder("ORD-2024-009").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(customer).
+		Pricing(pricing).
+		Coupon("SAVE10").
+		Coupon("save10").
+		AddItem(mouse, 1).
+		ShipTo(homeAddr).
+		Build()
+	fmt.Println("Repeated coupon:", err)
+	_, err = NewOrderBuilder("ORD-2024-010").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(customer).
+		Pricing(pricing).
+		AddItem(laptop, 9).
+		ShipTo(homeAddr).
+		Build()
+	fmt.Println("Too heavy:", err)
+
+	// Every transition is an event; the order is its event log replayed
+	fmt.Println("\n=== Order History Demo ===")
+	machine := NewOrderMachine(eventLog, OrderTransitions)
+	machine.OnTransition(func(o *Order, e OrderEvent) {
+		fmt.Println("  audit:", e)
+	})
+	tracked, err := NewOrderBuilder("ORD-2024-011").
+		Inventory(inventory).
+		Machine(machine).
+		Customer(customer).
+		AddItem(laptop, 1).
+		AddItem(mouse, 2).
+		ShipTo(homeAddr).
+		Build()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	refund, _ := ParseMoney("49.99", "USD")
+	for _, e := range []OrderEvent{
+		{Type: EventConfirmed, Actor: "payments", Reason: "card charged"},
+		{Type: EventPartiallyShipped, Actor: "warehouse", Items: map[string]int{mouse.SKU(): 2}},
+		{Type: EventShipped, Actor: "warehouse", Items: map[string]int{mouse.SKU(): 1}},
+		{Type: EventShipped, Actor: "warehouse", Items: map[string]int{laptop.SKU(): 1}},
+		{Type: EventDelivered, Actor: "courier"},
+		{Type: EventCancelled, Actor: customer.ID()},
+		{Type: EventReturned, Actor: customer.ID(), Reason: "arrived broken", Items: map[string]int{mouse.SKU(): 1}},
+		{Type: EventRefunded, Actor: "support", Reason: "broken mouse", Amount: refund},
+	} {
+		if err := tracked.Transition(e); err != nil {
+			fmt.Println("  rejected:", err)
+		}
+	}
+	fmt.Printf("%s is %s, refunded %s, mice on hand %d\n",
+		tracked.ID(), tracked.Status(), tracked.Refunded(), mouse.InStock())
+
+	events, err := machine.Store().Events(tracked.ID())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	rebuilt, err := NewOrderBuilder(tracked.ID()).
+		Inventory(inventory).
+		Machine(machine).
+		Customer(customer).
+		AddItem(laptop, 1).
+		AddItem(mouse, 2).
+		ShipTo(homeAddr).
+		Restore(events)
+	if err != nil {
+		fmt.Println("Error:", err)
+	} else {
+		fmt.Printf("Replayed %d events from the log file: %s, refunded %s, last change by %s\n",
+			len(events), rebuilt.Status(), rebuilt.Refunded(), events[len(events)-1].Actor)
+	}
+
+	// Replaying a log for a different order is caught by the guards
+	_, err = NewOrderBuilder(tracked.ID()).
+		Inventory(inventory).
+		Machine(machine).
+		Customer(customer).
+		AddItem(laptop, 2).
+		ShipTo(homeAddr).
+		Restore(events)
+	fmt.Println("Mismatched log:", err)
+
+	// Customers, products and orders outlive the process
+	fmt.Println("\n=== Repository Demo ===")
+	dataDir, err := os.MkdirTemp("", "orders-*")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer os.RemoveAll(dataDir)
+	jsonPath := filepath.Join(dataDir, "orders.json")
+	jsonRepo, err := OpenJSONRepository(jsonPath, inventory, lifecycle)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	repos := []struct {
+		name string
+		repo Repository
+	}{{"memory", NewMemoryRepository()}, {"json", jsonRepo}}
+	if sqliteRepo, err := OpenSQLiteRepository(filepath.Join(dataDir, "orders.db"), inventory, lifecycle); err != nil {
+		fmt.Println("SQLite skipped:", err)
+	} else {
+		defer sqliteRepo.Close()
+		repos = append(repos, struct {
+			name string
+			repo Repository
+		}{"sqlite", sqliteRepo})
+	}
+
+	var placed []*Order
+	for _, o := range []*Order{order, held, expiring, priced, abroad, tracked} {
+		if o != nil {
+			placed = append(placed, o)
+		}
+	}
+	ids := func(orders []*Order) []string {
+		result := make([]string, len(orders))
+		for i, o := range orders {
+			result[i] = o.ID()
+		}
+		return result
+	}
+	for _, backend := range repos {
+		repo := backend.repo
+		err := repo.SaveCustomer(customer)
+		for _, p := range []*Product{laptop, mouse, keyboard} {
+			err = errors.Join(err, repo.SaveProduct(p))
+		}
+		for _, o := range placed {
+			err = errors.Join(err, repo.SaveOrder(o))
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", backend.name, err)
+			continue
+		}
+		pending, _ := repo.ListOrders(OrderFilter{Status: StatusPending})
+		page2, _ := repo.ListOrders(OrderFilter{CustomerID: customer.ID(), Page: Page{Offset: 2, Limit: 2}})
+		recent, _ := repo.ListOrders(OrderFilter{From: time.Now().Add(-time.Hour), To: time.Now()})
+		fmt.Printf("%s: pending %v, page 2 %v, %d placed in the last hour\n",
+			backend.name, ids(pending), ids(page2), len(recent))
+	}
+
+	// A fresh process sees the same orders, events and stock
+	reopened, err := OpenJSONRepository(jsonPath,
+		NewInventory(15*time.Minute), NewOrderMachine(NewMemoryEventStore(), OrderTransitions))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if loaded, err := reopened.FindOrder(tracked.ID()); err != nil {
+		fmt.Println("Error:", err)
+	} else {
+		fmt.Printf("Reopened %s: %s is %s after %d events, refunded %s, total %s\n",
+			filepath.Base(jsonPath), loaded.ID(), loaded.Status(), len(loaded.History()), loaded.Refunded(), loaded.Total())
+	}
+	if stored, err := reopened.FindProduct(mouse.SKU()); err == nil {
+		fmt.Printf("Stored stock for %s: %d\n", stored.Name(), stored.InStock())
+		if loaded, err := reopened.FindOrder(tracked.ID()); err == nil {
+			fmt.Println("Order and catalog share one product:", loaded.Items()[1].Product() == stored)
+		}
+	}
+	if _, err := reopened.FindOrder("ORD-404"); errors.Is(err, ErrNotFound) {
+		fmt.Println("Lookup of unknown order:", err)
+	}
+	stranger := NewCustomer("CUST-999", "Not Saved", customer.email)
+	orphan, err := NewOrderBuilder("ORD-2024-012").
+		Inventory(inventory).
+		Machine(lifecycle).
+		Customer(stranger).
+		AddItem(mouse, 1).
+		ShipTo(homeAddr).
+		Build()
+	if err == nil {
+		fmt.Println("Order for unsaved customer:", reopened.SaveOrder(orphan))
+		orphan.Cancel()
+	}
+
 	fmt.Println("\n=== Concepts Applied ===")
 	fmt.Println("1. Constructor patterns: NewMoney, NewEmail, NewAddress, NewCustomer")
 	fmt.Println("2. Encapsulation: Private fields with getter/setter methods")
 	fmt.Println("3. Composition: Order contains Customer, Items, Address")
 	fmt.Println("4. Validation: Checked at creation and state transitions")
 	fmt.Println("5. Builder pattern: OrderBuilder for complex order creation")
+	fmt.Println("6. Inventory: Stock reserved on Build, committed on Confirm, released on Cancel")
+	fmt.Println("7. Money: Exact minor units per currency, conversion and allocation")
+	fmt.Println("8. Strategy pattern: Coupons share one interface; tax and shipping are rule tables")
+	fmt.Println("9. Event sourcing: A transition table drives the order; its events rebuild it")
+	fmt.Println("10. Repository pattern: One interface over memory, JSON file and SQLite storage")
 }
 
 // TO RUN: go run day9/06_challenge.go
 //
+// The SQLite repository needs a database/sql driver registered as
+// "sqlite"; add `import _ "modernc.org/sqlite"` in a module that
+// requires it. Without one the demo skips SQLite.
+//
 // OUTPUT:
 // === E-Commerce Order System ===
 // Creating products...
 // ...
 //
 // EXTENSIONS TO TRY:
-// 1. Add discount/coupon support to orders
-// 2. Implement inventory management (reserve stock on order)
-// 3. Add payment processing with multiple payment methods
-// 4. Create an order history for customers
-// 5. Add email notifications for status changes
+// 1. Add payment processing with multiple payment methods
+// 2. Let coupons expire or be used only once per customer
+// 3. Add a PostgreSQL repository next to the SQLite one
+// 4. Send email notifications from an OnTransition hook
+// 5. Restock automatically when a product runs low
 //
 // PATTERNS USED:
-// - Value Objects: Money, Email (immutable, validated)
+// - Value Objects: Money, Currency, Email (immutable, validated)
 // - Entity: Customer, Product, Order (identity, mutable)
 // - Builder: OrderBuilder (complex construction)
 // - Encapsulation: All structs hide internal state
 // - Composition: Order composes Customer, Items, Address
-// - State Machine: Order status transitions
+// - Repository: Memory, JSON file and SQLite storage behind one interface
+// - State Machine: Order transitions come from a table of guarded rows
+// - Event Sourcing: Orders are rebuilt by replaying their event log
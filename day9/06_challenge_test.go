@@ -0,0 +1,906 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/big"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ============================================================================
+// DAY 9: TESTS FOR THE ORDER SYSTEM CHALLENGE
+// ============================================================================
+//
+// The other files in this directory are separate programs, so name the
+// files explicitly:
+//
+//   go test day9/06_challenge.go day9/06_challenge_test.go
+//
+// ============================================================================
+
+// usd parses a USD amount
+func usd(t *testing.T, amount string) *Money {
+	t.Helper()
+	m, err := ParseMoney(amount, "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// stocked creates a product with qty units on hand
+func stocked(t *testing.T, sku string, qty int) *Product {
+	t.Helper()
+	p := NewProduct(sku, "Product "+sku, usd(t, "10.00"))
+	p.AddStock(qty)
+	return p
+}
+
+// testCustomer is a customer with a US address
+func testCustomer(t *testing.T) (*Customer, *Address) {
+	t.Helper()
+	email, err := NewEmail("buyer@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := NewAddress("1 Main St", "Boston", "MA", "02101", "USA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCustomer("CUST-T", "Test Buyer", email), addr
+}
+
+// newOrder starts a builder for a customer's order on inv and machine
+func newOrder(t *testing.T, id string, inv *Inventory, m *OrderMachine) *OrderBuilder {
+	t.Helper()
+	c, addr := testCustomer(t)
+	return NewOrderBuilder(id).Inventory(inv).Machine(m).Customer(c).ShipTo(addr)
+}
+
+// newMachine is a state machine recording in memory
+func newMachine() *OrderMachine {
+	return NewOrderMachine(NewMemoryEventStore(), OrderTransitions)
+}
+
+func TestConcurrentOrdersNeverOversell(t *testing.T) {
+	inv := NewInventory(time.Minute)
+	m := newMachine()
+	gpu := stocked(t, "GPU", 7)
+	cable := stocked(t, "CABLE", 100)
+
+	// Run with -race: every order locks the same two products
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sold := 0
+	for i := range 40 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o, err := newOrder(t, fmt.Sprintf("ORD-%02d", i), inv, m).
+				AddItem(cable, 1).
+				AddItem(gpu, 1).
+				Build()
+			if err != nil {
+				var rerr *ReservationError
+				if !errors.As(err, &rerr) {
+					t.Errorf("order %d: %v", i, err)
+				}
+				return
+			}
+			if err := o.Confirm(); err != nil {
+				t.Errorf("confirm %s: %v", o.ID(), err)
+				return
+			}
+			mu.Lock()
+			sold++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if sold != 7 {
+		t.Errorf("sold %d, want 7", sold)
+	}
+	if gpu.InStock() != 0 || gpu.Reserved() != 0 {
+		t.Errorf("gpu: %d on hand, %d reserved, want 0 and 0", gpu.InStock(), gpu.Reserved())
+	}
+	if cable.InStock() != 93 || cable.Reserved() != 0 {
+		t.Errorf("cable: %d on hand, %d reserved, want 93 and 0", cable.InStock(), cable.Reserved())
+	}
+}
+
+func TestReservationErrorListsEveryShortLine(t *testing.T) {
+	inv := NewInventory(time.Minute)
+	laptop, mouse, keyboard := stocked(t, "LAPTOP", 2), stocked(t, "MOUSE", 50), stocked(t, "KEYBOARD", 1)
+
+	_, err := newOrder(t, "ORD-SHORT", inv, newMachine()).
+		AddItem(laptop, 3).
+		AddItem(mouse, 1).
+		AddItem(keyboard, 4).
+		Build()
+	var rerr *ReservationError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("got %v, want *ReservationError", err)
+	}
+	want := map[string][2]int{"LAPTOP": {3, 2}, "KEYBOARD": {4, 1}}
+	if len(rerr.Shortages) != len(want) {
+		t.Fatalf("shortages %v, want %d", rerr.Shortages, len(want))
+	}
+	for _, s := range rerr.Shortages {
+		if w, ok := want[s.SKU]; !ok || s.Requested != w[0] || s.Available != w[1] {
+			t.Errorf("shortage %+v, want %v", *s, want)
+		}
+	}
+	var short *InsufficientStockError
+	if !errors.As(err, &short) {
+		t.Error("errors.As does not reach the shortages")
+	}
+	for _, p := range []*Product{laptop, mouse, keyboard} {
+		if p.Reserved() != 0 {
+			t.Errorf("%s: %d reserved after a rejected order", p.SKU(), p.Reserved())
+		}
+	}
+}
+
+func TestLapsedHoldsAreReleased(t *testing.T) {
+	inv := NewInventory(20 * time.Millisecond)
+	p := stocked(t, "P", 5)
+
+	o, err := newOrder(t, "ORD-LAPSE", inv, newMachine()).AddItem(p, 4).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Available() != 1 {
+		t.Fatalf("available while held: %d, want 1", p.Available())
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// Reading the product is enough; nothing else touches the inventory
+	if p.Available() != 5 || p.Reserved() != 0 {
+		t.Errorf("after expiry: %d available, %d reserved, want 5 and 0", p.Available(), p.Reserved())
+	}
+	if err := o.Confirm(); !errors.Is(err, ErrReservationExpired) {
+		t.Errorf("confirm after expiry: got %v, want ErrReservationExpired", err)
+	}
+	if o.Status() != StatusPending {
+		t.Errorf("status %s after a failed confirm, want pending", o.Status())
+	}
+	if r, ok := inv.Reservation(o.ID()); !ok || r.Status() != ReservationExpired {
+		t.Errorf("reservation %v %v, want expired", r.Status(), ok)
+	}
+}
+
+func TestCommitAndReleaseAccounting(t *testing.T) {
+	inv := NewInventory(time.Minute)
+	m := newMachine()
+	p := stocked(t, "P", 10)
+	check := func(step string, inStock, reserved int) {
+		t.Helper()
+		if p.InStock() != inStock || p.Reserved() != reserved {
+			t.Errorf("%s: %d on hand, %d reserved, want %d and %d", step, p.InStock(), p.Reserved(), inStock, reserved)
+		}
+	}
+
+	held, err := newOrder(t, "ORD-HELD", inv, m).AddItem(p, 2).AddItem(p, 1).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("built", 10, 3)
+	if err := held.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	check("cancelled while pending", 10, 0)
+	if _, ok := inv.Reservation(held.ID()); ok {
+		t.Error("released reservation is still kept")
+	}
+
+	confirmed, err := newOrder(t, "ORD-CONF", inv, m).AddItem(p, 4).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := confirmed.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	check("confirmed", 6, 0)
+	if err := p.RemoveStock(7); err == nil {
+		t.Error("removed more than is on hand")
+	}
+	if err := confirmed.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	check("cancelled after confirming", 10, 0)
+
+	shipped, err := newOrder(t, "ORD-SHIP", inv, m).AddItem(p, 5).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shipped.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	if err := shipped.Ship(); err != nil {
+		t.Fatal(err)
+	}
+	check("shipped", 5, 0)
+	if _, ok := inv.Reservation(shipped.ID()); ok {
+		t.Error("shipped order's reservation is still kept")
+	}
+	if err := inv.Commit(shipped.ID()); err == nil {
+		t.Error("committed a settled order twice")
+	}
+}
+
+func TestOrderNeedsInventoryAndMachine(t *testing.T) {
+	c, addr := testCustomer(t)
+	_, err := NewOrderBuilder("ORD-BARE").Customer(c).ShipTo(addr).AddItem(stocked(t, "P", 1), 1).Build()
+	if err == nil {
+		t.Fatal("built an order without an inventory or machine")
+	}
+	for _, want := range []string{"inventory is required", "state machine is required"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not say %q", err, want)
+		}
+	}
+
+	// A nil inventory is allowed when asked for
+	p := stocked(t, "P", 1)
+	if _, err := newOrder(t, "ORD-UNTRACKED", nil, newMachine()).AddItem(p, 5).Build(); err != nil {
+		t.Errorf("untracked order: %v", err)
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		minor            int64
+		wantErr          bool
+	}{
+		{"19.99", "USD", 1999, false},
+		{" 0.1 ", "usd", 10, false},
+		{"1000", "JPY", 1000, false},
+		{"1.5", "JPY", 0, true},
+		{"1.234", "KWD", 1234, false},
+		{"1.999", "USD", 0, true},
+		{"-1.00", "USD", 0, true},
+		{"1e3", "USD", 0, true},
+		{"12.", "USD", 0, true},
+		{"5", "XXX", 0, true},
+		{"92233720368547758.08", "USD", 0, true},
+	}
+	for _, tt := range tests {
+		m, err := ParseMoney(tt.amount, tt.currency)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseMoney(%q, %q) = %s, want an error", tt.amount, tt.currency, m)
+			}
+			continue
+		}
+		if err != nil || m.Minor() != tt.minor {
+			t.Errorf("ParseMoney(%q, %q) = %v, %v, want %d minor units", tt.amount, tt.currency, m, err, tt.minor)
+		}
+	}
+
+	// Float input goes through its shortest decimal form
+	if m, _ := NewMoney(1.005, "USD"); m.Minor() != 101 {
+		t.Errorf("NewMoney(1.005) = %s, want 1.01 USD", m)
+	}
+}
+
+func TestRoundingModes(t *testing.T) {
+	tests := []struct {
+		minor int64
+		mode  RoundingMode
+		want  int64
+	}{
+		// Scaling by 1/2: 5 -> 2.5, 7 -> 3.5, 3 -> 1.5
+		{5, RoundHalfUp, 3},
+		{5, RoundHalfEven, 2},
+		{7, RoundHalfEven, 4},
+		{5, RoundDown, 2},
+		{3, RoundUp, 2},
+		{4, RoundUp, 2},
+	}
+	for _, tt := range tests {
+		m, _ := NewMoneyFromMinor(tt.minor, "USD")
+		got, err := m.MulRat(big.NewRat(1, 2), tt.mode)
+		if err != nil || got.Minor() != tt.want {
+			t.Errorf("%d/2 with mode %d = %v, %v, want %d", tt.minor, tt.mode, got, err, tt.want)
+		}
+	}
+}
+
+func TestMoneyOverflow(t *testing.T) {
+	big1, _ := NewMoneyFromMinor(math.MaxInt64/2+1, "USD")
+	if _, err := big1.Multiply(2); err == nil {
+		t.Error("Multiply overflowed without an error")
+	}
+	if _, err := big1.MulRat(big.NewRat(3, 1), RoundHalfUp); err == nil {
+		t.Error("MulRat overflowed without an error")
+	}
+	if _, err := big1.Add(big1); err == nil {
+		t.Error("Add overflowed without an error")
+	}
+	if m, err := big1.Multiply(1); err != nil || m.Minor() != big1.Minor() {
+		t.Errorf("Multiply(1) = %v, %v", m, err)
+	}
+
+	pricey := NewProduct("YACHT", "Yacht", usd(t, "90000000000000.00"))
+	if _, err := NewOrderItem(pricey, 2000); err == nil {
+		t.Error("order item total overflowed without an error")
+	}
+}
+
+func TestConverterCrossRates(t *testing.T) {
+	rates, err := LoadRatesCSV(strings.NewReader("from,to,rate\n# quotes\nUSD,EUR,0.8\nUSD,JPY,150\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv := &Converter{Rates: rates, Rounding: RoundHalfEven}
+	tests := []struct {
+		amount, from, to, want string
+	}{
+		{"10.00", "USD", "EUR", "8.00 EUR"},
+		{"8.00", "EUR", "USD", "10.00 USD"}, // inverse
+		{"1.00", "EUR", "JPY", "188 JPY"},   // crossed through USD: 187.5 to even
+		{"3.00", "EUR", "JPY", "562 JPY"},   // 562.5 to even
+		{"100", "JPY", "EUR", "0.53 EUR"},   // 0.5333...
+		{"10.00", "USD", "USD", "10.00 USD"},
+	}
+	for _, tt := range tests {
+		m, err := ParseMoney(tt.amount, tt.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := conv.Convert(m, tt.to)
+		if err != nil || got.String() != tt.want {
+			t.Errorf("convert %s to %s = %v, %v, want %s", m, tt.to, got, err, tt.want)
+		}
+	}
+	if _, err := conv.Convert(usd(t, "1.00"), "GBP"); err == nil {
+		t.Error("converted to a currency with no rate")
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		amount string
+		ratios []int
+		want   []int64
+	}{
+		{"1.00", []int{1, 1, 1}, []int64{34, 33, 33}},
+		{"0.05", []int{3, 7}, []int64{2, 3}},
+		{"10.00", []int{1, 0, 1}, []int64{500, 0, 500}},
+		{"0.01", []int{1, 1}, []int64{1, 0}},
+		{"0.02", []int{1, 2, 2}, []int64{0, 1, 1}},
+	}
+	for _, tt := range tests {
+		shares, err := usd(t, tt.amount).Allocate(tt.ratios...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]int64, len(shares))
+		for i, s := range shares {
+			got[i] = s.Minor()
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s split %v = %v, want %v", tt.amount, tt.ratios, got, tt.want)
+		}
+	}
+	for _, ratios := range [][]int{{}, {0, 0}, {1, -1}} {
+		if _, err := usd(t, "1.00").Allocate(ratios...); err == nil {
+			t.Errorf("Allocate(%v) succeeded, want an error", ratios)
+		}
+	}
+}
+
+func TestPricingBreakdown(t *testing.T) {
+	mug := NewProduct("MUG", "Mug", usd(t, "10.00"))
+	mug.SetWeightGrams(300)
+	lamp := NewProduct("LAMP", "Lamp", usd(t, "40.00"))
+	lamp.SetWeightGrams(2000)
+
+	taxes := NewTaxTable()
+	for _, rule := range []TaxRule{
+		{Country: "USA", Name: "Sales tax", Rate: "5"},
+		{Country: "USA", State: "MA", Name: "MA sales tax", Rate: "6.25"},
+		{Country: "GBR", Name: "VAT", Rate: "20", TaxShipping: true},
+	} {
+		if err := taxes.AddRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shipping := NewShippingTable()
+	shipping.AddZone("domestic", "USA")
+	shipping.AddZone("abroad", "*")
+	shipping.AddRate("domestic", 5000, usd(t, "10.00"))
+	shipping.AddRate("domestic", 1000, usd(t, "5.00"))
+	euros, _ := ParseMoney("20.00", "EUR")
+	shipping.AddRate("abroad", 5000, euros)
+
+	pricing := NewPricing(taxes, shipping)
+	save10, _ := NewPercentCoupon("SAVE10", 10)
+	b2g1, _ := NewBuyXGetYCoupon("B2G1", "MUG", 2, 1)
+	pricing.AddCoupon(save10)
+	pricing.AddCoupon(b2g1)
+	pricing.AddCoupon(NewFixedCoupon("BIG", usd(t, "500.00")))
+
+	rates := NewStaticRates()
+	rates.Set("EUR", "USD", "1.25")
+	conv := &Converter{Rates: rates}
+
+	address := func(state, country string) *Address {
+		addr, err := NewAddress("1 High St", "Town", state, "12345", country)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+	type line struct {
+		p   *Product
+		qty int
+	}
+	tests := []struct {
+		name      string
+		lines     []line
+		to        *Address
+		coupons   []string
+		conv      *Converter
+		discounts []string
+		shipping  string
+		tax       string
+		total     string
+		err       string
+	}{
+		{name: "state rule", lines: []line{{mug, 3}}, to: address("MA", "USA"),
+			shipping: "5.00 USD", tax: "1.88 USD", total: "36.88 USD"},
+		{name: "country rule when the state has none", lines: []line{{mug, 1}}, to: address("TX", "USA"),
+			shipping: "5.00 USD", tax: "0.50 USD", total: "15.50 USD"},
+		{name: "free item then percent", lines: []line{{mug, 3}}, to: address("MA", "USA"), coupons: []string{"B2G1", "SAVE10"},
+			discounts: []string{"10.00 USD", "2.00 USD"}, shipping: "5.00 USD", tax: "1.13 USD", total: "24.13 USD"},
+		{name: "percent then free item", lines: []line{{mug, 3}}, to: address("MA", "USA"), coupons: []string{"save10", "b2g1"},
+			discounts: []string{"3.00 USD", "10.00 USD"}, shipping: "5.00 USD", tax: "1.06 USD", total: "23.06 USD"},
+		{name: "discount capped at the subtotal", lines: []line{{lamp, 1}}, to: address("MA", "USA"), coupons: []string{"BIG", "SAVE10"},
+			discounts: []string{"40.00 USD", "0.00 USD"}, shipping: "10.00 USD", tax: "0.00 USD", total: "10.00 USD"},
+		{name: "heavier parcel", lines: []line{{lamp, 1}, {mug, 4}}, to: address("TX", "USA"),
+			shipping: "10.00 USD", tax: "4.00 USD", total: "94.00 USD"},
+		{name: "shipping converted and taxed", lines: []line{{lamp, 1}}, to: address("", "GBR"), conv: conv,
+			shipping: "25.00 USD", tax: "13.00 USD", total: "78.00 USD"},
+		{name: "shipping needs a converter", lines: []line{{lamp, 1}}, to: address("", "GBR"),
+			err: "shipping is priced in EUR"},
+		{name: "too heavy", lines: []line{{lamp, 3}}, to: address("MA", "USA"),
+			err: "too heavy"},
+		{name: "unknown coupon", lines: []line{{mug, 1}}, to: address("MA", "USA"), coupons: []string{"NOPE"},
+			err: `unknown coupon code "NOPE"`},
+		{name: "coupon used twice", lines: []line{{mug, 1}}, to: address("MA", "USA"), coupons: []string{"SAVE10", "Save10"},
+			err: "applied more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testCustomer(t)
+			b := NewOrderBuilder("ORD-PRICE").Inventory(nil).Machine(newMachine()).
+				Customer(c).ShipTo(tt.to).Pricing(pricing).ConvertWith(tt.conv)
+			for _, l := range tt.lines {
+				b.AddItem(l.p, l.qty)
+			}
+			for _, code := range tt.coupons {
+				b.Coupon(code)
+			}
+			o, err := b.Build()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bd := o.Breakdown()
+			var discounts []string
+			for _, d := range bd.Discounts {
+				discounts = append(discounts, d.Amount.String())
+			}
+			if !slices.Equal(discounts, tt.discounts) {
+				t.Errorf("discounts %v, want %v", discounts, tt.discounts)
+			}
+			if bd.Shipping == nil || bd.Shipping.Amount.String() != tt.shipping {
+				t.Errorf("shipping %v, want %s", bd.Shipping, tt.shipping)
+			}
+			if bd.Tax == nil || bd.Tax.Amount.String() != tt.tax {
+				t.Errorf("tax %v, want %s", bd.Tax, tt.tax)
+			}
+			if bd.Total.String() != tt.total || o.Total().String() != tt.total {
+				t.Errorf("total %s (order %s), want %s", bd.Total, o.Total(), tt.total)
+			}
+		})
+	}
+}
+
+// failingStore records in memory until failing is set
+type failingStore struct {
+	*MemoryEventStore
+	failing bool
+}
+
+func (s *failingStore) Append(e OrderEvent) error {
+	if s.failing {
+		return errors.New("disk full")
+	}
+	return s.MemoryEventStore.Append(e)
+}
+
+// shippedOrder builds and confirms an order for 3 MUG and 2 LAMP
+func shippedOrder(t *testing.T, m *OrderMachine) (*Order, *Product, *Product) {
+	t.Helper()
+	mug, lamp := stocked(t, "MUG", 10), stocked(t, "LAMP", 10)
+	o, err := newOrder(t, "ORD-LIFE", NewInventory(time.Minute), m).
+		AddItem(mug, 3).
+		AddItem(lamp, 2).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	return o, mug, lamp
+}
+
+func TestShipmentGuards(t *testing.T) {
+	o, _, _ := shippedOrder(t, newMachine())
+
+	for _, tt := range []struct {
+		event OrderEvent
+		err   string
+	}{
+		{OrderEvent{Type: EventPartiallyShipped}, "shipment has no items"},
+		{OrderEvent{Type: EventPartiallyShipped, Items: map[string]int{"MUG": 4}}, "cannot ship 4 of MUG, 3 left"},
+		{OrderEvent{Type: EventPartiallyShipped, Items: map[string]int{"DESK": 1}}, "cannot ship 1 of DESK, 0 left"},
+		{OrderEvent{Type: EventPartiallyShipped, Items: map[string]int{"MUG": 0}}, "cannot ship 0 of MUG"},
+		{OrderEvent{Type: EventShipped, Items: map[string]int{"MUG": 3}}, "leaves items unshipped"},
+		{OrderEvent{Type: EventPartiallyShipped, Items: map[string]int{"MUG": 3, "LAMP": 2}}, "sends every remaining item"},
+	} {
+		if err := o.Transition(tt.event); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %v: got %v, want %q", tt.event.Type, tt.event.Items, err, tt.err)
+		}
+	}
+	if o.Status() != StatusConfirmed || len(o.History()) != 2 {
+		t.Fatalf("rejected shipments changed the order: %s, %d events", o.Status(), len(o.History()))
+	}
+
+	if err := o.ShipItems(map[string]int{"MUG": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if o.Status() != StatusPartiallyShipped {
+		t.Errorf("status %s, want %s", o.Status(), StatusPartiallyShipped)
+	}
+	if err := o.Deliver(); err == nil {
+		t.Error("delivered a partially shipped order")
+	}
+	var terr *TransitionError
+	if err := o.Cancel(); !errors.As(err, &terr) || terr.Status != StatusPartiallyShipped {
+		t.Errorf("cancel after shipping: got %v, want *TransitionError", err)
+	}
+	if err := o.ShipItems(map[string]int{"MUG": 1, "LAMP": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if o.Status() != StatusShipped {
+		t.Errorf("status %s, want %s", o.Status(), StatusShipped)
+	}
+	if got := o.Shipped(); got["MUG"] != 3 || got["LAMP"] != 2 {
+		t.Errorf("shipped %v, want MUG 3 and LAMP 2", got)
+	}
+	if err := o.Ship(); err == nil {
+		t.Error("shipped an order with nothing left to ship")
+	}
+}
+
+func TestReturnAndRefundLimits(t *testing.T) {
+	o, mug, lamp := shippedOrder(t, newMachine())
+	if err := o.Ship(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Return(map[string]int{"MUG": 1}, "chipped"); err == nil {
+		t.Error("returned items before delivery")
+	}
+	if err := o.Deliver(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Return(map[string]int{"MUG": 1}, "chipped"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Return(map[string]int{"MUG": 3}, "changed mind"); err == nil || !strings.Contains(err.Error(), "cannot return 3 of MUG, 2 returnable") {
+		t.Errorf("over-return: got %v", err)
+	}
+	if mug.InStock() != 8 || lamp.InStock() != 8 {
+		t.Errorf("stock MUG %d, LAMP %d after one return, want 8 and 8", mug.InStock(), lamp.InStock())
+	}
+
+	// Total is 50.00
+	for _, tt := range []struct {
+		amount string
+		err    string
+	}{
+		{"0.00", "must be positive"},
+		{"50.01", "exceeds the 50.00 USD left"},
+		{"10.00", ""},
+		{"40.01", "exceeds the 40.00 USD left"},
+		{"40.00", ""},
+		{"0.01", "exceeds the 0.00 USD left"},
+	} {
+		err := o.Refund(usd(t, tt.amount), "refund")
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("refund %s: got %v, want %q", tt.amount, err, tt.err)
+		}
+	}
+	euros, _ := ParseMoney("1.00", "EUR")
+	var mismatch *CurrencyMismatchError
+	if err := o.Refund(euros, "refund"); !errors.As(err, &mismatch) {
+		t.Errorf("refund in EUR: got %v, want *CurrencyMismatchError", err)
+	}
+	if o.Refunded().String() != "50.00 USD" || o.Status() != StatusRefunded {
+		t.Errorf("refunded %s, status %s", o.Refunded(), o.Status())
+	}
+
+	// A refunded order can still take back what was not returned
+	if err := o.Return(nil, "rest"); err != nil {
+		t.Fatal(err)
+	}
+	if mug.InStock() != 10 || lamp.InStock() != 10 || o.Status() != StatusReturned {
+		t.Errorf("after returning everything: MUG %d, LAMP %d, status %s", mug.InStock(), lamp.InStock(), o.Status())
+	}
+	if err := o.Return(nil, "again"); err == nil {
+		t.Error("returned items twice")
+	}
+}
+
+func TestFailedRecordLeavesStockAlone(t *testing.T) {
+	store := &failingStore{MemoryEventStore: NewMemoryEventStore()}
+	inv := NewInventory(time.Minute)
+	p := stocked(t, "MUG", 5)
+	o, err := newOrder(t, "ORD-FAIL", inv, NewOrderMachine(store, OrderTransitions)).AddItem(p, 3).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.failing = true
+	for name, fire := range map[string]func() error{"confirm": o.Confirm, "cancel": o.Cancel} {
+		if err := fire(); err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Errorf("%s: got %v, want the store's error", name, err)
+		}
+		if o.Status() != StatusPending || p.InStock() != 5 || p.Reserved() != 3 {
+			t.Errorf("%s failed but order is %s with %d on hand, %d reserved", name, o.Status(), p.InStock(), p.Reserved())
+		}
+	}
+	if events, _ := store.Events(o.ID()); len(events) != 1 {
+		t.Errorf("%d events stored, want only the creation", len(events))
+	}
+
+	store.failing = false
+	if err := o.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	if p.InStock() != 2 || p.Reserved() != 0 {
+		t.Errorf("after confirm: %d on hand, %d reserved, want 2 and 0", p.InStock(), p.Reserved())
+	}
+}
+
+func TestActionsRecordExactlyOnce(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		action func(o *Order, e OrderEvent, record func() error) error
+		err    string
+	}{
+		{"twice", func(o *Order, e OrderEvent, record func() error) error {
+			record()
+			return record()
+		}, "recorded twice"},
+		{"never", func(o *Order, e OrderEvent, record func() error) error {
+			return nil
+		}, "did not record its event"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			transitions := slices.Clone(OrderTransitions)
+			for i := range transitions {
+				if transitions[i].Event == EventConfirmed {
+					transitions[i].Action = tt.action
+				}
+			}
+			o, err := newOrder(t, "ORD-REC", nil, NewOrderMachine(NewMemoryEventStore(), transitions)).
+				AddItem(stocked(t, "MUG", 1), 1).
+				Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := o.Confirm(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+			if o.Status() != StatusPending {
+				t.Errorf("status %s, want %s", o.Status(), StatusPending)
+			}
+		})
+	}
+}
+
+func TestReplayMatchesLiveOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	o, mug, lamp := shippedOrder(t, NewOrderMachine(NewFileEventStore(path), OrderTransitions))
+	for _, step := range []func() error{
+		func() error { return o.ShipItems(map[string]int{"LAMP": 1}) },
+		func() error {
+			return o.Transition(OrderEvent{Type: EventShipped, Items: map[string]int{"MUG": 3, "LAMP": 1}, Actor: "warehouse"})
+		},
+		o.Deliver,
+		func() error { return o.Return(map[string]int{"MUG": 2}, "too small") },
+		func() error { return o.Refund(usd(t, "20.00"), "returned mugs") },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewFileEventStore(path)
+	events, err := store.Events(o.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, addr := testCustomer(t)
+	restored, err := NewOrderBuilder(o.ID()).
+		Inventory(NewInventory(time.Minute)).
+		Machine(NewOrderMachine(store, OrderTransitions)).
+		Customer(c).ShipTo(addr).
+		AddItem(mug, 3).
+		AddItem(lamp, 2).
+		Restore(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Status() != o.Status() || restored.Refunded().String() != o.Refunded().String() ||
+		!maps.Equal(restored.Shipped(), o.Shipped()) || !maps.Equal(restored.returnable(), o.returnable()) {
+		t.Errorf("restored %s, refunded %s, shipped %v; live %s, refunded %s, shipped %v",
+			restored.Status(), restored.Refunded(), restored.Shipped(), o.Status(), o.Refunded(), o.Shipped())
+	}
+	live, replayed := o.History(), restored.History()
+	if len(live) != len(replayed) {
+		t.Fatalf("%d events replayed, %d live", len(replayed), len(live))
+	}
+	for i := range live {
+		if live[i].String() != replayed[i].String() || !live[i].At.Equal(replayed[i].At) {
+			t.Errorf("event %d: replayed %s, live %s", i, replayed[i], live[i])
+		}
+	}
+	// Replay runs no actions: the return was restocked once, live
+	if mug.InStock() != 9 || lamp.InStock() != 8 {
+		t.Errorf("stock MUG %d, LAMP %d, want 9 and 8", mug.InStock(), lamp.InStock())
+	}
+
+	// Events that break a guard do not replay
+	tampered := slices.Clone(events)
+	tampered[len(tampered)-1].Amount = usd(t, "60.00")
+	_, err = NewOrderBuilder(o.ID()).Inventory(nil).Machine(newMachine()).
+		Customer(c).ShipTo(addr).AddItem(mug, 3).AddItem(lamp, 2).
+		Restore(tampered)
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("tampered refund: got %v", err)
+	}
+}
+
+// reopen opens the JSON repository in path as a fresh process would
+func reopen(t *testing.T, path string) *JSONRepository {
+	t.Helper()
+	repo, err := OpenJSONRepository(path, NewInventory(time.Minute), newMachine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestReopenedRepositoryKeepsCommittedStock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.json")
+	repo := reopen(t, path)
+	p := stocked(t, "MUG", 5)
+	c, _ := testCustomer(t)
+	if err := errors.Join(repo.SaveCustomer(c), repo.SaveProduct(p)); err != nil {
+		t.Fatal(err)
+	}
+	o, err := newOrder(t, "ORD-KEEP", NewInventory(time.Minute), newMachine()).AddItem(p, 3).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	// Saving the order is enough: the product is not saved again
+	if err := repo.SaveOrder(o); err != nil {
+		t.Fatal(err)
+	}
+
+	repo = reopen(t, path)
+	stored, err := repo.FindProduct("MUG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.InStock() != 2 {
+		t.Errorf("reopened with %d in stock, want 2", stored.InStock())
+	}
+	loaded, err := repo.FindOrder("ORD-KEEP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveOrder(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if stored.InStock() != 5 {
+		t.Errorf("%d in stock after cancelling, want 5", stored.InStock())
+	}
+
+	stored, _ = reopen(t, path).FindProduct("MUG")
+	if stored.InStock() != 5 {
+		t.Errorf("reopened with %d in stock after cancelling, want 5", stored.InStock())
+	}
+}
+
+func TestReopenedRepositoryHoldsPendingOrders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.json")
+	repo := reopen(t, path)
+	p := stocked(t, "MUG", 5)
+	c, _ := testCustomer(t)
+	if err := errors.Join(repo.SaveCustomer(c), repo.SaveProduct(p)); err != nil {
+		t.Fatal(err)
+	}
+	// Holds that lapse at once let both orders in, though only one of
+	// them fits the stock
+	inv := NewInventory(time.Millisecond)
+	for _, id := range []string{"ORD-A", "ORD-B"} {
+		o, err := newOrder(t, id, inv, newMachine()).AddItem(p, 3).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveOrder(o); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		p.Available()
+	}
+
+	repo = reopen(t, path)
+	stored, err := repo.FindProduct("MUG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening held the oldest order's stock before anything was read
+	if stored.Reserved() != 3 || stored.Available() != 2 {
+		t.Errorf("reopened with %d reserved, %d available, want 3 and 2", stored.Reserved(), stored.Available())
+	}
+	pending, err := repo.ListOrders(OrderFilter{Status: StatusPending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("%d pending orders, want 2", len(pending))
+	}
+	if err := pending[1].Confirm(); !errors.Is(err, ErrReservationExpired) {
+		t.Errorf("confirming the order left without stock: got %v, want ErrReservationExpired", err)
+	}
+	if err := pending[1].Cancel(); err != nil {
+		t.Errorf("cancelling the order left without stock: %v", err)
+	}
+	if err := pending[0].Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	if stored.InStock() != 2 || stored.Reserved() != 0 {
+		t.Errorf("%d on hand, %d reserved, want 2 and 0", stored.InStock(), stored.Reserved())
+	}
+}